@@ -44,12 +44,71 @@ func SetupConfig() {
 		"control":    10051,
 		"socks":      10050,
 		"cookiePath": "./tor/",
+		"password":   "",
 	})
 
 	viper.SetDefault("socks", map[string]interface{}{"enabled": true, "port": 10050})
 
+	viper.SetDefault("i2p", map[string]interface{}{
+		"enabled": false,
+		"sam":     "127.0.0.1:7656",
+		"session": "zif",
+		"options": []string{},
+	})
+
+	viper.SetDefault("transport", map[string]interface{}{
+		"dial":   []string{"tcp", "unix", "websocket"},
+		"listen": []string{},
+	})
+
+	viper.SetDefault("websocket", map[string]interface{}{
+		"listen": "",
+		"http":   false,
+	})
+
+	viper.SetDefault("nat", map[string]interface{}{
+		"enabled": true,
+		"lease":   "1h",
+	})
+
 	viper.SetDefault("net", map[string]interface{}{
-		"maxPeers": 100,
+		"maxPeers":             100,
+		"maxConnections":       512,
+		"maxConnectionsPerIp":  8,
+		"maxPendingHandshakes": 64,
+		"handshakeTimeout":     "10s",
+		"endpoints":            []string{},
+	})
+
+	viper.SetDefault("bandwidth", map[string]interface{}{
+		"upload":       0,
+		"download":     0,
+		"peerUpload":   0,
+		"peerDownload": 0,
+	})
+
+	viper.SetDefault("relay", map[string]interface{}{
+		"serve":              false,
+		"maxCircuits":        64,
+		"maxCircuitsPerPeer": 4,
+		"bandwidth":          256,
+		"circuitBandwidth":   64,
+		"use":                []string{},
+	})
+
+	quota := func(rate string, burst int) map[string]interface{} {
+		return map[string]interface{}{"rate": rate, "burst": burst}
+	}
+
+	viper.SetDefault("quotas", map[string]interface{}{
+		"search":      quota("1s", 10),
+		"query":       quota("333ms", 10),
+		"findclosest": quota("333ms", 10),
+		"piece":       quota("100ms", 50),
+		"announce":    quota("10m", 3),
+		"addpeer":     quota("1m", 3),
+		"relay":       quota("10s", 5),
+		"exchange":    quota("5m", 2),
 	})
 
 	viper.WatchConfig()
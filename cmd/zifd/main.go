@@ -1,16 +1,23 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
-
 	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 	zif "github.com/zif/zif"
 	data "github.com/zif/zif/data"
+	"github.com/zif/zif/dht"
+	"github.com/zif/zif/proto"
+	"github.com/zif/zif/torcontrol"
+	"github.com/zif/zif/util"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -21,6 +28,30 @@ var (
 	BuildTime = "N/A"
 )
 
+// The transport with the name given in zifd.toml, or nil if there is none.
+func transport(name string) proto.Transport {
+	switch name {
+	case "tcp":
+		return proto.TCPTransport{}
+	case "unix":
+		return proto.UnixTransport{}
+	case "websocket":
+		return proto.WebSocketTransport{}
+	}
+
+	return nil
+}
+
+// Dials everything a SOCKS proxy can carry through it, WebSockets included if
+// they are dialled at all.
+func useProxy(lp *zif.LocalPeer, addr string) {
+	lp.Transports.Add(proto.SocksTransport{Proxy: addr})
+
+	if lp.Transports.For(dht.EndpointWS) != nil {
+		lp.Transports.Add(proto.WebSocketTransport{Proxy: addr})
+	}
+}
+
 func SetupLocalPeer(addr string) *zif.LocalPeer {
 	var lp zif.LocalPeer
 
@@ -48,7 +79,13 @@ func main() {
 	addr := viper.GetString("bind.zif")
 	fmt.Println(addr)
 
-	port, _ := strconv.Atoi(strings.Split(addr, ":")[1])
+	_, portString, err := net.SplitHostPort(addr)
+
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	port, _ := strconv.Atoi(portString)
 
 	lp := SetupLocalPeer(fmt.Sprintf("%s", addr))
 	lp.LoadEntry()
@@ -58,44 +95,103 @@ func main() {
 		"built":   BuildTime,
 	}).Info("Starting zifd")
 
+	// still a hint for the public address, if there is one
+	if err := lp.SetPublicAddress(lp.Entry.PublicAddress, port); err != nil {
+		log.Error(err.Error())
+	}
+
+	lp.Transports = proto.NewTransports()
+
+	for _, i := range viper.GetStringSlice("transport.dial") {
+		if t := transport(i); t != nil {
+			lp.Transports.Add(t)
+		} else {
+			log.Error("Unknown transport: ", i)
+		}
+	}
+
+	// a proxy takes over everything it can dial
 	if viper.GetBool("tor.enabled") {
-		_, onion, err := zif.SetupZifTorService(port, viper.GetInt("tor.control"),
-			fmt.Sprintf("%s/cookie", viper.GetString("tor.cookiePath")))
+		lp.SetDialTypes(zif.DialTor)
+		useProxy(lp, fmt.Sprintf("127.0.0.1:%d", viper.GetInt("tor.socks")))
+
+		config := torcontrol.Config{
+			Control:  fmt.Sprintf("127.0.0.1:%d", viper.GetInt("tor.control")),
+			Password: viper.GetString("tor.password"),
+		}
+
+		// otherwise the cookie Tor says it uses is read
+		if dir := viper.GetString("tor.cookiePath"); dir != "" {
+			config.Cookie = filepath.Join(dir, "cookie")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		onion, err := lp.ListenTor(ctx, config, port)
+		cancel()
 
 		if err == nil {
 			lp.PublicAddress = onion
-			lp.Entry.PublicAddress = onion
-			lp.SetSocks(true)
-			lp.SetSocksPort(viper.GetInt("tor.socks"))
-			lp.Peer.Streams().Socks = true
-			lp.Peer.Streams().SocksPort = viper.GetInt("tor.socks")
+			lp.SetPublicAddress(onion, port)
 		} else {
-			panic(err)
+			log.Error("Could not create onion service, peers will not be able to connect: ", err.Error())
 		}
 
 		// should this override tor?
 	} else if viper.GetBool("socks.enabled") {
-		lp.SetSocks(true)
-		lp.SetSocksPort(viper.GetInt("socks.port"))
-		lp.Peer.Streams().Socks = true
-		lp.Peer.Streams().SocksPort = viper.GetInt("socks.port")
+		useProxy(lp, fmt.Sprintf("127.0.0.1:%d", viper.GetInt("socks.port")))
 
 		// TODO: configurable public address
 	} else {
-		if lp.Entry.PublicAddress == "" {
+		mapped := false
+
+		if viper.GetBool("nat.enabled") {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+			err := lp.MapPort(ctx, port, viper.GetDuration("nat.lease"))
+			cancel()
+
+			if err != nil {
+				log.Info("Could not map port, peers may not be able to connect: ", err.Error())
+			}
+
+			mapped = err == nil
+		}
+
+		if !mapped && lp.Entry.PublicAddress == "" {
 			log.Debug("Local peer public address is nil, attempting to fetch")
 			ip := zif.ExternalIp()
 			log.Debug("External IP is ", ip)
-			lp.Entry.PublicAddress = ip
+			lp.SetPublicAddress(ip, port)
+		}
+	}
+
+	if viper.GetBool("i2p.enabled") {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		err := lp.ListenI2P(ctx, viper.GetString("i2p.sam"), viper.GetString("i2p.session"),
+			viper.GetStringSlice("i2p.options"))
+		cancel()
+
+		if err != nil {
+			log.Error("Could not connect to I2P: ", err.Error())
+		}
+	}
+
+	for _, i := range viper.GetStringSlice("net.endpoints") {
+		endpoint, err := dht.ParseEndpoint(i)
+
+		if err == nil {
+			err = lp.AddEndpoint(endpoint)
+		}
+
+		if err != nil {
+			log.Error("Invalid endpoint: ", err.Error())
 		}
 	}
 
-	lp.Entry.Port = port
 	lp.Entry.SetLocalPeer(lp)
 	lp.SignEntry()
 	lp.SaveEntry()
 
-	err := lp.SaveEntry()
+	err = lp.SaveEntry()
 
 	if err != nil {
 		panic(err)
@@ -109,14 +205,116 @@ func main() {
 		log.Fatal(err.Error())
 	}
 
-	lp.Listen(viper.GetString("bind.zif"))
+	lp.SetMaxPeers(viper.GetInt("net.maxPeers"))
+
+	// configured in KiB/s
+	lp.Bandwidth.SetConfig(proto.BandwidthConfig{
+		Upload:       viper.GetInt("bandwidth.upload") * 1024,
+		Download:     viper.GetInt("bandwidth.download") * 1024,
+		PeerUpload:   viper.GetInt("bandwidth.peerUpload") * 1024,
+		PeerDownload: viper.GetInt("bandwidth.peerDownload") * 1024,
+	})
+
+	quotas := proto.DefaultQuotas()
+
+	for kind := range quotas {
+		quotas[kind] = util.Quota{
+			Rate:  viper.GetDuration("quotas." + kind + ".rate"),
+			Burst: viper.GetInt("quotas." + kind + ".burst"),
+		}
+	}
+
+	lp.Server.SetQuotas(quotas)
+
+	lp.Server.SetAdmission(proto.AdmissionConfig{
+		MaxConnections:       viper.GetInt("net.maxConnections"),
+		MaxConnectionsPerIP:  viper.GetInt("net.maxConnectionsPerIp"),
+		MaxPendingHandshakes: viper.GetInt("net.maxPendingHandshakes"),
+		HandshakeTimeout:     viper.GetDuration("net.handshakeTimeout"),
+	})
+
+	lp.Server.SetRelay(proto.RelayConfig{
+		Enabled:            viper.GetBool("relay.serve"),
+		MaxCircuits:        viper.GetInt("relay.maxCircuits"),
+		MaxCircuitsPerPeer: viper.GetInt("relay.maxCircuitsPerPeer"),
+		Bandwidth:          viper.GetInt("relay.bandwidth") * 1024,
+		CircuitBandwidth:   viper.GetInt("relay.circuitBandwidth") * 1024,
+	})
+
+	// the addresses of the machine would give away an onion service
+	advertise := !viper.GetBool("tor.enabled")
+
+	if addr := viper.GetString("websocket.listen"); addr != "" {
+		if err := lp.ListenOn(proto.WebSocketTransport{}, addr, advertise); err != nil {
+			log.Error("Failed to listen for WebSockets: ", err.Error())
+		}
+	}
+
+	var httpServer zif.HttpServer
+
+	if viper.GetBool("websocket.http") {
+		addr, err := net.ResolveTCPAddr("tcp", viper.GetString("bind.http"))
+
+		if err == nil {
+			httpServer.WebSocket, err = lp.ServeWebSocket(addr, advertise)
+		}
+
+		if err != nil {
+			log.Error("Failed to serve WebSockets over HTTP: ", err.Error())
+		}
+	}
+
+	// signs the entry, with any endpoints added above
+	err = lp.Listen(viper.GetString("bind.zif"))
+
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	for _, i := range viper.GetStringSlice("transport.listen") {
+		parts := strings.SplitN(i, ":", 2)
+		var t proto.Transport
+
+		if len(parts) == 2 {
+			t = transport(parts[0])
+		}
+
+		if t == nil {
+			log.Error("Invalid listen address: ", i)
+			continue
+		}
+
+		if err := lp.ListenOn(t, parts[1], false); err != nil {
+			log.Error("Failed to listen: ", err.Error())
+		}
+	}
+
+	if use := viper.GetStringSlice("relay.use"); len(use) > 0 {
+		relays := make([]dht.Address, 0, len(use))
+
+		for _, i := range use {
+			addr, err := dht.DecodeAddress(i)
+
+			if err != nil {
+				log.Error("Invalid relay address: ", err.Error())
+				continue
+			}
+
+			relays = append(relays, addr)
+		}
+
+		err = lp.UseRelays(relays)
+
+		if err != nil {
+			log.Error("Failed to use relays: ", err.Error())
+		}
+	}
 
 	log.Info("My name: ", lp.Entry.Name)
 	s, _ := lp.Address().String()
 	log.Info("My address: ", s)
 
 	commandServer := zif.NewCommandServer(lp)
-	var httpServer zif.HttpServer
 	httpServer.CommandServer = commandServer
 	go httpServer.ListenHttp(viper.GetString("bind.http"))
 
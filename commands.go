@@ -45,6 +45,15 @@ type CommandPeerRecent struct {
 	Page int `json:"page"`
 }
 type CommandPeerPopular CommandPeerRecent
+
+// Asks for a page of posts by cursor, rather than by page number. Query is only
+// used for searches.
+type CommandPeerPage struct {
+	CommandPeer
+	Query    string `json:"query"`
+	Cursor   []byte `json:"cursor"`
+	PageSize int    `json:"pageSize"`
+}
 type CommandMirror CommandPeer
 type CommandMirrorProgress CommandPeer
 type CommandPeerIndex struct {
@@ -91,7 +100,7 @@ type CommandSaveRoutingTable interface{}
 // Used for setting values in the localpeer entry
 type CommandLocalSet struct {
 	Key   string `json:"key"`
-	Value string `json:"key"`
+	Value string `json:"value"`
 }
 
 type CommandLocalGet struct {
@@ -112,6 +121,13 @@ type CommandNetMap struct {
 	Address string
 }
 
+type CommandForgetSticky CommandPeer
+
+// Key is either a Zif address or an IP.
+type CommandUnban struct {
+	Key string
+}
+
 // Command output types
 
 type CommandResult struct {
@@ -120,6 +136,13 @@ type CommandResult struct {
 	Error  error       `json:"err"`
 }
 
+// A page of posts, and the cursor to pass back for the next page. The cursor is
+// empty once there are no more posts.
+type PostPage struct {
+	Posts  interface{} `json:"posts"`
+	Cursor []byte      `json:"cursor"`
+}
+
 func (cr *CommandResult) WriteJSON(w io.Writer) {
 	e := json.NewEncoder(w)
 
@@ -1,17 +1,19 @@
 package zif
 
 import (
+	"context"
 	"errors"
-	"fmt"
+	"net"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
-	"time"
 
 	"runtime/pprof"
 
 	"github.com/zif/zif/data"
 	"github.com/zif/zif/dht"
+	"github.com/zif/zif/proto"
 	"github.com/zif/zif/util"
 
 	log "github.com/sirupsen/logrus"
@@ -38,7 +40,10 @@ func NewCommandServer(lp *LocalPeer) *CommandServer {
 
 // Command functions
 
-func (cs *CommandServer) Ping(p CommandPing) CommandResult {
+// Command functions which talk to the network take a context, cancelling it
+// abandons the request.
+
+func (cs *CommandServer) Ping(ctx context.Context, p CommandPing) CommandResult {
 	log.Info("Command: Ping request")
 
 	address, err := dht.DecodeAddress(p.Address)
@@ -47,17 +52,20 @@ func (cs *CommandServer) Ping(p CommandPing) CommandResult {
 		return CommandResult{false, nil, err}
 	}
 
-	peer, _, err := cs.LocalPeer.ConnectPeer(address)
+	peer, _, err := cs.LocalPeer.ConnectPeer(ctx, address)
 
 	if err != nil {
 		return CommandResult{false, nil, err}
 	}
 
-	time, err := peer.Ping(time.Second * 10)
+	ctx, cancel := context.WithTimeout(ctx, PeerTimeout)
+	defer cancel()
+
+	time, err := peer.Ping(ctx)
 
 	return CommandResult{err == nil, time.Seconds(), err}
 }
-func (cs *CommandServer) Announce(a CommandAnnounce) CommandResult {
+func (cs *CommandServer) Announce(ctx context.Context, a CommandAnnounce) CommandResult {
 	var err error
 
 	log.Info("Command: Announce request")
@@ -71,7 +79,7 @@ func (cs *CommandServer) Announce(a CommandAnnounce) CommandResult {
 	peer := cs.LocalPeer.GetPeer(address)
 
 	if peer == nil {
-		peer, _, err = cs.LocalPeer.ConnectPeer(address)
+		peer, _, err = cs.LocalPeer.ConnectPeer(ctx, address)
 
 		if err != nil {
 			return CommandResult{false, nil, err}
@@ -82,11 +90,11 @@ func (cs *CommandServer) Announce(a CommandAnnounce) CommandResult {
 		return CommandResult{false, nil, err}
 	}
 
-	err = peer.Announce(cs.LocalPeer)
+	err = peer.Announce(ctx, cs.LocalPeer)
 
 	return CommandResult{err == nil, nil, err}
 }
-func (cs *CommandServer) RSearch(rs CommandRSearch) CommandResult {
+func (cs *CommandServer) RSearch(ctx context.Context, rs CommandRSearch) CommandResult {
 	var err error
 
 	log.Info("Command: Peer Remote Search request")
@@ -102,23 +110,23 @@ func (cs *CommandServer) RSearch(rs CommandRSearch) CommandResult {
 	if peer == nil {
 		// Remote searching is not allowed to be done on seeds, it has no
 		// verification so can be falsified easily. Mirror people, mirror!
-		peer, _, err = cs.LocalPeer.ConnectPeer(address)
+		peer, _, err = cs.LocalPeer.ConnectPeer(ctx, address)
 		if err != nil {
 			return CommandResult{false, nil, err}
 		}
 	}
 
-	posts, err := peer.Search(rs.Query, rs.Page)
+	posts, err := peer.Search(ctx, rs.Query, rs.Page)
 
 	return CommandResult{err == nil, posts, err}
 }
-func (cs *CommandServer) PeerSearch(ps CommandPeerSearch) CommandResult {
+func (cs *CommandServer) PeerSearch(ctx context.Context, ps CommandPeerSearch) CommandResult {
 	var err error
 
 	log.Info("Command: Peer Search request")
 
 	if !cs.LocalPeer.Databases.Has(ps.CommandPeer.Address) {
-		return cs.RSearch(CommandRSearch{ps.CommandPeer, ps.Query, ps.Page})
+		return cs.RSearch(ctx, CommandRSearch{ps.CommandPeer, ps.Query, ps.Page})
 	}
 
 	db, _ := cs.LocalPeer.Databases.Get(ps.CommandPeer.Address)
@@ -149,7 +157,7 @@ func (cs *CommandServer) EntrySearch(ps CommandSearchEntry) CommandResult {
 	return CommandResult{err == nil, addresses, err}
 }
 
-func (cs *CommandServer) PeerRecent(pr CommandPeerRecent) CommandResult {
+func (cs *CommandServer) PeerRecent(ctx context.Context, pr CommandPeerRecent) CommandResult {
 	var err error
 	var posts []*data.Post
 
@@ -170,17 +178,17 @@ func (cs *CommandServer) PeerRecent(pr CommandPeerRecent) CommandResult {
 	peer := cs.LocalPeer.GetPeer(address)
 
 	if peer == nil {
-		peer, _, err = cs.LocalPeer.ConnectPeer(address)
+		peer, _, err = cs.LocalPeer.ConnectPeer(ctx, address)
 		if err != nil {
 			return CommandResult{false, nil, err}
 		}
 	}
 
-	posts, err = peer.Recent(pr.Page)
+	posts, err = peer.Recent(ctx, pr.Page)
 
 	return CommandResult{err == nil, posts, err}
 }
-func (cs *CommandServer) PeerPopular(pp CommandPeerPopular) CommandResult {
+func (cs *CommandServer) PeerPopular(ctx context.Context, pp CommandPeerPopular) CommandResult {
 	var err error
 	var posts []*data.Post
 
@@ -201,17 +209,91 @@ func (cs *CommandServer) PeerPopular(pp CommandPeerPopular) CommandResult {
 	peer := cs.LocalPeer.GetPeer(address)
 
 	if peer == nil {
-		peer, _, err = cs.LocalPeer.ConnectPeer(address)
+		peer, _, err = cs.LocalPeer.ConnectPeer(ctx, address)
 		if err != nil {
 			return CommandResult{false, nil, err}
 		}
 	}
 
-	posts, err = peer.Popular(pp.Page)
+	posts, err = peer.Popular(ctx, pp.Page)
 
 	return CommandResult{err == nil, posts, err}
 }
-func (cs *CommandServer) Mirror(cm CommandMirror) CommandResult {
+
+// Fetches a page of posts by cursor, from our own database if the address is
+// ours, otherwise from the peer.
+func (cs *CommandServer) peerPage(ctx context.Context, cp CommandPeerPage,
+	local func(*data.Cursor, int) ([]*data.Post, *data.Cursor, error),
+	remote func(*Peer) (interface{}, []byte, error)) CommandResult {
+
+	if cp.CommandPeer.Address == cs.LocalPeer.Address().StringOr("") {
+		cursor, err := data.DecodeCursor(cp.Cursor)
+
+		if err != nil {
+			return CommandResult{false, nil, err}
+		}
+
+		posts, next, err := local(cursor, proto.PostPageSize(cp.PageSize))
+
+		if err != nil {
+			return CommandResult{false, nil, err}
+		}
+
+		return CommandResult{true, PostPage{posts, next.Encode()}, nil}
+	}
+
+	address, err := dht.DecodeAddress(cp.Address)
+
+	if err != nil {
+		return CommandResult{false, nil, err}
+	}
+
+	peer := cs.LocalPeer.GetPeer(address)
+
+	if peer == nil {
+		peer, _, err = cs.LocalPeer.ConnectPeer(ctx, address)
+
+		if err != nil {
+			return CommandResult{false, nil, err}
+		}
+	}
+
+	posts, next, err := remote(peer)
+
+	if err != nil {
+		return CommandResult{false, nil, err}
+	}
+
+	return CommandResult{true, PostPage{posts, next}, nil}
+}
+
+func (cs *CommandServer) RSearchPage(ctx context.Context, cp CommandPeerPage) CommandResult {
+	log.Info("Command: Peer Remote Search page request")
+
+	return cs.peerPage(ctx, cp, func(cursor *data.Cursor, size int) ([]*data.Post, *data.Cursor, error) {
+		return cs.LocalPeer.Database.SearchCursor(cp.Query, cursor, size)
+	}, func(peer *Peer) (interface{}, []byte, error) {
+		return peer.SearchPage(ctx, cp.Query, cp.Cursor, cp.PageSize)
+	})
+}
+
+func (cs *CommandServer) PeerRecentPage(ctx context.Context, cp CommandPeerPage) CommandResult {
+	log.Info("Command: Peer Recent page request")
+
+	return cs.peerPage(ctx, cp, cs.LocalPeer.Database.QueryRecentCursor, func(peer *Peer) (interface{}, []byte, error) {
+		return peer.RecentPage(ctx, cp.Cursor, cp.PageSize)
+	})
+}
+
+func (cs *CommandServer) PeerPopularPage(ctx context.Context, cp CommandPeerPage) CommandResult {
+	log.Info("Command: Peer Popular page request")
+
+	return cs.peerPage(ctx, cp, cs.LocalPeer.Database.QueryPopularCursor, func(peer *Peer) (interface{}, []byte, error) {
+		return peer.PopularPage(ctx, cp.Cursor, cp.PageSize)
+	})
+}
+
+func (cs *CommandServer) Mirror(ctx context.Context, cm CommandMirror) CommandResult {
 	var err error
 
 	log.Info("Command: Peer Mirror request")
@@ -222,7 +304,7 @@ func (cs *CommandServer) Mirror(cm CommandMirror) CommandResult {
 		return CommandResult{false, nil, err}
 	}
 
-	mirroring, err := cs.LocalPeer.Resolve(address)
+	mirroring, err := cs.LocalPeer.Resolve(ctx, address)
 
 	if err != nil {
 		return CommandResult{false, nil, err}
@@ -231,60 +313,61 @@ func (cs *CommandServer) Mirror(cm CommandMirror) CommandResult {
 	peer := cs.LocalPeer.GetPeer(address)
 
 	if peer == nil {
-		var entry *dht.Entry
-		peer, entry, err = cs.LocalPeer.ConnectPeer(address)
-
-		if err != nil {
-			if err == PeerUnreachable {
-
-				// first up, check if we have an entry for the peer
-				if len(entry.Seeds) == 0 {
-					// if not, not much we can do :(
-					return CommandResult{false, nil, err}
-				}
+		peer, _, err = cs.LocalPeer.ConnectPeer(ctx, address)
 
-				// balances load amongst all seeds
-				util.ShuffleBytes(entry.Seeds)
+		if err != nil && err != PeerUnreachable {
+			return CommandResult{false, nil, err}
+		}
+	}
 
-				// Keep picking seeds until one connects
-				for _, i := range entry.Seeds {
-					addr := &dht.Address{Raw: i}
+	// Pieces are fetched from seeds as well as the peer itself, so connect to as
+	// many as we can use. Balances load amongst all seeds.
+	util.ShuffleBytes(mirroring.Seeds)
 
-					if addr.Equals(cs.LocalPeer.Address()) {
-						continue
-					}
+	seeds := make([]*Peer, 0, SwarmMaxSources)
+	for _, i := range mirroring.Seeds {
+		if len(seeds) >= SwarmMaxSources-1 {
+			break
+		}
 
-					peer, _, err = cs.LocalPeer.ConnectPeer(*addr)
+		addr := &dht.Address{Raw: i}
 
-					if err != nil || peer == nil {
-						continue
-					}
+		if addr.Equals(cs.LocalPeer.Address()) || addr.Equals(&address) {
+			continue
+		}
 
-					// make sure the correct values are chosen when mirroring
-					// peers act a little differently when seeding for another
-					peer.seed = true
-					peer.seedFor = entry
-				}
+		seedCtx, cancel := context.WithTimeout(ctx, PeerTimeout)
+		seed, _, err := cs.LocalPeer.ConnectPeer(seedCtx, *addr)
+		cancel()
 
-			} else {
-				return CommandResult{false, nil, err}
-			}
+		if err != nil || seed == nil {
+			continue
 		}
+
+		seeds = append(seeds, seed)
 	}
 
 	if peer == nil {
-		return CommandResult{false, nil, PeerUnreachable}
+		if len(seeds) == 0 {
+			return CommandResult{false, nil, PeerUnreachable}
+		}
+
+		// make sure the correct values are chosen when mirroring
+		// peers act a little differently when seeding for another
+		peer, seeds = seeds[0], seeds[1:]
+		peer.seed = true
+		peer.seedFor = mirroring
 	}
 
-	// TODO: make this configurable
-	d := fmt.Sprintf("./data/%s", mirroring.Address.StringOr(""))
+	d := cs.LocalPeer.DataPath(mirroring.Address.StringOr(""))
 
 	os.Mkdir(d, 0777)
 
-	db := data.NewDatabase(fmt.Sprintf("%s/posts.db", d))
+	db := data.NewDatabase(filepath.Join(d, "posts.db"))
 	db.Connect()
 
-	cs.LocalPeer.Databases.Set(peer.Address().StringOr(""), db)
+	// peer may be a seed, but the posts are those of the peer being mirrored
+	cs.LocalPeer.Databases.Set(mirroring.Address.StringOr(""), db)
 
 	progressChan := make(chan int)
 
@@ -294,11 +377,14 @@ func (cs *CommandServer) Mirror(cm CommandMirror) CommandResult {
 		}
 	}()
 
-	err = peer.Mirror(db, *cs.LocalPeer.Address(), progressChan)
+	err = peer.Mirror(ctx, db, d, progressChan, seeds...)
 	if err != nil {
 		return CommandResult{false, nil, err}
 	}
 
+	// stay connected, so that the mirror can be kept up to date
+	cs.LocalPeer.AddSticky(mirroring.Address, StickyMirror)
+
 	return CommandResult{true, nil, nil}
 }
 
@@ -362,7 +448,7 @@ func (cs *CommandServer) SelfIndex(ci CommandSelfIndex) CommandResult {
 
 	return CommandResult{err == nil, nil, err}
 }
-func (cs *CommandServer) Resolve(cr CommandResolve) CommandResult {
+func (cs *CommandServer) Resolve(ctx context.Context, cr CommandResolve) CommandResult {
 	log.Info("Command: Resolve request")
 
 	address, err := dht.DecodeAddress(cr.Address)
@@ -371,7 +457,7 @@ func (cs *CommandServer) Resolve(cr CommandResolve) CommandResult {
 		return CommandResult{false, nil, err}
 	}
 
-	entry, err := cs.LocalPeer.Resolve(address)
+	entry, err := cs.LocalPeer.Resolve(ctx, address)
 
 	if err != nil {
 		return CommandResult{false, nil, err}
@@ -383,27 +469,30 @@ func (cs *CommandServer) Resolve(cr CommandResolve) CommandResult {
 
 	return CommandResult{err == nil, entry, err}
 }
-func (cs *CommandServer) Bootstrap(cb CommandBootstrap) CommandResult {
+func (cs *CommandServer) Bootstrap(ctx context.Context, cb CommandBootstrap) CommandResult {
 	log.Info("Command: Bootstrap request")
 
-	addrnport := strings.Split(cb.Address, ":")
+	host, port, err := net.SplitHostPort(cb.Address)
 
-	host := addrnport[0]
-	var port string
-	if len(addrnport) == 1 {
+	if err != nil {
+		host = strings.Trim(cb.Address, "[]")
 		port = "5050" // TODO: make this configurable
-	} else {
-		port = addrnport[1]
 	}
 
-	peer, err := cs.LocalPeer.ConnectPeerDirect(host + ":" + port)
+	peer, err := cs.LocalPeer.ConnectPeerDirect(ctx, net.JoinHostPort(host, port))
 	if err != nil {
 		return CommandResult{false, nil, err}
 	}
 
-	err = peer.Bootstrap(cs.LocalPeer.DHT)
+	err = peer.Bootstrap(ctx, cs.LocalPeer.DHT)
 
-	return CommandResult{err == nil, nil, err}
+	if err != nil {
+		return CommandResult{false, nil, err}
+	}
+
+	cs.LocalPeer.AddSticky(*peer.Address(), StickyBootstrap)
+
+	return CommandResult{true, nil, nil}
 }
 func (cs *CommandServer) SelfSuggest(css CommandSuggest) CommandResult {
 	completions, err := cs.LocalPeer.SearchProvider.Suggest(cs.LocalPeer.Database, css.Query)
@@ -442,8 +531,7 @@ func (cs *CommandServer) AddMeta(cam CommandAddMeta) CommandResult {
 func (cs *CommandServer) SaveCollection(csc CommandSaveCollection) CommandResult {
 	log.Info("Command: Save Collection request")
 
-	// TODO: make this configurable
-	cs.LocalPeer.Collection.Save("./data/collection.dat")
+	cs.LocalPeer.Collection.Save(cs.LocalPeer.DataPath("collection.dat"))
 
 	return CommandResult{true, nil, nil}
 }
@@ -455,13 +543,14 @@ func (cs *CommandServer) RebuildCollection(crc CommandRebuildCollection) Command
 	cs.LocalPeer.Collection, err = data.CreateCollection(cs.LocalPeer.Database, 0, data.PieceSize)
 	return CommandResult{err == nil, nil, err}
 }
-func (cs *CommandServer) Peers(cp CommandPeers) CommandResult {
+func (cs *CommandServer) Peers(ctx context.Context, cp CommandPeers) CommandResult {
 	log.Info("Command: Peers request")
 
 	ps := make([]*dht.Entry, cs.LocalPeer.PeerCount()+1)
 	var err error
 
-	ps[0] = cs.LocalPeer.Entry
+	self := cs.LocalPeer.CopyEntry()
+	ps[0] = &self
 
 	if err != nil {
 		return CommandResult{false, nil, err}
@@ -469,7 +558,7 @@ func (cs *CommandServer) Peers(cp CommandPeers) CommandResult {
 
 	i := 1
 	for _, p := range cs.LocalPeer.Peers() {
-		ps[i], err = p.Entry()
+		ps[i], err = p.Entry(ctx)
 
 		if err != nil {
 			return CommandResult{false, nil, err}
@@ -481,7 +570,7 @@ func (cs *CommandServer) Peers(cp CommandPeers) CommandResult {
 	return CommandResult{true, ps, nil}
 }
 
-func (cs *CommandServer) RequestAddPeer(crap CommandRequestAddPeer) CommandResult {
+func (cs *CommandServer) RequestAddPeer(ctx context.Context, crap CommandRequestAddPeer) CommandResult {
 	log.Info("Command: Request Add Peer request")
 
 	address, err := dht.DecodeAddress(crap.Peer)
@@ -490,7 +579,7 @@ func (cs *CommandServer) RequestAddPeer(crap CommandRequestAddPeer) CommandResul
 		return CommandResult{true, nil, err}
 	}
 
-	peer, _, err := cs.LocalPeer.ConnectPeer(address)
+	peer, _, err := cs.LocalPeer.ConnectPeer(ctx, address)
 
 	if err != nil {
 		return CommandResult{true, nil, err}
@@ -502,7 +591,7 @@ func (cs *CommandServer) RequestAddPeer(crap CommandRequestAddPeer) CommandResul
 		return CommandResult{true, nil, err}
 	}
 
-	err = peer.RequestAddPeer(*entry)
+	err = peer.RequestAddPeer(ctx, *entry)
 
 	return CommandResult{err == nil, nil, err}
 }
@@ -512,17 +601,20 @@ func (cs *CommandServer) LocalSet(cls CommandLocalSet) CommandResult {
 
 	switch strings.ToLower(cls.Key) {
 	case "name":
-		cs.LocalPeer.Entry.Name = cls.Value
+		cs.LocalPeer.UpdateEntry(func(entry *dht.Entry) { entry.Name = cls.Value })
 	case "desc":
-		cs.LocalPeer.Entry.Desc = cls.Value
+		cs.LocalPeer.UpdateEntry(func(entry *dht.Entry) { entry.Desc = cls.Value })
 	case "public":
-		cs.LocalPeer.Entry.PublicAddress = cls.Value
+		err := cs.LocalPeer.SetPublicAddress(cls.Value, cs.LocalPeer.CopyEntry().Port)
+
+		if err != nil {
+			return CommandResult{false, nil, err}
+		}
 
 	default:
 		return CommandResult{false, nil, errors.New("Unknown key")}
 	}
 
-	cs.LocalPeer.SignEntry()
 	err := cs.LocalPeer.SaveEntry()
 
 	return CommandResult{err == nil, nil, err}
@@ -531,20 +623,21 @@ func (cs *CommandServer) LocalSet(cls CommandLocalSet) CommandResult {
 func (cs *CommandServer) LocalGet(clg CommandLocalGet) CommandResult {
 	log.Info("Command: LocalGet")
 	value := ""
+	entry := cs.LocalPeer.CopyEntry()
 
 	switch strings.ToLower(clg.Key) {
 	case "name":
-		value = cs.LocalPeer.Entry.Name
+		value = entry.Name
 	case "desc":
-		value = cs.LocalPeer.Entry.Desc
+		value = entry.Desc
 	case "public":
-		value = cs.LocalPeer.Entry.PublicAddress
+		value = entry.PublicAddress
 	case "zif":
-		value, _ = cs.LocalPeer.Entry.Address.String()
+		value, _ = entry.Address.String()
 	case "postcount":
-		value = strconv.Itoa(cs.LocalPeer.Entry.PostCount)
+		value = strconv.Itoa(entry.PostCount)
 	case "entry":
-		value, _ = cs.LocalPeer.Entry.EncodeString()
+		value, _ = entry.EncodeString()
 
 	default:
 		return CommandResult{false, nil, errors.New("Unknown key")}
@@ -583,7 +676,7 @@ func (cs *CommandServer) StartCpuProfile(cf CommandFile) CommandResult {
 func (cs *CommandServer) StopCpuProfile() CommandResult {
 	pprof.StopCPUProfile()
 
-	return CommandResult{true,nil,nil}
+	return CommandResult{true, nil, nil}
 }
 
 func (cs *CommandServer) MemProfile(cf CommandFile) CommandResult {
@@ -610,6 +703,47 @@ func (cs *CommandServer) SetSeedLeech(csl CommandSetSeedLeech) CommandResult {
 	return CommandResult{err == nil, nil, err}
 }
 
+func (cs *CommandServer) ConnectionStats() CommandResult {
+	return CommandResult{true, cs.LocalPeer.Server.AdmissionStats(), nil}
+}
+
+func (cs *CommandServer) StickyPeers() CommandResult {
+	return CommandResult{true, cs.LocalPeer.StickyPeers(), nil}
+}
+
+// Stops keeping a peer connected, whatever it was kept connected for.
+func (cs *CommandServer) ForgetSticky(cf CommandForgetSticky) CommandResult {
+	address, err := dht.DecodeAddress(cf.Address)
+
+	if err != nil {
+		return CommandResult{false, nil, err}
+	}
+
+	if !cs.LocalPeer.reconnector.Forget(address) {
+		return CommandResult{false, nil, errors.New("Peer is not being kept connected")}
+	}
+
+	return CommandResult{true, nil, nil}
+}
+
+// Every address and IP that is banned, or has been banned before.
+func (cs *CommandServer) Bans() CommandResult {
+	return CommandResult{true, cs.LocalPeer.Server.Reputation().Bans(), nil}
+}
+
+func (cs *CommandServer) Unban(cu CommandUnban) CommandResult {
+	if !cs.LocalPeer.Server.Reputation().Unban(cu.Key) {
+		return CommandResult{false, nil, errors.New("Not banned")}
+	}
+
+	return CommandResult{true, nil, nil}
+}
+
+// The connections being relayed for other peers.
+func (cs *CommandServer) RelayStats() CommandResult {
+	return CommandResult{true, cs.LocalPeer.Server.Relay().Stats(), nil}
+}
+
 func (cs *CommandServer) NetMap(cnm CommandNetMap) CommandResult {
 	address, err := dht.DecodeAddress(cnm.Address)
 
@@ -1,13 +1,17 @@
 package common
 
-import "github.com/zif/zif/dht"
+import (
+	"context"
 
-type ConnectPeer func(dht.Address) (interface{}, error)
+	"github.com/zif/zif/dht"
+)
+
+type ConnectPeer func(context.Context, dht.Address) (interface{}, error)
 
 type Peer interface {
 	EAddress() Encoder
-	FindClosest(dht.Address) ([]Verifier, error)
-	Query(dht.Address) (Verifier, error)
+	FindClosest(context.Context, dht.Address) ([]Verifier, error)
+	Query(context.Context, dht.Address) (Verifier, error)
 }
 
 type Closable interface {
@@ -0,0 +1,109 @@
+package data
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// Keeps track of which pieces of a remote collection have been verified and
+// committed to the local database, so that an interrupted mirror can carry on
+// from where it left off. The file holds the hash of each committed piece at its
+// index, anything else is zeroed.
+//
+// As the hashes themselves are stored, a piece that has since changed on the
+// remote peer (usually the last one) no longer matches and is fetched again.
+type Checkpoint struct {
+	lock   sync.RWMutex
+	file   *os.File
+	hashes []byte
+}
+
+// Opens the checkpoint at path, creating it if needed.
+func OpenCheckpoint(path string) (*Checkpoint, error) {
+	hashes, err := ioutil.ReadFile(path)
+
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// a partially written hash is useless, just drop it
+	hashes = hashes[:len(hashes)-len(hashes)%32]
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Checkpoint{file: file, hashes: hashes}, nil
+}
+
+// Whether the piece at id has been committed with the given hash.
+func (c *Checkpoint) Has(id int, hash []byte) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.has(id, hash)
+}
+
+func (c *Checkpoint) has(id int, hash []byte) bool {
+	if id < 0 || 32*id+32 > len(c.hashes) {
+		return false
+	}
+
+	return bytes.Equal(c.hashes[32*id:32*id+32], hash)
+}
+
+// The ids of all pieces in a hash list which have not been committed, in order.
+func (c *Checkpoint) Missing(hashList []byte) []int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	ret := make([]int, 0)
+
+	for i := 0; 32*i+32 <= len(hashList); i++ {
+		if !c.has(i, hashList[32*i:32*i+32]) {
+			ret = append(ret, i)
+		}
+	}
+
+	return ret
+}
+
+// Records that the piece at id has been committed. This goes straight to disk,
+// so must only be called once the piece really is in the database.
+func (c *Checkpoint) Commit(id int, hash []byte) error {
+	if id < 0 || len(hash) != 32 {
+		return errors.New("Invalid piece for checkpoint")
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	_, err := c.file.WriteAt(hash, int64(32*id))
+
+	if err != nil {
+		return err
+	}
+
+	err = c.file.Sync()
+
+	if err != nil {
+		return err
+	}
+
+	if len(c.hashes) < 32*id+32 {
+		c.hashes = append(c.hashes, make([]byte, 32*id+32-len(c.hashes))...)
+	}
+
+	copy(c.hashes[32*id:], hash)
+
+	return nil
+}
+
+func (c *Checkpoint) Close() error {
+	return c.file.Close()
+}
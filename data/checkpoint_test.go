@@ -0,0 +1,170 @@
+package data
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// A database of count pieces, and its hash list.
+func testDatabase(t *testing.T, path string, count int) (*Database, []byte) {
+	db := NewDatabase(path)
+
+	if err := db.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(db.Close)
+
+	for i := 0; i < count; i++ {
+		piece := &Piece{Id: uint(i)}
+		piece.Setup()
+
+		for j := 0; j < PieceSize; j++ {
+			id := i*PieceSize + j + 1
+
+			piece.Add(Post{
+				Id:         id,
+				InfoHash:   fmt.Sprintf("%040d", id),
+				Title:      fmt.Sprintf("post %d", id),
+				Size:       1024,
+				FileCount:  1,
+				UploadDate: 1500000000,
+			}, true)
+		}
+
+		if err := db.InsertPiece(piece); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	col, err := CreateCollection(db, 0, PieceSize)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db, col.HashList
+}
+
+// Copies the pieces with the given ids from one database to another, committing
+// each to the checkpoint, as a mirror would.
+func mirrorPieces(t *testing.T, from, to *Database, checkpoint *Checkpoint, hashList []byte, ids ...int) {
+	for _, id := range ids {
+		piece, err := from.QueryPiece(uint(id), true)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := to.InsertPiece(piece); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := checkpoint.Commit(id, hashList[32*id:32*id+32]); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func openCheckpoint(t *testing.T, path string) *Checkpoint {
+	checkpoint, err := OpenCheckpoint(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { checkpoint.Close() })
+
+	return checkpoint
+}
+
+func TestCheckpointResume(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "checkpoint.dat")
+
+	source, hashList := testDatabase(t, filepath.Join(dir, "source.db"), 4)
+	mirror, _ := testDatabase(t, filepath.Join(dir, "mirror.db"), 0)
+
+	checkpoint := openCheckpoint(t, path)
+
+	if missing := checkpoint.Missing(hashList); !reflect.DeepEqual(missing, []int{0, 1, 2, 3}) {
+		t.Fatal("New checkpoint is missing ", missing)
+	}
+
+	// interrupted part way through, out of order as a swarm would be
+	mirrorPieces(t, source, mirror, checkpoint, hashList, 2, 0)
+	checkpoint.Close()
+
+	checkpoint = openCheckpoint(t, path)
+	missing := checkpoint.Missing(hashList)
+
+	if !reflect.DeepEqual(missing, []int{1, 3}) {
+		t.Fatal("Reopened checkpoint is missing ", missing, ", expected [1 3]")
+	}
+
+	mirrorPieces(t, source, mirror, checkpoint, hashList, missing...)
+
+	if missing := checkpoint.Missing(hashList); len(missing) != 0 {
+		t.Fatal("Resumed checkpoint is still missing ", missing)
+	}
+
+	col, err := CreateCollection(mirror, 0, PieceSize)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(col.HashList, hashList) {
+		t.Fatal("Resumed mirror does not match the source")
+	}
+}
+
+func TestCheckpointCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "checkpoint.dat")
+
+	source, hashList := testDatabase(t, filepath.Join(dir, "source.db"), 3)
+	mirror, _ := testDatabase(t, filepath.Join(dir, "mirror.db"), 0)
+
+	checkpoint := openCheckpoint(t, path)
+	mirrorPieces(t, source, mirror, checkpoint, hashList, 0, 1, 2)
+	checkpoint.Close()
+
+	// a flipped bit in the second hash, and the third only partly written
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := file.WriteAt([]byte{hashList[32] ^ 1}, 32); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := file.Truncate(32*2 + 10); err != nil {
+		t.Fatal(err)
+	}
+
+	file.Close()
+
+	checkpoint = openCheckpoint(t, path)
+
+	if missing := checkpoint.Missing(hashList); !reflect.DeepEqual(missing, []int{1, 2}) {
+		t.Fatal("Corrupt checkpoint is missing ", missing, ", expected [1 2]")
+	}
+
+	// a collection that has changed since is fetched again too
+	changed := append([]byte{}, hashList...)
+	changed[0] ^= 1
+
+	if missing := checkpoint.Missing(changed); !reflect.DeepEqual(missing, []int{0, 1, 2}) {
+		t.Fatal("Checkpoint of a changed collection is missing ", missing, ", expected [0 1 2]")
+	}
+
+	if err := checkpoint.Commit(0, hashList[:31]); err == nil {
+		t.Fatal("Committed a piece with a short hash")
+	}
+}
@@ -81,7 +81,7 @@ func (c *Collection) Save(path string) error {
 // Add a piece to the collection, storing it in c.Pieces and appending it's hash
 // to the hash list.
 func (c *Collection) Add(piece *Piece) {
-	if uint(len(c.HashList)) < piece.Id+1 {
+	if uint(len(c.HashList)/32) < piece.Id+1 {
 		c.HashList = append(c.HashList, piece.Hash()...)
 	} else {
 		copy(c.HashList[piece.Id*32:piece.Id*32+32], piece.Hash())
@@ -0,0 +1,63 @@
+package data
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+var ErrInvalidCursor = errors.New("Invalid cursor")
+
+// Marks a place in an ordered list of posts, just after the last post that was
+// returned. Posts are ordered by a score (upload date, popularity or search rank)
+// and then by id, both descending. As the id breaks any ties, the next page always
+// starts exactly where the last one ended, however many posts are added in the
+// meantime.
+type Cursor struct {
+	Score float64
+	Id    int
+}
+
+// The cursor as it is sent to other peers. They should treat it as opaque, and
+// only ever hand it back.
+func (c *Cursor) Encode() []byte {
+	if c == nil {
+		return nil
+	}
+
+	ret := make([]byte, 16)
+	binary.BigEndian.PutUint64(ret[:8], math.Float64bits(c.Score))
+	binary.BigEndian.PutUint64(ret[8:], uint64(c.Id))
+
+	return ret
+}
+
+// Decodes a cursor made by Encode. Nothing at all means the start of the list, in
+// which case the cursor is nil.
+func DecodeCursor(b []byte) (*Cursor, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+
+	if len(b) != 16 {
+		return nil, ErrInvalidCursor
+	}
+
+	score := math.Float64frombits(binary.BigEndian.Uint64(b[:8]))
+
+	if math.IsNaN(score) {
+		return nil, ErrInvalidCursor
+	}
+
+	return &Cursor{score, int(binary.BigEndian.Uint64(b[8:]))}, nil
+}
+
+// The arguments a cursor query takes for it: the score and id to carry on after,
+// or nulls to start from the beginning.
+func (c *Cursor) args() (interface{}, interface{}) {
+	if c == nil {
+		return nil, nil
+	}
+
+	return c.Score, c.Id
+}
@@ -0,0 +1,141 @@
+package data
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestCursorEncode(t *testing.T) {
+	cursor := &Cursor{Score: 1.5, Id: 42}
+	decoded, err := DecodeCursor(cursor.Encode())
+
+	if err != nil || *decoded != *cursor {
+		t.Fatal("Decoded ", decoded, ", ", err)
+	}
+
+	if decoded, err := DecodeCursor(nil); decoded != nil || err != nil {
+		t.Fatal("Empty cursor decoded as ", decoded, ", ", err)
+	}
+
+	if _, err := DecodeCursor([]byte("short")); err != ErrInvalidCursor {
+		t.Fatal("Short cursor decoded with ", err)
+	}
+}
+
+type cursorDatabase struct {
+	*Database
+	count int
+}
+
+// Adds a post with the given score, whether posts are ordered by upload date,
+// popularity or search rank.
+func (cd *cursorDatabase) insert(t *testing.T, score int) {
+	cd.count++
+
+	id, err := cd.InsertPost(Post{
+		InfoHash:   fmt.Sprintf("%040d", cd.count),
+		Title:      fmt.Sprintf("cursor post %d", cd.count),
+		Size:       1024,
+		FileCount:  1,
+		Leechers:   score,
+		UploadDate: score,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cd.GenerateFts(id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Pages through posts, adding more after every page: some that sort before the
+// cursor, which should never be returned, and some after it, which should be.
+// Ten posts share each score to begin with, so pages have to split ties.
+func testCursor(t *testing.T, next func(*Database, *Cursor) ([]*Post, *Cursor, error)) {
+	db := NewDatabase(filepath.Join(t.TempDir(), "posts.db"))
+
+	if err := db.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(db.Close)
+
+	cd := &cursorDatabase{Database: db}
+
+	for i := 0; i < 30; i++ {
+		cd.insert(t, 10+i%3)
+	}
+
+	expected := cd.count
+	seen := make(map[int]bool)
+
+	var cursor *Cursor
+	var last *Post
+
+	for pages := 0; ; pages++ {
+		if pages > expected {
+			t.Fatal("Pagination never ended")
+		}
+
+		posts, nextCursor, err := next(db, cursor)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, i := range posts {
+			if seen[i.Id] {
+				t.Fatal("Post ", i.Id, " was returned twice")
+			}
+
+			if last != nil && (i.Leechers > last.Leechers || (i.Leechers == last.Leechers && i.Id > last.Id)) {
+				t.Fatal("Post ", i.Id, " is out of order")
+			}
+
+			seen[i.Id] = true
+			last = i
+		}
+
+		if nextCursor == nil {
+			break
+		}
+
+		// as it would come back from another peer
+		cursor, err = DecodeCursor(nextCursor.Encode())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// newer, tied with the last post but with a higher id, and older
+		cd.insert(t, 100)
+		cd.insert(t, last.Leechers)
+		cd.insert(t, 1)
+		expected++
+	}
+
+	if len(seen) != expected {
+		t.Fatal("Paginated ", len(seen), " posts, expected ", expected)
+	}
+}
+
+func TestCursorRecent(t *testing.T) {
+	testCursor(t, func(db *Database, c *Cursor) ([]*Post, *Cursor, error) {
+		return db.QueryRecentCursor(c, 7)
+	})
+}
+
+func TestCursorPopular(t *testing.T) {
+	testCursor(t, func(db *Database, c *Cursor) ([]*Post, *Cursor, error) {
+		return db.QueryPopularCursor(c, 7)
+	})
+}
+
+func TestCursorSearch(t *testing.T) {
+	testCursor(t, func(db *Database, c *Cursor) ([]*Post, *Cursor, error) {
+		return db.SearchCursor("cursor", c, 7)
+	})
+}
@@ -54,10 +54,15 @@ func (db *Database) Connect() error {
 }
 
 // Inserts a piece into the database. All the posts are iterated over and inserted
-// within a single SQL transaction.
+// within a single SQL transaction. Posts keep their ids, so pieces can be inserted
+// in any order, and inserting a piece again replaces it.
 func (db *Database) InsertPiece(piece *Piece) (err error) {
 	tx, err := db.conn.Begin()
 
+	if err != nil {
+		return err
+	}
+
 	defer func() {
 		if err != nil {
 			tx.Rollback()
@@ -68,8 +73,8 @@ func (db *Database) InsertPiece(piece *Piece) (err error) {
 	}()
 
 	for _, i := range piece.Posts {
-		_, err = tx.Exec(sql_insert_post, i.InfoHash, i.Title, i.Size, i.FileCount,
-			i.Seeders, i.Leechers, i.UploadDate, i.Tags)
+		_, err = tx.Exec(sql_insert_post_id, i.Id, i.InfoHash, i.Title, i.Size,
+			i.FileCount, i.Seeders, i.Leechers, i.UploadDate, i.Tags, i.Meta)
 
 		if err != nil {
 			return
@@ -218,6 +223,67 @@ func (db *Database) PaginatedQuery(query string, page int) ([]*Post, error) {
 	return posts, nil
 }
 
+// Runs one of the cursor queries, returning the page of posts along with the
+// cursor for the next page. The cursor is nil once there are no more posts.
+func (db *Database) cursorQuery(query string, cursor *Cursor, pageSize int, score func(*Post) float64) ([]*Post, *Cursor, error) {
+	after, id := cursor.args()
+	posts, err := db.queryPosts(query, after, id, pageSize)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(posts) < pageSize || len(posts) == 0 {
+		return posts, nil, nil
+	}
+
+	last := posts[len(posts)-1]
+
+	return posts, &Cursor{score(last), last.Id}, nil
+}
+
+func (db *Database) queryPosts(query string, args ...interface{}) ([]*Post, error) {
+	posts := make([]*Post, 0)
+	rows, err := db.conn.Query(query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var post Post
+
+		err := rows.Scan(&post.Id, &post.InfoHash, &post.Title, &post.Size,
+			&post.FileCount, &post.Seeders, &post.Leechers, &post.UploadDate,
+			&post.Tags, &post.Meta)
+
+		if err != nil {
+			return nil, err
+		}
+
+		posts = append(posts, &post)
+	}
+
+	return posts, rows.Err()
+}
+
+// Returns up to pageSize posts after the cursor, newest first.
+func (db *Database) QueryRecentCursor(cursor *Cursor, pageSize int) ([]*Post, *Cursor, error) {
+	return db.cursorQuery(sql_query_recent_cursor, cursor, pageSize, func(p *Post) float64 {
+		return float64(p.UploadDate)
+	})
+}
+
+// Returns up to pageSize posts after the cursor, most seeders and leechers first.
+// Unlike QueryPopular, this looks at every post, not just the most recent.
+func (db *Database) QueryPopularCursor(cursor *Cursor, pageSize int) ([]*Post, *Cursor, error) {
+	return db.cursorQuery(sql_query_popular_cursor, cursor, pageSize, func(p *Post) float64 {
+		return float64(p.Seeders + p.Leechers)
+	})
+}
+
 // Returns a page of posts ordered by upload data, descending.
 func (db *Database) QueryRecent(page int) ([]*Post, error) {
 	return db.PaginatedQuery(sql_query_recent_post, page)
@@ -263,6 +329,59 @@ func (db *Database) Search(query string, page, pageSize int) ([]*Post, error) {
 	return posts, nil
 }
 
+// Searches like Search, but returns up to pageSize posts after the cursor, along
+// with the cursor for the next page.
+func (db *Database) SearchCursor(query string, cursor *Cursor, pageSize int) ([]*Post, *Cursor, error) {
+	after, id := cursor.args()
+	rows, err := db.conn.Query(sql_search_cursor, after, id, pageSize, query)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer rows.Close()
+
+	ids := make([]uint, 0, pageSize)
+	var score float64
+
+	for rows.Next() {
+		var result uint
+
+		err = rows.Scan(&result, &score)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		ids = append(ids, result)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	// finish with the results before querying again
+	rows.Close()
+
+	posts := make([]*Post, 0, len(ids))
+
+	for _, i := range ids {
+		post, err := db.QueryPostId(i)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		posts = append(posts, &post)
+	}
+
+	if len(ids) < pageSize || len(ids) == 0 {
+		return posts, nil, nil
+	}
+
+	return posts, &Cursor{score, int(ids[len(ids)-1])}, nil
+}
+
 // Return a single post given it's id.
 func (db *Database) QueryPostId(id uint) (Post, error) {
 	var post Post
@@ -330,7 +449,7 @@ func (db *Database) QueryPiecePosts(start, length int, store bool) chan *Post {
 		defer close(ret)
 
 		rows, err := db.conn.Query(sql_query_paged_post, start*page_size,
-			start+page_size*length)
+			page_size*length)
 
 		if err != nil {
 			return
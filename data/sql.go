@@ -38,6 +38,20 @@ const sql_insert_post string = `INSERT OR IGNORE INTO post(
 									meta
 								) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
+// Used when the id of a post is already known, for instance when mirroring.
+const sql_insert_post_id string = `INSERT OR REPLACE INTO post(
+									id,
+									info_hash,
+									title,
+									size,
+									file_count,
+									seeders,
+									leechers,
+									upload_date,
+									tags,
+									meta
+								) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
 const sql_attach_meta string = `UPDATE POST
 								SET meta=?
 								WHERE id=?`
@@ -62,6 +76,31 @@ const sql_query_popular_post string = ` SELECT * FROM(
 												 ORDER BY seeders + leechers DESC
 												 LIMIT ?,?`
 
+// The cursor queries below order by a score and then id, so that no two posts
+// are ever tied. ?1 and ?2 are the score and id of the last post on the previous
+// page, or null for the first page.
+const sql_query_recent_cursor string = `SELECT * FROM post
+										WHERE ?1 IS NULL
+											OR upload_date < ?1
+											OR (upload_date = ?1 AND id < ?2)
+										ORDER BY upload_date DESC, id DESC
+										LIMIT ?3`
+
+const sql_query_popular_cursor string = `SELECT * FROM post
+										WHERE ?1 IS NULL
+											OR seeders + leechers < ?1
+											OR (seeders + leechers = ?1 AND id < ?2)
+										ORDER BY seeders + leechers DESC, id DESC
+										LIMIT ?3`
+
+const sql_search_cursor string = `SELECT docid, (seeders * 1.1) + leechers AS score
+									FROM fts_post
+									WHERE title MATCH ?4 AND (?1 IS NULL
+										OR (seeders * 1.1) + leechers < ?1
+										OR ((seeders * 1.1) + leechers = ?1 AND docid < ?2))
+									ORDER BY score DESC, docid DESC
+									LIMIT ?3`
+
 const sql_query_post_id string = `SELECT 	 * FROM post
 												 WHERE id = ?`
 
@@ -59,6 +59,12 @@ func (dht *DHT) FindClosest(addr Address) (Entries, error) {
 	return dht.db.FindClosest(addr)
 }
 
+// Up to n entries from the routing table, picked at random from those seen most
+// recently.
+func (dht *DHT) Sample(n int) Entries {
+	return dht.db.Sample(n)
+}
+
 func (dht *DHT) SaveTable(path string) {
 	dht.db.SaveTable(path)
 }
@@ -67,6 +73,10 @@ func (dht *DHT) LoadTable(path string) {
 	dht.db.LoadTable(path)
 }
 
+func (dht *DHT) Close() error {
+	return dht.db.Close()
+}
+
 func (dht *DHT) SearchEntries(name, desc string, page int) ([]Address, error) {
 	return dht.db.SearchPeer(name, desc, page)
 }
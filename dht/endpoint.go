@@ -0,0 +1,257 @@
+// Endpoints are the ways a peer can be reached, each of a type that says how to
+// dial it. Entries list them so that a peer can be on IPv4, IPv6 and Tor at once,
+// and so that peers which cannot dial some of them know to try the others.
+
+package dht
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Endpoint types that we know how to check. Others are allowed in entries, so
+// that peers can add new ways of being reached without older peers rejecting
+// their entries, but are never dialled.
+const (
+	EndpointIPv4  = "ipv4"
+	EndpointIPv6  = "ipv6"
+	EndpointDNS   = "dns"
+	EndpointOnion = "onion"
+
+	// A .b32.i2p address. I2P streams go to a destination rather than a port,
+	// so there is none.
+	EndpointI2P = "i2p"
+
+	// The path of a unix socket, for peers on the same machine.
+	EndpointUnix = "unix"
+
+	// The name of an in-memory listener, for peers in the same process.
+	EndpointPipe = "pipe"
+
+	// A host, IP or name, and port that serves WebSockets on the Zif path, over
+	// TLS for wss.
+	EndpointWS  = "ws"
+	EndpointWSS = "wss"
+
+	// The address is the Zif address of a peer that relays for this one, there
+	// is no port.
+	EndpointRelay = "relay"
+)
+
+const (
+	MaxEntryEndpoints      = 16
+	MaxEndpointTypeLength  = 16
+	MaxEndpointAddrLength  = 253
+	onionSuffix            = ".onion"
+	i2pSuffix              = ".b32.i2p"
+	endpointFieldSeparator = "\x00"
+)
+
+type Endpoint struct {
+	Type    string `json:"type"`
+	Address string `json:"address"`
+	Port    int    `json:"port"`
+}
+
+// Guesses the type of an endpoint from its host.
+func NewEndpoint(host string, port int) Endpoint {
+	ret := Endpoint{Address: host, Port: port}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil {
+			ret.Type = EndpointIPv4
+			ret.Address = ip.To4().String()
+		} else {
+			ret.Type = EndpointIPv6
+			ret.Address = ip.String()
+		}
+	} else if strings.HasSuffix(host, onionSuffix) {
+		ret.Type = EndpointOnion
+	} else if strings.HasSuffix(host, i2pSuffix) {
+		ret.Type = EndpointI2P
+		ret.Port = 0
+	} else {
+		ret.Type = EndpointDNS
+	}
+
+	return ret
+}
+
+func NewRelayEndpoint(addr Address) Endpoint {
+	return Endpoint{Type: EndpointRelay, Address: addr.StringOr("")}
+}
+
+// Parses an endpoint as written by String, such as "ipv6:[::1]:5050".
+func ParseEndpoint(s string) (Endpoint, error) {
+	parts := strings.SplitN(s, ":", 2)
+
+	if len(parts) != 2 {
+		return Endpoint{}, errors.New("Endpoint has no type: " + s)
+	}
+
+	if !hasPort(parts[0]) {
+		ret := Endpoint{Type: parts[0], Address: parts[1]}
+
+		return ret, ret.Valid()
+	}
+
+	host, port, err := net.SplitHostPort(parts[1])
+
+	if err != nil {
+		return Endpoint{}, err
+	}
+
+	ret := Endpoint{Type: parts[0], Address: host}
+	ret.Port, err = strconv.Atoi(port)
+
+	if err != nil {
+		return Endpoint{}, err
+	}
+
+	return ret, ret.Valid()
+}
+
+// Whether endpoints of a type have a port.
+func hasPort(kind string) bool {
+	switch kind {
+	case EndpointRelay, EndpointI2P, EndpointUnix, EndpointPipe:
+		return false
+	}
+
+	return true
+}
+
+func (e Endpoint) String() string {
+	if !hasPort(e.Type) {
+		return e.Type + ":" + e.Address
+	}
+
+	return e.Type + ":" + e.HostPort()
+}
+
+// The address to dial, such as "[::1]:5050".
+func (e Endpoint) HostPort() string {
+	return net.JoinHostPort(e.Address, strconv.Itoa(e.Port))
+}
+
+// The relay this endpoint is, if it is one.
+func (e Endpoint) Relay() (Address, error) {
+	if e.Type != EndpointRelay {
+		return Address{}, errors.New("Endpoint is not a relay")
+	}
+
+	return DecodeAddress(e.Address)
+}
+
+// What is signed for the endpoint. The fields are separated so that they cannot
+// run into each other.
+func (e Endpoint) bytes() string {
+	return e.Type + endpointFieldSeparator + e.Address + endpointFieldSeparator +
+		strconv.Itoa(e.Port) + endpointFieldSeparator
+}
+
+func (e Endpoint) Valid() error {
+	if e.Type == "" || len(e.Type) > MaxEndpointTypeLength {
+		return errors.New("Endpoint type invalid")
+	}
+
+	if e.Address == "" || len(e.Address) > MaxEndpointAddrLength {
+		return errors.New("Endpoint address invalid")
+	}
+
+	if e.Type == EndpointRelay {
+		if e.Port != 0 {
+			return errors.New("Relay endpoints have no port")
+		}
+
+		_, err := e.Relay()
+
+		return err
+	}
+
+	if !hasPort(e.Type) {
+		if e.Port != 0 {
+			return errors.New("Endpoint type " + e.Type + " has no port")
+		}
+
+		if e.Type == EndpointI2P && (!strings.HasSuffix(e.Address, i2pSuffix) ||
+			strings.ContainsAny(e.Address, ":/ ")) {
+			return errors.New("Endpoint is not a .b32.i2p address")
+		}
+
+		return nil
+	}
+
+	if e.Port < 0 || e.Port > 65535 {
+		return errors.New("Endpoint port invalid")
+	}
+
+	ip := net.ParseIP(e.Address)
+
+	switch e.Type {
+	case EndpointIPv4, EndpointIPv6, EndpointOnion, EndpointDNS, EndpointWS, EndpointWSS:
+		if e.Port == 0 {
+			return errors.New("Endpoint has no port")
+		}
+	}
+
+	switch e.Type {
+	case EndpointIPv4:
+		if ip == nil || ip.To4() == nil {
+			return errors.New("Endpoint is not an IPv4 address")
+		}
+	case EndpointIPv6:
+		if ip == nil || ip.To4() != nil {
+			return errors.New("Endpoint is not an IPv6 address")
+		}
+	case EndpointOnion:
+		if !strings.HasSuffix(e.Address, onionSuffix) {
+			return errors.New("Endpoint is not an onion address")
+		}
+	case EndpointDNS:
+		if ip != nil || strings.ContainsAny(e.Address, ":/ ") {
+			return errors.New("Endpoint is not a host name")
+		}
+	case EndpointWS, EndpointWSS:
+		if ip == nil && strings.ContainsAny(e.Address, ":/ ") {
+			return errors.New("Endpoint is not a host")
+		}
+	}
+
+	return nil
+}
+
+// The endpoints of an entry. Entries signed before endpoints existed have only
+// their public address, port and relays, which are turned into endpoints here.
+func (e *Entry) AllEndpoints() []Endpoint {
+	if len(e.Endpoints) > 0 {
+		return e.Endpoints
+	}
+
+	ret := make([]Endpoint, 0, len(e.Relays)+1)
+
+	if e.PublicAddress != "" {
+		ret = append(ret, NewEndpoint(e.PublicAddress, e.Port))
+	}
+
+	for _, i := range e.Relays {
+		ret = append(ret, NewRelayEndpoint(Address{Raw: i}))
+	}
+
+	return ret
+}
+
+// Moves an entry signed before endpoints existed onto them. The entry has to be
+// signed again afterwards, so only the owner of an entry can do this.
+func (e *Entry) MigrateEndpoints() bool {
+	if len(e.Endpoints) > 0 || (e.PublicAddress == "" && len(e.Relays) == 0) {
+		return false
+	}
+
+	e.Endpoints = e.AllEndpoints()
+	e.Relays = nil
+
+	return true
+}
@@ -17,6 +17,7 @@ const (
 	MaxEntryDescLength          = 160
 	MaxEntryPublicAddressLength = 253
 	MaxEntrySeeds               = 100000
+	MaxEntryRelays              = 8
 )
 
 // This is an entry into the DHT. It is used to connect to a peer given just
@@ -42,6 +43,15 @@ type Entry struct {
 	Seeding [][]byte `json:"seeding"`
 	Seen    int      `json:"seed"`
 
+	// Addresses of peers that will relay connections to this one, for when it
+	// cannot be connected to directly. Only in entries signed before endpoints,
+	// which list relays themselves.
+	Relays [][]byte `json:"relays"`
+
+	// Every way the peer can be reached. PublicAddress and Port are still set
+	// to one of them, for peers that do not know about endpoints.
+	Endpoints []Endpoint `json:"endpoints"`
+
 	// Used in the FindClosest function, for sorting.
 	distance Address
 }
@@ -89,7 +99,7 @@ func (e Entry) String() (string, error) {
 	str += e.Desc
 	str += string(e.PublicAddress)
 	str += string(e.PublicKey)
-	str += string(e.Port)
+	str += string(rune(e.Port))
 	str += postCount
 	str += updated
 	str += string(e.CollectionHash)
@@ -98,6 +108,14 @@ func (e Entry) String() (string, error) {
 		str += string(i)
 	}
 
+	for _, i := range e.Relays {
+		str += string(i)
+	}
+
+	for _, i := range e.Endpoints {
+		str += i.bytes()
+	}
+
 	// note that we do not, in fact, sign who the seeds are. This allows others
 	// to build the swarm while this peer is not online.
 
@@ -166,6 +184,26 @@ func (entry *Entry) Verify() error {
 		return errors.New("Entry has too many seeds")
 	}
 
+	if len(entry.Relays) > MaxEntryRelays {
+		return errors.New("Entry has too many relays")
+	}
+
+	for _, i := range entry.Relays {
+		if len(i) != AddressBinarySize {
+			return errors.New("Relay address size invalid")
+		}
+	}
+
+	if len(entry.Endpoints) > MaxEntryEndpoints {
+		return errors.New("Entry has too many endpoints")
+	}
+
+	for _, i := range entry.Endpoints {
+		if err := i.Valid(); err != nil {
+			return err
+		}
+	}
+
 	if len(entry.PublicKey) < ed25519.PublicKeySize {
 		return errors.New(fmt.Sprintf("Public key too small: %d", len(entry.PublicKey)))
 	}
@@ -181,8 +219,14 @@ func (entry *Entry) Verify() error {
 		return errors.New("Failed to verify signature")
 	}
 
-	if len(entry.PublicAddress) == 0 {
-		return errors.New("Public address must be set")
+	// otherwise anyone could sign an entry of their own under another address
+	if owner := NewAddress(entry.PublicKey); !owner.Equals(&entry.Address) {
+		return errors.New("Address is not that of the public key")
+	}
+
+	// peers only on I2P, or behind relays, may have nothing else
+	if len(entry.PublicAddress) == 0 && len(entry.Endpoints) == 0 {
+		return errors.New("Public address or endpoints must be set")
 	}
 
 	// 253 is the maximum length of a domain name
@@ -191,7 +235,7 @@ func (entry *Entry) Verify() error {
 	}
 
 	if entry.Port > 65535 {
-		return errors.New("Port too large (" + string(entry.Port) + ")")
+		return errors.New("Port too large (" + strconv.Itoa(entry.Port) + ")")
 	}
 
 	return nil
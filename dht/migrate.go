@@ -0,0 +1,106 @@
+package dht
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Changes made to the schema since the tables were first created. Each is run
+// once, in order, and the database remembers how many it has had in its
+// user_version. New changes go on the end, existing ones must never change.
+var migrations = []string{
+	// relays were added to entries, as their raw addresses one after another
+	`ALTER TABLE entry ADD COLUMN relays BLOB`,
+
+	// endpoints were added to entries, as JSON
+	`ALTER TABLE entry ADD COLUMN endpoints TEXT`,
+}
+
+func migrate(conn *sql.DB) error {
+	version := 0
+	err := conn.QueryRow("PRAGMA user_version").Scan(&version)
+
+	if err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		log.WithField("version", i+1).Info("Migrating NetDB")
+
+		tx, err := conn.Begin()
+
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(migrations[i])
+
+		if err == nil {
+			// pragmas cannot take parameters
+			_, err = tx.Exec("PRAGMA user_version = " + strconv.Itoa(i+1))
+		}
+
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		err = tx.Commit()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Relays are stored as their raw addresses, one after another.
+func joinRelays(relays [][]byte) []byte {
+	ret := make([]byte, 0, len(relays)*AddressBinarySize)
+
+	for _, i := range relays {
+		ret = append(ret, i...)
+	}
+
+	return ret
+}
+
+func splitRelays(joined []byte) [][]byte {
+	ret := make([][]byte, 0, len(joined)/AddressBinarySize)
+
+	for len(joined) >= AddressBinarySize {
+		relay := make([]byte, AddressBinarySize)
+		copy(relay, joined)
+
+		ret = append(ret, relay)
+		joined = joined[AddressBinarySize:]
+	}
+
+	return ret
+}
+
+// Endpoints are stored as JSON, or NULL if there are none.
+func encodeEndpoints(endpoints []Endpoint) (interface{}, error) {
+	if len(endpoints) == 0 {
+		return nil, nil
+	}
+
+	dat, err := json.Marshal(endpoints)
+
+	return string(dat), err
+}
+
+func decodeEndpoints(encoded sql.NullString) ([]Endpoint, error) {
+	if !encoded.Valid || encoded.String == "" {
+		return nil, nil
+	}
+
+	var ret []Endpoint
+	err := json.Unmarshal([]byte(encoded.String), &ret)
+
+	return ret, err
+}
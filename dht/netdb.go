@@ -4,6 +4,8 @@ import (
 	"database/sql"
 	"encoding/json"
 	"io/ioutil"
+	"math/rand"
+	"sync"
 
 	_ "github.com/mattn/go-sqlite3"
 	log "github.com/sirupsen/logrus"
@@ -14,9 +16,14 @@ const (
 )
 
 type NetDB struct {
-	table [][]Address
-	addr  Address
-	conn  *sql.DB
+	table     [][]Address
+	tableLock sync.RWMutex
+
+	addr Address
+	conn *sql.DB
+
+	// Where the routing table is saved whenever it changes, set by LoadTable.
+	tablePath string
 
 	stmtInsertEntry      *sql.Stmt
 	stmtInsertFtsEntry   *sql.Stmt
@@ -78,6 +85,12 @@ func NewNetDB(addr Address, path string) (*NetDB, error) {
 		return nil, err
 	}
 
+	// bring tables made by older versions up to date
+	err = migrate(ret.conn)
+	if err != nil {
+		return nil, err
+	}
+
 	// prepare all the SQL we will be needing
 	ret.stmtInsertEntry, err = ret.conn.Prepare(sqlInsertEntry)
 	if err != nil {
@@ -139,6 +152,9 @@ func NewNetDB(addr Address, path string) (*NetDB, error) {
 
 // Get the total size of the in-memory routing table
 func (ndb *NetDB) TableLen() int {
+	ndb.tableLock.RLock()
+	defer ndb.tableLock.RUnlock()
+
 	size := 0
 
 	for _, i := range ndb.table {
@@ -168,6 +184,8 @@ func (ndb *NetDB) insertIntoTable(addr Address) {
 	// Find the distance between the kv address and our own address, this is the
 	// index in the table
 	index := addr.Xor(&ndb.addr).LeadingZeroes()
+
+	ndb.tableLock.Lock()
 	bucket := ndb.table[index]
 
 	// there is capacity, insert at the front
@@ -194,8 +212,21 @@ func (ndb *NetDB) insertIntoTable(addr Address) {
 	bucket = append([]Address{addr}, bucket...)
 
 	ndb.table[index] = bucket
+	path := ndb.tablePath
+
+	ndb.tableLock.Unlock()
+
+	if path != "" {
+		ndb.SaveTable(path)
+	}
+}
 
-	ndb.SaveTable("./data/table.dat")
+// A copy of a bucket, which can be used while the table changes.
+func (ndb *NetDB) bucket(index int) []Address {
+	ndb.tableLock.RLock()
+	defer ndb.tableLock.RUnlock()
+
+	return append([]Address(nil), ndb.table[index]...)
 }
 
 // Returns updated, inserted. One should be zero.
@@ -207,12 +238,18 @@ func (ndb *NetDB) insertIntoDB(entry Entry) (int64, error) {
 		return 0, err
 	}
 
+	endpoints, err := encodeEndpoints(entry.Endpoints)
+
+	if err != nil {
+		return 0, err
+	}
+
 	// Insert the entry into the main entry table
 	res, err := ndb.stmtInsertEntry.Exec(addressString, entry.Name, entry.Desc,
 		entry.PublicAddress, entry.Port, entry.PublicKey,
 		entry.Signature, entry.CollectionHash,
 		entry.PostCount, len(entry.Seeds), len(entry.Seeding),
-		entry.Updated, entry.Seen)
+		entry.Updated, entry.Seen, joinRelays(entry.Relays), endpoints)
 
 	if err != nil {
 		return 0, err
@@ -351,10 +388,16 @@ func (ndb *NetDB) Update(entry Entry) (int64, error) {
 		return 0, err
 	}
 
+	endpoints, err := encodeEndpoints(entry.Endpoints)
+
+	if err != nil {
+		return 0, err
+	}
+
 	res, err := ndb.stmtUpdateEntry.Exec(entry.Name, entry.Desc, entry.PublicAddress,
 		entry.Port, entry.PublicKey, entry.Signature,
 		entry.CollectionHash, entry.PostCount, len(entry.Seeds), len(entry.Seeding),
-		entry.Updated, entry.Seen, addressString)
+		entry.Updated, entry.Seen, joinRelays(entry.Relays), endpoints, addressString)
 
 	if err == sql.ErrNoRows {
 		return 0, nil
@@ -384,10 +427,13 @@ func (ndb *NetDB) Query(addr Address) (*Entry, int, error) {
 	seedCount := 0
 	seedingCount := 0
 	address := ""
+	var relays []byte
+	var endpoints sql.NullString
 
 	err = row.Scan(&id, &address, &ret.Name, &ret.Desc, &ret.PublicAddress,
 		&ret.Port, &ret.PublicKey, &ret.Signature, &ret.CollectionHash,
-		&ret.PostCount, &seedCount, &seedingCount, &ret.Updated, &ret.Seen)
+		&ret.PostCount, &seedCount, &seedingCount, &ret.Updated, &ret.Seen,
+		&relays, &endpoints)
 
 	if err == sql.ErrNoRows {
 		return nil, -1, nil
@@ -405,6 +451,12 @@ func (ndb *NetDB) Query(addr Address) (*Entry, int, error) {
 
 	ret.Address.Raw = make([]byte, len(decoded.Raw))
 	copy(ret.Address.Raw, decoded.Raw)
+	ret.Relays = splitRelays(relays)
+	ret.Endpoints, err = decodeEndpoints(endpoints)
+
+	if err != nil {
+		return nil, -1, err
+	}
 
 	err = ndb.addSeedToEntry(&ret, seedCount, seedingCount, id)
 	if err != nil {
@@ -558,7 +610,7 @@ func (ndb *NetDB) FindClosest(addr Address) (Entries, error) {
 	// Find the distance between the kv address and our own address, this is the
 	// index in the table
 	index := addr.Xor(&ndb.addr).LeadingZeroes()
-	bucket := ndb.table[index]
+	bucket := ndb.bucket(index)
 
 	if len(bucket) == BucketSize {
 		return ndb.queryAddresses(bucket), nil
@@ -572,7 +624,7 @@ func (ndb *NetDB) FindClosest(addr Address) (Entries, error) {
 		len(ret) < BucketSize; i++ {
 
 		if index-i >= 0 {
-			bucket = ndb.table[index-i]
+			bucket = ndb.bucket(index - i)
 
 			for _, i := range bucket {
 				if len(ret) >= BucketSize {
@@ -589,8 +641,9 @@ func (ndb *NetDB) FindClosest(addr Address) (Entries, error) {
 			}
 		}
 
-		if index+i < len(addr.Raw)*8 {
-			bucket = ndb.table[index+i]
+		// at first both sides are the same bucket
+		if i > 0 && index+i < len(addr.Raw)*8 {
+			bucket = ndb.bucket(index + i)
 
 			for _, i := range bucket {
 				if len(ret) >= BucketSize {
@@ -612,6 +665,35 @@ func (ndb *NetDB) FindClosest(addr Address) (Entries, error) {
 	return ret, nil
 }
 
+// Up to n entries picked at random from those seen most recently, which are at
+// the front of each bucket.
+func (ndb *NetDB) Sample(n int) Entries {
+	candidates := make([]Address, 0, n*2)
+
+	ndb.tableLock.RLock()
+
+	// the front of every bucket first, then the next along, and so on
+	for depth := 0; depth < BucketSize && len(candidates) < n*2; depth++ {
+		for _, bucket := range ndb.table {
+			if depth < len(bucket) {
+				candidates = append(candidates, bucket[depth])
+			}
+		}
+	}
+
+	ndb.tableLock.RUnlock()
+
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+
+	return ndb.queryAddresses(candidates)
+}
+
 func (ndb *NetDB) QueryLatest() ([]Entry, error) {
 	ret := make([]Entry, 0, 20)
 	entries, err := ndb.stmtQueryLatest.Query()
@@ -627,10 +709,20 @@ func (ndb *NetDB) QueryLatest() ([]Entry, error) {
 		seedCount := 0
 		seedingCount := 0
 		address := ""
+		var relays []byte
+		var endpoints sql.NullString
 
 		err = entries.Scan(&id, &address, &e.Name, &e.Desc, &e.PublicAddress,
 			&e.Port, &e.PublicKey, &e.Signature, &e.CollectionHash,
-			&e.PostCount, &seedCount, &seedingCount, &e.Updated, &e.Seen)
+			&e.PostCount, &seedCount, &seedingCount, &e.Updated, &e.Seen,
+			&relays, &endpoints)
+
+		if err != nil {
+			return nil, err
+		}
+
+		e.Relays = splitRelays(relays)
+		e.Endpoints, err = decodeEndpoints(endpoints)
 
 		if err != nil {
 			return nil, err
@@ -677,7 +769,9 @@ func (ndb *NetDB) SearchPeer(name, desc string, page int) ([]Address, error) {
 }
 
 func (ndb *NetDB) SaveTable(path string) {
+	ndb.tableLock.RLock()
 	data, err := json.Marshal(ndb.table)
+	ndb.tableLock.RUnlock()
 
 	if err != nil {
 		log.Error(err.Error())
@@ -687,8 +781,18 @@ func (ndb *NetDB) SaveTable(path string) {
 
 }
 
+// Loads the routing table from path, which it is then saved back to whenever it
+// changes.
 func (ndb *NetDB) LoadTable(path string) {
 	raw, _ := ioutil.ReadFile(path)
 
+	ndb.tableLock.Lock()
+	defer ndb.tableLock.Unlock()
+
+	ndb.tablePath = path
 	json.Unmarshal(raw, &ndb.table)
 }
+
+func (ndb *NetDB) Close() error {
+	return ndb.conn.Close()
+}
@@ -160,6 +160,61 @@ func TestInsert(t *testing.T) {
 	}
 }
 
+// The routing table is sampled for peer exchange while entries are still being
+// inserted into it, run with -race to be of any use.
+func TestSampleWhileInserting(t *testing.T) {
+	db := dbWithRandomAddress(t)
+	db.LoadTable(".testing/" + randString(10) + ".dat")
+
+	entries := make([]dht.Entry, 100)
+
+	for i := range entries {
+		entries[i] = randomEntry(t)
+	}
+
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+
+	go func() {
+		defer close(sampled)
+
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			db.Sample(10)
+			db.FindClosest(entries[0].Address)
+			db.TableLen()
+		}
+	}()
+
+	for _, i := range entries {
+		if _, err := db.Insert(i); err != nil {
+			t.Error(err)
+			break
+		}
+	}
+
+	close(done)
+	<-sampled
+
+	// now that nothing is being inserted, every address in the table has an entry
+	sample := db.Sample(len(entries))
+
+	if len(sample) != db.TableLen() {
+		t.Fatal("Sampled ", len(sample), " entries, expected ", db.TableLen())
+	}
+
+	for _, i := range sample {
+		if i == nil {
+			t.Fatal("Sampled an address with no entry")
+		}
+	}
+}
+
 func TestInsertSeed(t *testing.T) {
 	db := dbWithRandomAddress(t)
 	entry := randomEntry(t)
@@ -231,3 +286,59 @@ func BenchmarkQuery(b *testing.B) {
 
 	removeTesting()
 }
+
+func TestEndpoints(t *testing.T) {
+	db := dbWithRandomAddress(t)
+
+	// entries from before endpoints still work, and are dialled the same way
+	legacy := randomEntry(t)
+	_, err := db.Insert(legacy)
+	fatalErr(err, t)
+
+	endpoints := legacy.AllEndpoints()
+
+	if len(endpoints) != 1 || endpoints[0].String() != "dns:localhost:5050" {
+		t.Fatalf("Legacy endpoints wrong: %v", endpoints)
+	}
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	fatalErr(err, t)
+
+	entry := dht.Entry{Name: "endpoints", PublicKey: pub, PublicAddress: "192.0.2.1", Port: 5050}
+	entry.Address.Generate(pub)
+	entry.MigrateEndpoints()
+
+	for _, i := range []string{"ipv6:[2001:db8::1]:5050", "onion:example.onion:5050",
+		"wss:zif.example.org:443", "i2p:ukeu3k5oycgaauneqgtnvselmt4yemvoilkln7jpvamvfx7dnkdq.b32.i2p"} {
+		endpoint, err := dht.ParseEndpoint(i)
+		fatalErr(err, t)
+
+		entry.Endpoints = append(entry.Endpoints, endpoint)
+	}
+
+	// types we do not know are kept, in case newer peers know them
+	entry.Endpoints = append(entry.Endpoints, dht.Endpoint{Type: "future", Address: "whatever"})
+
+	dat, err := entry.Bytes()
+	fatalErr(err, t)
+	entry.Signature = ed25519.Sign(priv, dat)
+
+	_, err = db.Insert(entry)
+	fatalErr(err, t)
+
+	queried, _, err := db.Query(entry.Address)
+	fatalErr(err, t)
+	fatalErr(queried.Verify(), t)
+
+	if len(queried.Endpoints) != 6 || queried.Endpoints[0].Type != dht.EndpointIPv4 ||
+		queried.Endpoints[1].HostPort() != "[2001:db8::1]:5050" {
+		t.Fatalf("Endpoints not stored properly: %v", queried.Endpoints)
+	}
+
+	// endpoints are signed
+	queried.Endpoints[0].Port = 5051
+
+	if queried.Verify() == nil {
+		t.Fatal("Changed endpoint still verifies")
+	}
+}
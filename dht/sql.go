@@ -20,6 +20,10 @@ const (
 		seedCount      - the number of seeds this node has
 		updated        - when this entry was last updated by the node, or another adding seeds
 		seen           - when this node was last seen online
+		relays         - the raw addresses of the peers relaying for this one, added
+		                 by a migration so always last
+		endpoints      - the endpoints of this node as JSON, also added by a
+		                 migration, after relays
 
 		Zif addresses are stored encoded mostly because it makes debugging *far*
 		easier, at the code of some extra encoding and decoding.
@@ -80,7 +84,9 @@ const (
 				seedCount=?,
 				seedingCount=?,
 				updated=?,
-				seen=?
+				seen=?,
+				relays=?,
+				endpoints=?
 			WHERE address=?
 	`
 
@@ -98,9 +104,11 @@ const (
 				seedCount,
 				seedingCount,
 				updated,
-				seen
+				seen,
+				relays,
+				endpoints
 			)
-			VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
 	sqlInsertSeed = `
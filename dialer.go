@@ -0,0 +1,213 @@
+// Chooses which of the endpoints in an entry to dial, and dials them. Endpoints
+// the local peer has no transport for, such as onions without Tor, are left
+// out. The rest are raced in the style of happy eyeballs (RFC 8305): each is
+// given a head start over the next, and whichever handshakes first is used.
+
+package zif
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/zif/zif/dht"
+)
+
+// How long one endpoint is given before the next is dialled alongside it, unless
+// it fails sooner.
+const DialStagger = time.Millisecond * 250
+
+// The endpoint types a peer can dial, best first. Only those there is a
+// transport for are dialled.
+var (
+	DialAll = []string{dht.EndpointIPv6, dht.EndpointIPv4, dht.EndpointDNS,
+		dht.EndpointWSS, dht.EndpointWS, dht.EndpointOnion, dht.EndpointI2P, dht.EndpointUnix, dht.EndpointPipe,
+		dht.EndpointRelay}
+
+	// Tor only reaches the internet through exits, which may well be watched,
+	// so only onions, and anything else anonymous, are dialled.
+	DialTor = []string{dht.EndpointOnion, dht.EndpointI2P, dht.EndpointRelay}
+)
+
+// The endpoint types this peer will dial, best first. Relays are not a transport
+// of their own, they are dialled through the peers that relay.
+func (pm *PeerManager) dialTypes() []string {
+	types := DialAll
+
+	if pm.dial != nil {
+		types = pm.dial
+	}
+
+	ret := make([]string, 0, len(types))
+
+	for _, i := range types {
+		if i == dht.EndpointRelay || pm.localPeer.Transports.For(i) != nil {
+			ret = append(ret, i)
+		}
+	}
+
+	return ret
+}
+
+// Picks the endpoints of the given types, in the order they should be dialled.
+// Types take turns, in order of preference, so that if one kind of network is
+// broken the next is not far behind. Relays are left out, they are only used once
+// nothing else works.
+func chooseEndpoints(endpoints []dht.Endpoint, types []string) []dht.Endpoint {
+	byType := make(map[string][]dht.Endpoint)
+	seen := make(map[dht.Endpoint]bool)
+	count := 0
+
+	for _, i := range endpoints {
+		if i.Type == dht.EndpointRelay || seen[i] || i.Valid() != nil {
+			continue
+		}
+
+		seen[i] = true
+		byType[i.Type] = append(byType[i.Type], i)
+		count++
+	}
+
+	ret := make([]dht.Endpoint, 0, count)
+
+	for len(ret) < count {
+		added := false
+
+		for _, t := range types {
+			if len(byType[t]) == 0 {
+				continue
+			}
+
+			ret = append(ret, byType[t][0])
+			byType[t] = byType[t][1:]
+			added = true
+		}
+
+		// the rest are of types we cannot dial
+		if !added {
+			break
+		}
+	}
+
+	return ret
+}
+
+// The relays of an entry, if this peer may use relays at all.
+func chooseRelays(endpoints []dht.Endpoint, types []string) []dht.Address {
+	allowed := false
+
+	for _, i := range types {
+		allowed = allowed || i == dht.EndpointRelay
+	}
+
+	if !allowed {
+		return nil
+	}
+
+	ret := make([]dht.Address, 0, len(endpoints))
+
+	for _, i := range endpoints {
+		if addr, err := i.Relay(); err == nil {
+			ret = append(ret, addr)
+		}
+	}
+
+	return ret
+}
+
+// Dials and handshakes with the peer at a single endpoint.
+func (pm *PeerManager) dialEndpoint(ctx context.Context, endpoint dht.Endpoint) (*Peer, error) {
+	peer := &Peer{}
+	peer.streams.SetBandwidth(pm.localPeer.Bandwidth)
+
+	err := peer.Connect(ctx, endpoint, pm.localPeer)
+
+	if err != nil {
+		// let the caller know it gave up, rather than the peer being at fault
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		log.WithField("endpoint", endpoint.String()).Debug("Failed to connect: ", err.Error())
+
+		return nil, PeerUnreachable
+	}
+
+	return peer, nil
+}
+
+// Races the endpoints, which should be in the order chooseEndpoints gives. The
+// first peer to handshake is returned, the rest are disconnected.
+func (pm *PeerManager) dialEndpoints(ctx context.Context, endpoints []dht.Endpoint) (*Peer, error) {
+	type dialResult struct {
+		peer *Peer
+		err  error
+	}
+
+	if len(endpoints) == 0 {
+		return nil, PeerUnreachable
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// buffered so that attempts still going when we return can finish
+	results := make(chan dialResult, len(endpoints))
+	started, pending := 0, 0
+
+	start := func() {
+		endpoint := endpoints[started]
+		started++
+		pending++
+
+		go func() {
+			peer, err := pm.dialEndpoint(ctx, endpoint)
+			results <- dialResult{peer, err}
+		}()
+	}
+
+	start()
+
+	var err error = PeerUnreachable
+
+	for pending > 0 {
+		var stagger <-chan time.Time
+
+		if started < len(endpoints) {
+			stagger = time.After(DialStagger)
+		}
+
+		select {
+		case res := <-results:
+			pending--
+
+			if res.err == nil {
+				// anything that handshakes after this one is not needed
+				go func(n int) {
+					for ; n > 0; n-- {
+						if late := <-results; late.peer != nil {
+							late.peer.Terminate()
+						}
+					}
+				}(pending)
+
+				return res.peer, nil
+			}
+
+			if err == PeerUnreachable {
+				err = res.err
+			}
+
+			// no point waiting on one that has already failed
+			if started < len(endpoints) && ctx.Err() == nil {
+				start()
+			}
+
+		case <-stagger:
+			start()
+		}
+	}
+
+	return nil, err
+}
@@ -0,0 +1,190 @@
+// Peer exchange, see proto/exchange.go. Each peer we dial is sent a sample of
+// our routing table and sends one back, which is merged into the DHT like any
+// other entries, so long as it is no older than what we have. Peers that dial us
+// are only answered, as they start an exchange of their own.
+
+package zif
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/zif/zif/dht"
+	"github.com/zif/zif/proto"
+)
+
+// How long before entries are exchanged with a peer again, however often we
+// connect to it.
+const ExchangeInterval = time.Minute * 10
+
+var errNoExchange = errors.New("Peer does not exchange entries")
+
+// Sends the peer a sample of entries, and returns the fresh and properly signed
+// entries it sends back.
+func (p *Peer) Exchange(ctx context.Context, entries dht.Entries) (dht.Entries, error) {
+	if !proto.HasExtension(p.GetCapabilities(), proto.CapabilityExchange) {
+		return nil, errNoExchange
+	}
+
+	stream, err := p.OpenStream(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer stream.Close()
+
+	res, err := stream.Exchange(ctx, entries)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret, invalid := proto.CheckExchange(res, time.Now())
+
+	if invalid > 0 {
+		p.Penalise(proto.PenaltyBadEntry, "Sent an invalid entry")
+	}
+
+	return ret, nil
+}
+
+// Exchanges entries with a peer that has just been dialled, unless they were
+// exchanged with it recently.
+func (pm *PeerManager) exchangePeer(p *Peer) {
+	if !pm.exchangeDue(string(p.Address().Raw), time.Now()) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), PeerTimeout)
+	defer cancel()
+
+	entries, err := p.Exchange(ctx, pm.localPeer.exchangeSample(p.Address()))
+
+	if err == errNoExchange {
+		return
+	}
+
+	if err != nil {
+		log.WithField("peer", p.Address().StringOr("")).Info("Failed to exchange entries: ", err.Error())
+		return
+	}
+
+	pm.localPeer.takeExchanged(entries, p.Address())
+}
+
+// Whether entries are due to be exchanged with the peer at key, marking them as
+// exchanged now if so. Peers that were exchanged with over ExchangeInterval ago
+// are forgotten first, otherwise every peer ever dialled would be remembered.
+func (pm *PeerManager) exchangeDue(key string, now time.Time) bool {
+	for i := range pm.exchanged.IterBuffered() {
+		if now.Sub(i.Val.(time.Time)) >= ExchangeInterval {
+			pm.exchanged.Remove(i.Key)
+		}
+	}
+
+	return pm.exchanged.SetIfAbsent(key, now)
+}
+
+// A sample of the fresh entries in the routing table, leaving out those of the
+// peer it is for and ourselves.
+func (lp *LocalPeer) exchangeSample(to *dht.Address) dht.Entries {
+	ret := make(dht.Entries, 0, proto.ExchangeSize)
+	now := time.Now()
+
+	// some will be stale, or of the peer
+	for _, i := range lp.DHT.Sample(proto.ExchangeSize * 2) {
+		if len(ret) == proto.ExchangeSize {
+			break
+		}
+
+		if i == nil || i.Address.Equals(to) || i.Address.Equals(lp.Address()) ||
+			!proto.ExchangeFresh(i, now) {
+			continue
+		}
+
+		ret = append(ret, i)
+	}
+
+	return ret
+}
+
+// Inserts the entries from an exchange that we do not have, or only have older
+// versions of, and returns how many there were. Entries should have been
+// checked already.
+func (lp *LocalPeer) takeExchanged(entries dht.Entries, from *dht.Address) int {
+	taken := 0
+
+	for _, i := range entries {
+		if i.Address.Equals(from) || i.Address.Equals(lp.Address()) {
+			continue
+		}
+
+		current, err := lp.DHT.Query(i.Address)
+
+		if err != nil {
+			log.Error(err.Error())
+			continue
+		}
+
+		// an older entry could undo changes the owner has made since
+		if current != nil && current.Updated >= i.Updated {
+			continue
+		}
+
+		if _, err := lp.DHT.Insert(*i); err != nil {
+			log.Error(err.Error())
+			continue
+		}
+
+		taken++
+	}
+
+	if taken > 0 {
+		log.WithFields(log.Fields{
+			"peer":    from.StringOr(""),
+			"entries": taken,
+		}).Info("Learned of peers by exchange")
+	}
+
+	return taken
+}
+
+// Answers an exchange with a sample of our own, then takes what was sent.
+func (lp *LocalPeer) HandleExchange(msg *proto.Message) error {
+	entries := make(dht.Entries, 0, proto.ExchangeSize)
+	err := msg.Read(&entries)
+
+	if err != nil {
+		return proto.NewError(proto.CodeInvalid, err.Error())
+	}
+
+	entries, invalid := proto.CheckExchange(entries, time.Now())
+
+	if invalid > 0 {
+		if peer := lp.GetPeer(*msg.From); peer != nil {
+			peer.Penalise(proto.PenaltyBadEntry, "Exchanged an invalid entry")
+		}
+	}
+
+	// sampled first, so that nothing is sent straight back
+	reply := &proto.Message{Header: proto.ProtoDhtEntries}
+	err = reply.Write(lp.exchangeSample(msg.From))
+
+	if err != nil {
+		return err
+	}
+
+	err = msg.Client.WriteMessage(reply)
+
+	if err != nil {
+		return err
+	}
+
+	lp.takeExchanged(entries, msg.From)
+
+	return nil
+}
@@ -0,0 +1,32 @@
+package zif
+
+import (
+	"testing"
+	"time"
+)
+
+// Peers are exchanged with at most once an interval, and forgotten after it.
+func TestExchangeDue(t *testing.T) {
+	pm := NewPeerManager(nil)
+	now := time.Now()
+
+	if !pm.exchangeDue("a", now) {
+		t.Fatal("First exchange was not due")
+	}
+
+	if pm.exchangeDue("a", now.Add(ExchangeInterval/2)) {
+		t.Fatal("Exchange was due again within the interval")
+	}
+
+	if !pm.exchangeDue("b", now.Add(ExchangeInterval)) {
+		t.Fatal("Exchange with another peer was not due")
+	}
+
+	if pm.exchanged.Has("a") {
+		t.Fatal("Peer was remembered after the interval")
+	}
+
+	if !pm.exchangeDue("a", now.Add(ExchangeInterval)) {
+		t.Fatal("Exchange was not due after the interval")
+	}
+}
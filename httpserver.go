@@ -12,10 +12,15 @@ import (
 	"github.com/gorilla/mux"
 
 	log "github.com/sirupsen/logrus"
+
+	"github.com/zif/zif/proto"
 )
 
 type HttpServer struct {
 	CommandServer *CommandServer
+
+	// Serves Zif connections over WebSockets at proto.WebSocketPath, if set.
+	WebSocket http.Handler
 }
 
 func (hs *HttpServer) ListenHttp(addr string) {
@@ -23,6 +28,10 @@ func (hs *HttpServer) ListenHttp(addr string) {
 
 	router.HandleFunc("/", hs.IndexHandler)
 
+	if hs.WebSocket != nil {
+		router.Handle(proto.WebSocketPath, hs.WebSocket)
+	}
+
 	// This should be the ONLY route where the address is a non-Zif address
 
 	router.HandleFunc("/peer/{address}/ping/", hs.Ping)
@@ -31,6 +40,11 @@ func (hs *HttpServer) ListenHttp(addr string) {
 	router.HandleFunc("/peer/{address}/search/", hs.PeerSearch).Methods("POST")
 	router.HandleFunc("/peer/{address}/recent/{page}/", hs.Recent)
 	router.HandleFunc("/peer/{address}/popular/{page}/", hs.Popular)
+
+	// Paged by cursor rather than page number, see CommandPeerPage
+	router.HandleFunc("/peer/{address}/rsearch/page/", hs.PeerRSearchPage).Methods("POST")
+	router.HandleFunc("/peer/{address}/recent/", hs.RecentPage)
+	router.HandleFunc("/peer/{address}/popular/", hs.PopularPage)
 	router.HandleFunc("/peer/{address}/mirror/", hs.Mirror)
 	router.HandleFunc("/peer/{address}/mirrorprogress/", hs.MirrorProgress)
 	router.HandleFunc("/peer/{address}/index/{since}/", hs.PeerFtsIndex)
@@ -60,6 +74,12 @@ func (hs *HttpServer) ListenHttp(addr string) {
 
 	router.HandleFunc("/self/seedleech/", hs.SetSeedLeech).Methods("POST")
 	router.HandleFunc("/self/map/", hs.NetMap)
+	router.HandleFunc("/self/connections/", hs.ConnectionStats)
+	router.HandleFunc("/self/sticky/", hs.StickyPeers)
+	router.HandleFunc("/self/sticky/{address}/forget/", hs.ForgetSticky).Methods("POST")
+	router.HandleFunc("/self/bans/", hs.Bans)
+	router.HandleFunc("/self/bans/{key}/unban/", hs.Unban).Methods("POST")
+	router.HandleFunc("/self/relay/", hs.RelayStats)
 
 	log.WithField("address", addr).Info("Starting HTTP server")
 
@@ -88,12 +108,12 @@ func write_http_response(w http.ResponseWriter, cr CommandResult) {
 func (hs *HttpServer) Ping(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
-	write_http_response(w, hs.CommandServer.Ping(CommandPing{vars["address"]}))
+	write_http_response(w, hs.CommandServer.Ping(r.Context(), CommandPing{vars["address"]}))
 }
 func (hs *HttpServer) Announce(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
-	write_http_response(w, hs.CommandServer.Announce(CommandAnnounce{vars["address"]}))
+	write_http_response(w, hs.CommandServer.Announce(r.Context(), CommandAnnounce{vars["address"]}))
 }
 func (hs *HttpServer) PeerRSearch(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -109,7 +129,7 @@ func (hs *HttpServer) PeerRSearch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	write_http_response(w, hs.CommandServer.RSearch(
+	write_http_response(w, hs.CommandServer.RSearch(r.Context(),
 		CommandRSearch{CommandPeer{addr}, query, pagei}))
 }
 func (hs *HttpServer) PeerSearch(w http.ResponseWriter, r *http.Request) {
@@ -126,7 +146,7 @@ func (hs *HttpServer) PeerSearch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	write_http_response(w, hs.CommandServer.PeerSearch(
+	write_http_response(w, hs.CommandServer.PeerSearch(r.Context(),
 		CommandPeerSearch{CommandPeer{addr}, query, pagei}))
 }
 func (hs *HttpServer) Recent(w http.ResponseWriter, r *http.Request) {
@@ -141,7 +161,7 @@ func (hs *HttpServer) Recent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	write_http_response(w, hs.CommandServer.PeerRecent(
+	write_http_response(w, hs.CommandServer.PeerRecent(r.Context(),
 		CommandPeerRecent{CommandPeer{addr}, pagei}))
 }
 func (hs *HttpServer) Popular(w http.ResponseWriter, r *http.Request) {
@@ -156,13 +176,68 @@ func (hs *HttpServer) Popular(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	write_http_response(w, hs.CommandServer.PeerPopular(
+	write_http_response(w, hs.CommandServer.PeerPopular(r.Context(),
 		CommandPeerPopular{CommandPeer{addr}, pagei}))
 }
+
+// Reads the cursor and page size for a paged request. The cursor is the base64
+// one from the previous page, the size may be left out for the default.
+func readPageRequest(r *http.Request) (CommandPeerPage, error) {
+	ret := CommandPeerPage{CommandPeer: CommandPeer{mux.Vars(r)["address"]}}
+	var err error
+
+	ret.Cursor, err = base64.StdEncoding.DecodeString(r.FormValue("cursor"))
+
+	if err != nil {
+		return ret, err
+	}
+
+	if size := r.FormValue("size"); size != "" {
+		ret.PageSize, err = strconv.Atoi(size)
+	}
+
+	return ret, err
+}
+
+func (hs *HttpServer) PeerRSearchPage(w http.ResponseWriter, r *http.Request) {
+	page, err := readPageRequest(r)
+
+	if err != nil {
+		write_http_response(w, CommandResult{false, nil, err})
+		return
+	}
+
+	page.Query = r.FormValue("query")
+
+	write_http_response(w, hs.CommandServer.RSearchPage(r.Context(), page))
+}
+
+func (hs *HttpServer) RecentPage(w http.ResponseWriter, r *http.Request) {
+	page, err := readPageRequest(r)
+
+	if err != nil {
+		write_http_response(w, CommandResult{false, nil, err})
+		return
+	}
+
+	write_http_response(w, hs.CommandServer.PeerRecentPage(r.Context(), page))
+}
+
+func (hs *HttpServer) PopularPage(w http.ResponseWriter, r *http.Request) {
+	page, err := readPageRequest(r)
+
+	if err != nil {
+		write_http_response(w, CommandResult{false, nil, err})
+		return
+	}
+
+	write_http_response(w, hs.CommandServer.PeerPopularPage(r.Context(), page))
+}
+
 func (hs *HttpServer) Mirror(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
-	write_http_response(w, hs.CommandServer.Mirror(CommandMirror{vars["address"]}))
+	write_http_response(w, hs.CommandServer.Mirror(r.Context(), CommandMirror{vars["address"]}))
 }
 
 func (hs *HttpServer) MirrorProgress(w http.ResponseWriter, r *http.Request) {
@@ -220,14 +295,14 @@ func (hs *HttpServer) FtsIndex(w http.ResponseWriter, r *http.Request) {
 func (hs *HttpServer) Resolve(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
-	resolved := hs.CommandServer.Resolve(CommandResolve{vars["address"]})
+	resolved := hs.CommandServer.Resolve(r.Context(), CommandResolve{vars["address"]})
 
 	write_http_response(w, resolved)
 }
 func (hs *HttpServer) Bootstrap(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
-	write_http_response(w, hs.CommandServer.Bootstrap(CommandBootstrap{vars["address"]}))
+	write_http_response(w, hs.CommandServer.Bootstrap(r.Context(), CommandBootstrap{vars["address"]}))
 }
 func (hs *HttpServer) SelfSearch(w http.ResponseWriter, r *http.Request) {
 	query := r.FormValue("query")
@@ -294,13 +369,13 @@ func (hs *HttpServer) RebuildCollection(w http.ResponseWriter, r *http.Request)
 	write_http_response(w, hs.CommandServer.RebuildCollection(nil))
 }
 func (hs *HttpServer) Peers(w http.ResponseWriter, r *http.Request) {
-	write_http_response(w, hs.CommandServer.Peers(nil))
+	write_http_response(w, hs.CommandServer.Peers(r.Context(), nil))
 }
 
 func (hs *HttpServer) RequestAddPeer(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
-	write_http_response(w, hs.CommandServer.RequestAddPeer(CommandRequestAddPeer{
+	write_http_response(w, hs.CommandServer.RequestAddPeer(r.Context(), CommandRequestAddPeer{
 		vars["remote"], vars["peer"],
 	}))
 }
@@ -418,6 +493,34 @@ func (hs *HttpServer) SearchEntry(w http.ResponseWriter, r *http.Request) {
 		CommandSearchEntry{name, desc, pagei}))
 }
 
+func (hs *HttpServer) ConnectionStats(w http.ResponseWriter, r *http.Request) {
+	write_http_response(w, hs.CommandServer.ConnectionStats())
+}
+
+func (hs *HttpServer) StickyPeers(w http.ResponseWriter, r *http.Request) {
+	write_http_response(w, hs.CommandServer.StickyPeers())
+}
+
+func (hs *HttpServer) ForgetSticky(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	write_http_response(w, hs.CommandServer.ForgetSticky(CommandForgetSticky{vars["address"]}))
+}
+
+func (hs *HttpServer) Bans(w http.ResponseWriter, r *http.Request) {
+	write_http_response(w, hs.CommandServer.Bans())
+}
+
+func (hs *HttpServer) Unban(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	write_http_response(w, hs.CommandServer.Unban(CommandUnban{vars["key"]}))
+}
+
+func (hs *HttpServer) RelayStats(w http.ResponseWriter, r *http.Request) {
+	write_http_response(w, hs.CommandServer.RelayStats())
+}
+
 func (hs *HttpServer) NetMap(w http.ResponseWriter, r *http.Request) {
 	res := hs.CommandServer.NetMap(CommandNetMap{hs.CommandServer.LocalPeer.Entry.Address.StringOr("")})
 	write_http_response(w, res)
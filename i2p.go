@@ -0,0 +1,99 @@
+package zif
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/zif/zif/dht"
+	"github.com/zif/zif/i2p"
+)
+
+// Puts the local peer on I2P through the SAM bridge at sam, listening for
+// streams and dialling .b32.i2p endpoints. The destination is kept in the data
+// directory so that the address stays the same, and is added to our entry. The
+// session is closed along with the local peer.
+func (lp *LocalPeer) ListenI2P(ctx context.Context, sam, id string, options []string) error {
+	key, err := lp.i2pKey(ctx, sam)
+
+	if err != nil {
+		return err
+	}
+
+	session, err := i2p.NewSession(ctx, sam, id, key, options)
+
+	if err != nil {
+		return err
+	}
+
+	t := &i2pTransport{session: session}
+
+	err = lp.ListenOn(t, "", true)
+
+	if err != nil {
+		session.Close()
+		return err
+	}
+
+	lp.Transports.Add(t)
+
+	return nil
+}
+
+// The private key of our destination, which is made the first time it is needed.
+func (lp *LocalPeer) i2pKey(ctx context.Context, sam string) (string, error) {
+	path := lp.DataPath("i2p.dat")
+	dat, err := ioutil.ReadFile(path)
+
+	if err == nil {
+		return strings.TrimSpace(string(dat)), nil
+	}
+
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	log.Info("Generating I2P destination")
+
+	key, err := i2p.GenerateKey(ctx, sam)
+
+	if err != nil {
+		return "", err
+	}
+
+	err = ioutil.WriteFile(path, []byte(key), 0400)
+
+	if err != nil {
+		return "", err
+	}
+
+	return key, nil
+}
+
+// Dials .b32.i2p endpoints through a session, which is also the only thing it
+// listens on.
+type i2pTransport struct {
+	session *i2p.Session
+}
+
+func (it *i2pTransport) Types() []string {
+	return []string{dht.EndpointI2P}
+}
+
+func (it *i2pTransport) Dial(ctx context.Context, endpoint dht.Endpoint) (net.Conn, error) {
+	return it.session.Dial(ctx, endpoint.Address)
+}
+
+func (it *i2pTransport) Listen(addr string) (net.Listener, error) {
+	return it.session, nil
+}
+
+func (it *i2pTransport) Endpoints(listener net.Listener) []dht.Endpoint {
+	return []dht.Endpoint{dht.NewEndpoint(it.session.Addr().String(), 0)}
+}
+
+func (it *i2pTransport) String() string { return "i2p" }
@@ -0,0 +1,550 @@
+// Talks to an I2P router through its SAM v3 bridge, so that Zif can be reached
+// on I2P as well as, or instead of, Tor. A session holds a destination, which is
+// the I2P equivalent of an onion address, and streams are dialled and accepted
+// through it. Each stream is its own connection to the bridge, which carries the
+// stream's bytes once it has been set up.
+
+package i2p
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultSAM = "127.0.0.1:7656"
+
+	// EdDSA, the signature type I2P recommends for new destinations.
+	SignatureType = "7"
+
+	// How long to wait for the bridge when it is not up to the caller.
+	setupTimeout = time.Second * 30
+
+	// How long Accept waits to try again after the bridge fails to give it a
+	// stream, doubling each time up to acceptBackoffMax.
+	acceptBackoff    = time.Millisecond * 100
+	acceptBackoffMax = time.Minute
+
+	b32Suffix = ".b32.i2p"
+
+	// A destination is two 256 byte keys followed by a certificate, which has a
+	// one byte type and two bytes of length.
+	destinationLength = 387
+)
+
+var (
+	ErrClosed         = errors.New("I2P session closed")
+	errBadDestination = errors.New("Invalid I2P destination")
+)
+
+// I2P uses its own base64 alphabet, so that it is safe in file names and URLs.
+var Encoding = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-~")
+
+// An error the bridge replied with, such as KEY_NOT_FOUND or CANT_REACH_PEER.
+type Error struct {
+	Result  string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return "SAM bridge replied " + e.Result
+	}
+
+	return "SAM bridge replied " + e.Result + ": " + e.Message
+}
+
+// A .b32.i2p address, the hash of a destination.
+type Addr string
+
+func (a Addr) Network() string { return "i2p" }
+func (a Addr) String() string  { return string(a) }
+
+// The .b32.i2p address of a destination.
+func B32(destination []byte) Addr {
+	hash := sha256.Sum256(destination)
+	b32 := base32.StdEncoding.EncodeToString(hash[:])
+
+	return Addr(strings.ToLower(strings.TrimRight(b32, "=")) + b32Suffix)
+}
+
+func IsB32(addr string) bool {
+	return strings.HasSuffix(addr, b32Suffix)
+}
+
+// The public destination at the start of a private key, as DEST GENERATE gives.
+func PublicDestination(key string) ([]byte, error) {
+	raw, err := Encoding.DecodeString(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(raw) < destinationLength {
+		return nil, errBadDestination
+	}
+
+	length := destinationLength + int(binary.BigEndian.Uint16(raw[destinationLength-2:]))
+
+	if len(raw) < length {
+		return nil, errBadDestination
+	}
+
+	return raw[:length], nil
+}
+
+// A connection to the bridge. Replies are read through a buffer, so once a
+// stream is set up the bytes after the reply must be read through it too.
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Connects to the bridge at addr and agrees on a version.
+func dial(ctx context.Context, addr string) (*conn, error) {
+	dialer := net.Dialer{}
+	nc, err := dialer.DialContext(ctx, "tcp", addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	c := &conn{nc, bufio.NewReader(nc)}
+
+	stop := c.bind(ctx)
+	_, err = c.command("HELLO VERSION MIN=3.1 MAX=3.3", "HELLO REPLY")
+	err = stop(err)
+
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Makes reads and writes give up when ctx is done. The returned function stops
+// this, and replaces the error with the context's if that is why it failed.
+func (c *conn) bind(ctx context.Context) func(error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+
+	done, stopped := make(chan struct{}), make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		select {
+		case <-ctx.Done():
+			c.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	return func(err error) error {
+		close(done)
+		<-stopped
+
+		c.SetDeadline(time.Time{})
+
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		return err
+	}
+}
+
+// Sends a command, then reads the reply, which must start with expect.
+func (c *conn) command(cmd, expect string) (map[string]string, error) {
+	_, err := c.Write([]byte(cmd + "\n"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return c.reply(expect)
+}
+
+func (c *conn) reply(expect string) (map[string]string, error) {
+	line, err := c.r.ReadString('\n')
+
+	if err != nil {
+		return nil, err
+	}
+
+	words, values := parseReply(line)
+
+	if len(words) < 2 || words[0]+" "+words[1] != expect {
+		return nil, errors.New("Unexpected reply from SAM bridge: " + strings.TrimSpace(line))
+	}
+
+	if result, ok := values["RESULT"]; ok && result != "OK" {
+		return nil, &Error{result, values["MESSAGE"]}
+	}
+
+	return values, nil
+}
+
+// Splits a line such as `HELLO REPLY RESULT=OK VERSION=3.1` into its leading
+// words and its KEY=VALUE pairs. Values may be quoted.
+func parseReply(line string) ([]string, map[string]string) {
+	words := make([]string, 0, 2)
+	values := make(map[string]string)
+
+	for _, token := range splitReply(strings.TrimSpace(line)) {
+		if i := strings.IndexByte(token, '='); i > 0 {
+			values[token[:i]] = token[i+1:]
+		} else {
+			words = append(words, token)
+		}
+	}
+
+	return words, values
+}
+
+func splitReply(line string) []string {
+	ret := make([]string, 0, 4)
+	var token strings.Builder
+	quoted, escaped, started := false, false, false
+
+	for _, r := range line {
+		switch {
+		case escaped:
+			token.WriteRune(r)
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+			started = true
+		case r == ' ' && !quoted:
+			if started {
+				ret = append(ret, token.String())
+				token.Reset()
+				started = false
+			}
+		default:
+			token.WriteRune(r)
+			started = true
+		}
+	}
+
+	if started {
+		ret = append(ret, token.String())
+	}
+
+	return ret
+}
+
+// Asks the bridge at sam for a new destination, returning its private key.
+func GenerateKey(ctx context.Context, sam string) (string, error) {
+	c, err := dial(ctx, sam)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer c.Close()
+
+	stop := c.bind(ctx)
+	values, err := c.command("DEST GENERATE SIGNATURE_TYPE="+SignatureType, "DEST REPLY")
+	err = stop(err)
+
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := PublicDestination(values["PRIV"]); err != nil {
+		return "", err
+	}
+
+	return values["PRIV"], nil
+}
+
+// A stream to or from another destination.
+type Conn struct {
+	*conn
+
+	local, remote Addr
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return c.local }
+func (c *Conn) RemoteAddr() net.Addr { return c.remote }
+
+// A destination that is up on the I2P network, for as long as the connection it
+// was created on stays open. It is a net.Listener for the streams to it.
+type Session struct {
+	sam     string
+	id      string
+	control *conn
+	addr    Addr
+
+	lock      sync.Mutex
+	accepting *conn
+	closed    chan struct{}
+	once      sync.Once
+}
+
+// Creates a session called id, for the destination with the private key key.
+// Options are passed on to the router, such as "inbound.length=2".
+func NewSession(ctx context.Context, sam, id, key string, options []string) (*Session, error) {
+	destination, err := PublicDestination(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := dial(ctx, sam)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := "SESSION CREATE STYLE=STREAM ID=" + id + " DESTINATION=" + key
+
+	if len(options) > 0 {
+		cmd += " " + strings.Join(options, " ")
+	}
+
+	stop := c.bind(ctx)
+	_, err = c.command(cmd, "SESSION STATUS")
+	err = stop(err)
+
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	s := &Session{
+		sam:     sam,
+		id:      id,
+		control: c,
+		addr:    B32(destination),
+		closed:  make(chan struct{}),
+	}
+
+	go s.keepAlive()
+
+	return s, nil
+}
+
+// Answers pings from the bridge. When the connection drops, so does the
+// destination, and the session is closed.
+func (s *Session) keepAlive() {
+	defer s.Close()
+
+	for {
+		line, err := s.control.r.ReadString('\n')
+
+		if err != nil {
+			select {
+			case <-s.closed:
+			default:
+				log.Error("Lost connection to SAM bridge: ", err.Error())
+			}
+
+			return
+		}
+
+		if strings.HasPrefix(line, "PING") {
+			_, err = s.control.Write([]byte("PONG" + strings.TrimPrefix(line, "PING")))
+
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// The .b32.i2p address of the session.
+func (s *Session) Addr() net.Addr {
+	return s.addr
+}
+
+// Opens a stream to addr, which is a .b32.i2p address or a full destination.
+func (s *Session) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	c, err := dial(ctx, s.sam)
+
+	if err != nil {
+		return nil, err
+	}
+
+	stop := c.bind(ctx)
+	remote, err := s.connect(c, addr)
+	err = stop(err)
+
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return &Conn{c, s.addr, remote}, nil
+}
+
+func (s *Session) connect(c *conn, addr string) (Addr, error) {
+	destination := addr
+
+	if strings.HasSuffix(addr, ".i2p") {
+		values, err := c.command("NAMING LOOKUP NAME="+addr, "NAMING REPLY")
+
+		if err != nil {
+			return "", err
+		}
+
+		destination = values["VALUE"]
+	}
+
+	raw, err := Encoding.DecodeString(destination)
+
+	if err != nil {
+		return "", errBadDestination
+	}
+
+	_, err = c.command("STREAM CONNECT ID="+s.id+" DESTINATION="+destination+" SILENT=false", "STREAM STATUS")
+
+	if err != nil {
+		return "", err
+	}
+
+	return B32(raw), nil
+}
+
+// Waits for a stream to the session. Failures of the bridge are retried, as the
+// session may well still be up, so this only fails once it is closed.
+func (s *Session) Accept() (net.Conn, error) {
+	backoff := acceptBackoff
+
+	for {
+		conn, err := s.acceptOnce()
+
+		if err == nil || err == ErrClosed {
+			return conn, err
+		}
+
+		log.WithField("session", s.id).Error("Failed to accept I2P stream: ", err.Error())
+
+		timer := time.NewTimer(backoff)
+
+		select {
+		case <-timer.C:
+		case <-s.closed:
+			timer.Stop()
+			return nil, ErrClosed
+		}
+
+		if backoff *= 2; backoff > acceptBackoffMax {
+			backoff = acceptBackoffMax
+		}
+	}
+}
+
+func (s *Session) acceptOnce() (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), setupTimeout)
+	c, err := dial(ctx, s.sam)
+	cancel()
+
+	if err != nil {
+		return nil, s.closedOr(err)
+	}
+
+	s.lock.Lock()
+	select {
+	case <-s.closed:
+		s.lock.Unlock()
+		c.Close()
+		return nil, ErrClosed
+	default:
+		s.accepting = c
+	}
+	s.lock.Unlock()
+
+	remote, err := s.accept(c)
+
+	s.lock.Lock()
+	s.accepting = nil
+	s.lock.Unlock()
+
+	if err != nil {
+		c.Close()
+		return nil, s.closedOr(err)
+	}
+
+	return &Conn{c, s.addr, remote}, nil
+}
+
+func (s *Session) accept(c *conn) (Addr, error) {
+	_, err := c.command("STREAM ACCEPT ID="+s.id+" SILENT=false", "STREAM STATUS")
+
+	if err != nil {
+		return "", err
+	}
+
+	// the destination of the peer, then possibly its ports
+	line, err := c.r.ReadString('\n')
+
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(line)
+
+	if len(fields) == 0 {
+		return "", errBadDestination
+	}
+
+	raw, err := Encoding.DecodeString(fields[0])
+
+	if err != nil {
+		return "", errBadDestination
+	}
+
+	return B32(raw), nil
+}
+
+func (s *Session) closedOr(err error) error {
+	select {
+	case <-s.closed:
+		return ErrClosed
+	default:
+		return err
+	}
+}
+
+// Takes the destination off the network. Streams that are open stay open.
+func (s *Session) Close() error {
+	s.once.Do(func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		close(s.closed)
+		s.control.Close()
+
+		if s.accepting != nil {
+			s.accepting.Close()
+		}
+	})
+
+	return nil
+}
+
+// Closed once the session is, whether by Close or by losing the bridge.
+func (s *Session) Done() <-chan struct{} {
+	return s.closed
+}
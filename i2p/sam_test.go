@@ -0,0 +1,478 @@
+package i2p
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testTimeout = time.Second * 10
+
+// A stream waiting in STREAM ACCEPT.
+type fakeAccept struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// Just enough of a SAM bridge to create sessions and pass streams between them.
+// It has no network behind it, sessions can only reach each other.
+type fakeSAM struct {
+	listener net.Listener
+
+	lock     sync.Mutex
+	sessions map[string]string
+	controls map[string]net.Conn
+	accepts  map[string]chan fakeAccept
+	pongs    int
+
+	// how many of the next STREAM ACCEPTs fail, as they do when the router is
+	// busy
+	failAccepts int
+}
+
+func newFakeSAM(t *testing.T) *fakeSAM {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := &fakeSAM{
+		listener: listener,
+		sessions: make(map[string]string),
+		controls: make(map[string]net.Conn),
+		accepts:  make(map[string]chan fakeAccept),
+	}
+
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go fs.handle(conn)
+		}
+	}()
+
+	return fs
+}
+
+func (fs *fakeSAM) addr() string {
+	return fs.listener.Addr().String()
+}
+
+// Drops every session, as a router restarting would.
+func (fs *fakeSAM) drop() {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	for _, i := range fs.controls {
+		i.Close()
+	}
+}
+
+func (fs *fakeSAM) handle(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	keep := false
+
+	defer func() {
+		if !keep {
+			conn.Close()
+		}
+	}()
+
+	line, err := r.ReadString('\n')
+
+	if err != nil || !strings.HasPrefix(line, "HELLO VERSION") {
+		return
+	}
+
+	io.WriteString(conn, "HELLO REPLY RESULT=OK VERSION=3.1\n")
+
+	for {
+		line, err := r.ReadString('\n')
+
+		if err != nil {
+			return
+		}
+
+		words, values := parseReply(line)
+
+		if len(words) < 2 {
+			return
+		}
+
+		switch words[0] + " " + words[1] {
+		case "DEST GENERATE":
+			pub, priv := fakeDestination()
+			io.WriteString(conn, "DEST REPLY PUB="+pub+" PRIV="+priv+"\n")
+
+		case "SESSION CREATE":
+			fs.createSession(conn, r, values["ID"], values["DESTINATION"])
+			return
+
+		case "NAMING LOOKUP":
+			if dest := fs.lookup(values["NAME"]); dest != "" {
+				io.WriteString(conn, "NAMING REPLY RESULT=OK NAME="+values["NAME"]+" VALUE="+dest+"\n")
+			} else {
+				io.WriteString(conn, "NAMING REPLY RESULT=KEY_NOT_FOUND NAME="+values["NAME"]+"\n")
+			}
+
+		case "STREAM ACCEPT":
+			fs.lock.Lock()
+			accepts, ok := fs.accepts[values["ID"]]
+			fail := fs.failAccepts > 0
+
+			if fail {
+				fs.failAccepts--
+			}
+			fs.lock.Unlock()
+
+			if fail {
+				io.WriteString(conn, "STREAM STATUS RESULT=I2P_ERROR\n")
+				continue
+			}
+
+			if !ok {
+				io.WriteString(conn, "STREAM STATUS RESULT=INVALID_ID\n")
+				continue
+			}
+
+			io.WriteString(conn, "STREAM STATUS RESULT=OK\n")
+			accepts <- fakeAccept{conn, r}
+			keep = true
+
+			return
+
+		case "STREAM CONNECT":
+			keep = fs.connect(conn, r, values["ID"], values["DESTINATION"])
+
+			if keep {
+				return
+			}
+
+		default:
+			return
+		}
+	}
+}
+
+func (fs *fakeSAM) createSession(conn net.Conn, r *bufio.Reader, id, key string) {
+	raw, err := PublicDestination(key)
+
+	if err != nil {
+		io.WriteString(conn, "SESSION STATUS RESULT=INVALID_KEY\n")
+		return
+	}
+
+	fs.lock.Lock()
+
+	if _, ok := fs.sessions[id]; ok {
+		fs.lock.Unlock()
+		io.WriteString(conn, `SESSION STATUS RESULT=DUPLICATED_ID MESSAGE="Session already exists"`+"\n")
+		return
+	}
+
+	fs.sessions[id] = Encoding.EncodeToString(raw)
+	fs.controls[id] = conn
+	fs.accepts[id] = make(chan fakeAccept, 4)
+	fs.lock.Unlock()
+
+	io.WriteString(conn, "SESSION STATUS RESULT=OK DESTINATION="+key+"\nPING 1\n")
+
+	for {
+		line, err := r.ReadString('\n')
+
+		if err != nil {
+			break
+		}
+
+		if line == "PONG 1\n" {
+			fs.lock.Lock()
+			fs.pongs++
+			fs.lock.Unlock()
+		}
+	}
+
+	fs.lock.Lock()
+	delete(fs.sessions, id)
+	delete(fs.controls, id)
+	delete(fs.accepts, id)
+	fs.lock.Unlock()
+}
+
+func (fs *fakeSAM) lookup(name string) string {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	for _, dest := range fs.sessions {
+		raw, _ := Encoding.DecodeString(dest)
+
+		if B32(raw).String() == name {
+			return dest
+		}
+	}
+
+	return ""
+}
+
+// Hands the stream to a session waiting for one on the destination, and
+// returns whether it did.
+func (fs *fakeSAM) connect(conn net.Conn, r *bufio.Reader, id, dest string) bool {
+	fs.lock.Lock()
+	from := fs.sessions[id]
+	var accepts chan fakeAccept
+
+	for i, d := range fs.sessions {
+		if d == dest {
+			accepts = fs.accepts[i]
+		}
+	}
+	fs.lock.Unlock()
+
+	if from == "" {
+		io.WriteString(conn, "STREAM STATUS RESULT=INVALID_ID\n")
+		return false
+	}
+
+	var accept fakeAccept
+
+	select {
+	case accept = <-accepts:
+	case <-time.After(time.Second):
+		io.WriteString(conn, "STREAM STATUS RESULT=CANT_REACH_PEER\n")
+		return false
+	}
+
+	io.WriteString(conn, "STREAM STATUS RESULT=OK\n")
+	io.WriteString(accept.conn, from+" FROM_PORT=0 TO_PORT=0\n")
+
+	go func() {
+		io.Copy(accept.conn, r)
+		accept.conn.Close()
+	}()
+
+	go func() {
+		io.Copy(conn, accept.r)
+		conn.Close()
+	}()
+
+	return true
+}
+
+// A destination with a key certificate, and a private key for it.
+func fakeDestination() (string, string) {
+	pub := make([]byte, destinationLength+4)
+	rand.Read(pub[:destinationLength-3])
+
+	copy(pub[destinationLength-3:], []byte{5, 0, 4, 0, 7, 0, 0})
+
+	priv := make([]byte, len(pub)+256+32)
+	copy(priv, pub)
+	rand.Read(priv[len(pub):])
+
+	return Encoding.EncodeToString(pub), Encoding.EncodeToString(priv)
+}
+
+func newSession(t *testing.T, ctx context.Context, fs *fakeSAM, id string) *Session {
+	key, err := GenerateKey(ctx, fs.addr())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSession(ctx, fs.addr(), id, key, []string{"inbound.length=1"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+func TestStream(t *testing.T) {
+	fs := newFakeSAM(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	a := newSession(t, ctx, fs, "a")
+	b := newSession(t, ctx, fs, "b")
+
+	if !IsB32(a.Addr().String()) || a.Addr() == b.Addr() {
+		t.Fatal("Sessions do not have their own .b32.i2p addresses: ", a.Addr(), b.Addr())
+	}
+
+	accepted := make(chan net.Conn, 1)
+
+	go func() {
+		conn, err := a.Accept()
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		accepted <- conn
+	}()
+
+	conn, err := b.Dial(ctx, a.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	server := <-accepted
+
+	if server == nil {
+		t.FailNow()
+	}
+
+	defer server.Close()
+
+	if server.RemoteAddr() != b.Addr() || conn.RemoteAddr() != a.Addr() {
+		t.Fatal("Streams have the wrong remote addresses: ", server.RemoteAddr(), conn.RemoteAddr())
+	}
+
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4)
+
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "ping" {
+		t.Fatal("Stream did not carry the bytes written to it: ", err)
+	}
+
+	pongs := 0
+
+	// answered in the background, so may not have arrived yet
+	for i := 0; i < 100 && pongs < 2; i++ {
+		time.Sleep(time.Millisecond * 10)
+
+		fs.lock.Lock()
+		pongs = fs.pongs
+		fs.lock.Unlock()
+	}
+
+	if pongs != 2 {
+		t.Fatal("Sessions did not answer pings from the bridge: ", pongs)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	fs := newFakeSAM(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	a := newSession(t, ctx, fs, "a")
+
+	key, err := GenerateKey(ctx, fs.addr())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewSession(ctx, fs.addr(), "a", key, nil)
+
+	if e, ok := err.(*Error); !ok || e.Result != "DUPLICATED_ID" || e.Message != "Session already exists" {
+		t.Fatal("Created a session with a name that is taken: ", err)
+	}
+
+	raw, _ := PublicDestination(key)
+
+	_, err = a.Dial(ctx, B32(raw).String())
+
+	if e, ok := err.(*Error); !ok || e.Result != "KEY_NOT_FOUND" {
+		t.Fatal("Dialled a destination that is not up: ", err)
+	}
+}
+
+// A failed accept does not stop the session taking streams.
+func TestAcceptRetry(t *testing.T) {
+	fs := newFakeSAM(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	a := newSession(t, ctx, fs, "a")
+	b := newSession(t, ctx, fs, "b")
+
+	fs.lock.Lock()
+	fs.failAccepts = 2
+	fs.lock.Unlock()
+
+	accepted := make(chan error, 1)
+
+	go func() {
+		conn, err := a.Accept()
+
+		if err == nil {
+			conn.Close()
+		}
+
+		accepted <- err
+	}()
+
+	conn, err := b.Dial(ctx, a.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Close()
+
+	if err := <-accepted; err != nil {
+		t.Fatal("Accept gave up when the bridge failed: ", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	fs := newFakeSAM(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	a := newSession(t, ctx, fs, "a")
+	b := newSession(t, ctx, fs, "b")
+
+	accepted := make(chan error, 1)
+
+	go func() {
+		_, err := a.Accept()
+		accepted <- err
+	}()
+
+	time.Sleep(time.Millisecond * 50)
+	a.Close()
+
+	if err := <-accepted; err != ErrClosed {
+		t.Fatal("Accept did not stop when the session closed: ", err)
+	}
+
+	fs.drop()
+
+	select {
+	case <-b.Done():
+	case <-ctx.Done():
+		t.Fatal("Session stayed up after losing the bridge")
+	}
+
+	if _, err := b.Accept(); err != ErrClosed {
+		t.Fatal("Accepted on a session that has gone: ", err)
+	}
+}
@@ -1,6 +1,7 @@
 package jobs
 
 import (
+	"context"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -11,12 +12,15 @@ import (
 const ExploreFrequency = time.Minute * 2
 const ExploreBufferSize = 100
 
+// How long a single peer is given to be explored.
+const ExploreTimeout = time.Minute
+
 // This job runs every two minutes, and tries to build the netdb with as many
 // entries as it possibly can
 func ExploreJob(in chan dht.Entry, data ...interface{}) <-chan dht.Entry {
 	ret := make(chan dht.Entry, ExploreBufferSize)
 
-	connector := data[0].(func(dht.Address) (interface{}, error))
+	connector := data[0].(func(context.Context, dht.Address) (interface{}, error))
 	me := data[1].(dht.Address)
 	seed := data[2].(func(ret chan dht.Entry))
 
@@ -44,7 +48,10 @@ func exploreTick(in chan dht.Entry, ret chan dht.Entry, me dht.Address, connecto
 
 	log.WithField("peer", s).Info("Exploring")
 
-	if err := explorePeer(i.Address, me, ret, connector); err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), ExploreTimeout)
+	defer cancel()
+
+	if err := explorePeer(ctx, i.Address, me, ret, connector); err != nil {
 		log.Error(err.Error())
 	}
 
@@ -54,8 +61,8 @@ func exploreTick(in chan dht.Entry, ret chan dht.Entry, me dht.Address, connecto
 	}
 }
 
-func explorePeer(addr dht.Address, me dht.Address, ret chan<- dht.Entry, connectPeer common.ConnectPeer) error {
-	peer, err := connectPeer(addr)
+func explorePeer(ctx context.Context, addr dht.Address, me dht.Address, ret chan<- dht.Entry, connectPeer common.ConnectPeer) error {
+	peer, err := connectPeer(ctx, addr)
 	p := peer.(common.Peer)
 
 	if err != nil {
@@ -69,7 +76,7 @@ func explorePeer(addr dht.Address, me dht.Address, ret chan<- dht.Entry, connect
 	}
 
 	log.Debug("Exploring random")
-	closest, err := p.FindClosest(*randAddr)
+	closest, err := p.FindClosest(ctx, *randAddr)
 
 	if err != nil {
 		return err
@@ -82,7 +89,7 @@ func explorePeer(addr dht.Address, me dht.Address, ret chan<- dht.Entry, connect
 	}
 
 	log.Debug("Exploring closest to self")
-	closestToMe, err := p.FindClosest(me)
+	closestToMe, err := p.FindClosest(ctx, me)
 
 	if err != nil {
 		return err
@@ -4,12 +4,16 @@
 package zif
 
 import (
+	"context"
 	"errors"
 	"io/ioutil"
 	"math"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
-	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -19,13 +23,19 @@ import (
 	"github.com/zif/zif/data"
 	"github.com/zif/zif/dht"
 	"github.com/zif/zif/jobs"
+	"github.com/zif/zif/nat"
 	"github.com/zif/zif/proto"
+	"github.com/zif/zif/torcontrol"
 	"github.com/zif/zif/util"
+	"github.com/zif/zif/websocket"
 )
 
 const ResolveListSize = 1
 const TimeBeforeReExplore = 60 * 60
 
+// Where everything is stored, unless the local peer is given a directory.
+const DefaultDirectory = "./data"
+
 type LocalPeer struct {
 	Peer
 	Entry         *dht.Entry
@@ -40,9 +50,30 @@ type LocalPeer struct {
 
 	SearchProvider *data.SearchProvider
 
+	// Limits on the bandwidth used by peers, unlimited until configured.
+	Bandwidth *proto.Bandwidth
+
+	// Dial peers by the type of endpoint, TCP and unix sockets until
+	// configured.
+	Transports *proto.Transports
+
+	// The directory the identity, entry, routing table, collection and mirrors
+	// are kept in. Must be set before anything is read or written, empty means
+	// DefaultDirectory.
+	Directory string
+
+	// Guards Entry, which handshakes and queries read while it changes, such as
+	// when a port mapping is renewed. Changes replace its slices rather than
+	// writing to them, so copies taken by CopyEntry stay as they were.
+	entryLock sync.RWMutex
+
 	privateKey  ed25519.PrivateKey
 	peerManager *PeerManager
 	seedManager *SeedManager
+	reconnector *Reconnector
+	portMapper  *nat.PortMapper
+	torService  *torcontrol.Service
+	closed      chan struct{}
 }
 
 func (lp *LocalPeer) Setup() {
@@ -53,84 +84,150 @@ func (lp *LocalPeer) Setup() {
 
 	lp.Databases = cmap.New()
 	lp.Collections = cmap.New()
+	lp.closed = make(chan struct{})
+	lp.Bandwidth = proto.NewBandwidth(proto.BandwidthConfig{})
+	lp.Transports = proto.NewTransports(proto.TCPTransport{}, proto.UnixTransport{})
 
 	lp.peerManager = NewPeerManager(lp)
+	lp.reconnector = NewReconnector(lp)
 
 	lp.Address().Generate(lp.PublicKey())
 
-	lp.DHT = dht.NewDHT(lp.address, "./data/peers.db")
-	lp.DHT.LoadTable("./data/table.dat")
-
-	if err != nil {
-		panic(err)
-	}
+	lp.DHT = dht.NewDHT(lp.address, lp.DataPath("peers.db"))
+	lp.DHT.LoadTable(lp.DataPath("table.dat"))
 
-	lp.Collection, err = data.LoadCollection("./data/collection.dat")
+	lp.Collection, err = data.LoadCollection(lp.DataPath("collection.dat"))
 
 	if err != nil {
 		lp.Collection = data.NewCollection()
 		log.Info("Created new collection")
 	}
 
-	// Loop through all the databases of other peers in ./data, load them.
-	handler := func(path string, info os.FileInfo, err error) error {
-		if path != "data/posts.db" && info.Name() == "posts.db" {
-			r, err := regexp.Compile("data/(\\w+)/.+")
-
-			if err != nil {
-				return err
-			}
+	// Loop through all the databases of other peers in the data directory, which
+	// are each kept in a directory named after their address, and load them.
+	dir := lp.DataPath()
 
-			addr := r.FindStringSubmatch(path)
+	handler := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
 
-			db := data.NewDatabase(path)
+		rel, err := filepath.Rel(dir, path)
 
-			err = db.Connect()
+		if err != nil {
+			return err
+		}
 
-			if err != nil {
-				return err
-			}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
 
-			if len(addr) < 2 {
-				return nil
-			}
+		// anything at the top level is our own
+		if len(parts) < 2 {
+			return nil
+		}
 
-			lp.Databases.Set(addr[1], db)
+		if info.Name() == "posts.db" {
+			db := data.NewDatabase(path)
 
-		} else if path != "data/collection.dat" && info.Name() == "collection.dat" {
-			r, err := regexp.Compile("data/(\\w+)/.+")
+			err = db.Connect()
 
 			if err != nil {
 				return err
 			}
 
-			addr := r.FindStringSubmatch(path)
+			lp.Databases.Set(parts[0], db)
 
+		} else if info.Name() == "collection.dat" {
 			dat, err := ioutil.ReadFile(path)
 
 			if err != nil {
 				return err
 			}
 
-			lp.Collections.Set(addr[1], dat)
+			lp.Collections.Set(parts[0], dat)
 		}
 		return nil
 	}
 
-	filepath.Walk("./data", handler)
+	filepath.Walk(dir, handler)
 
 	lp.SearchProvider = data.NewSearchProvider()
 
 	lp.capabilities.Compression = append(lp.capabilities.Compression,
-		[]string{"gzip", "none"}...)
+		[]string{"gzip", "deflate", proto.CompressionNone}...)
+	lp.capabilities.Pieces = append(lp.capabilities.Pieces,
+		[]string{proto.PieceFormatFramed, proto.PieceFormatText}...)
 
 	lp.Server = proto.NewServer(&lp.capabilities)
+	lp.registerHandlers()
+
+	err = lp.Server.Reputation().Load(lp.DataPath("bans.json"))
+
+	if err != nil {
+		log.Error("Failed to load bans: ", err.Error())
+	}
 }
 
 func (lp *LocalPeer) SignEntry() {
+	lp.entryLock.Lock()
+	defer lp.entryLock.Unlock()
+
+	lp.signEntry()
+}
+
+func (lp *LocalPeer) signEntry() {
 	lp.Entry.Updated = uint64(time.Now().Unix())
 	data, _ := lp.Entry.Bytes()
-	copy(lp.Entry.Signature, ed25519.Sign(lp.privateKey, data))
+	lp.Entry.Signature = ed25519.Sign(lp.privateKey, data)
+}
+
+// A copy of our entry as it is now, safe to read while it is being changed.
+func (lp *LocalPeer) CopyEntry() dht.Entry {
+	lp.entryLock.RLock()
+	defer lp.entryLock.RUnlock()
+
+	return *lp.Entry
+}
+
+// A copy of the capabilities we advertise, safe to read while the server adds
+// to them.
+func (lp *LocalPeer) GetCapabilities() *proto.MessageCapabilities {
+	caps := lp.Server.Capabilities()
+	return &caps
+}
+
+// Encodes our entry as it is whenever it is sent, for the handshakes of the
+// server and announces.
+type localEntry struct {
+	lp *LocalPeer
+}
+
+func (le localEntry) Bytes() ([]byte, error) {
+	entry := le.lp.CopyEntry()
+	return entry.Bytes()
+}
+
+func (le localEntry) String() (string, error) {
+	entry := le.lp.CopyEntry()
+	return entry.String()
+}
+
+func (le localEntry) Encode() ([]byte, error) {
+	entry := le.lp.CopyEntry()
+	return entry.Encode()
+}
+
+func (le localEntry) EncodeString() (string, error) {
+	entry := le.lp.CopyEntry()
+	return entry.EncodeString()
+}
+
+// Changes our entry, with nothing reading it meanwhile. The entry is not signed
+// or saved.
+func (lp *LocalPeer) UpdateEntry(update func(*dht.Entry)) {
+	lp.entryLock.Lock()
+	defer lp.entryLock.Unlock()
+
+	update(lp.Entry)
 }
 
 // Sign any bytes.
@@ -138,8 +235,70 @@ func (lp *LocalPeer) Sign(msg []byte) []byte {
 	return ed25519.Sign(lp.privateKey, msg)
 }
 
-// Pass the address to listen on. This is for the Zif connection.
-func (lp *LocalPeer) Listen(addr string) {
+// Pass the address to listen on. This is for the Zif connection, over TCP.
+func (lp *LocalPeer) Listen(addr string) error {
+	var err error
+	lp.seedManager, err = NewSeedManager(lp.Entry.Address, lp)
+
+	if err != nil {
+		return err
+	}
+
+	lp.SignEntry()
+
+	_, err = lp.Server.Listen(proto.TCPTransport{}, addr, lp, localEntry{lp})
+
+	if err != nil {
+		return err
+	}
+
+	lp.start()
+
+	return nil
+}
+
+// Listens with a transport as well as on the main listener, adding where it
+// can be reached to our entry if advertise is set. The entry is not signed or
+// saved.
+func (lp *LocalPeer) ListenOn(t proto.Transport, addr string, advertise bool) error {
+	listener, err := lp.Server.Listen(t, addr, lp, localEntry{lp})
+
+	if err != nil || !advertise {
+		return err
+	}
+
+	for _, i := range t.Endpoints(listener) {
+		if err := lp.AddEndpoint(i); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Serves Zif connections over WebSockets upgraded by the handler that is
+// returned, for mounting on an HTTP server at addr. As with ListenOn, the entry
+// is neither signed nor saved.
+func (lp *LocalPeer) ServeWebSocket(addr net.Addr, advertise bool) (http.Handler, error) {
+	listener := websocket.NewListener(addr)
+	go lp.Server.Serve(listener, lp, localEntry{lp})
+
+	if !advertise {
+		return listener, nil
+	}
+
+	for _, i := range (proto.WebSocketTransport{}).Endpoints(listener) {
+		if err := lp.AddEndpoint(i); err != nil {
+			return nil, err
+		}
+	}
+
+	return listener, nil
+}
+
+// Serves Zif connections from a listener that is already open, rather than
+// opening one. The listener is closed along with the local peer.
+func (lp *LocalPeer) Serve(listener net.Listener) {
 	var err error
 	lp.seedManager, err = NewSeedManager(lp.Entry.Address, lp)
 
@@ -148,13 +307,30 @@ func (lp *LocalPeer) Listen(addr string) {
 	}
 
 	lp.SignEntry()
-	go lp.Server.Listen(addr, lp, lp.Entry)
+	go lp.Server.Serve(listener, lp, localEntry{lp})
+	lp.start()
+}
+
+func (lp *LocalPeer) start() {
 	go lp.QuerySelf()
 	go lp.peerManager.LoadSeeds()
+	lp.reconnector.Start()
 
 	lp.seedManager.Start()
 }
 
+// The path of a file in the data directory, or of the directory itself if
+// nothing is given.
+func (lp *LocalPeer) DataPath(elem ...string) string {
+	dir := lp.Directory
+
+	if dir == "" {
+		dir = DefaultDirectory
+	}
+
+	return filepath.Join(append([]string{dir}, elem...)...)
+}
+
 // Generate a ed25519 keypair.
 func (lp *LocalPeer) GenerateKey() {
 	var err error
@@ -175,7 +351,7 @@ func (lp *LocalPeer) WriteKey() error {
 			New("LocalPeer does not have a private key, please generate")
 	}
 
-	err := ioutil.WriteFile("./data/identity.dat", lp.privateKey, 0400)
+	err := ioutil.WriteFile(lp.DataPath("identity.dat"), lp.privateKey, 0400)
 
 	return err
 }
@@ -183,7 +359,7 @@ func (lp *LocalPeer) WriteKey() error {
 // Read the private key from file. This is the "identity.dat" file. The public
 // key is also then generated from the private key.
 func (lp *LocalPeer) ReadKey() error {
-	pk, err := ioutil.ReadFile("./data/identity.dat")
+	pk, err := ioutil.ReadFile(lp.DataPath("identity.dat"))
 
 	if err != nil {
 		return err
@@ -195,8 +371,13 @@ func (lp *LocalPeer) ReadKey() error {
 	return nil
 }
 
+// Signs our entry, then stores it in the DHT and on disk.
 func (lp *LocalPeer) SaveEntry() error {
-	lp.SignEntry()
+	// held throughout, so that an older entry is never written over a newer one
+	lp.entryLock.Lock()
+	defer lp.entryLock.Unlock()
+
+	lp.signEntry()
 	dat, err := lp.Entry.EncodeString()
 
 	if err != nil {
@@ -209,11 +390,11 @@ func (lp *LocalPeer) SaveEntry() error {
 		return err
 	}
 
-	return ioutil.WriteFile("./data/entry.json", []byte(dat), 0644)
+	return ioutil.WriteFile(lp.DataPath("entry.json"), []byte(dat), 0644)
 }
 
 func (lp *LocalPeer) LoadEntry() error {
-	dat, err := ioutil.ReadFile("./data/entry.json")
+	dat, err := ioutil.ReadFile(lp.DataPath("entry.json"))
 
 	if err != nil {
 		return err
@@ -227,14 +408,56 @@ func (lp *LocalPeer) LoadEntry() error {
 
 	lp.Entry = entry
 
+	// signed again when it is next saved
+	lp.Entry.MigrateEndpoints()
+
 	return nil
 }
 
+// Stops serving, disconnects from every peer and closes all of the databases.
 func (lp *LocalPeer) Close() {
-	lp.CloseStreams()
-	lp.DHT.SaveTable("./data/table.dat")
+	close(lp.closed)
+
 	lp.Server.Close()
-	lp.Database.Close()
+	lp.CloseStreams()
+
+	if lp.portMapper != nil {
+		if err := lp.portMapper.Close(); err != nil {
+			log.Error("Failed to remove port mapping: ", err.Error())
+		}
+	}
+
+	if lp.torService != nil {
+		if err := lp.torService.Close(); err != nil {
+			log.Error("Failed to remove onion service: ", err.Error())
+		}
+	}
+
+	if lp.seedManager != nil {
+		lp.seedManager.Stop()
+	}
+
+	// otherwise everything would be redialled as soon as it is disconnected
+	lp.reconnector.Close()
+
+	for _, p := range lp.Peers() {
+		p.Terminate()
+		lp.HandleCloseConnection(p.Address())
+	}
+
+	// including those for peers that were never connected
+	lp.peerManager.StopSeedManagers()
+
+	lp.DHT.SaveTable(lp.DataPath("table.dat"))
+	lp.DHT.Close()
+
+	for i := range lp.Databases.IterBuffered() {
+		i.Val.(*data.Database).Close()
+	}
+
+	if lp.Database != nil {
+		lp.Database.Close()
+	}
 }
 
 func (lp *LocalPeer) AddPost(p data.Post, store bool) (int64, error) {
@@ -246,7 +469,9 @@ func (lp *LocalPeer) AddPost(p data.Post, store bool) (int64, error) {
 		return -1, valid
 	}
 
-	lp.Entry.PostCount += 1
+	lp.UpdateEntry(func(entry *dht.Entry) {
+		entry.PostCount += 1
+	})
 
 	id, err := lp.Database.InsertPost(p)
 
@@ -255,12 +480,14 @@ func (lp *LocalPeer) AddPost(p data.Post, store bool) (int64, error) {
 
 	lp.Collection.Add(piece)
 	lp.Collection.Rehash()
-	lp.Collection.Save("./data/collection.dat")
+	lp.Collection.Save(lp.DataPath("collection.dat"))
 
 	hash := lp.Collection.Hash()
 
-	lp.Entry.CollectionHash = make([]byte, len(hash))
-	copy(lp.Entry.CollectionHash, hash)
+	lp.UpdateEntry(func(entry *dht.Entry) {
+		entry.CollectionHash = make([]byte, len(hash))
+		copy(entry.CollectionHash, hash)
+	})
 
 	if err != nil {
 		return id, err
@@ -288,8 +515,8 @@ func (lp *LocalPeer) StartExploring() error {
 	}
 
 	ret := jobs.ExploreJob(in,
-		func(addr dht.Address) (interface{}, error) {
-			peer, _, err := lp.ConnectPeer(addr)
+		func(ctx context.Context, addr dht.Address) (interface{}, error) {
+			peer, _, err := lp.ConnectPeer(ctx, addr)
 			return peer, err
 		},
 		lp.address,
@@ -382,6 +609,22 @@ func (lp *LocalPeer) seedExplore(in chan dht.Entry, seen *cmap.ConcurrentMap) er
 	closestRand, err := lp.DHT.FindClosest(*addr)
 
 	closest = append(closest, closestRand...)
+
+	// both lists may well hold the same entries, and ourselves, which would
+	// leave nothing to explore if they were all picked
+	seeds := make(dht.Entries, 0, len(closest))
+	picked := make(map[string]bool)
+
+	for _, i := range closest {
+		if i == nil || i.Address.Equals(lp.Address()) || picked[string(i.Address.Raw)] {
+			continue
+		}
+
+		picked[string(i.Address.Raw)] = true
+		seeds = append(seeds, i)
+	}
+
+	closest = seeds
 	log.WithField("seeds", len(closest)).Info("Seeding peer explore")
 
 	dht.ShuffleEntries(closest)
@@ -432,18 +675,175 @@ func (lp *LocalPeer) Peers() map[string]*Peer {
 	return lp.peerManager.Peers()
 }
 
-func (lp *LocalPeer) ConnectPeerDirect(addr string) (*Peer, error) {
-	return lp.peerManager.ConnectPeerDirect(addr)
+func (lp *LocalPeer) ConnectPeerDirect(ctx context.Context, addr string) (*Peer, error) {
+	return lp.peerManager.ConnectPeerDirect(ctx, addr)
 }
 
-func (lp *LocalPeer) ConnectPeer(addr dht.Address) (*Peer, *dht.Entry, error) {
-	return lp.peerManager.ConnectPeer(addr)
+func (lp *LocalPeer) ConnectPeer(ctx context.Context, addr dht.Address) (*Peer, *dht.Entry, error) {
+	return lp.peerManager.ConnectPeer(ctx, addr)
 }
 
 func (lp *LocalPeer) HandleCloseConnection(addr *dht.Address) {
 	lp.peerManager.HandleCloseConnection(addr)
 }
 
+// Keeps a peer connected, redialling it whenever it is lost. See reconnect.go.
+func (lp *LocalPeer) AddSticky(addr dht.Address, reason string) {
+	lp.reconnector.Add(addr, reason)
+}
+
+func (lp *LocalPeer) RemoveSticky(addr dht.Address, reason string) {
+	lp.reconnector.Remove(addr, reason)
+}
+
+func (lp *LocalPeer) StickyPeers() []StickyPeer {
+	return lp.reconnector.Peers()
+}
+
+// Lists the peers that relay connections to us in our entry, replacing any that
+// were there before, and keeps us connected to them. Peers that cannot accept
+// connections can only be reached this way.
+func (lp *LocalPeer) UseRelays(relays []dht.Address) error {
+	if len(relays) > dht.MaxEntryRelays {
+		return errors.New("Too many relays")
+	}
+
+	entry := lp.CopyEntry()
+
+	for _, i := range entry.AllEndpoints() {
+		if addr, err := i.Relay(); err == nil {
+			lp.RemoveSticky(addr, StickyRelay)
+		}
+	}
+
+	endpoints := make([]dht.Endpoint, 0, len(relays))
+
+	for _, i := range relays {
+		if i.Equals(lp.Address()) {
+			continue
+		}
+
+		endpoints = append(endpoints, dht.NewRelayEndpoint(i))
+		lp.AddSticky(i, StickyRelay)
+	}
+
+	err := lp.SetEndpoints(dht.EndpointRelay, endpoints...)
+
+	if err != nil {
+		return err
+	}
+
+	return lp.SaveEntry()
+}
+
+// Replaces the endpoints of the given type in our entry. The entry is not signed
+// or saved.
+func (lp *LocalPeer) SetEndpoints(kind string, endpoints ...dht.Endpoint) error {
+	lp.entryLock.Lock()
+	defer lp.entryLock.Unlock()
+
+	return lp.setEndpoints(kind, endpoints...)
+}
+
+func (lp *LocalPeer) setEndpoints(kind string, endpoints ...dht.Endpoint) error {
+	lp.Entry.MigrateEndpoints()
+
+	ret := make([]dht.Endpoint, 0, len(lp.Entry.Endpoints)+len(endpoints))
+
+	for _, i := range lp.Entry.Endpoints {
+		if i.Type != kind {
+			ret = append(ret, i)
+		}
+	}
+
+	for _, i := range endpoints {
+		if i.Type != kind {
+			return errors.New("Endpoint is not of type " + kind)
+		}
+
+		if err := i.Valid(); err != nil {
+			return err
+		}
+
+		ret = append(ret, i)
+	}
+
+	if len(ret) > dht.MaxEntryEndpoints {
+		return errors.New("Too many endpoints")
+	}
+
+	lp.Entry.Endpoints = ret
+
+	return nil
+}
+
+// Adds an endpoint to our entry, if it is not already there. The entry is not
+// signed or saved.
+func (lp *LocalPeer) AddEndpoint(endpoint dht.Endpoint) error {
+	lp.entryLock.Lock()
+	defer lp.entryLock.Unlock()
+
+	lp.Entry.MigrateEndpoints()
+
+	same := make([]dht.Endpoint, 0, 1)
+
+	for _, i := range lp.Entry.Endpoints {
+		if i == endpoint {
+			return nil
+		}
+
+		if i.Type == endpoint.Type {
+			same = append(same, i)
+		}
+	}
+
+	return lp.setEndpoints(endpoint.Type, append(same, endpoint)...)
+}
+
+// Sets the address older peers will dial, replacing the endpoint it was before.
+// Other endpoints are left alone. The entry is not signed or saved.
+func (lp *LocalPeer) SetPublicAddress(host string, port int) error {
+	lp.entryLock.Lock()
+	defer lp.entryLock.Unlock()
+
+	lp.Entry.MigrateEndpoints()
+
+	old := dht.NewEndpoint(lp.Entry.PublicAddress, lp.Entry.Port)
+	endpoints := make([]dht.Endpoint, 0, len(lp.Entry.Endpoints)+1)
+
+	if host != "" {
+		endpoint := dht.NewEndpoint(host, port)
+
+		if err := endpoint.Valid(); err != nil {
+			return err
+		}
+
+		endpoints = append(endpoints, endpoint)
+	}
+
+	for _, i := range lp.Entry.Endpoints {
+		if i != old && (len(endpoints) == 0 || i != endpoints[0]) {
+			endpoints = append(endpoints, i)
+		}
+	}
+
+	if len(endpoints) > dht.MaxEntryEndpoints {
+		return errors.New("Too many endpoints")
+	}
+
+	lp.Entry.PublicAddress = host
+	lp.Entry.Port = port
+	lp.Entry.Endpoints = endpoints
+
+	return nil
+}
+
+// Limits the endpoint types we dial, best first. By default anything we can
+// reach is dialled.
+func (lp *LocalPeer) SetDialTypes(types []string) {
+	lp.peerManager.dial = types
+}
+
 func (lp *LocalPeer) SetPeer(p *Peer) {
 	lp.peerManager.SetPeer(p)
 }
@@ -465,25 +865,18 @@ func (lp *LocalPeer) GetNetworkPeer(addr dht.Address) proto.NetworkPeer {
 	return lp.peerManager.GetPeer(addr)
 }
 
-func (lp *LocalPeer) SetSocks(on bool) {
-	lp.peerManager.socks = on
-}
-
-func (lp *LocalPeer) SetSocksPort(port int) {
-	lp.peerManager.socksPort = port
+func (lp *LocalPeer) SetMaxPeers(max int) {
+	lp.peerManager.maxPeers = max
 }
 
-func (lp *LocalPeer) GetSocksPort() int {
-	return lp.peerManager.socksPort
-}
-
-func (lp *LocalPeer) Resolve(addr dht.Address) (*dht.Entry, error) {
-	return lp.peerManager.Resolve(addr)
+func (lp *LocalPeer) Resolve(ctx context.Context, addr dht.Address) (*dht.Entry, error) {
+	return lp.peerManager.Resolve(ctx, addr)
 }
 
 func (lp *LocalPeer) QueryEntry(addr dht.Address) (*dht.Entry, error) {
 	if addr.Equals(lp.Address()) {
-		return lp.Entry, nil
+		entry := lp.CopyEntry()
+		return &entry, nil
 	}
 
 	kv, err := lp.DHT.Query(addr)
@@ -502,13 +895,22 @@ func (lp *LocalPeer) QueryEntry(addr dht.Address) (*dht.Entry, error) {
 func (lp *LocalPeer) QuerySelf() {
 	log.Info("Querying for seeds")
 	ticker := time.NewTicker(time.Minute * 5)
+	defer ticker.Stop()
 
-	for _ = range ticker.C {
-		if len(lp.Entry.Seeds) == 0 {
+	for {
+		select {
+		case <-ticker.C:
+		case <-lp.closed:
+			return
+		}
+
+		seeds := lp.CopyEntry().Seeds
+
+		if len(seeds) == 0 {
 			continue
 		}
 
-		i := lp.Entry.Seeds[util.CryptoRandInt(0, int64(len(lp.Entry.Seeds)))]
+		i := seeds[util.CryptoRandInt(0, int64(len(seeds)))]
 
 		addr := dht.Address{Raw: i}
 
@@ -524,25 +926,29 @@ func (lp *LocalPeer) QuerySelf() {
 
 		log.WithField("peer", s).Info("Querying for new feeds for self")
 
-		peer, _, err := lp.ConnectPeer(addr)
+		ctx, cancel := context.WithTimeout(context.Background(), PeerTimeout)
+
+		peer, _, err := lp.ConnectPeer(ctx, addr)
 
 		if err != nil {
+			cancel()
 			continue
 		}
 
-		e, err := peer.Query(*lp.Address())
+		e, err := peer.Query(ctx, *lp.Address())
+		cancel()
 
 		if err != nil {
 			continue
 		}
 		entry := e.(*dht.Entry)
 
-		if len(entry.Seeds) > len(lp.Entry.Seeds) {
-			log.WithField("from", s).Info("Found new seeds for self")
-			lp.Entry.Seeds = util.MergeSeeds(lp.Entry.Seeds, entry.Seeds)
-		}
-
-		time.Sleep(time.Minute * 5)
+		lp.UpdateEntry(func(self *dht.Entry) {
+			if len(entry.Seeds) > len(self.Seeds) {
+				log.WithField("from", s).Info("Found new seeds for self")
+				self.Seeds = util.MergeSeeds(self.Seeds, entry.Seeds)
+			}
+		})
 	}
 }
 
@@ -553,7 +959,9 @@ func (lp *LocalPeer) AddEntry(entry dht.Entry) error {
 
 func (lp *LocalPeer) AddSeeding(entry dht.Entry) error {
 	// save with the local entry, then the remote
-	lp.Entry.Seeding = append(lp.Entry.Seeding, entry.Address.Raw)
+	lp.UpdateEntry(func(self *dht.Entry) {
+		self.Seeding = append(self.Seeding, entry.Address.Raw)
+	})
 	entry.Seeds = append(entry.Seeds, lp.Address().Raw)
 
 	lp.SignEntry()
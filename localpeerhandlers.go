@@ -3,10 +3,10 @@ package zif
 import (
 	"bufio"
 	"compress/gzip"
+	"context"
 	"database/sql"
-	"errors"
-	"fmt"
 	"io/ioutil"
+	"os"
 
 	log "github.com/sirupsen/logrus"
 
@@ -17,7 +17,24 @@ import (
 
 const MaxSearchLength = 256
 
-// TODO: Move this into some sort of handler object, can handle general requests.
+// Registers every message this peer handles with its server.
+func (lp *LocalPeer) registerHandlers() {
+	lp.Server.Handle(proto.ProtoDhtAnnounce, lp.HandleAnnounce)
+	lp.Server.Handle(proto.ProtoDhtQuery, lp.HandleQuery)
+	lp.Server.Handle(proto.ProtoDhtFindClosest, lp.HandleFindClosest)
+	lp.Server.HandleCapability(proto.ProtoDhtExchange, proto.CapabilityExchange, lp.HandleExchange)
+	lp.Server.Handle(proto.ProtoSearch, lp.HandleSearch)
+	lp.Server.Handle(proto.ProtoRecent, lp.HandleRecent)
+	lp.Server.Handle(proto.ProtoPopular, lp.HandlePopular)
+	lp.Server.HandleCapability(proto.ProtoSearchStream, proto.CapabilityPostStream, lp.HandleSearchStream)
+	lp.Server.HandleCapability(proto.ProtoRecentStream, proto.CapabilityPostStream, lp.HandleRecentStream)
+	lp.Server.HandleCapability(proto.ProtoPopularStream, proto.CapabilityPostStream, lp.HandlePopularStream)
+	lp.Server.Handle(proto.ProtoRequestHashList, lp.HandleHashList)
+	lp.Server.Handle(proto.ProtoRequestPiece, lp.HandlePiece)
+	lp.Server.Handle(proto.ProtoRequestAddPeer, lp.HandleAddPeer)
+	lp.Server.Handle(proto.ProtoRelayConnect, lp.HandleRelayConnect)
+	lp.Server.Handle(proto.ProtoRelayIncoming, lp.HandleRelayIncoming)
+}
 
 // TODO: While I think about it, move all these TODOs to issues or a separate
 // file/issue tracker or something.
@@ -33,17 +50,18 @@ func (lp *LocalPeer) HandleQuery(msg *proto.Message) error {
 	err := msg.Read(&address)
 
 	if err != nil {
-		return err
+		return proto.NewError(proto.CodeInvalid, err.Error())
 	}
 
 	log.WithField("target", address.StringOr("")).Info("Recieved query")
 
 	if address.Equals(lp.Address()) {
-		log.WithField("name", lp.Entry.Name).Debug("Query for local peer")
+		entry := lp.CopyEntry()
+		log.WithField("name", entry.Name).Debug("Query for local peer")
 
 		msg := &proto.Message{Header: proto.ProtoDhtQuery}
 
-		err = msg.Write(lp.Entry)
+		err = msg.Write(entry)
 
 		if err != nil {
 			return err
@@ -54,12 +72,12 @@ func (lp *LocalPeer) HandleQuery(msg *proto.Message) error {
 	} else {
 		kv, err := lp.DHT.Query(address)
 
-		if err != nil {
-			return err
+		if err == sql.ErrNoRows || (err == nil && kv == nil) {
+			return proto.NewError(proto.CodeNotFound, "No entry for "+address.StringOr(""))
 		}
 
-		if kv == nil {
-			cl.WriteMessage(&proto.Message{Header: proto.ProtoNo})
+		if err != nil {
+			return err
 		}
 
 		msg := &proto.Message{Header: proto.ProtoDhtQuery}
@@ -84,7 +102,7 @@ func (lp *LocalPeer) HandleFindClosest(msg *proto.Message) error {
 	err := msg.Read(&address)
 
 	if err != nil {
-		return err
+		return proto.NewError(proto.CodeInvalid, err.Error())
 	}
 
 	log.WithField("target", address.StringOr("")).Info("Recieved find closest")
@@ -114,36 +132,38 @@ func (lp *LocalPeer) HandleFindClosest(msg *proto.Message) error {
 }
 
 func (lp *LocalPeer) HandleAnnounce(msg *proto.Message) error {
-	cl, err := proto.NewClient(msg.Stream)
+	entry := dht.Entry{}
+	err := msg.Read(&entry)
+
+	log.WithField("address", entry.Address.StringOr("")).Info("Announce")
 
 	if err != nil {
-		return err
+		return proto.NewError(proto.CodeInvalid, err.Error())
 	}
 
-	defer msg.Stream.Close()
-
-	entry := dht.Entry{}
-	err = msg.Read(&entry)
-
-	log.WithField("address", entry.Address.StringOr("")).Info("Announce")
+	err = entry.Verify()
 
 	if err != nil {
-		return err
+		if peer := lp.GetPeer(*msg.From); peer != nil {
+			peer.Penalise(proto.PenaltyBadEntry, "Announced an invalid entry")
+		}
+
+		return proto.NewError(proto.CodeInvalid, err.Error())
 	}
 
 	affected, err := lp.DHT.Insert(entry)
 
-	if err == nil && affected > 0 {
-		cl.WriteMessage(&proto.Message{Header: proto.ProtoOk})
-		log.WithField("peer", entry.Address.StringOr("")).Info("Saved new peer")
+	if err != nil {
+		return err
+	}
 
-	} else {
-		cl.WriteMessage(&proto.Message{Header: proto.ProtoNo})
-		return errors.New("Failed to save entry")
+	if affected == 0 {
+		return proto.NewError(proto.CodeInvalid, "Entry not saved")
 	}
 
-	return nil
+	log.WithField("peer", entry.Address.StringOr("")).Info("Saved new peer")
 
+	return msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoOk})
 }
 
 func (lp *LocalPeer) HandleSearch(msg *proto.Message) error {
@@ -152,7 +172,11 @@ func (lp *LocalPeer) HandleSearch(msg *proto.Message) error {
 	err := msg.Read(&sq)
 
 	if err != nil {
-		return err
+		return proto.NewError(proto.CodeInvalid, err.Error())
+	}
+
+	if len(sq.Query) > MaxSearchLength {
+		return proto.NewError(proto.CodeInvalid, "Search query too long")
 	}
 
 	log.WithField("query", sq.Query).Info("Search recieved")
@@ -184,7 +208,7 @@ func (lp *LocalPeer) HandleRecent(msg *proto.Message) error {
 	err := msg.Read(&page)
 
 	if err != nil {
-		return err
+		return proto.NewError(proto.CodeInvalid, err.Error())
 	}
 
 	recent, err := lp.Database.QueryRecent(page)
@@ -213,7 +237,7 @@ func (lp *LocalPeer) HandlePopular(msg *proto.Message) error {
 	err := msg.Read(&page)
 
 	if err != nil {
-		return err
+		return proto.NewError(proto.CodeInvalid, err.Error())
 	}
 
 	recent, err := lp.Database.QueryPopular(page)
@@ -235,12 +259,61 @@ func (lp *LocalPeer) HandlePopular(msg *proto.Message) error {
 	return msg.Client.WriteMessage(resp)
 }
 
+// Replies to a MessagePostQuery with a page of posts from query, followed by the
+// cursor for the next page.
+func (lp *LocalPeer) handlePostQuery(msg *proto.Message, query func(proto.MessagePostQuery, *data.Cursor, int) ([]*data.Post, *data.Cursor, error)) error {
+	pq := proto.MessagePostQuery{}
+	err := msg.Read(&pq)
+
+	if err != nil {
+		return proto.NewError(proto.CodeInvalid, err.Error())
+	}
+
+	cursor, err := data.DecodeCursor(pq.Cursor)
+
+	if err != nil {
+		return proto.NewError(proto.CodeInvalid, err.Error())
+	}
+
+	posts, next, err := query(pq, cursor, proto.PostPageSize(pq.PageSize))
+
+	if err != nil {
+		return err
+	}
+
+	return proto.WritePosts(msg.Client, posts, next.Encode())
+}
+
+func (lp *LocalPeer) HandleSearchStream(msg *proto.Message) error {
+	return lp.handlePostQuery(msg, func(pq proto.MessagePostQuery, cursor *data.Cursor, size int) ([]*data.Post, *data.Cursor, error) {
+		if len(pq.Query) > MaxSearchLength {
+			return nil, nil, proto.NewError(proto.CodeInvalid, "Search query too long")
+		}
+
+		log.WithField("query", pq.Query).Info("Search recieved")
+
+		return lp.Database.SearchCursor(pq.Query, cursor, size)
+	})
+}
+
+func (lp *LocalPeer) HandleRecentStream(msg *proto.Message) error {
+	return lp.handlePostQuery(msg, func(pq proto.MessagePostQuery, cursor *data.Cursor, size int) ([]*data.Post, *data.Cursor, error) {
+		return lp.Database.QueryRecentCursor(cursor, size)
+	})
+}
+
+func (lp *LocalPeer) HandlePopularStream(msg *proto.Message) error {
+	return lp.handlePostQuery(msg, func(pq proto.MessagePostQuery, cursor *data.Cursor, size int) ([]*data.Post, *data.Cursor, error) {
+		return lp.Database.QueryPopularCursor(cursor, size)
+	})
+}
+
 func (lp *LocalPeer) HandleHashList(msg *proto.Message) error {
 	address := dht.Address{}
 	err := msg.Read(&address)
 
 	if err != nil {
-		return err
+		return proto.NewError(proto.CodeInvalid, err.Error())
 	}
 
 	log.WithField("address", address.StringOr("")).Info("Collection request recieved")
@@ -266,7 +339,11 @@ func (lp *LocalPeer) HandleHashList(msg *proto.Message) error {
 	} else if entry != nil {
 		// load the hashlist from disk, if it exists. If not, err
 		// if not "err", then it'd probably read its own collection
-		hl, err := ioutil.ReadFile(fmt.Sprintf("./data/%s/collection.dat", address.StringOr("err")))
+		hl, err := ioutil.ReadFile(lp.DataPath(address.StringOr("err"), "collection.dat"))
+
+		if os.IsNotExist(err) {
+			return proto.NewError(proto.CodeNotFound, "Collection not mirrored")
+		}
 
 		if err != nil {
 			return err
@@ -276,7 +353,7 @@ func (lp *LocalPeer) HandleHashList(msg *proto.Message) error {
 		copy(hashList, hl)
 
 	} else {
-		return errors.New("Cannot return collection hash list")
+		return proto.NewError(proto.CodeNotFound, "Cannot return collection hash list")
 	}
 
 	mhl := proto.MessageCollection{
@@ -288,15 +365,13 @@ func (lp *LocalPeer) HandleHashList(msg *proto.Message) error {
 		Header: proto.ProtoHashList,
 	}
 
-	resp.Write(mhl)
+	err = resp.Write(mhl)
 
 	if err != nil {
 		return err
 	}
 
-	msg.Client.WriteMessage(resp)
-
-	return nil
+	return msg.Client.WriteMessage(resp)
 }
 
 func (lp *LocalPeer) HandlePiece(msg *proto.Message) error {
@@ -310,7 +385,7 @@ func (lp *LocalPeer) HandlePiece(msg *proto.Message) error {
 	}).Info("Recieved piece request")
 
 	if err != nil {
-		return err
+		return proto.NewError(proto.CodeInvalid, err.Error())
 	}
 
 	var posts chan *data.Post
@@ -323,7 +398,19 @@ func (lp *LocalPeer) HandlePiece(msg *proto.Message) error {
 		posts = db.(*data.Database).QueryPiecePosts(mrp.Id, mrp.Length, true)
 
 	} else {
-		return errors.New("Piece not found")
+		return proto.NewError(proto.CodeNotFound, "Piece not found")
+	}
+
+	if mrp.Format == proto.PieceFormatFramed {
+		err = proto.WritePieces(msg.Client, mrp.Id, posts)
+
+		if err != nil {
+			return err
+		}
+
+		log.Info("Sent all")
+
+		return nil
 	}
 
 	// Buffered writer -> gzip -> net
@@ -335,8 +422,17 @@ func (lp *LocalPeer) HandlePiece(msg *proto.Message) error {
 	bw := bufio.NewWriter(msg.Stream)
 	gzw := gzip.NewWriter(bw)
 
+	sent := 0
+
 	for i := range posts {
+		// as with the framed format, each batch gets a deadline of its own.
+		// Posts are drained whatever happens, so errors are left to the writes.
+		if sent%proto.PieceBatchSize == 0 {
+			msg.Client.ExtendDeadline()
+		}
+
 		i.Write("|", "", true, gzw)
+		sent++
 	}
 
 	(&data.Post{Id: -1}).Write("|", "", true, gzw)
@@ -357,7 +453,7 @@ func (lp *LocalPeer) HandleAddPeer(msg *proto.Message) error {
 	err := msg.Read(&address)
 
 	if err != nil {
-		return err
+		return proto.NewError(proto.CodeInvalid, err.Error())
 	}
 
 	from, _ := msg.From.String()
@@ -366,18 +462,16 @@ func (lp *LocalPeer) HandleAddPeer(msg *proto.Message) error {
 
 	if address.Equals(lp.Address()) {
 
-		add := true
-
-		for _, i := range lp.Entry.Seeds {
-			if msg.From.Equals(&dht.Address{Raw: i}) {
-				add = false
+		lp.UpdateEntry(func(entry *dht.Entry) {
+			for _, i := range entry.Seeds {
+				if msg.From.Equals(&dht.Address{Raw: i}) {
+					return
+				}
 			}
-		}
 
-		if add {
 			b, _ := msg.From.Bytes()
-			lp.Entry.Seeds = append(lp.Entry.Seeds, b)
-		}
+			entry.Seeds = append(entry.Seeds, b)
+		})
 
 		err := lp.SaveEntry()
 		if err != nil {
@@ -390,12 +484,12 @@ func (lp *LocalPeer) HandleAddPeer(msg *proto.Message) error {
 		// then we need to see if we have the entry for that address
 		entry, err := lp.DHT.Query(address)
 
-		if err != nil {
-			return err
+		if err == sql.ErrNoRows || (err == nil && entry == nil) {
+			return proto.NewError(proto.CodeNotFound, "Cannot add peer, do not have entry")
 		}
 
-		if entry == nil {
-			return errors.New("Cannot add peer, do not have entry")
+		if err != nil {
+			return err
 		}
 
 		// read the address of the peer as raw bytes, and add it to the seed list
@@ -410,24 +504,115 @@ func (lp *LocalPeer) HandleAddPeer(msg *proto.Message) error {
 		lp.DHT.Insert(*entry)
 	}
 
-	msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoOk})
+	return msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoOk})
+}
+
+// Relays a connection from the sender to the peer it asks for, which we must
+// already be connected to. Returns once the connection is over.
+func (lp *LocalPeer) HandleRelayConnect(msg *proto.Message) error {
+	address := dht.Address{}
+	err := msg.Read(&address)
+
+	if err != nil {
+		return proto.NewError(proto.CodeInvalid, err.Error())
+	}
+
+	log.WithFields(log.Fields{
+		"from": msg.From.StringOr(""),
+		"to":   address.StringOr(""),
+	}).Info("Handling relay request")
+
+	circuit, err := lp.Server.Relay().Open(msg.From)
+
+	if err != nil {
+		return err
+	}
+
+	defer circuit.Close()
+
+	peer := lp.GetPeer(address)
+
+	if peer == nil || address.Equals(msg.From) {
+		return proto.ErrRelayNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), PeerTimeout)
+	defer cancel()
+
+	stream, err := peer.OpenStream(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	err = stream.RelayIncoming(ctx, *msg.From)
+
+	if err == nil {
+		err = msg.Client.WriteMessage(proto.Message{Header: proto.ProtoOk})
+	}
+
+	if err != nil {
+		stream.Close()
+		return err
+	}
+
+	circuit.Splice(msg.Client, stream)
+
+	log.WithFields(log.Fields{
+		"from": msg.From.StringOr(""),
+		"to":   address.StringOr(""),
+	}).Info("Relayed connection closed")
+
+	return nil
+}
+
+// Accepts a connection relayed by the sender, and serves it as if it had come
+// in directly. Returns once the connection is over.
+func (lp *LocalPeer) HandleRelayIncoming(msg *proto.Message) error {
+	address := dht.Address{}
+	err := msg.Read(&address)
+
+	if err != nil {
+		return proto.NewError(proto.CodeInvalid, err.Error())
+	}
+
+	log.WithFields(log.Fields{
+		"from":  address.StringOr(""),
+		"relay": msg.From.StringOr(""),
+	}).Info("Accepting relayed connection")
+
+	conn, err := proto.AcceptRelay(msg)
+
+	if err != nil {
+		return err
+	}
+
+	lp.Server.HandleConnection(conn, lp, localEntry{lp})
 
 	return nil
 }
 
 func (lp *LocalPeer) HandleHandshake(header proto.ConnHeader) (proto.NetworkPeer, error) {
 	peer := &Peer{}
+	peer.streams.SetBandwidth(lp.Bandwidth)
 	peer.SetTCP(header)
+	peer.SetCapabilities(header.Capabilities)
+	peer.compression = proto.ChooseCompression(header.Capabilities, *lp.GetCapabilities())
+	peer.pieceFormat = proto.ChoosePieceFormat(header.Capabilities, *lp.GetCapabilities())
 	_, err := peer.ConnectServer()
 
 	if err != nil {
 		return nil, err
 	}
 
+	lp.peerManager.setCallbacks(peer)
 	lp.peerManager.SetPeer(peer)
 
 	// we have a "free" entry, insert it! Just in case :D
-	entry, err := peer.Entry()
+	ctx, cancel := context.WithTimeout(context.Background(), PeerTimeout)
+	defer cancel()
+
+	entry, err := peer.Entry(ctx)
 	if err != nil {
 		return nil, err
 	}
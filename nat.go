@@ -1,13 +1,19 @@
 package zif
 
 import (
+	"context"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+
+	"github.com/zif/zif/nat"
 )
 
-// TODO: Make this check using UpNp/NAT_PMP first, then query services.
+// Asks a web service what our IP is, for when the gateway will not say.
 func ExternalIp() string {
 	resp, err := http.Get("https://api.ipify.org/")
 
@@ -25,5 +31,51 @@ func ExternalIp() string {
 		return ""
 	}
 
-	return string(ret)
+	return strings.TrimSpace(string(ret))
+}
+
+// Forwards port on the local gateway with PCP, NAT-PMP or UPnP, then points our
+// entry at the IP and port it is mapped to. The mapping is renewed until the
+// local peer is closed, and then removed. If the gateway will not say what its
+// external IP is, or it is not a public one (as happens behind more than one
+// NAT), ExternalIp is used instead.
+func (lp *LocalPeer) MapPort(ctx context.Context, port int, lifetime time.Duration) error {
+	mapper := nat.NewPortMapper(port, lifetime, nat.Discover(ctx))
+
+	mapper.OnChange(func(ip net.IP, external int) {
+		address := ip.String()
+
+		if !nat.IsPublic(ip) {
+			log.WithField("ip", ip).Info("Gateway is not on the internet, looking up external IP")
+			address = ExternalIp()
+		}
+
+		// better an address that may be out of date than none at all
+		if address == "" {
+			address = lp.CopyEntry().PublicAddress
+		}
+
+		if address == "" {
+			return
+		}
+
+		if err := lp.SetPublicAddress(address, external); err != nil {
+			log.Error(err.Error())
+			return
+		}
+
+		if err := lp.SaveEntry(); err != nil {
+			log.Error(err.Error())
+		}
+	})
+
+	err := mapper.Start(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	lp.portMapper = mapper
+
+	return nil
 }
@@ -0,0 +1,121 @@
+// Forwards a port on the local gateway, so that peers behind a home router can
+// still be connected to. Gateways are asked with PCP, NAT-PMP or UPnP IGD,
+// whichever they answer to first.
+
+package nat
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNoGateway    = errors.New("No gateway would map the port")
+	ErrNoExternalIP = errors.New("Gateway did not say what its external IP is")
+)
+
+// A gateway that can forward TCP ports to us.
+type Gateway interface {
+	// Forwards external on the gateway to internal on this machine, for
+	// lifetime. The gateway may pick another external port and lifetime, which
+	// are returned. A lifetime of zero means the mapping does not expire.
+	AddMapping(ctx context.Context, internal, external int, lifetime time.Duration) (int, time.Duration, error)
+	DeleteMapping(ctx context.Context, internal, external int) error
+
+	ExternalIP(ctx context.Context) (net.IP, error)
+
+	String() string
+}
+
+// Finds the gateways that might map ports for us, best first. PCP and NAT-PMP
+// are tried on the default gateway, and UPnP devices are searched for.
+func Discover(ctx context.Context) []Gateway {
+	ret := make([]Gateway, 0, 3)
+
+	if gw, err := DefaultGateway(); err == nil {
+		addr := net.JoinHostPort(gw.String(), strconv.Itoa(PMPPort))
+		ret = append(ret, NewPCP(addr), NewNATPMP(addr))
+	}
+
+	if upnp, err := DiscoverUPnP(ctx, SSDPAddr); err == nil {
+		ret = append(ret, upnp)
+	}
+
+	return ret
+}
+
+// The IP of the default gateway. Only Linux is supported, elsewhere only UPnP
+// gateways can be found.
+func DefaultGateway() (net.IP, error) {
+	file, err := os.Open("/proc/net/route")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		// the default route is the one to 0.0.0.0
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+
+		gw, err := strconv.ParseUint(fields[2], 16, 32)
+
+		if err != nil || gw == 0 {
+			continue
+		}
+
+		ip := make(net.IP, 4)
+		binary.LittleEndian.PutUint32(ip, uint32(gw))
+
+		return ip, nil
+	}
+
+	return nil, errors.New("No default gateway")
+}
+
+// Whether an IP can be reached from the internet. Gateways behind another NAT,
+// such as carrier grade NAT, will give an external IP that cannot.
+func IsPublic(ip net.IP) bool {
+	if ip == nil || ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() {
+		return false
+	}
+
+	private := []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"}
+
+	for _, i := range private {
+		_, block, _ := net.ParseCIDR(i)
+
+		if block.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// The IP this machine uses to talk to addr.
+func localIP(addr string) (net.IP, error) {
+	conn, err := net.Dial("udp", addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
@@ -0,0 +1,226 @@
+package nat
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultLifetime = time.Hour
+
+	// how long to wait before trying again when a mapping could not be made or
+	// renewed
+	MapRetry = time.Minute
+
+	mapTimeout = time.Second * 30
+)
+
+// Keeps a TCP port mapped on a gateway, renewing it before its lease runs out.
+// If the gateway goes away or forgets the mapping, every gateway is tried again.
+type PortMapper struct {
+	port     int
+	lifetime time.Duration
+	gateways []Gateway
+
+	lock     sync.Mutex
+	gateway  Gateway
+	ip       net.IP
+	external int
+	granted  time.Duration
+	onChange func(net.IP, int)
+
+	closed chan struct{}
+	done   chan struct{}
+}
+
+// Maps port on the first of gateways that will, asking for the same port on the
+// outside.
+func NewPortMapper(port int, lifetime time.Duration, gateways []Gateway) *PortMapper {
+	if lifetime <= 0 {
+		lifetime = DefaultLifetime
+	}
+
+	return &PortMapper{
+		port:     port,
+		lifetime: lifetime,
+		gateways: gateways,
+		closed:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Called with the external IP and port whenever they change. The IP is nil if
+// the gateway would not say what it is.
+func (pm *PortMapper) OnChange(fn func(net.IP, int)) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	pm.onChange = fn
+}
+
+// Maps the port, then keeps it mapped until Close. Returns ErrNoGateway if none
+// of the gateways would map it, in which case nothing is kept running.
+func (pm *PortMapper) Start(ctx context.Context) error {
+	err := pm.mapPort(ctx)
+
+	if err != nil {
+		close(pm.done)
+		return err
+	}
+
+	go pm.renew()
+
+	return nil
+}
+
+// The external IP and port the port is mapped to.
+func (pm *PortMapper) External() (net.IP, int) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	return pm.ip, pm.external
+}
+
+func (pm *PortMapper) Gateway() Gateway {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	return pm.gateway
+}
+
+// Tries the gateway that worked last, then the rest in order.
+func (pm *PortMapper) mapPort(ctx context.Context) error {
+	pm.lock.Lock()
+	gateways := make([]Gateway, 0, len(pm.gateways)+1)
+	external := pm.port
+
+	if pm.gateway != nil {
+		gateways = append(gateways, pm.gateway)
+		external = pm.external
+	}
+
+	for _, i := range pm.gateways {
+		if i != pm.gateway {
+			gateways = append(gateways, i)
+		}
+	}
+	pm.lock.Unlock()
+
+	for _, gw := range gateways {
+		mapped, granted, err := gw.AddMapping(ctx, pm.port, external, pm.lifetime)
+
+		if err != nil {
+			log.WithField("gateway", gw.String()).Debug("Failed to map port: ", err.Error())
+			continue
+		}
+
+		ip, err := gw.ExternalIP(ctx)
+
+		if err != nil {
+			log.WithField("gateway", gw.String()).Info("Failed to get external IP: ", err.Error())
+		}
+
+		pm.mapped(gw, ip, mapped, granted)
+
+		return nil
+	}
+
+	return ErrNoGateway
+}
+
+func (pm *PortMapper) mapped(gw Gateway, ip net.IP, external int, granted time.Duration) {
+	pm.lock.Lock()
+
+	changed := !ip.Equal(pm.ip) || external != pm.external
+	onChange := pm.onChange
+
+	pm.gateway = gw
+	pm.ip = ip
+	pm.external = external
+	pm.granted = granted
+
+	pm.lock.Unlock()
+
+	if !changed {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"gateway":  gw.String(),
+		"external": external,
+		"ip":       ip,
+	}).Info("Mapped port")
+
+	if onChange != nil {
+		onChange(ip, external)
+	}
+}
+
+// Renews the mapping halfway through its lease. Mappings that never expire are
+// renewed as often as ones that would, in case the gateway restarts and forgets.
+func (pm *PortMapper) renew() {
+	defer close(pm.done)
+
+	failed := false
+
+	for {
+		pm.lock.Lock()
+		wait := pm.granted / 2
+
+		if wait <= 0 {
+			wait = pm.lifetime / 2
+		}
+		pm.lock.Unlock()
+
+		if failed && wait > MapRetry {
+			wait = MapRetry
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-pm.closed:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), mapTimeout)
+		err := pm.mapPort(ctx)
+		cancel()
+
+		failed = err != nil
+
+		if failed {
+			log.Error("Failed to renew port mapping: ", err.Error())
+		}
+	}
+}
+
+// Stops renewing the mapping and removes it from the gateway.
+func (pm *PortMapper) Close() error {
+	select {
+	case <-pm.closed:
+		return nil
+	default:
+		close(pm.closed)
+	}
+
+	<-pm.done
+
+	pm.lock.Lock()
+	gw, external := pm.gateway, pm.external
+	pm.lock.Unlock()
+
+	if gw == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	log.WithField("gateway", gw.String()).Info("Removing port mapping")
+
+	return gw.DeleteMapping(ctx, pm.port, external)
+}
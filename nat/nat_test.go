@@ -0,0 +1,437 @@
+package nat
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var externalIP = net.IPv4(203, 0, 113, 7)
+
+// Records the TCP mappings a fake gateway has been asked for, internal port to
+// external port.
+type fakeMappings struct {
+	lock     sync.Mutex
+	mappings map[int]int
+	requests int
+}
+
+func newFakeMappings() *fakeMappings {
+	return &fakeMappings{mappings: make(map[int]int)}
+}
+
+func (fm *fakeMappings) set(internal, external int) {
+	fm.lock.Lock()
+	defer fm.lock.Unlock()
+
+	fm.requests++
+
+	if external == 0 {
+		delete(fm.mappings, internal)
+	} else {
+		fm.mappings[internal] = external
+	}
+}
+
+func (fm *fakeMappings) get(internal int) (int, int) {
+	fm.lock.Lock()
+	defer fm.lock.Unlock()
+
+	return fm.mappings[internal], fm.requests
+}
+
+// Answers NAT-PMP requests, and PCP ones if pcp is set. Mappings are granted on
+// the port after the one asked for, to check that the gateway's choice is used.
+func fakePMP(t *testing.T, pcp bool, lifetime uint32) (string, *fakeMappings) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	fm := newFakeMappings()
+
+	go func() {
+		buf := make([]byte, 1100)
+
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+
+			if err != nil {
+				return
+			}
+
+			req := buf[:n]
+			var res []byte
+
+			switch {
+			case req[0] == pcpVersion && pcp && n == 60:
+				res = make([]byte, 60)
+				res[0] = pcpVersion
+				res[1] = req[1] | 0x80
+				copy(res[24:], req[24:40])
+
+				internal := int(binary.BigEndian.Uint16(req[40:]))
+
+				if binary.BigEndian.Uint32(req[4:]) == 0 {
+					fm.set(internal, 0)
+				} else {
+					fm.set(internal, internal+1)
+					binary.BigEndian.PutUint32(res[4:], lifetime)
+					binary.BigEndian.PutUint16(res[42:], uint16(internal+1))
+					copy(res[44:], externalIP.To16())
+				}
+
+			case req[0] != pmpVersion:
+				// unsupported version
+				res = []byte{pmpVersion, req[1] | 0x80, 0, 1, 0, 0, 0, 0}
+
+			case req[1] == pmpOpExternal:
+				res = make([]byte, 12)
+				res[1] = 0x80
+				copy(res[8:], externalIP.To4())
+
+			case req[1] == pmpOpMapTCP:
+				res = make([]byte, 16)
+				res[1] = req[1] | 0x80
+
+				internal := int(binary.BigEndian.Uint16(req[4:]))
+				copy(res[8:10], req[4:6])
+
+				if binary.BigEndian.Uint32(req[8:]) == 0 {
+					fm.set(internal, 0)
+				} else {
+					fm.set(internal, internal+1)
+					binary.BigEndian.PutUint16(res[10:], uint16(internal+1))
+					binary.BigEndian.PutUint32(res[12:], lifetime)
+				}
+			}
+
+			conn.WriteTo(res, addr)
+		}
+	}()
+
+	return conn.LocalAddr().String(), fm
+}
+
+func TestNATPMP(t *testing.T) {
+	addr, fm := fakePMP(t, false, 3600)
+	gw := NewNATPMP(addr)
+	ctx := context.Background()
+
+	ip, err := gw.ExternalIP(ctx)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !ip.Equal(externalIP) {
+		t.Fatal("Wrong external IP ", ip)
+	}
+
+	external, granted, err := gw.AddMapping(ctx, 5050, 5050, time.Hour)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if external != 5051 || granted != time.Hour {
+		t.Fatal("Mapping was not the one the gateway chose")
+	}
+
+	if err := gw.DeleteMapping(ctx, 5050, external); err != nil {
+		t.Fatal(err)
+	}
+
+	if mapped, _ := fm.get(5050); mapped != 0 {
+		t.Fatal("Mapping was not deleted")
+	}
+}
+
+func TestPCP(t *testing.T) {
+	addr, fm := fakePMP(t, true, 3600)
+	gw := NewPCP(addr)
+	ctx := context.Background()
+
+	if _, err := gw.ExternalIP(ctx); err != ErrNoExternalIP {
+		t.Fatal("PCP knew its external IP before mapping anything")
+	}
+
+	external, _, err := gw.AddMapping(ctx, 5050, 5050, time.Hour)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mapped, _ := fm.get(5050); external != 5051 || mapped != 5051 {
+		t.Fatal("Mapping was not the one the gateway chose")
+	}
+
+	ip, err := gw.ExternalIP(ctx)
+
+	if err != nil || !ip.Equal(externalIP) {
+		t.Fatal("Wrong external IP ", ip, err)
+	}
+
+	if err := gw.DeleteMapping(ctx, 5050, external); err != nil {
+		t.Fatal(err)
+	}
+
+	if mapped, _ := fm.get(5050); mapped != 0 {
+		t.Fatal("Mapping was not deleted")
+	}
+}
+
+func TestPCPUnsupported(t *testing.T) {
+	addr, _ := fakePMP(t, false, 3600)
+
+	_, _, err := NewPCP(addr).AddMapping(context.Background(), 5050, 5050, time.Hour)
+
+	if err != errPCPUnsupported {
+		t.Fatal("Expected PCP to be unsupported, got ", err)
+	}
+}
+
+// An internet gateway device, found with SSDP and controlled over HTTP.
+func fakeUPnP(t *testing.T, permanentOnly bool) (string, *fakeMappings) {
+	fm := newFakeMappings()
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/desc.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+<deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+<deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+<serviceList><service>
+<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+<controlURL>/control</controlURL>
+</service></serviceList>
+</device></deviceList>
+</device></deviceList>
+</device>
+</root>`)
+	})
+
+	mux.HandleFunc("/control", func(w http.ResponseWriter, r *http.Request) {
+		action := r.Header.Get("SOAPAction")
+		body, _ := ioutil.ReadAll(r.Body)
+
+		var args struct {
+			Internal int `xml:"Body>AddPortMapping>NewInternalPort"`
+			External int `xml:"Body>AddPortMapping>NewExternalPort"`
+			Lease    int `xml:"Body>AddPortMapping>NewLeaseDuration"`
+			Delete   int `xml:"Body>DeletePortMapping>NewExternalPort"`
+		}
+
+		if err := xml.Unmarshal(body, &args); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		fault := func(code int) {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>Nope</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`, code)
+		}
+
+		switch {
+		case strings.HasSuffix(action, `#GetExternalIPAddress"`):
+			fmt.Fprintf(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1"><NewExternalIPAddress>%s</NewExternalIPAddress></u:GetExternalIPAddressResponse></s:Body></s:Envelope>`, externalIP)
+
+		case strings.HasSuffix(action, `#AddPortMapping"`):
+			if permanentOnly && args.Lease != 0 {
+				fault(upnpOnlyPermanent)
+				return
+			}
+
+			// the port asked for is taken by someone else
+			if args.External == args.Internal {
+				fault(upnpConflict)
+				return
+			}
+
+			fm.set(args.Internal, args.External)
+
+		case strings.HasSuffix(action, `#DeletePortMapping"`):
+			// everything is mapped one port up, as the one asked for is taken
+			fm.set(args.Delete-1, 0)
+
+		default:
+			fault(401)
+		}
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 2048)
+
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+
+			if err != nil {
+				return
+			}
+
+			if !strings.HasPrefix(string(buf[:n]), "M-SEARCH") {
+				continue
+			}
+
+			conn.WriteTo([]byte("HTTP/1.1 200 OK\r\n"+
+				"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n"+
+				"LOCATION: "+server.URL+"/desc.xml\r\n\r\n"), addr)
+		}
+	}()
+
+	return conn.LocalAddr().String(), fm
+}
+
+func TestUPnP(t *testing.T) {
+	for _, permanent := range []bool{false, true} {
+		addr, fm := fakeUPnP(t, permanent)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+
+		gw, err := DiscoverUPnP(ctx, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ip, err := gw.ExternalIP(ctx)
+
+		if err != nil || !ip.Equal(externalIP) {
+			t.Fatal("Wrong external IP ", ip, err)
+		}
+
+		external, granted, err := gw.AddMapping(ctx, 5050, 5050, time.Hour)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if mapped, _ := fm.get(5050); external != 5051 || mapped != 5051 {
+			t.Fatal("Taken port was not skipped")
+		}
+
+		if permanent && granted != 0 {
+			t.Fatal("Expected a permanent mapping")
+		}
+
+		if err := gw.DeleteMapping(ctx, 5050, external); err != nil {
+			t.Fatal(err)
+		}
+
+		if mapped, _ := fm.get(5050); mapped != 0 {
+			t.Fatal("Mapping was not deleted")
+		}
+	}
+}
+
+// A gateway that is not there, so that the mapper has to move on.
+type deadGateway struct{}
+
+func (deadGateway) AddMapping(context.Context, int, int, time.Duration) (int, time.Duration, error) {
+	return 0, 0, ErrNoGateway
+}
+
+func (deadGateway) DeleteMapping(context.Context, int, int) error { return ErrNoGateway }
+func (deadGateway) ExternalIP(context.Context) (net.IP, error)    { return nil, ErrNoGateway }
+func (deadGateway) String() string                                { return "dead" }
+
+func TestPortMapper(t *testing.T) {
+	// leases of a second are renewed every half a second
+	addr, fm := fakePMP(t, false, 1)
+	pmp := NewNATPMP(addr)
+
+	mapper := NewPortMapper(5050, time.Second, []Gateway{deadGateway{}, pmp})
+	changes := make(chan int, 10)
+
+	mapper.OnChange(func(ip net.IP, external int) {
+		if !ip.Equal(externalIP) {
+			t.Error("Wrong external IP ", ip)
+		}
+
+		changes <- external
+	})
+
+	if err := mapper.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if mapper.Gateway() != pmp {
+		t.Fatal("Mapper did not fall back to the working gateway")
+	}
+
+	if external := <-changes; external != 5051 {
+		t.Fatal("Wrong external port ", external)
+	}
+
+	time.Sleep(time.Millisecond * 1200)
+
+	if _, requests := fm.get(5050); requests < 2 {
+		t.Fatal("Mapping was not renewed")
+	}
+
+	if err := mapper.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if mapped, _ := fm.get(5050); mapped != 0 {
+		t.Fatal("Mapping was not removed on close")
+	}
+
+	if len(changes) != 0 {
+		t.Fatal("Renewing the same mapping counted as a change")
+	}
+}
+
+func TestNoGateway(t *testing.T) {
+	mapper := NewPortMapper(5050, time.Hour, []Gateway{deadGateway{}})
+
+	if err := mapper.Start(context.Background()); err != ErrNoGateway {
+		t.Fatal("Expected no gateway, got ", err)
+	}
+
+	if err := mapper.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIsPublic(t *testing.T) {
+	for ip, public := range map[string]bool{
+		"203.0.113.7": true,
+		"8.8.8.8":     true,
+		"192.168.1.1": false,
+		"10.1.2.3":    false,
+		"100.64.0.1":  false,
+		"127.0.0.1":   false,
+	} {
+		if IsPublic(net.ParseIP(ip)) != public {
+			t.Error(ip, " should be public: ", public)
+		}
+	}
+}
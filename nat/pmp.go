@@ -0,0 +1,271 @@
+// NAT-PMP (RFC 6886) and its successor PCP (RFC 6887), which gateways answer on
+// the same UDP port.
+
+package nat
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const PMPPort = 5351
+
+const (
+	pmpVersion = 0
+	pcpVersion = 2
+
+	pmpOpExternal = 0
+	pmpOpMapTCP   = 2
+	pcpOpMap      = 1
+
+	pcpProtoTCP = 6
+
+	// requests are retried this many times, waiting twice as long each time
+	pmpTries        = 4
+	pmpRetryInitial = time.Millisecond * 250
+)
+
+var errPCPUnsupported = errors.New("Gateway does not support PCP")
+
+// A result code other than success from NAT-PMP or PCP.
+type pmpError struct {
+	protocol string
+	code     int
+}
+
+func (e pmpError) Error() string {
+	return fmt.Sprintf("%s request failed with result code %d", e.protocol, e.code)
+}
+
+// Sends req to addr until a reply that check accepts comes back, retrying as the
+// RFCs say to.
+func pmpRequest(ctx context.Context, addr string, req []byte, check func([]byte) bool) ([]byte, error) {
+	conn, err := net.Dial("udp", addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	buf := make([]byte, 1100)
+	wait := pmpRetryInitial
+
+	for i := 0; i < pmpTries; i++ {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		_, err = conn.Write(req)
+
+		if err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(wait)
+
+		if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+			deadline = dl
+		}
+
+		conn.SetReadDeadline(deadline)
+
+		for {
+			n, err := conn.Read(buf)
+
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+
+			// nothing is listening, so no point trying again
+			if err != nil {
+				return nil, err
+			}
+
+			if check(buf[:n]) {
+				return buf[:n], nil
+			}
+		}
+
+		wait *= 2
+	}
+
+	return nil, errors.New("Gateway did not reply")
+}
+
+type natPMP struct {
+	addr string
+}
+
+// A NAT-PMP gateway at addr, usually the default gateway on PMPPort.
+func NewNATPMP(addr string) Gateway {
+	return &natPMP{addr}
+}
+
+func (np *natPMP) String() string {
+	return "NAT-PMP " + np.addr
+}
+
+func (np *natPMP) request(ctx context.Context, req []byte, size int) ([]byte, error) {
+	res, err := pmpRequest(ctx, np.addr, req, func(res []byte) bool {
+		return len(res) >= size && res[0] == pmpVersion && res[1] == req[1]|0x80
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if code := binary.BigEndian.Uint16(res[2:]); code != 0 {
+		return nil, pmpError{"NAT-PMP", int(code)}
+	}
+
+	return res, nil
+}
+
+func (np *natPMP) ExternalIP(ctx context.Context) (net.IP, error) {
+	res, err := np.request(ctx, []byte{pmpVersion, pmpOpExternal}, 12)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return net.IPv4(res[8], res[9], res[10], res[11]), nil
+}
+
+func (np *natPMP) AddMapping(ctx context.Context, internal, external int, lifetime time.Duration) (int, time.Duration, error) {
+	return np.mapping(ctx, internal, external, uint32(lifetime/time.Second))
+}
+
+// Mappings are deleted by asking for one with no lifetime.
+func (np *natPMP) DeleteMapping(ctx context.Context, internal, external int) error {
+	_, _, err := np.mapping(ctx, internal, 0, 0)
+
+	return err
+}
+
+func (np *natPMP) mapping(ctx context.Context, internal, external int, lifetime uint32) (int, time.Duration, error) {
+	req := make([]byte, 12)
+	req[0] = pmpVersion
+	req[1] = pmpOpMapTCP
+	binary.BigEndian.PutUint16(req[4:], uint16(internal))
+	binary.BigEndian.PutUint16(req[6:], uint16(external))
+	binary.BigEndian.PutUint32(req[8:], lifetime)
+
+	res, err := np.request(ctx, req, 16)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	mapped := int(binary.BigEndian.Uint16(res[10:]))
+	granted := time.Duration(binary.BigEndian.Uint32(res[12:])) * time.Second
+
+	return mapped, granted, nil
+}
+
+type pcp struct {
+	addr string
+
+	// the same nonce must be used to renew or delete a mapping
+	nonce [12]byte
+
+	lock     sync.Mutex
+	external net.IP
+}
+
+// A PCP gateway at addr, usually the default gateway on PMPPort.
+func NewPCP(addr string) Gateway {
+	ret := &pcp{addr: addr}
+	rand.Read(ret.nonce[:])
+
+	return ret
+}
+
+func (p *pcp) String() string {
+	return "PCP " + p.addr
+}
+
+// PCP has no request for the external IP, it comes back with each mapping.
+func (p *pcp) ExternalIP(ctx context.Context) (net.IP, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.external == nil {
+		return nil, ErrNoExternalIP
+	}
+
+	return p.external, nil
+}
+
+func (p *pcp) AddMapping(ctx context.Context, internal, external int, lifetime time.Duration) (int, time.Duration, error) {
+	return p.mapping(ctx, internal, external, uint32(lifetime/time.Second))
+}
+
+func (p *pcp) DeleteMapping(ctx context.Context, internal, external int) error {
+	_, _, err := p.mapping(ctx, internal, 0, 0)
+
+	return err
+}
+
+// Sends a MAP request, which has to include the IP we talk to the gateway from.
+func (p *pcp) mapping(ctx context.Context, internal, external int, lifetime uint32) (int, time.Duration, error) {
+	client, err := localIP(p.addr)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	req := make([]byte, 60)
+	req[0] = pcpVersion
+	req[1] = pcpOpMap
+	binary.BigEndian.PutUint32(req[4:], lifetime)
+	copy(req[8:24], client.To16())
+
+	copy(req[24:36], p.nonce[:])
+	req[36] = pcpProtoTCP
+	binary.BigEndian.PutUint16(req[40:], uint16(internal))
+	binary.BigEndian.PutUint16(req[42:], uint16(external))
+	copy(req[44:60], net.IPv4zero.To16())
+
+	unsupported := false
+
+	res, err := pmpRequest(ctx, p.addr, req, func(res []byte) bool {
+		// NAT-PMP gateways reply to versions they do not know with their own
+		if len(res) >= 4 && res[0] == pmpVersion {
+			unsupported = true
+			return true
+		}
+
+		return len(res) >= 60 && res[0] == pcpVersion && res[1] == pcpOpMap|0x80 &&
+			string(res[24:36]) == string(p.nonce[:])
+	})
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if unsupported {
+		return 0, 0, errPCPUnsupported
+	}
+
+	if res[3] != 0 {
+		return 0, 0, pmpError{"PCP", int(res[3])}
+	}
+
+	granted := time.Duration(binary.BigEndian.Uint32(res[4:])) * time.Second
+	mapped := int(binary.BigEndian.Uint16(res[42:]))
+
+	if lifetime != 0 {
+		p.lock.Lock()
+		p.external = net.IP(append([]byte{}, res[44:60]...))
+		p.lock.Unlock()
+	}
+
+	return mapped, granted, nil
+}
@@ -0,0 +1,376 @@
+// UPnP Internet Gateway Devices. They are found by multicasting an SSDP search,
+// then controlled with SOAP requests to the WANIPConnection (or, on DSL routers,
+// WANPPPConnection) service in their device description.
+
+package nat
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const SSDPAddr = "239.255.255.250:1900"
+
+// How long to wait for gateways to answer a search.
+const SSDPTimeout = time.Second * 2
+
+// UPnP error codes that we work around.
+const (
+	upnpConflict      = 718
+	upnpOnlyPermanent = 725
+)
+
+const (
+	upnpDescription = "zif"
+	upnpMaxResponse = 1024 * 1024
+
+	// if the port is taken, say by another peer on the same network, this many
+	// ports after it are tried too
+	upnpConflictTries = 8
+)
+
+var upnpDeviceTypes = []string{
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:2",
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+}
+
+var upnpServiceTypes = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+type upnpDevice struct {
+	Services []upnpService `xml:"serviceList>service"`
+	Devices  []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpRoot struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+// Finds the first service of one of the given types on a device, or any of the
+// devices inside it.
+func (d upnpDevice) find(types []string) (upnpService, bool) {
+	for _, t := range types {
+		for _, i := range d.Services {
+			if i.ServiceType == t {
+				return i, true
+			}
+		}
+	}
+
+	for _, i := range d.Devices {
+		if s, ok := i.find(types); ok {
+			return s, true
+		}
+	}
+
+	return upnpService{}, false
+}
+
+// An error from a UPnP action, as a SOAP fault.
+type upnpError struct {
+	Code        int    `xml:"Body>Fault>detail>UPnPError>errorCode"`
+	Description string `xml:"Body>Fault>detail>UPnPError>errorDescription"`
+}
+
+func (e *upnpError) Error() string {
+	return fmt.Sprintf("UPnP error %d: %s", e.Code, e.Description)
+}
+
+type upnp struct {
+	control     string
+	serviceType string
+
+	// the IP the gateway sees us as
+	local net.IP
+
+	http *http.Client
+}
+
+// Searches for a gateway by sending an SSDP search to addr, usually SSDPAddr,
+// and using the first one that answers with a usable service.
+func DiscoverUPnP(ctx context.Context, addr string) (Gateway, error) {
+	remote, err := net.ResolveUDPAddr("udp4", addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenPacket("udp4", ":0")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	for _, i := range upnpDeviceTypes {
+		search := "M-SEARCH * HTTP/1.1\r\n" +
+			"HOST: " + SSDPAddr + "\r\n" +
+			"ST: " + i + "\r\n" +
+			"MAN: \"ssdp:discover\"\r\n" +
+			"MX: 2\r\n\r\n"
+
+		_, err = conn.WriteTo([]byte(search), remote)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	deadline := time.Now().Add(SSDPTimeout)
+
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+
+	conn.SetReadDeadline(deadline)
+	buf := make([]byte, 2048)
+	tried := make(map[string]bool)
+
+	for {
+		n, _, err := conn.ReadFrom(buf)
+
+		if err != nil {
+			return nil, errors.New("No UPnP gateway found")
+		}
+
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+
+		if err != nil {
+			continue
+		}
+
+		location := res.Header.Get("Location")
+
+		if location == "" || tried[location] {
+			continue
+		}
+
+		tried[location] = true
+		gw, err := newUPnP(ctx, location)
+
+		if err == nil {
+			return gw, nil
+		}
+	}
+}
+
+// Reads the device description at location, and finds the service to control.
+func newUPnP(ctx context.Context, location string) (*upnp, error) {
+	base, err := url.Parse(location)
+
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: time.Second * 10}
+	req, err := http.NewRequest("GET", location, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := client.Do(req.WithContext(ctx))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	var root upnpRoot
+	err = xml.NewDecoder(io.LimitReader(res.Body, upnpMaxResponse)).Decode(&root)
+
+	if err != nil {
+		return nil, err
+	}
+
+	service, ok := root.Device.find(upnpServiceTypes)
+
+	if !ok {
+		return nil, errors.New("Device is not an internet gateway")
+	}
+
+	if root.URLBase != "" {
+		if b, err := url.Parse(root.URLBase); err == nil {
+			base = b
+		}
+	}
+
+	control, err := base.Parse(service.ControlURL)
+
+	if err != nil {
+		return nil, err
+	}
+
+	host := control.Host
+
+	if control.Port() == "" {
+		host = net.JoinHostPort(control.Hostname(), "80")
+	}
+
+	local, err := localIP(host)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &upnp{
+		control:     control.String(),
+		serviceType: service.ServiceType,
+		local:       local,
+		http:        client,
+	}, nil
+}
+
+func (u *upnp) String() string {
+	return "UPnP " + u.control
+}
+
+// Performs an action on the service, decoding the response into ret if it is
+// not nil.
+func (u *upnp) soap(ctx context.Context, action string, args [][2]string, ret interface{}) error {
+	var body bytes.Buffer
+
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:` + action + ` xmlns:u="` + u.serviceType + `">`)
+
+	for _, i := range args {
+		body.WriteString("<" + i[0] + ">")
+		xml.EscapeText(&body, []byte(i[1]))
+		body.WriteString("</" + i[0] + ">")
+	}
+
+	body.WriteString(`</u:` + action + `></s:Body></s:Envelope>`)
+
+	req, err := http.NewRequest("POST", u.control, &body)
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+u.serviceType+"#"+action+`"`)
+
+	res, err := u.http.Do(req.WithContext(ctx))
+
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	dat, err := ioutil.ReadAll(io.LimitReader(res.Body, upnpMaxResponse))
+
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		fault := &upnpError{}
+
+		if xml.Unmarshal(dat, fault) == nil && fault.Code != 0 {
+			return fault
+		}
+
+		return errors.New("UPnP request failed: " + res.Status)
+	}
+
+	if ret == nil {
+		return nil
+	}
+
+	return xml.Unmarshal(dat, ret)
+}
+
+func (u *upnp) ExternalIP(ctx context.Context) (net.IP, error) {
+	var res struct {
+		IP string `xml:"Body>GetExternalIPAddressResponse>NewExternalIPAddress"`
+	}
+
+	err := u.soap(ctx, "GetExternalIPAddress", nil, &res)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(res.IP))
+
+	if ip == nil {
+		return nil, ErrNoExternalIP
+	}
+
+	return ip, nil
+}
+
+// Unlike NAT-PMP and PCP, UPnP gateways do not pick another port if the one asked
+// for is taken, so the next few are tried. Some gateways only allow mappings that
+// never expire, in which case one is asked for instead. Those are deleted on
+// shutdown all the same.
+func (u *upnp) AddMapping(ctx context.Context, internal, external int, lifetime time.Duration) (int, time.Duration, error) {
+	var err error
+
+	for i := 0; i < upnpConflictTries && external+i <= 65535; i++ {
+		err = u.addMapping(ctx, internal, external+i, lifetime)
+
+		if e, ok := err.(*upnpError); ok && e.Code == upnpOnlyPermanent {
+			lifetime = 0
+			err = u.addMapping(ctx, internal, external+i, lifetime)
+		}
+
+		if e, ok := err.(*upnpError); ok && e.Code == upnpConflict {
+			continue
+		}
+
+		if err != nil {
+			return 0, 0, err
+		}
+
+		return external + i, lifetime, nil
+	}
+
+	return 0, 0, err
+}
+
+func (u *upnp) addMapping(ctx context.Context, internal, external int, lifetime time.Duration) error {
+	return u.soap(ctx, "AddPortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(external)},
+		{"NewProtocol", "TCP"},
+		{"NewInternalPort", strconv.Itoa(internal)},
+		{"NewInternalClient", u.local.String()},
+		{"NewEnabled", "1"},
+		{"NewPortMappingDescription", upnpDescription},
+		{"NewLeaseDuration", strconv.Itoa(int(lifetime / time.Second))},
+	}, nil)
+}
+
+func (u *upnp) DeleteMapping(ctx context.Context, internal, external int) error {
+	return u.soap(ctx, "DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(external)},
+		{"NewProtocol", "TCP"},
+	}, nil)
+}
@@ -6,11 +6,10 @@
 package zif
 
 import (
-	"bytes"
+	"context"
 	"errors"
-	"fmt"
-	"math"
 	"net"
+	"path/filepath"
 	"time"
 
 	"github.com/hashicorp/yamux"
@@ -39,13 +38,23 @@ type Peer struct {
 	seed    bool
 	seedFor *dht.Entry
 
-	capabilities proto.MessageCapabilities
-	compression  string
+	capabilities     proto.MessageCapabilities
+	compression      string
+	compressionStats proto.CompressionStats
+	pieceFormat      string
 
 	addSeedManager func(dht.Address) error
 	addSeeding     func(dht.Entry) error
 	addEntry       func(dht.Entry) error
 	updateSeen     func()
+	penalise       func(int, string)
+}
+
+// Adds penalty points to the peer for misbehaving, see proto.Reputation.
+func (p *Peer) Penalise(points int, reason string) {
+	if p.penalise != nil {
+		p.penalise(points, reason)
+	}
 }
 
 func (p *Peer) UpdateSeen() {
@@ -70,7 +79,8 @@ func (p *Peer) Streams() *proto.StreamManager {
 	return &p.streams
 }
 
-func (p *Peer) Ping(timeOut time.Duration) (time.Duration, error) {
+// Pings the peer over its session, giving up once ctx is done.
+func (p *Peer) Ping(ctx context.Context) (time.Duration, error) {
 	type timeErr struct {
 		t   time.Duration
 		err error
@@ -86,9 +96,8 @@ func (p *Peer) Ping(timeOut time.Duration) (time.Duration, error) {
 		return -1, errors.New("Session closed")
 	}
 
-	timer := time.NewTimer(timeOut)
-
-	ret := make(chan timeErr)
+	// buffered so the goroutine can always finish, even if nobody is waiting
+	ret := make(chan timeErr, 1)
 
 	go func() {
 		t, err := session.Ping()
@@ -99,28 +108,26 @@ func (p *Peer) Ping(timeOut time.Duration) (time.Duration, error) {
 	case ping := <-ret:
 		return ping.t, ping.err
 
-	case _ = <-timer.C:
-		return -1, errors.New("Timeout")
+	case <-ctx.Done():
+		return -1, ctx.Err()
 	}
 }
 
-func (p *Peer) Announce(lp *LocalPeer) error {
-	_, err := p.Ping(time.Second * 10)
-	if err != nil {
-		return err
-	}
-
+func (p *Peer) Announce(ctx context.Context, lp *LocalPeer) error {
 	log.WithField("peer", p.Address().StringOr("")).Debug("Sending announce")
 
-	if lp.Entry.PublicAddress == "" {
+	if entry := lp.CopyEntry(); entry.PublicAddress == "" && len(entry.Endpoints) == 0 {
 		log.Debug("Local peer public address is nil, attempting to fetch")
 		ip := ExternalIp()
 		log.Debug("External IP is ", ip)
-		lp.Entry.PublicAddress = ip
+
+		if err := lp.SetPublicAddress(ip, entry.Port); err != nil {
+			return err
+		}
 	}
 	lp.SignEntry()
 
-	stream, err := p.OpenStream()
+	stream, err := p.OpenStream(ctx)
 
 	if err != nil {
 		return err
@@ -128,21 +135,69 @@ func (p *Peer) Announce(lp *LocalPeer) error {
 
 	defer stream.Close()
 
-	err = stream.Announce(lp.Entry)
+	// the entry itself, a localEntry would be encoded as an empty struct
+	entry := lp.CopyEntry()
+	err = stream.Announce(ctx, &entry)
 
 	return err
 }
 
-func (p *Peer) Connect(addr string, lp *LocalPeer) error {
-	log.WithField("address", addr).Debug("Connecting")
+// Dials the peer at endpoint with whichever of our transports takes its type,
+// then handshakes.
+func (p *Peer) Connect(ctx context.Context, endpoint dht.Endpoint, lp *LocalPeer) error {
+	log.WithField("endpoint", endpoint.String()).Debug("Connecting")
 
-	pair, err := p.streams.OpenTCP(addr, lp, lp.Entry)
+	conn, err := lp.Transports.Dial(ctx, endpoint)
 
 	if err != nil {
 		return err
 	}
 
+	return p.ConnectConn(ctx, conn, lp)
+}
+
+// Connects to the peer at addr through relay, which must be connected to it
+// already. The handshake is with the peer itself, the relay only passes it on.
+func (p *Peer) Relay(ctx context.Context, relay *Peer, addr dht.Address, lp *LocalPeer) error {
+	log.WithFields(log.Fields{
+		"peer":  addr.StringOr(""),
+		"relay": relay.Address().StringOr(""),
+	}).Debug("Connecting through relay")
+
+	stream, err := relay.OpenStream(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	conn, err := stream.RelayConnect(ctx, *relay.Address(), addr)
+
+	if err != nil {
+		stream.Close()
+		return err
+	}
+
+	return p.ConnectConn(ctx, conn, lp)
+}
+
+// Handshakes with the peer over a connection that has been opened some other
+// way, such as a circuit through a relay.
+func (p *Peer) ConnectConn(ctx context.Context, conn net.Conn, lp *LocalPeer) error {
+	pair, err := p.streams.OpenConn(ctx, conn, lp, localEntry{lp})
+
+	if err != nil {
+		return err
+	}
+
+	p.connected(pair, lp)
+
+	return nil
+}
+
+func (p *Peer) connected(pair *proto.ConnHeader, lp *LocalPeer) {
 	p.SetCapabilities(pair.Capabilities)
+	p.compression = proto.ChooseCompression(*lp.GetCapabilities(), pair.Capabilities)
+	p.pieceFormat = proto.ChoosePieceFormat(*lp.GetCapabilities(), pair.Capabilities)
 	p.publicKey = pair.Entry.PublicKey
 	p.address = pair.Entry.Address
 
@@ -150,8 +205,6 @@ func (p *Peer) Connect(addr string, lp *LocalPeer) error {
 	p.limiter.Setup()
 
 	lp.DHT.Insert(pair.Entry)
-
-	return nil
 }
 
 func (p *Peer) SetTCP(header proto.ConnHeader) {
@@ -188,22 +241,39 @@ func (p *Peer) Terminate() {
 	p.streams.Close()
 }
 
-func (p *Peer) OpenStream() (*proto.Client, error) {
-	_, err := p.Ping(time.Second * 10)
+// Opens a new stream to the peer, making sure the session is still alive first.
+// The stream has the deadline of ctx, or StreamTimeout if it has none.
+func (p *Peer) OpenStream(ctx context.Context) (*proto.Client, error) {
+	_, err := p.Ping(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	p.UpdateSeen()
 
-	s, err := p.streams.OpenStream()
-	return s, err
+	s, err := p.streams.OpenStream(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.SetCompression(p.compression, &p.compressionStats)
+
+	return s, nil
 }
 
 func (p *Peer) AddStream(conn net.Conn) {
 	p.streams.AddStream(conn)
 }
 
+func (p *Peer) Limiter() *util.PeerLimiter {
+	return p.limiter
+}
+
+func (p *Peer) ShapeStream(conn net.Conn) net.Conn {
+	return p.streams.Shape(conn)
+}
+
 func (p *Peer) RemoveStream(conn net.Conn) {
 	p.streams.RemoveStream(conn)
 }
@@ -216,21 +286,16 @@ func (p *Peer) CloseStreams() {
 	p.streams.Close()
 }
 
-func (p *Peer) Entry() (*dht.Entry, error) {
+func (p *Peer) Entry(ctx context.Context) (*dht.Entry, error) {
 	if p.entry != nil {
 		return p.entry, nil
 	}
 
-	return p.GetEntry()
+	return p.GetEntry(ctx)
 }
 
-func (p *Peer) GetEntry() (*dht.Entry, error) {
-	_, err := p.Ping(time.Second * 10)
-	if err != nil {
-		return nil, err
-	}
-
-	e, err := p.Query(*p.Address())
+func (p *Peer) GetEntry(ctx context.Context) (*dht.Entry, error) {
+	e, err := p.Query(ctx, *p.Address())
 
 	if err != nil {
 		return nil, err
@@ -249,33 +314,40 @@ func (p *Peer) GetEntry() (*dht.Entry, error) {
 	return p.entry, nil
 }
 
-func (p *Peer) Bootstrap(d *dht.DHT) error {
-	_, err := p.Ping(time.Second * 10)
+func (p *Peer) Bootstrap(ctx context.Context, d *dht.DHT) error {
+	closest, err := p.FindClosest(ctx, d.Address())
+
 	if err != nil {
 		return err
 	}
 
-	stream, err := p.OpenStream()
+	self := d.Address()
 
-	if err != nil {
-		return err
-	}
+	// add them all to our routing table! :D
+	for _, i := range closest {
+		entry := i.(*dht.Entry)
 
-	defer stream.Close()
+		if entry.Address.Equals(&self) {
+			continue
+		}
 
-	return stream.Bootstrap(d, d.Address())
-}
+		_, err = d.Insert(*entry)
 
-func (p *Peer) Query(address dht.Address) (common.Verifier, error) {
-	_, err := p.Ping(time.Second * 10)
-	if err != nil {
-		return nil, err
+		if err != nil {
+			return err
+		}
 	}
 
+	log.Info("Bootstrapped with ", len(closest), " new peers")
+
+	return nil
+}
+
+func (p *Peer) Query(ctx context.Context, address dht.Address) (common.Verifier, error) {
 	addressString, _ := address.String()
 	log.WithField("target", addressString).Info("Querying")
 
-	stream, err := p.OpenStream()
+	stream, err := p.OpenStream(ctx)
 
 	if err != nil {
 		return nil, err
@@ -283,21 +355,20 @@ func (p *Peer) Query(address dht.Address) (common.Verifier, error) {
 
 	defer stream.Close()
 
-	entry, err := stream.Query(address)
+	entry, err := stream.Query(ctx, address)
+
+	if _, ok := err.(*proto.InvalidEntryError); ok {
+		p.Penalise(proto.PenaltyBadEntry, err.Error())
+	}
 
 	return entry, err
 }
 
-func (p *Peer) FindClosest(address dht.Address) ([]common.Verifier, error) {
-	_, err := p.Ping(time.Second * 10)
-	if err != nil {
-		return nil, err
-	}
-
+func (p *Peer) FindClosest(ctx context.Context, address dht.Address) ([]common.Verifier, error) {
 	addressString, _ := address.String()
 	log.WithField("target", addressString).Info("Finding closest")
 
-	stream, err := p.OpenStream()
+	stream, err := p.OpenStream(ctx)
 
 	if err != nil {
 		return nil, err
@@ -305,26 +376,37 @@ func (p *Peer) FindClosest(address dht.Address) ([]common.Verifier, error) {
 
 	defer stream.Close()
 
-	res, err := stream.FindClosest(address)
+	res, err := stream.FindClosest(ctx, address)
 
 	ret := make([]common.Verifier, 0, len(res))
+	invalid := false
 
 	for _, i := range res {
+		if i == nil {
+			continue
+		}
+
+		if verr := i.Verify(); verr != nil {
+			log.WithField("address", i.Address.StringOr("")).Error("Bad peer, entry not valid: ", verr.Error())
+			invalid = true
+
+			continue
+		}
+
 		ret = append(ret, i)
 	}
 
+	if invalid {
+		p.Penalise(proto.PenaltyBadEntry, "Sent an invalid entry")
+	}
+
 	return ret, err
 }
 
 // asks a peer to query its database and return the results
-func (p *Peer) Search(search string, page int) (*data.SearchResult, error) {
-	_, err := p.Ping(time.Second * 10)
-	if err != nil {
-		return nil, err
-	}
-
+func (p *Peer) Search(ctx context.Context, search string, page int) (*data.SearchResult, error) {
 	log.WithField("peer", p.Address().StringOr("")).Info("Searching")
-	stream, err := p.OpenStream()
+	stream, err := p.OpenStream(ctx)
 
 	if err != nil {
 		return nil, err
@@ -332,7 +414,7 @@ func (p *Peer) Search(search string, page int) (*data.SearchResult, error) {
 
 	defer stream.Close()
 
-	posts, err := stream.Search(search, page)
+	posts, err := stream.Search(ctx, search, page)
 	res := &data.SearchResult{
 		Posts:  posts,
 		Source: p.Address().StringOr(""),
@@ -345,13 +427,23 @@ func (p *Peer) Search(search string, page int) (*data.SearchResult, error) {
 	return res, nil
 }
 
-func (p *Peer) Recent(page int) ([]*data.Post, error) {
-	_, err := p.Ping(time.Second * 10)
+func (p *Peer) Recent(ctx context.Context, page int) ([]*data.Post, error) {
+	stream, err := p.OpenStream(ctx)
+
 	if err != nil {
 		return nil, err
 	}
 
-	stream, err := p.OpenStream()
+	defer stream.Close()
+
+	posts, err := stream.Recent(ctx, page)
+
+	return posts, err
+
+}
+
+func (p *Peer) Popular(ctx context.Context, page int) ([]*data.Post, error) {
+	stream, err := p.OpenStream(ctx)
 
 	if err != nil {
 		return nil, err
@@ -359,46 +451,67 @@ func (p *Peer) Recent(page int) ([]*data.Post, error) {
 
 	defer stream.Close()
 
-	posts, err := stream.Recent(page)
+	posts, err := stream.Popular(ctx, page)
 
 	return posts, err
 
 }
 
-func (p *Peer) Popular(page int) ([]*data.Post, error) {
-	_, err := p.Ping(time.Second * 10)
-	if err != nil {
-		return nil, err
+var PostStreamUnsupported = errors.New("Peer does not support paging through posts")
+
+// Opens a stream and asks the peer for a page of posts, if it knows how to page.
+func (p *Peer) postPage(ctx context.Context, page func(*proto.Client) ([]*data.Post, []byte, error)) ([]*data.Post, []byte, error) {
+	if !proto.HasExtension(p.GetCapabilities(), proto.CapabilityPostStream) {
+		return nil, nil, PostStreamUnsupported
 	}
 
-	stream, err := p.OpenStream()
+	stream, err := p.OpenStream(ctx)
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	defer stream.Close()
 
-	posts, err := stream.Popular(page)
-
-	return posts, err
-
+	return page(stream)
 }
 
-func (p *Peer) Mirror(db *data.Database, lp dht.Address, onPiece chan int) error {
-	_, err := p.Ping(time.Second * 10)
+// Searches the peer a page at a time, see proto.Client.SearchPage.
+func (p *Peer) SearchPage(ctx context.Context, search string, cursor []byte, pageSize int) (*data.SearchResult, []byte, error) {
+	posts, next, err := p.postPage(ctx, func(stream *proto.Client) ([]*data.Post, []byte, error) {
+		return stream.SearchPage(ctx, search, cursor, pageSize)
+	})
+
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	pieces := make(chan *data.Piece, data.PieceSize)
-	defer close(onPiece)
+	return &data.SearchResult{Posts: posts, Source: p.Address().StringOr("")}, next, nil
+}
+
+func (p *Peer) RecentPage(ctx context.Context, cursor []byte, pageSize int) ([]*data.Post, []byte, error) {
+	return p.postPage(ctx, func(stream *proto.Client) ([]*data.Post, []byte, error) {
+		return stream.RecentPage(ctx, cursor, pageSize)
+	})
+}
+
+func (p *Peer) PopularPage(ctx context.Context, cursor []byte, pageSize int) ([]*data.Post, []byte, error) {
+	return p.postPage(ctx, func(stream *proto.Client) ([]*data.Post, []byte, error) {
+		return stream.PopularPage(ctx, cursor, pageSize)
+	})
+}
 
-	go db.InsertPieces(pieces, true)
+// Downloads the collection of the peer, or the peer it is seeding for, into db.
+// The collection and checkpoint are kept in dir. Pieces are fetched from this
+// peer and any seeds given at the same time.
+// Progress is checkpointed per piece, so if this fails or ctx is cancelled it can
+// be called again later and will pick up where it left off.
+func (p *Peer) Mirror(ctx context.Context, db *data.Database, dir string, onPiece chan int, seeds ...*Peer) error {
+	defer close(onPiece)
 
 	var entry *dht.Entry
 	if p.seed {
-		e, err := p.Query(p.seedFor.Address)
+		e, err := p.Query(ctx, p.seedFor.Address)
 
 		if err != nil {
 			return err
@@ -406,13 +519,13 @@ func (p *Peer) Mirror(db *data.Database, lp dht.Address, onPiece chan int) error
 
 		entry = e.(*dht.Entry)
 	} else {
-		_, err = p.GetEntry()
+		_, err := p.GetEntry(ctx)
 
 		if err != nil {
 			return err
 		}
 
-		entry, err = p.Entry()
+		entry, err = p.Entry(ctx)
 
 		if err != nil {
 			return err
@@ -423,10 +536,7 @@ func (p *Peer) Mirror(db *data.Database, lp dht.Address, onPiece chan int) error
 
 	log.WithField("peer", entry.Address.StringOr("")).Info("Mirroring")
 
-	if err != nil {
-		return err
-	}
-	stream, err := p.OpenStream()
+	stream, err := p.OpenStream(ctx)
 
 	if err != nil {
 		return err
@@ -434,7 +544,7 @@ func (p *Peer) Mirror(db *data.Database, lp dht.Address, onPiece chan int) error
 
 	defer stream.Close()
 
-	mcol, err := stream.Collection(entry.Address, *entry)
+	mcol, err := stream.Collection(ctx, entry.Address, *entry)
 
 	if err != nil {
 		return err
@@ -442,61 +552,41 @@ func (p *Peer) Mirror(db *data.Database, lp dht.Address, onPiece chan int) error
 
 	collection := data.Collection{HashList: mcol.HashList}
 
-	err = collection.Save(fmt.Sprintf("./data/%s/collection.dat", entry.Address.StringOr("err")))
+	err = collection.Save(filepath.Join(dir, "collection.dat"))
 
 	if err != nil {
 		return err
 	}
 
-	if int(db.PostCount()) == entry.PostCount {
-		return nil
-	}
-
-	currentStore := int(math.Ceil(float64(db.PostCount()) / float64(data.PieceSize)))
-
-	since := 0
-	if currentStore != 0 {
-		since = currentStore - 1
-	}
-
-	log.WithField("size", mcol.Size).Info("Downloading collection")
-
-	pieceStream, err := p.OpenStream()
+	checkpoint, err := data.OpenCheckpoint(filepath.Join(dir, "checkpoint.dat"))
 
 	if err != nil {
 		return err
 	}
 
-	defer pieceStream.Close()
+	defer checkpoint.Close()
 
-	piece_chan := pieceStream.Pieces(entry.Address, since, mcol.Size)
+	// nothing to fetch if we are up to date, but we still become a seed below
+	if len(checkpoint.Missing(mcol.HashList)) > 0 {
+		log.WithField("size", mcol.Size).Info("Downloading collection")
 
-	i := 0
-	for piece := range piece_chan {
-		log.Info(len(mcol.HashList))
-		hash := piece.Hash()
+		swarm := NewSwarm(entry.Address, mcol.HashList, db, checkpoint)
+		swarm.AddSource(p)
 
-		if !bytes.Equal(mcol.HashList[32*i:32*i+32], hash) {
-			return errors.New("Piece hash mismatch")
+		for _, i := range seeds {
+			swarm.AddSource(i)
 		}
 
-		onPiece <- i
+		err = swarm.Run(ctx, onPiece)
 
-		if len(pieces) == 100 {
-			log.Info("Piece buffer full, io is blocking")
+		if err != nil {
+			return err
 		}
-		pieces <- piece
 
-		i++
-	}
-
-	log.Info("Mirror complete, generating index")
-
-	if err != nil {
-		return err
+		log.Info("Mirror complete, generating index")
 	}
 
-	err = p.RequestAddPeer(*entry)
+	err = p.RequestAddPeer(ctx, *entry)
 
 	// we're done mirroring, so now we need to switch OFF the fact that this is
 	// a seed. If it becomes a seed again, it will be properly set by the
@@ -504,18 +594,11 @@ func (p *Peer) Mirror(db *data.Database, lp dht.Address, onPiece chan int) error
 	p.seed = false
 	p.seedFor = nil
 
-	pieces <- nil
-
 	return err
 }
 
-func (p *Peer) RequestAddPeer(entry dht.Entry) error {
-	_, err := p.Ping(time.Second * 10)
-	if err != nil {
-		return err
-	}
-
-	stream, err := p.OpenStream()
+func (p *Peer) RequestAddPeer(ctx context.Context, entry dht.Entry) error {
+	stream, err := p.OpenStream(ctx)
 
 	if err != nil {
 		return err
@@ -523,7 +606,7 @@ func (p *Peer) RequestAddPeer(entry dht.Entry) error {
 
 	defer stream.Close()
 
-	err = stream.RequestAddPeer(entry.Address)
+	err = stream.RequestAddPeer(ctx, entry.Address)
 	if err != nil {
 		return err
 	}
@@ -554,11 +637,12 @@ func (p *Peer) SetCapabilities(caps proto.MessageCapabilities) {
 	p.capabilities = caps
 }
 
-func (p *Peer) NewMessage(header string) *proto.Message {
-	ret := &proto.Message{
-		Header:      header,
-		Compression: p.compression,
-	}
+// The compression method used for messages sent to this peer.
+func (p *Peer) Compression() string {
+	return p.compression
+}
 
-	return ret
+// How well messages to and from this peer have compressed.
+func (p *Peer) CompressionStats() *proto.CompressionStats {
+	return &p.compressionStats
 }
@@ -1,17 +1,18 @@
 package zif
 
 import (
+	"context"
 	"database/sql"
 	"errors"
-	"fmt"
 	"io/ioutil"
+	"net"
 	"strconv"
 	"time"
 
-	"github.com/spf13/viper"
 	"github.com/streamrail/concurrent-map"
 	"github.com/zif/zif/data"
 	"github.com/zif/zif/dht"
+	"github.com/zif/zif/proto"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -19,6 +20,12 @@ import (
 const HeartbeatFrequency = time.Second * 30
 const AnnounceFrequency = time.Minute * 30
 
+// How many peers may be connected at once, unless told otherwise.
+const DefaultMaxPeers = 100
+
+// How long background requests to a peer are given before being abandoned.
+const PeerTimeout = time.Second * 10
+
 // errors
 
 var (
@@ -37,9 +44,15 @@ type PeerManager struct {
 	// A map of public address to Zif address
 	publicToZif  cmap.ConcurrentMap
 	seedManagers cmap.ConcurrentMap
+	// maps a peer address to when entries were last exchanged with it
+	exchanged cmap.ConcurrentMap
+
+	maxPeers int
+
+	// The endpoint types to dial, see dialer.go. Nil dials everything there is
+	// a transport for.
+	dial []string
 
-	socks     bool
-	socksPort int
 	localPeer *LocalPeer
 }
 
@@ -50,6 +63,8 @@ func NewPeerManager(lp *LocalPeer) *PeerManager {
 	ret.publicToZif = cmap.New()
 	ret.seedManagers = cmap.New()
 	ret.peerSeen = cmap.New()
+	ret.exchanged = cmap.New()
+	ret.maxPeers = DefaultMaxPeers
 	ret.localPeer = lp
 
 	return ret
@@ -72,7 +87,7 @@ func (pm *PeerManager) Peers() map[string]*Peer {
 // Given a direct address, for instance an IP or domain, connect to the peer there.
 // This can be used for something like bootstrapping, or for something like
 // connecting to a peer whose Zif address we have just resolved.
-func (pm *PeerManager) ConnectPeerDirect(addr string) (*Peer, error) {
+func (pm *PeerManager) ConnectPeerDirect(ctx context.Context, addr string) (*Peer, error) {
 	var peer *Peer
 	var err error
 
@@ -83,32 +98,59 @@ func (pm *PeerManager) ConnectPeerDirect(addr string) (*Peer, error) {
 		}
 	}
 
-	peer = &Peer{}
+	host, port, err := net.SplitHostPort(addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	portNum, err := strconv.Atoi(port)
 
-	if pm.socks {
-		peer.streams.Socks = true
-		peer.streams.SocksPort = pm.socksPort
+	if err != nil {
+		return nil, err
 	}
 
-	err = peer.Connect(addr, pm.localPeer)
+	peer, err = pm.dialEndpoint(ctx, dht.NewEndpoint(host, portNum))
 
 	if err != nil {
-		return nil, PeerUnreachable
+		return nil, err
 	}
 
+	return pm.connected(peer)
+}
+
+// Starts using a peer that has just been dialled, unless it turns out to be
+// banned, and exchanges entries with it.
+func (pm *PeerManager) connected(peer *Peer) (*Peer, error) {
+	if pm.localPeer.Server.Reputation().Banned(peer.Address(), proto.PeerIP(peer)) {
+		peer.Terminate()
+		return nil, proto.ErrBanned
+	}
+
+	// before anything the peer sends is handled, as handlers use them
+	pm.setCallbacks(peer)
+
 	peer.ConnectClient(pm.localPeer)
 
 	pm.SetPeer(peer)
 
+	go pm.exchangePeer(peer)
+
 	return peer, nil
 }
 
 // Resolved a Zif address into an entry, connects to the peer at the
 // PublicAddress in the Entry, then return it. The peer is also stored in a map.
-func (pm *PeerManager) ConnectPeer(addr dht.Address) (*Peer, *dht.Entry, error) {
+// Peers that cannot be reached directly are connected to through the relays in
+// their entry, if they have any.
+func (pm *PeerManager) ConnectPeer(ctx context.Context, addr dht.Address) (*Peer, *dht.Entry, error) {
+	return pm.connectPeer(ctx, addr, true)
+}
+
+func (pm *PeerManager) connectPeer(ctx context.Context, addr dht.Address, relay bool) (*Peer, *dht.Entry, error) {
 	var peer *Peer
 
-	entry, err := pm.Resolve(addr)
+	entry, err := pm.Resolve(ctx, addr)
 
 	if err != nil {
 		return nil, nil, err
@@ -122,6 +164,10 @@ func (pm *PeerManager) ConnectPeer(addr dht.Address) (*Peer, *dht.Entry, error)
 		return nil, nil, data.AddressResolutionError{Address: entry.Address.StringOr("")}
 	}
 
+	if pm.localPeer.Server.Reputation().Banned(&entry.Address, "") {
+		return nil, entry, proto.ErrBanned
+	}
+
 	if peer = pm.GetPeer(entry.Address); peer != nil {
 		return peer, entry, nil
 	}
@@ -134,7 +180,7 @@ func (pm *PeerManager) ConnectPeer(addr dht.Address) (*Peer, *dht.Entry, error)
 	// now should have an entry for the peer, connect to it!
 	log.WithField("address", entry.Address.StringOr("")).Debug("Connecting")
 
-	peer, err = pm.ConnectPeerDirect(entry.PublicAddress + ":" + strconv.Itoa(entry.Port))
+	peer, err = pm.connectEntry(ctx, entry, relay)
 
 	// Caller can go on to choose a seed to connect to, not quite the end of the
 	// world :P
@@ -144,9 +190,79 @@ func (pm *PeerManager) ConnectPeer(addr dht.Address) (*Peer, *dht.Entry, error)
 		return nil, entry, err
 	}
 
+	// whoever answered proved they own the key in the entry they sent, make sure
+	// that is actually the peer we wanted
+	if !peer.Address().Equals(&entry.Address) {
+		log.WithFields(log.Fields{
+			"wanted": entry.Address.StringOr(""),
+			"got":    peer.Address().StringOr(""),
+		}).Error("Connected to the wrong peer")
+
+		return nil, entry, PeerUnreachable
+	}
+
 	return peer, entry, nil
 }
 
+// Dials the endpoints in the entry that we can, falling back to its relays if
+// none of them work.
+func (pm *PeerManager) connectEntry(ctx context.Context, entry *dht.Entry, relay bool) (*Peer, error) {
+	types := pm.dialTypes()
+	endpoints := entry.AllEndpoints()
+
+	peer, err := pm.dialEndpoints(ctx, chooseEndpoints(endpoints, types))
+
+	if err == nil {
+		return pm.connected(peer)
+	}
+
+	if relays := chooseRelays(endpoints, types); err == PeerUnreachable && relay && len(relays) > 0 {
+		return pm.connectRelayed(ctx, entry.Address, relays)
+	}
+
+	return nil, err
+}
+
+// Connects to the peer at addr through each of its relays in turn, until one of
+// them works. Relays are only ever connected to directly, a relay that needs
+// relaying itself is no use.
+func (pm *PeerManager) connectRelayed(ctx context.Context, addr dht.Address, relays []dht.Address) (*Peer, error) {
+	for _, i := range relays {
+		if i.Equals(pm.localPeer.Address()) {
+			continue
+		}
+
+		relay, _, err := pm.connectPeer(ctx, i, false)
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			log.WithField("relay", i.StringOr("")).Info("Failed to connect to relay: ", err.Error())
+			continue
+		}
+
+		peer := &Peer{}
+		peer.streams.SetBandwidth(pm.localPeer.Bandwidth)
+
+		err = peer.Relay(ctx, relay, addr, pm.localPeer)
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			log.WithField("relay", i.StringOr("")).Info("Failed to connect through relay: ", err.Error())
+			continue
+		}
+
+		return pm.connected(peer)
+	}
+
+	return nil, PeerUnreachable
+}
+
 func (pm *PeerManager) GetPeer(addr dht.Address) *Peer {
 	peer, has := pm.peers.Get(string(addr.Raw))
 
@@ -157,13 +273,30 @@ func (pm *PeerManager) GetPeer(addr dht.Address) *Peer {
 	return peer.(*Peer)
 }
 
+// Gives a peer the callbacks its handlers use. They are read without a lock, so
+// this must be done before its streams are listened to.
+func (pm *PeerManager) setCallbacks(p *Peer) {
+	p.addSeedManager = pm.AddSeedManager
+	p.addEntry = pm.localPeer.AddEntry
+	p.addSeeding = pm.localPeer.AddSeeding
+	p.penalise = func(points int, reason string) {
+		pm.Penalise(p, points, reason)
+	}
+
+	p.updateSeen = func() {
+		pm.peerSeen.Set(string(p.Address().Raw), time.Now().UnixNano())
+	}
+}
+
 func (pm *PeerManager) SetPeer(p *Peer) {
 
 	if pm.peers.Has(string(p.Address().Raw)) {
 		return
 	}
 
-	e, err := p.Entry()
+	ctx, cancel := context.WithTimeout(context.Background(), PeerTimeout)
+	e, err := p.Entry(ctx)
+	cancel()
 
 	if err != nil {
 		log.Error(err.Error())
@@ -172,19 +305,11 @@ func (pm *PeerManager) SetPeer(p *Peer) {
 
 	pm.publicToZif.Set(e.PublicAddress, p.Address())
 
-	p.addSeedManager = pm.AddSeedManager
-	p.addEntry = pm.localPeer.AddEntry
-	p.addSeeding = pm.localPeer.AddSeeding
-
-	p.updateSeen = func() {
-		pm.peerSeen.Set(string(p.Address().Raw), time.Now().UnixNano())
-	}
-
 	pm.peers.Set(string(p.Address().Raw), p)
 	pm.peerSeen.Set(string(p.Address().Raw), time.Now().UnixNano())
 
 	// if we need to clear space for another, remove the least recently used one
-	for pm.peers.Count() > viper.GetInt("net.maxPeers") {
+	for pm.maxPeers > 0 && pm.peers.Count() > pm.maxPeers {
 
 		oldestKey := ""
 		oldestValue := int64(time.Now().UnixNano())
@@ -225,14 +350,27 @@ func (pm *PeerManager) SetPeer(p *Peer) {
 	go pm.announcePeer(p)
 }
 
+// Adds penalty points to a peer, disconnecting it if that gets it banned.
+func (pm *PeerManager) Penalise(p *Peer, points int, reason string) {
+	if !pm.localPeer.Server.Reputation().Penalise(p.Address(), proto.PeerIP(p), points, reason) {
+		return
+	}
+
+	log.WithField("peer", p.Address().StringOr("")).Info("Disconnecting banned peer")
+
+	p.Terminate()
+	pm.HandleCloseConnection(p.Address())
+}
+
 func (pm *PeerManager) HandleCloseConnection(addr *dht.Address) {
 	pm.peers.Remove(string(addr.Raw))
 	pm.peerSeen.Remove(string(addr.Raw))
+	pm.localPeer.reconnector.Disconnected(*addr)
 
-	sm, ok := pm.seedManagers.Get(string(addr.Raw))
+	sm, ok := pm.seedManagers.Pop(string(addr.Raw))
 
 	if ok {
-		sm.(*SeedManager).Close <- true
+		sm.(*SeedManager).Stop()
 	}
 }
 
@@ -252,9 +390,15 @@ func (pm *PeerManager) heartbeatPeer(p *Peer) {
 			return
 		}
 
-		log.WithField("peer", p.Address().StringOr("")).Debug("Sending heartbeat")
+		log.WithFields(log.Fields{
+			"peer":        p.Address().StringOr(""),
+			"compression": p.Compression(),
+			"ratio":       p.CompressionStats().Ratio(),
+		}).Debug("Sending heartbeat")
 		// allows for a suddenly slower connection, most requests have a lower timeout
-		_, err := p.Ping(HeartbeatFrequency)
+		ctx, cancel := context.WithTimeout(context.Background(), HeartbeatFrequency)
+		_, err := p.Ping(ctx)
+		cancel()
 
 		if err != nil {
 			log.WithField("peer", p.Address().StringOr("")).Info("Peer has no heartbeat, terminating")
@@ -281,7 +425,11 @@ func (pm *PeerManager) announcePeer(p *Peer) {
 		}
 
 		log.WithField("peer", p.Address().StringOr("")).Info("Announcing to peer")
-		err := p.Announce(pm.localPeer)
+
+		ctx, cancel := context.WithTimeout(context.Background(), PeerTimeout)
+		defer cancel()
+
+		err := p.Announce(ctx, pm.localPeer)
 
 		if err != nil {
 			return err
@@ -318,15 +466,32 @@ func (pm *PeerManager) AddSeedManager(addr dht.Address) error {
 		return err
 	}
 
-	pm.seedManagers.Set(string(addr.Raw), sm)
+	// another may have been added while this one was being made
+	if !pm.seedManagers.SetIfAbsent(string(addr.Raw), sm) {
+		return nil
+	}
+
 	sm.Start()
 
+	pm.localPeer.AddSticky(addr, StickySeed)
+
 	return nil
 }
 
+// Stops every seed manager, whether or not its peer is connected.
+func (pm *PeerManager) StopSeedManagers() {
+	for _, key := range pm.seedManagers.Keys() {
+		sm, ok := pm.seedManagers.Pop(key)
+
+		if ok {
+			sm.(*SeedManager).Stop()
+		}
+	}
+}
+
 func (pm *PeerManager) LoadSeeds() error {
 	log.Info("Loading seed list")
-	file, err := ioutil.ReadFile("./data/seeding.dat")
+	file, err := ioutil.ReadFile(pm.localPeer.DataPath("seeding.dat"))
 
 	if err != nil {
 		return err
@@ -351,11 +516,12 @@ func (pm *PeerManager) LoadSeeds() error {
 // Resolves a Zif address into an entry. Hopefully we already have the entry,
 // in which case it's just loaded from disk. Otherwise, recursive network
 // queries are made to try and find it.
-func (pm *PeerManager) Resolve(addr dht.Address) (*dht.Entry, error) {
+func (pm *PeerManager) Resolve(ctx context.Context, addr dht.Address) (*dht.Entry, error) {
 	log.WithField("address", addr.StringOr("")).Debug("Resolving")
 
 	if addr.Equals(pm.localPeer.Address()) {
-		return pm.localPeer.Entry, nil
+		entry := pm.localPeer.CopyEntry()
+		return &entry, nil
 	}
 
 	kv, err := pm.localPeer.DHT.Query(addr)
@@ -382,10 +548,10 @@ func (pm *PeerManager) Resolve(addr dht.Address) (*dht.Entry, error) {
 	depth := 6
 	for _, i := range closest {
 		// TODO: Goroutine this.
-		entry, err := pm.resolveStep(i, addr, &depth)
+		entry, err := pm.resolveStep(ctx, i, addr, &depth)
 
 		if err != nil {
-			if err == RecursionLimit {
+			if err == RecursionLimit || ctx.Err() != nil {
 				return nil, err
 			}
 
@@ -408,7 +574,7 @@ func (pm *PeerManager) Resolve(addr dht.Address) (*dht.Entry, error) {
 }
 
 // Will return the entry itself, or an error.
-func (pm *PeerManager) resolveStep(e *dht.Entry, addr dht.Address, depth *int) (*dht.Entry, error) {
+func (pm *PeerManager) resolveStep(ctx context.Context, e *dht.Entry, addr dht.Address, depth *int) (*dht.Entry, error) {
 	// connect to the peer
 	var peer *Peer
 	var err error
@@ -423,14 +589,19 @@ func (pm *PeerManager) resolveStep(e *dht.Entry, addr dht.Address, depth *int) (
 	peer = pm.GetPeer(e.Address)
 
 	if peer == nil {
-		peer, err = pm.ConnectPeerDirect(fmt.Sprintf("%s:%d", e.PublicAddress, e.Port))
+		peer, err = pm.connectEntry(ctx, e, false)
 
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	kv, err := peer.Query(addr)
+	kv, err := peer.Query(ctx, addr)
+
+	// the peer not having it is no failure, it may know who does
+	if proto.IsCode(err, proto.CodeNotFound) {
+		kv, err = nil, nil
+	}
 
 	if err != nil {
 		return nil, err
@@ -441,7 +612,7 @@ func (pm *PeerManager) resolveStep(e *dht.Entry, addr dht.Address, depth *int) (
 		return entry.(*dht.Entry), err
 	}
 
-	closest, err := peer.FindClosest(addr)
+	closest, err := peer.FindClosest(ctx, addr)
 
 	if err != nil {
 		return nil, err
@@ -450,7 +621,7 @@ func (pm *PeerManager) resolveStep(e *dht.Entry, addr dht.Address, depth *int) (
 	for _, i := range closest {
 		entry := i.(*dht.Entry)
 
-		result, err := pm.resolveStep(entry, addr, depth)
+		result, err := pm.resolveStep(ctx, entry, addr, depth)
 
 		if err != nil {
 			return nil, err
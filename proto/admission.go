@@ -0,0 +1,213 @@
+// Decides which incoming connections the server takes on. Every connection costs
+// a goroutine and a socket for as long as it is open, and a handshake costs a
+// key exchange and signature checks, so all three are limited.
+
+package proto
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTooManyConnections = errors.New("Too many connections")
+	ErrTooManyFromIP      = errors.New("Too many connections from this IP")
+	ErrTooManyHandshakes  = errors.New("Too many handshakes in progress")
+)
+
+// Limits on incoming connections. A limit of zero or less disables it.
+type AdmissionConfig struct {
+	// Connections open at once, handshaking or not.
+	MaxConnections int
+
+	// Connections open at once from a single IP, or relayed by a single peer.
+	// Loopback connections are not counted, as everything from a Tor hidden
+	// service comes from there.
+	MaxConnectionsPerIP int
+
+	// Connections that have not yet finished their handshake.
+	MaxPendingHandshakes int
+
+	// How long a connection has to negotiate a version and handshake.
+	HandshakeTimeout time.Duration
+}
+
+func DefaultAdmissionConfig() AdmissionConfig {
+	return AdmissionConfig{
+		MaxConnections:       512,
+		MaxConnectionsPerIP:  8,
+		MaxPendingHandshakes: 64,
+		HandshakeTimeout:     time.Second * 10,
+	}
+}
+
+// How many connections are open, and how many have been turned away and why.
+type AdmissionStats struct {
+	Connections       int `json:"connections"`
+	PendingHandshakes int `json:"pendingHandshakes"`
+
+	Accepted          uint64 `json:"accepted"`
+	RejectedTotal     uint64 `json:"rejectedTotal"`
+	RejectedPerIP     uint64 `json:"rejectedPerIp"`
+	RejectedPending   uint64 `json:"rejectedPending"`
+	HandshakeTimeouts uint64 `json:"handshakeTimeouts"`
+	HandshakeFailures uint64 `json:"handshakeFailures"`
+}
+
+type admission struct {
+	lock   sync.Mutex
+	config AdmissionConfig
+	perIP  map[string]int
+	stats  AdmissionStats
+}
+
+func newAdmission(config AdmissionConfig) *admission {
+	return &admission{
+		config: config,
+		perIP:  make(map[string]int),
+	}
+}
+
+// Takes a connection on if there is room for it, in which case it counts as
+// handshaking until handshakeDone is called. The returned connection gives its
+// place up when it is closed.
+func (a *admission) admit(conn net.Conn) (net.Conn, error) {
+	ip := admissionKey(conn.RemoteAddr())
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.config.MaxConnections > 0 && a.stats.Connections >= a.config.MaxConnections {
+		a.stats.RejectedTotal++
+		return nil, ErrTooManyConnections
+	}
+
+	if ip != "" && a.config.MaxConnectionsPerIP > 0 && a.perIP[ip] >= a.config.MaxConnectionsPerIP {
+		a.stats.RejectedPerIP++
+		return nil, ErrTooManyFromIP
+	}
+
+	if a.config.MaxPendingHandshakes > 0 && a.stats.PendingHandshakes >= a.config.MaxPendingHandshakes {
+		a.stats.RejectedPending++
+		return nil, ErrTooManyHandshakes
+	}
+
+	a.stats.Connections++
+	a.stats.PendingHandshakes++
+	a.stats.Accepted++
+
+	if ip != "" {
+		a.perIP[ip]++
+	}
+
+	return &admittedConn{Conn: conn, admission: a, ip: ip}, nil
+}
+
+// Marks the handshake of an admitted connection as over, err being whatever it
+// failed with.
+func (a *admission) handshakeDone(err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.stats.PendingHandshakes--
+
+	if err == nil {
+		return
+	}
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		a.stats.HandshakeTimeouts++
+	} else {
+		a.stats.HandshakeFailures++
+	}
+}
+
+func (a *admission) release(ip string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.stats.Connections--
+
+	if ip == "" {
+		return
+	}
+
+	a.perIP[ip]--
+
+	if a.perIP[ip] <= 0 {
+		delete(a.perIP, ip)
+	}
+}
+
+func (a *admission) setConfig(config AdmissionConfig) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.config = config
+}
+
+func (a *admission) getConfig() AdmissionConfig {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.config
+}
+
+func (a *admission) getStats() AdmissionStats {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.stats
+}
+
+// The IP of a remote address, or nothing if it should not be limited or
+// penalised per IP. Loopback connections may well be many peers coming in
+// through Tor.
+func RemoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+
+	if err != nil {
+		return ""
+	}
+
+	ip := net.ParseIP(host)
+
+	if ip == nil || ip.IsLoopback() {
+		return ""
+	}
+
+	return ip.String()
+}
+
+// What a connection is counted under for MaxConnectionsPerIP: its IP, or the
+// relay it came through, so that a peer cannot relay more connections to us than
+// it could make itself.
+func admissionKey(addr net.Addr) string {
+	if ra, ok := addr.(relayAddr); ok {
+		return ra.String()
+	}
+
+	return RemoteIP(addr)
+}
+
+type admittedConn struct {
+	net.Conn
+
+	admission *admission
+	ip        string
+	once      sync.Once
+}
+
+func (ac *admittedConn) Close() error {
+	ac.once.Do(func() {
+		ac.admission.release(ac.ip)
+	})
+
+	return ac.Conn.Close()
+}
@@ -0,0 +1,183 @@
+package proto
+
+import (
+	"net"
+	"testing"
+
+	"github.com/zif/zif/dht"
+)
+
+// A connection that appears to come from addr, since loopback IPs are never
+// banned or limited.
+type remoteConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (rc *remoteConn) RemoteAddr() net.Addr {
+	return rc.addr
+}
+
+func newRemoteConn(ip string) (*remoteConn, net.Conn) {
+	local, remote := net.Pipe()
+
+	return &remoteConn{local, &net.TCPAddr{IP: net.ParseIP(ip), Port: 5050}}, remote
+}
+
+func admitFrom(t *testing.T, a *admission, ip string) (net.Conn, error) {
+	conn, remote := newRemoteConn(ip)
+	t.Cleanup(func() { remote.Close() })
+
+	admitted, err := a.admit(conn)
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	a.handshakeDone(nil)
+	t.Cleanup(func() { admitted.Close() })
+
+	return admitted, nil
+}
+
+func TestAdmissionPerIP(t *testing.T) {
+	a := newAdmission(AdmissionConfig{MaxConnectionsPerIP: 2})
+
+	for i := 0; i < 2; i++ {
+		if _, err := admitFrom(t, a, "203.0.113.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := admitFrom(t, a, "203.0.113.1"); err != ErrTooManyFromIP {
+		t.Fatal("Third connection from one IP was ", err)
+	}
+
+	if _, err := admitFrom(t, a, "203.0.113.2"); err != nil {
+		t.Fatal("Connection from another IP was refused: ", err)
+	}
+
+	// loopback could be any number of peers coming in over Tor
+	for i := 0; i < 4; i++ {
+		if _, err := admitFrom(t, a, "127.0.0.1"); err != nil {
+			t.Fatal("Loopback connection was refused: ", err)
+		}
+	}
+
+	if stats := a.getStats(); stats.Connections != 7 || stats.RejectedPerIP != 1 {
+		t.Fatalf("Stats were %+v", stats)
+	}
+}
+
+// Relayed connections count against the relay, whatever the IP under them.
+func TestAdmissionRelayed(t *testing.T) {
+	a := newAdmission(AdmissionConfig{MaxConnectionsPerIP: 2})
+	relay := testAddress(t)
+
+	admitRelayed := func(via *dht.Address) error {
+		conn, remote := newRemoteConn("203.0.113.1")
+		t.Cleanup(func() { remote.Close() })
+
+		admitted, err := a.admit(&relayedConn{conn, relayAddr{via.StringOr("")}})
+
+		if err != nil {
+			conn.Close()
+			return err
+		}
+
+		a.handshakeDone(nil)
+		t.Cleanup(func() { admitted.Close() })
+
+		return nil
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := admitRelayed(relay); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := admitRelayed(relay); err != ErrTooManyFromIP {
+		t.Fatal("Third connection through one relay was ", err)
+	}
+
+	if err := admitRelayed(testAddress(t)); err != nil {
+		t.Fatal("Connection through another relay was refused: ", err)
+	}
+
+	if _, err := admitFrom(t, a, "203.0.113.1"); err != nil {
+		t.Fatal("Direct connection was refused: ", err)
+	}
+}
+
+func TestAdmissionTotal(t *testing.T) {
+	a := newAdmission(AdmissionConfig{MaxConnections: 3})
+	ips := []string{"203.0.113.1", "203.0.113.2", "203.0.113.3", "203.0.113.4"}
+
+	for _, ip := range ips[:3] {
+		if _, err := admitFrom(t, a, ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := admitFrom(t, a, ips[3]); err != ErrTooManyConnections {
+		t.Fatal("Connection over the limit was ", err)
+	}
+
+	if stats := a.getStats(); stats.Connections != 3 || stats.RejectedTotal != 1 {
+		t.Fatalf("Stats were %+v", stats)
+	}
+}
+
+func TestAdmissionPending(t *testing.T) {
+	a := newAdmission(AdmissionConfig{MaxPendingHandshakes: 1})
+
+	conn, _ := newRemoteConn("203.0.113.1")
+	defer conn.Close()
+
+	if _, err := a.admit(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := admitFrom(t, a, "203.0.113.2"); err != ErrTooManyHandshakes {
+		t.Fatal("Connection during a handshake was ", err)
+	}
+
+	a.handshakeDone(nil)
+
+	if _, err := admitFrom(t, a, "203.0.113.2"); err != nil {
+		t.Fatal("Connection after the handshake was refused: ", err)
+	}
+}
+
+// Closing a connection gives its place to the next one, however many times it
+// is closed.
+func TestAdmissionRelease(t *testing.T) {
+	a := newAdmission(AdmissionConfig{MaxConnections: 1, MaxConnectionsPerIP: 1})
+
+	first, err := admitFrom(t, a, "203.0.113.1")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := admitFrom(t, a, "203.0.113.1"); err == nil {
+		t.Fatal("Second connection was admitted")
+	}
+
+	first.Close()
+	first.Close()
+
+	if stats := a.getStats(); stats.Connections != 0 || len(a.perIP) != 0 {
+		t.Fatalf("Closed connection was not released, stats were %+v", stats)
+	}
+
+	if _, err := admitFrom(t, a, "203.0.113.1"); err != nil {
+		t.Fatal("Connection after a close was refused: ", err)
+	}
+
+	if _, err := admitFrom(t, a, "203.0.113.2"); err != ErrTooManyConnections {
+		t.Fatal("Connection over the limit was ", err)
+	}
+}
@@ -0,0 +1,302 @@
+// Limits how much bandwidth peers can use, both per peer and across all of them.
+//
+// Every stream draws on a token bucket for its peer, and one shared by every
+// peer, filled at the configured rate in bytes per second. Streams that carry
+// bulk transfers such as pieces wait for the buckets to refill, everything else
+// goes straight through and leaves the buckets in debt, which the bulk streams
+// then have to wait out. That way DHT requests and searches are never stuck
+// behind someone mirroring us, but still count towards the limits.
+
+package proto
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Writes are split into chunks of at most this many bytes, so that a large one
+// does not take all of the bandwidth for a long time in one go.
+const BandwidthChunkSize = 16 * 1024
+
+var errShapedClosed = errors.New("Connection closed while waiting for bandwidth")
+
+// Requests whose streams are bulk transfers, whichever side of them we are on.
+var bulkHeaders = map[string]bool{
+	ProtoRequestPiece:    true,
+	ProtoPiece:           true,
+	ProtoRequestHashList: true,
+	ProtoHashList:        true,
+}
+
+// Limits in bytes per second, zero or less is unlimited.
+type BandwidthConfig struct {
+	// Across all peers.
+	Upload   int
+	Download int
+
+	// For each peer.
+	PeerUpload   int
+	PeerDownload int
+}
+
+// The bandwidth limits shared by all of the peers of a local peer.
+type Bandwidth struct {
+	lock   sync.Mutex
+	config BandwidthConfig
+
+	upload   tokenBucket
+	download tokenBucket
+}
+
+func NewBandwidth(config BandwidthConfig) *Bandwidth {
+	return &Bandwidth{config: config}
+}
+
+// Changes the limits, which applies to streams that are already open too.
+func (b *Bandwidth) SetConfig(config BandwidthConfig) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.config = config
+}
+
+func (b *Bandwidth) Config() BandwidthConfig {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.config
+}
+
+// Bandwidth used by a single peer, drawing on the limits shared by all of them.
+type peerBandwidth struct {
+	shared *Bandwidth
+
+	upload   tokenBucket
+	download tokenBucket
+}
+
+// Takes n bytes from the buckets of the peer and the shared ones, returning how
+// long to wait until they are paid for.
+func (pb *peerBandwidth) take(n int, upload bool) time.Duration {
+	config := pb.shared.Config()
+	now := time.Now()
+
+	var peer, all time.Duration
+
+	if upload {
+		peer = pb.upload.take(n, config.PeerUpload, now)
+		all = pb.shared.upload.take(n, config.Upload, now)
+	} else {
+		peer = pb.download.take(n, config.PeerDownload, now)
+		all = pb.shared.download.take(n, config.Download, now)
+	}
+
+	if peer > all {
+		return peer
+	}
+
+	return all
+}
+
+// A token bucket holding up to one second worth of tokens. The rate is given
+// each time it is used, so that it can be changed at any time.
+type tokenBucket struct {
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// Takes n tokens, even if there are not that many, and returns how long it will
+// take for the bucket to refill enough to cover them. rate is in tokens per
+// second, if it is zero or less nothing is taken.
+func (tb *tokenBucket) take(n, rate int, now time.Time) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+
+	if tb.last.IsZero() {
+		tb.tokens = float64(rate)
+	} else {
+		tb.tokens += now.Sub(tb.last).Seconds() * float64(rate)
+	}
+
+	if tb.tokens > float64(rate) {
+		tb.tokens = float64(rate)
+	}
+
+	tb.last = now
+	tb.tokens -= float64(n)
+
+	if tb.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-tb.tokens / float64(rate) * float64(time.Second))
+}
+
+// A stream that uses the bandwidth of its peer. Streams are not bulk to begin
+// with, they become bulk once a bulk request or reply is seen on them.
+type shapedConn struct {
+	net.Conn
+
+	bandwidth *peerBandwidth
+	bulk      int32
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// the read and write deadlines of the stream, as unix nanoseconds
+	readDeadline  int64
+	writeDeadline int64
+}
+
+func newShapedConn(conn net.Conn, bandwidth *peerBandwidth) *shapedConn {
+	return &shapedConn{
+		Conn:      conn,
+		bandwidth: bandwidth,
+		closed:    make(chan struct{}),
+	}
+}
+
+func (sc *shapedConn) setBulk() {
+	atomic.StoreInt32(&sc.bulk, 1)
+}
+
+func (sc *shapedConn) isBulk() bool {
+	return atomic.LoadInt32(&sc.bulk) == 1
+}
+
+func (sc *shapedConn) Write(b []byte) (int, error) {
+	written := 0
+
+	for len(b) > 0 {
+		chunk := b
+
+		if len(chunk) > BandwidthChunkSize {
+			chunk = chunk[:BandwidthChunkSize]
+		}
+
+		err := sc.wait(sc.bandwidth.take(len(chunk), true), &sc.writeDeadline)
+
+		if err != nil {
+			return written, err
+		}
+
+		n, err := sc.Conn.Write(chunk)
+		written += n
+
+		if err != nil {
+			return written, err
+		}
+
+		b = b[n:]
+	}
+
+	return written, nil
+}
+
+// Reads are paid for after the fact, holding off the next read means the peer
+// has to slow down once its window on the stream is full.
+func (sc *shapedConn) Read(b []byte) (int, error) {
+	n, err := sc.Conn.Read(b)
+
+	if n > 0 {
+		werr := sc.wait(sc.bandwidth.take(n, false), &sc.readDeadline)
+
+		if err == nil {
+			err = werr
+		}
+	}
+
+	return n, err
+}
+
+// Waits for d if the stream is bulk, giving up if the stream is closed or its
+// deadline passes first.
+func (sc *shapedConn) wait(d time.Duration, deadline *int64) error {
+	if d <= 0 || !sc.isBulk() {
+		return nil
+	}
+
+	timeout := false
+
+	if dl := atomic.LoadInt64(deadline); dl != 0 {
+		if left := time.Until(time.Unix(0, dl)); left < d {
+			d, timeout = left, true
+		}
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-sc.closed:
+		return errShapedClosed
+	}
+
+	if timeout {
+		return shapedTimeout{}
+	}
+
+	return nil
+}
+
+func (sc *shapedConn) SetDeadline(t time.Time) error {
+	sc.storeDeadline(&sc.readDeadline, t)
+	sc.storeDeadline(&sc.writeDeadline, t)
+
+	return sc.Conn.SetDeadline(t)
+}
+
+func (sc *shapedConn) SetReadDeadline(t time.Time) error {
+	sc.storeDeadline(&sc.readDeadline, t)
+
+	return sc.Conn.SetReadDeadline(t)
+}
+
+func (sc *shapedConn) SetWriteDeadline(t time.Time) error {
+	sc.storeDeadline(&sc.writeDeadline, t)
+
+	return sc.Conn.SetWriteDeadline(t)
+}
+
+func (sc *shapedConn) storeDeadline(deadline *int64, t time.Time) {
+	if t.IsZero() {
+		atomic.StoreInt64(deadline, 0)
+	} else {
+		atomic.StoreInt64(deadline, t.UnixNano())
+	}
+}
+
+func (sc *shapedConn) Close() error {
+	sc.closeOnce.Do(func() {
+		close(sc.closed)
+	})
+
+	return sc.Conn.Close()
+}
+
+// The deadline of a stream passed while it was waiting for bandwidth.
+type shapedTimeout struct{}
+
+func (shapedTimeout) Error() string   { return "Timed out waiting for bandwidth" }
+func (shapedTimeout) Timeout() bool   { return true }
+func (shapedTimeout) Temporary() bool { return true }
+
+// Marks the stream of a client as bulk if header is a bulk transfer.
+func (c *Client) classify(header string) {
+	if !bulkHeaders[header] {
+		return
+	}
+
+	if sc, ok := c.conn.(*shapedConn); ok {
+		sc.setBulk()
+	}
+}
@@ -0,0 +1,55 @@
+package proto
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zif/zif/data"
+)
+
+// A capped piece reply takes longer than the first deadline of its stream, which
+// each batch pushes back.
+func TestWritePiecesShaped(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	go io.Copy(ioutil.Discard, remote)
+
+	bandwidth := &peerBandwidth{shared: NewBandwidth(BandwidthConfig{PeerUpload: 64 * 1024})}
+	conn := newShapedConn(local, bandwidth)
+	defer conn.Close()
+
+	conn.setBulk()
+	conn.SetDeadline(time.Now().Add(time.Millisecond * 100))
+
+	cl, err := NewClient(conn)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// about 100KiB, so over a second at the cap
+	posts := make(chan *data.Post)
+
+	go func() {
+		defer close(posts)
+
+		for i := 0; i < 1000; i++ {
+			posts <- &data.Post{Id: i, Title: strings.Repeat("z", 100)}
+		}
+	}()
+
+	began := time.Now()
+
+	if err := WritePieces(cl, 0, posts); err != nil {
+		t.Fatal("Capped reply did not get past the first deadline: ", err)
+	}
+
+	if time.Since(began) < time.Millisecond*500 {
+		t.Fatal("Reply was not held to the bandwidth cap")
+	}
+}
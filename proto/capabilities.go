@@ -1,20 +1,47 @@
 package proto
 
-func ChooseCompression(client MessageCapabilities, server MessageCapabilities) string {
+const (
+	// Posts are written as gzip'd text, with fields separated by "|". This is
+	// what peers without a piece format capability use.
+	PieceFormatText = "text"
+
+	// Each piece is sent as a MessagePiece followed by its posts, all as
+	// ordinary messages, with ProtoDone at the end.
+	PieceFormatFramed = "framed"
+)
+
+// Returns the first of the server's choices which the client also has, or an
+// empty string if they share nothing.
+func choose(client []string, server []string) string {
 	// check if the peer has our caps, in order of preference
 	// the server has preference
-	compression := ""
-	for _, i := range server.Compression {
-		if compression != "" {
+	chosen := ""
+	for _, i := range server {
+		if chosen != "" {
 			break
 		}
 
-		for _, j := range client.Compression {
+		for _, j := range client {
 			if i == j {
-				compression = i
+				chosen = i
 			}
 		}
 	}
 
-	return compression
+	return chosen
+}
+
+func ChooseCompression(client MessageCapabilities, server MessageCapabilities) string {
+	return choose(client.Compression, server.Compression)
+}
+
+// Peers that do not advertise any piece formats only understand text.
+func ChoosePieceFormat(client MessageCapabilities, server MessageCapabilities) string {
+	format := choose(client.Pieces, server.Pieces)
+
+	if format == "" {
+		return PieceFormatText
+	}
+
+	return format
 }
@@ -2,10 +2,12 @@ package proto
 
 import (
 	"compress/gzip"
+	"context"
 	"errors"
 	"io"
 	"net"
 	"strconv"
+	"time"
 
 	"gopkg.in/vmihailenco/msgpack.v2"
 
@@ -26,6 +28,15 @@ type Client struct {
 	limiter *io.LimitedReader
 	decoder *msgpack.Decoder
 	encoder *msgpack.Encoder
+
+	// The codec used for outgoing message content, and stats on how well it is
+	// doing. Incoming messages say how they are compressed.
+	compression string
+	stats       *CompressionStats
+
+	// Identifies the encrypted channel this client is using, if any. Signed in
+	// the handshake, so it cannot be relayed onto another connection.
+	binding []byte
 }
 
 // Creates a new client, automatically setting up the json encoder/decoder.
@@ -39,6 +50,38 @@ func NewClient(conn net.Conn) (*Client, error) {
 	return c, nil
 }
 
+// Set the codec used to compress outgoing messages, this should be the one
+// negotiated with the peer. Stats may be nil.
+func (c *Client) SetCompression(compression string, stats *CompressionStats) {
+	c.compression = compression
+	c.stats = stats
+}
+
+// Ties a call on the client to ctx. The deadline of ctx is applied to the
+// connection, and if ctx is cancelled the connection is closed so that any
+// blocked reads or writes return. The returned function must be called once the
+// call has finished, if the call failed because of ctx then *err is replaced
+// with the context error. Usually used as:
+//
+//	defer c.bind(ctx)(&err)
+func (c *Client) bind(ctx context.Context) func(*error) {
+	stop := bindConn(ctx, c.conn)
+
+	return func(err *error) {
+		stop()
+
+		if err != nil && *err != nil && ctx.Err() != nil {
+			*err = ctx.Err()
+		}
+	}
+}
+
+// Gives the stream another StreamTimeout, for replies too big to be written
+// within the first one, especially under a bandwidth limit.
+func (c *Client) ExtendDeadline() error {
+	return c.conn.SetDeadline(time.Now().Add(StreamTimeout))
+}
+
 func (c *Client) Terminate() {
 	//c.conn.Write(proto_terminate)
 }
@@ -51,7 +94,8 @@ func (c *Client) Close() (err error) {
 	return
 }
 
-// Encodes v as json and writes it to c.conn.
+// Encodes v as msgpack and writes it to c.conn. The content of messages is
+// compressed first, if a compression method has been set.
 func (c *Client) WriteMessage(v interface{}) error {
 	if c == nil {
 		return errors.New("Client nil")
@@ -61,14 +105,70 @@ func (c *Client) WriteMessage(v interface{}) error {
 		c.encoder = msgpack.NewEncoder(c.conn)
 	}
 
+	switch msg := v.(type) {
+	case *Message:
+		c.classify(msg.Header)
+		compressed, err := c.compress(msg)
+
+		if err != nil {
+			return err
+		}
+
+		v = compressed
+	case Message:
+		c.classify(msg.Header)
+		compressed, err := c.compress(&msg)
+
+		if err != nil {
+			return err
+		}
+
+		v = compressed
+	}
+
 	err := c.encoder.Encode(v)
 
 	return err
 }
 
+// Returns a copy of the message with its content compressed. If compressing
+// will not help, the message is returned as it is.
+func (c *Client) compress(msg *Message) (*Message, error) {
+	if c.compression == "" || c.compression == CompressionNone ||
+		msg.Compression != "" || len(msg.Content) < CompressionThreshold {
+		return msg, nil
+	}
+
+	content, err := Compress(c.compression, msg.Content)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(content) >= len(msg.Content) {
+		if c.stats != nil {
+			c.stats.Add(len(msg.Content), len(msg.Content))
+		}
+
+		return msg, nil
+	}
+
+	if c.stats != nil {
+		c.stats.Add(len(msg.Content), len(content))
+	}
+
+	ret := *msg
+	ret.Content = content
+	ret.Compression = c.compression
+
+	return &ret, nil
+}
+
+// Sends an error to the peer, as an *Error if it is one or an internal error if
+// not.
 func (c *Client) WriteErr(toSend error) error {
-	msg := &Message{Header: ProtoNo}
-	err := msg.Write(toSend.Error())
+	msg := &Message{Header: ProtoError}
+	err := msg.Write(toError(toSend).message())
 
 	if err != nil {
 		return err
@@ -95,9 +195,26 @@ func (c *Client) ReadMessage() (*Message, error) {
 		return nil, err
 	}
 
+	c.limiter.N = common.MaxMessageSize
+	c.classify(msg.Header)
+
+	if msg.Compression != "" && msg.Compression != CompressionNone {
+		content, err := Decompress(msg.Compression, msg.Content, common.MaxMessageContentSize)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if c.stats != nil {
+			c.stats.Add(len(content), len(msg.Content))
+		}
+
+		msg.Content = content
+		msg.Compression = ""
+	}
+
 	msg.Stream = c.conn
 
-	c.limiter.N = common.MaxMessageSize
 	return &msg, nil
 }
 
@@ -122,12 +239,14 @@ func (c *Client) SendStruct(e common.Encoder) error {
 
 // Announce the given DHT entry to a peer, passes on this peers details,
 // meaning that it can be reached by other peers on the network.
-func (c *Client) Announce(e common.Encoder) error {
+func (c *Client) Announce(ctx context.Context, e common.Encoder) (err error) {
+	defer c.bind(ctx)(&err)
+
 	msg := &Message{
 		Header: ProtoDhtAnnounce,
 	}
 
-	err := msg.Write(e)
+	err = msg.Write(e)
 
 	if err != nil {
 		return err
@@ -139,7 +258,7 @@ func (c *Client) Announce(e common.Encoder) error {
 		return err
 	}
 
-	ok, err := c.ReadMessage()
+	ok, err := c.readReply()
 
 	if err != nil {
 		return err
@@ -152,14 +271,16 @@ func (c *Client) Announce(e common.Encoder) error {
 	return nil
 }
 
-func (c *Client) FindClosest(address dht.Address) ([]*dht.Entry, error) {
+func (c *Client) FindClosest(ctx context.Context, address dht.Address) (_ []*dht.Entry, err error) {
+	defer c.bind(ctx)(&err)
+
 	// TODO: LimitReader
 
 	msg := &Message{
 		Header: ProtoDhtFindClosest,
 	}
 
-	err := msg.Write(address)
+	err = msg.Write(address)
 
 	if err != nil {
 		return nil, err
@@ -174,7 +295,7 @@ func (c *Client) FindClosest(address dht.Address) ([]*dht.Entry, error) {
 
 	log.Debug("Send FindClosest request")
 
-	closest, err := c.ReadMessage()
+	closest, err := c.readReply()
 
 	if err != nil {
 		return nil, err
@@ -192,14 +313,16 @@ func (c *Client) FindClosest(address dht.Address) ([]*dht.Entry, error) {
 	return ret, err
 }
 
-func (c *Client) Query(address dht.Address) (*dht.Entry, error) {
+func (c *Client) Query(ctx context.Context, address dht.Address) (_ *dht.Entry, err error) {
+	defer c.bind(ctx)(&err)
+
 	// TODO: LimitReader
 
 	msg := &Message{
 		Header: ProtoDhtQuery,
 	}
 
-	err := msg.Write(address)
+	err = msg.Write(address)
 
 	if err != nil {
 		return nil, err
@@ -214,15 +337,12 @@ func (c *Client) Query(address dht.Address) (*dht.Entry, error) {
 	log.Debug("Written address")
 
 	var entry dht.Entry
-	er, err := c.ReadMessage()
+	er, err := c.readReply()
 
 	if err != nil {
 		return nil, err
 	}
 
-	if er.Header == ProtoNo {
-		return nil, errors.New("Peer returned no")
-	}
 	log.Debug("Recieved entry")
 
 	err = er.Read(&entry)
@@ -236,7 +356,7 @@ func (c *Client) Query(address dht.Address) (*dht.Entry, error) {
 	err = entry.Verify()
 
 	if err != nil {
-		return nil, err
+		return nil, &InvalidEntryError{err}
 	}
 
 	log.Debug("Verified entry")
@@ -247,9 +367,9 @@ func (c *Client) Query(address dht.Address) (*dht.Entry, error) {
 // Adds the initial entries into the given routing table. Essentially queries for
 // both it's own and the peers address, storing the result. This means that after
 // a bootstrap, it should be possible to connect to *any* peer!
-func (c *Client) Bootstrap(d *dht.DHT, address dht.Address) error {
+func (c *Client) Bootstrap(ctx context.Context, d *dht.DHT, address dht.Address) error {
 	defer c.Close()
-	peers, err := c.FindClosest(address)
+	peers, err := c.FindClosest(ctx, address)
 
 	if err != nil {
 		return err
@@ -289,7 +409,9 @@ func (c *Client) Bootstrap(d *dht.DHT, address dht.Address) error {
 }
 
 // TODO: Paginate searches
-func (c *Client) Search(search string, page int) ([]*data.Post, error) {
+func (c *Client) Search(ctx context.Context, search string, page int) (_ []*data.Post, err error) {
+	defer c.bind(ctx)(&err)
+
 	log.WithField("Query", search).Info("Querying")
 
 	sq := MessageSearchQuery{search, page}
@@ -298,7 +420,7 @@ func (c *Client) Search(search string, page int) ([]*data.Post, error) {
 		Header: ProtoSearch,
 	}
 
-	err := msg.Write(sq)
+	err = msg.Write(sq)
 
 	if err != nil {
 		return nil, err
@@ -308,7 +430,7 @@ func (c *Client) Search(search string, page int) ([]*data.Post, error) {
 
 	var posts []*data.Post
 
-	recv, err := c.ReadMessage()
+	recv, err := c.readReply()
 
 	if err != nil {
 		return nil, err
@@ -323,14 +445,16 @@ func (c *Client) Search(search string, page int) ([]*data.Post, error) {
 	return posts, nil
 }
 
-func (c *Client) Recent(page int) ([]*data.Post, error) {
+func (c *Client) Recent(ctx context.Context, page int) (_ []*data.Post, err error) {
+	defer c.bind(ctx)(&err)
+
 	log.Info("Fetching recent posts from peer")
 
 	msg := &Message{
 		Header: ProtoRecent,
 	}
 
-	err := msg.Write(page)
+	err = msg.Write(page)
 
 	if err != nil {
 		return nil, err
@@ -342,7 +466,7 @@ func (c *Client) Recent(page int) ([]*data.Post, error) {
 		return nil, err
 	}
 
-	posts_msg, err := c.ReadMessage()
+	posts_msg, err := c.readReply()
 
 	if err != nil {
 		return nil, err
@@ -360,14 +484,16 @@ func (c *Client) Recent(page int) ([]*data.Post, error) {
 	return posts, nil
 }
 
-func (c *Client) Popular(page int) ([]*data.Post, error) {
+func (c *Client) Popular(ctx context.Context, page int) (_ []*data.Post, err error) {
+	defer c.bind(ctx)(&err)
+
 	log.Info("Fetching popular posts from peer")
 
 	msg := &Message{
 		Header: ProtoPopular,
 	}
 
-	err := msg.Write(page)
+	err = msg.Write(page)
 
 	if err != nil {
 		return nil, err
@@ -379,7 +505,7 @@ func (c *Client) Popular(page int) ([]*data.Post, error) {
 		return nil, err
 	}
 
-	posts_msg, err := c.ReadMessage()
+	posts_msg, err := c.readReply()
 
 	if err != nil {
 		return nil, err
@@ -399,14 +525,16 @@ func (c *Client) Popular(page int) ([]*data.Post, error) {
 
 // Download a hash list for a peer. Expects said hash list to be valid and
 // signed.
-func (c *Client) Collection(address dht.Address, entry dht.Entry) (*MessageCollection, error) {
+func (c *Client) Collection(ctx context.Context, address dht.Address, entry dht.Entry) (_ *MessageCollection, err error) {
+	defer c.bind(ctx)(&err)
+
 	log.WithField("for", address.StringOr("")).Info("Sending request for a collection")
 
 	msg := &Message{
 		Header: ProtoRequestHashList,
 	}
 
-	err := msg.Write(address)
+	err = msg.Write(address)
 
 	if err != nil {
 		return nil, err
@@ -420,7 +548,7 @@ func (c *Client) Collection(address dht.Address, entry dht.Entry) (*MessageColle
 
 	log.Debug("Sent hash list request")
 
-	hl, err := c.ReadMessage()
+	hl, err := c.readReply()
 
 	if err != nil {
 		return nil, err
@@ -449,16 +577,22 @@ func (c *Client) Collection(address dht.Address, entry dht.Entry) (*MessageColle
 }
 
 // Download a piece from a peer, given the address and id of the piece we want.
-func (c *Client) Pieces(address dht.Address, id, length int) chan *data.Piece {
+// Requests length pieces from address, starting at piece id, in the given format
+// (see ChoosePieceFormat). The stream is tied to ctx until all of the pieces have
+// been recieved.
+func (c *Client) Pieces(ctx context.Context, address dht.Address, id, length int, format string) chan *data.Piece {
+	done := c.bind(ctx)
+
 	log.WithFields(log.Fields{
 		"address": address.StringOr(""),
 		"id":      id,
 		"length":  length,
+		"format":  format,
 	}).Info("Sending request for piece")
 
 	ret := make(chan *data.Piece, 100)
 
-	mrp := MessageRequestPiece{address.StringOr(""), id, length}
+	mrp := MessageRequestPiece{address.StringOr(""), id, length, format}
 
 	msg := &Message{
 		Header: ProtoRequestPiece,
@@ -468,6 +602,7 @@ func (c *Client) Pieces(address dht.Address, id, length int) chan *data.Piece {
 
 	if err != nil {
 		log.Error(err.Error())
+		done(nil)
 		return nil
 	}
 
@@ -475,9 +610,34 @@ func (c *Client) Pieces(address dht.Address, id, length int) chan *data.Piece {
 
 	if err != nil {
 		log.Error(err.Error())
+		done(nil)
 		return nil
 	}
 
+	go func() {
+		defer done(nil)
+		defer close(ret)
+		log.Info("Recieving pieces")
+
+		var err error
+
+		if format == PieceFormatFramed {
+			err = readPieces(c, length, ret)
+		} else {
+			err = c.readTextPieces(id, length, ret)
+		}
+
+		if err != nil {
+			log.Error(err.Error())
+		}
+	}()
+
+	return ret
+}
+
+// Reads pieces in the old text format, as posts separated by "|" and ended by a
+// post with an id of -1.
+func (c *Client) readTextPieces(start, length int, ret chan<- *data.Piece) error {
 	// Convert a string to an int, prevents endless error checks below.
 	convert := func(val string) int {
 		ret, err := strconv.Atoi(val)
@@ -490,86 +650,83 @@ func (c *Client) Pieces(address dht.Address, id, length int) chan *data.Piece {
 		return ret
 	}
 
-	go func() {
-		defer close(ret)
-		log.Info("Recieving pieces")
+	gzr, err := gzip.NewReader(c.conn)
+
+	if err != nil {
+		return err
+	}
 
-		gzr, err := gzip.NewReader(c.conn)
+	errReader := data.NewErrorReader(gzr)
 
-		if err != nil {
-			log.Error(err.Error())
-			return
+	for i := 0; i < length; i++ {
+		// each piece is given StreamTimeout to arrive
+		if err := c.ExtendDeadline(); err != nil {
+			return err
 		}
 
-		errReader := data.NewErrorReader(gzr)
-
-		for i := 0; i < length; i++ {
-			piece := data.Piece{}
-			piece.Setup()
-
-			count := 0
-			for {
-				if count >= data.PieceSize {
-					break
-				}
-
-				id_s := errReader.ReadString('|')
-				id := convert(id_s)
-
-				if id == -1 {
-					break
-				}
-
-				ih := errReader.ReadString('|')
-				title := errReader.ReadString('|')
-				size := convert(errReader.ReadString('|'))
-				filecount := convert(errReader.ReadString('|'))
-				seeders := convert(errReader.ReadString('|'))
-				leechers := convert(errReader.ReadString('|'))
-				uploaddate := convert(errReader.ReadString('|'))
-				tags := errReader.ReadString('|')
-				meta := errReader.ReadString('|')
-
-				if errReader.Err != nil {
-					log.Error("Failed to read post: ", errReader.Err.Error())
-					break
-				}
-
-				if err != nil {
-					log.Error(err.Error())
-				}
-
-				post := data.Post{
-					Id:         id,
-					InfoHash:   ih,
-					Title:      title,
-					Size:       size,
-					FileCount:  filecount,
-					Seeders:    seeders,
-					Leechers:   leechers,
-					UploadDate: uploaddate,
-					Tags:       tags,
-					Meta:       meta,
-				}
-
-				piece.Add(post, true)
-				count++
+		piece := data.Piece{Id: uint(start + i)}
+		piece.Setup()
+
+		count := 0
+		for {
+			if count >= data.PieceSize {
+				break
+			}
+
+			id_s := errReader.ReadString('|')
+			id := convert(id_s)
+
+			if id == -1 {
+				break
+			}
+
+			ih := errReader.ReadString('|')
+			title := errReader.ReadString('|')
+			size := convert(errReader.ReadString('|'))
+			filecount := convert(errReader.ReadString('|'))
+			seeders := convert(errReader.ReadString('|'))
+			leechers := convert(errReader.ReadString('|'))
+			uploaddate := convert(errReader.ReadString('|'))
+			tags := errReader.ReadString('|')
+			meta := errReader.ReadString('|')
+
+			if errReader.Err != nil {
+				log.Error("Failed to read post: ", errReader.Err.Error())
+				break
+			}
+
+			post := data.Post{
+				Id:         id,
+				InfoHash:   ih,
+				Title:      title,
+				Size:       size,
+				FileCount:  filecount,
+				Seeders:    seeders,
+				Leechers:   leechers,
+				UploadDate: uploaddate,
+				Tags:       tags,
+				Meta:       meta,
 			}
-			ret <- &piece
+
+			piece.Add(post, true)
+			count++
 		}
-	}()
+		ret <- &piece
+	}
 
-	return ret
+	return nil
 }
 
-func (c *Client) RequestAddPeer(addr dht.Address) error {
+func (c *Client) RequestAddPeer(ctx context.Context, addr dht.Address) (err error) {
+	defer c.bind(ctx)(&err)
+
 	log.WithField("for", addr.StringOr("")).Info("Registering as seed")
 
 	msg := &Message{
 		Header: ProtoRequestAddPeer,
 	}
 
-	err := msg.Write(addr)
+	err = msg.Write(addr)
 
 	if err != nil {
 		return err
@@ -581,7 +738,7 @@ func (c *Client) RequestAddPeer(addr dht.Address) error {
 		return err
 	}
 
-	rep, err := c.ReadMessage()
+	rep, err := c.readReply()
 
 	if err != nil {
 		return err
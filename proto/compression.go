@@ -0,0 +1,162 @@
+// Message content compression. Codecs are looked up by the names peers
+// advertise in MessageCapabilities, so adding a new algorithm is just a case of
+// registering it here (or from another package) and advertising it.
+
+package proto
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// Used when no compression should be applied to message content.
+	CompressionNone = "none"
+
+	// Content smaller than this is not worth compressing.
+	CompressionThreshold = 256
+)
+
+var ErrContentTooLarge = errors.New("Message content exceeds the maximum decompressed size")
+
+type Codec interface {
+	NewWriter(io.Writer) (io.WriteCloser, error)
+	NewReader(io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	codecLock sync.RWMutex
+	codecs    = make(map[string]Codec)
+)
+
+// Makes a codec available for use under the given name. Registering a name
+// twice replaces the old codec.
+func RegisterCodec(name string, codec Codec) {
+	codecLock.Lock()
+	defer codecLock.Unlock()
+
+	codecs[name] = codec
+}
+
+func GetCodec(name string) (Codec, bool) {
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+
+	codec, ok := codecs[name]
+	return codec, ok
+}
+
+// Compresses content with the named codec.
+func Compress(name string, content []byte) ([]byte, error) {
+	codec, ok := GetCodec(name)
+
+	if !ok {
+		return nil, fmt.Errorf("Unknown compression: %s", name)
+	}
+
+	buf := bytes.Buffer{}
+	w, err := codec.NewWriter(&buf)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(content)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.Close()
+
+	return buf.Bytes(), err
+}
+
+// Decompresses content with the named codec. If the result is larger than limit
+// bytes, decompression stops and ErrContentTooLarge is returned, this stops a
+// small message from inflating into something huge.
+func Decompress(name string, content []byte, limit int64) ([]byte, error) {
+	codec, ok := GetCodec(name)
+
+	if !ok {
+		return nil, fmt.Errorf("Unknown compression: %s", name)
+	}
+
+	r, err := codec.NewReader(bytes.NewReader(content))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	// read one more byte than allowed, so we know if the limit was passed
+	ret, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(ret)) > limit {
+		return nil, ErrContentTooLarge
+	}
+
+	return ret, nil
+}
+
+// Keeps track of how well message content is compressing on a connection.
+type CompressionStats struct {
+	raw  int64
+	wire int64
+}
+
+// Record a message, given its uncompressed size and the size actually sent.
+func (cs *CompressionStats) Add(raw, wire int) {
+	atomic.AddInt64(&cs.raw, int64(raw))
+	atomic.AddInt64(&cs.wire, int64(wire))
+}
+
+// The uncompressed size of all content divided by the size on the wire. Higher
+// is better, 1 means nothing has been saved.
+func (cs *CompressionStats) Ratio() float64 {
+	raw := atomic.LoadInt64(&cs.raw)
+	wire := atomic.LoadInt64(&cs.wire)
+
+	if wire == 0 {
+		return 1
+	}
+
+	return float64(raw) / float64(wire)
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+type deflateCodec struct{}
+
+func (deflateCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, flate.DefaultCompression)
+}
+
+func (deflateCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+func init() {
+	RegisterCodec("gzip", gzipCodec{})
+	RegisterCodec("deflate", deflateCodec{})
+}
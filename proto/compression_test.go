@@ -0,0 +1,53 @@
+package proto
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/zif/zif/common"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	client, server := testClients(t)
+	client.SetCompression("gzip", nil)
+
+	content := bytes.Repeat([]byte("zif "), CompressionThreshold)
+
+	go client.WriteMessage(&Message{Header: ProtoOk, Content: content})
+
+	msg, err := server.ReadMessage()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(msg.Content, content) {
+		t.Fatal("Content changed after decompression")
+	}
+}
+
+// Content that inflates past MaxMessageContentSize is refused, even though the
+// message itself is small enough to be read.
+func TestDecompressionBomb(t *testing.T) {
+	bomb := make([]byte, common.MaxMessageContentSize+1)
+
+	for _, name := range []string{"gzip", "deflate"} {
+		content, err := Compress(name, bomb)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(content) >= common.MaxMessageSize {
+			t.Fatal(name, " bomb is too large to send: ", len(content))
+		}
+
+		client, server := testClients(t)
+
+		go client.WriteMessage(&Message{Header: ProtoOk, Content: content, Compression: name})
+
+		if _, err := server.ReadMessage(); err != ErrContentTooLarge {
+			t.Error(name, " bomb was not refused: ", err)
+		}
+	}
+}
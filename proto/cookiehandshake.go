@@ -0,0 +1,262 @@
+// The handshake spoken before ProtoVersionTranscript, kept for peers that have
+// not upgraded yet.
+//
+// Each side sends its entry and capabilities, then signs a random cookie chosen
+// by the other, along with the channel binding if the connection is encrypted.
+// Unlike the transcript handshake nothing else is signed, so on an unencrypted
+// connection a signature can be relayed to a third peer.
+
+package proto
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/ed25519"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zif/zif/common"
+	"github.com/zif/zif/dht"
+	"github.com/zif/zif/util"
+)
+
+const CookieSize = 20
+
+// The initiator sends its side first, then receives the other. The responder
+// does the opposite, with an ok between the two.
+func cookieHandshake(cl *Client, initiator bool, lp handshaker, data common.Encoder, check func(*dht.Entry) error) (*dht.Entry, *MessageCapabilities, error) {
+	if initiator {
+		err := sendCookieHandshake(cl, lp, data)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		msg, err := cl.ReadMessage()
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if !msg.Ok() {
+			return nil, nil, errors.New("Peer refused handshake")
+		}
+
+		return receiveCookieHandshake(cl, check)
+	}
+
+	entry, caps, err := receiveCookieHandshake(cl, check)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = cl.WriteMessage(Message{Header: ProtoOk})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = sendCookieHandshake(cl, lp, data)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return entry, caps, nil
+}
+
+// Reads the entry and capabilities of the peer, then has it sign a cookie to
+// prove it holds the key for that entry.
+func receiveCookieHandshake(cl *Client, check func(*dht.Entry) error) (*dht.Entry, *MessageCapabilities, error) {
+	refuse := func(err error) (*dht.Entry, *MessageCapabilities, error) {
+		cl.WriteMessage(Message{Header: ProtoNo})
+		return nil, nil, err
+	}
+
+	header, err := cl.ReadMessage()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if header.Header != ProtoHeader {
+		return refuse(errors.New("Unexpected handshake message: " + header.Header))
+	}
+
+	var entry dht.Entry
+	err = header.Read(&entry)
+
+	if err != nil {
+		return refuse(err)
+	}
+
+	err = entry.Verify()
+
+	if err != nil {
+		return refuse(err)
+	}
+
+	// otherwise anyone could present an entry of their own under our address
+	address := dht.NewAddress(entry.PublicKey)
+
+	if !address.Equals(&entry.Address) {
+		return refuse(ErrHandshakeAddress)
+	}
+
+	if check != nil {
+		if err = check(&entry); err != nil {
+			return refuse(err)
+		}
+	}
+
+	err = cl.WriteMessage(Message{Header: ProtoOk})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	msg, err := cl.ReadMessage()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	caps := &MessageCapabilities{}
+	err = msg.Read(caps)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cookie, err := util.CryptoRandBytes(CookieSize)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	msg = &Message{Header: ProtoCookie}
+	err = msg.Write(cookie)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = cl.WriteMessage(msg)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	msg, err = cl.ReadMessage()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var signature []byte
+	err = msg.Read(&signature)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !ed25519.Verify(entry.PublicKey, append(cookie, cl.binding...), signature) {
+		log.Error("Failed to verify peer ", entry.Address.StringOr(""))
+		return refuse(ErrHandshakeSignature)
+	}
+
+	err = cl.WriteMessage(Message{Header: ProtoOk})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.WithField("peer", entry.Address.StringOr("")).Info("Handshake complete")
+
+	return &entry, caps, nil
+}
+
+// Sends our entry and capabilities, then signs the cookie the peer replies with.
+func sendCookieHandshake(cl *Client, lp handshaker, data common.Encoder) error {
+	entry, err := data.Encode()
+
+	if err != nil {
+		return err
+	}
+
+	err = cl.WriteMessage(Message{Header: ProtoHeader, Content: entry})
+
+	if err != nil {
+		return err
+	}
+
+	msg, err := cl.ReadMessage()
+
+	if err != nil {
+		return err
+	}
+
+	if !msg.Ok() {
+		return errors.New("Peer refused header")
+	}
+
+	msg = &Message{Header: ProtoCap}
+	err = msg.Write(lp.GetCapabilities())
+
+	if err != nil {
+		return err
+	}
+
+	err = cl.WriteMessage(msg)
+
+	if err != nil {
+		return err
+	}
+
+	msg, err = cl.ReadMessage()
+
+	if err != nil {
+		return err
+	}
+
+	if msg.Header != ProtoCookie {
+		return errors.New("Unexpected handshake message: " + msg.Header)
+	}
+
+	var cookie []byte
+	err = msg.Read(&cookie)
+
+	if err != nil {
+		return err
+	}
+
+	// anything longer could be made to look like something else we sign
+	if len(cookie) != CookieSize {
+		return errors.New("Invalid cookie")
+	}
+
+	msg = &Message{Header: ProtoSig}
+	err = msg.Write(lp.Sign(append(cookie, cl.binding...)))
+
+	if err != nil {
+		return err
+	}
+
+	err = cl.WriteMessage(msg)
+
+	if err != nil {
+		return err
+	}
+
+	msg, err = cl.ReadMessage()
+
+	if err != nil {
+		return err
+	}
+
+	if !msg.Ok() {
+		return errors.New("Peer refused signature")
+	}
+
+	return nil
+}
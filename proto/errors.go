@@ -0,0 +1,187 @@
+// Errors sent between peers. Any request can be answered with a ProtoError
+// instead of its usual reply, which the client returns as an *Error so that
+// callers can tell why it failed, and whether it is worth trying again.
+
+package proto
+
+import (
+	"fmt"
+	"time"
+)
+
+type ErrorCode int
+
+const (
+	// Something went wrong on the remote peer, through no fault of the request.
+	CodeInternal ErrorCode = iota + 1
+
+	// The request was malformed, or asked for something that is not allowed.
+	CodeInvalid
+
+	// Whatever was asked for does not exist on the remote peer.
+	CodeNotFound
+
+	// Too many requests, wait for RetryAfter before trying again.
+	CodeRateLimited
+
+	// The remote peer does not handle this kind of request.
+	CodeUnsupported
+
+	// The remote peer will not talk to us, during a handshake for instance.
+	CodeRefused
+)
+
+func (ec ErrorCode) String() string {
+	switch ec {
+	case CodeInternal:
+		return "internal error"
+	case CodeInvalid:
+		return "invalid request"
+	case CodeNotFound:
+		return "not found"
+	case CodeRateLimited:
+		return "rate limited"
+	case CodeUnsupported:
+		return "unsupported"
+	case CodeRefused:
+		return "refused"
+	}
+
+	return fmt.Sprintf("error %d", int(ec))
+}
+
+// An error from a remote peer, or one to be sent to it.
+type Error struct {
+	Code      ErrorCode
+	Retryable bool
+	Text      string
+
+	// How long to wait before trying again, zero if the peer did not say.
+	RetryAfter time.Duration
+}
+
+// Creates an error with the given code. Internal errors are retryable, as they
+// may well be temporary, anything else is not.
+func NewError(code ErrorCode, text string) *Error {
+	return &Error{Code: code, Retryable: code == CodeInternal, Text: text}
+}
+
+func NewErrorf(code ErrorCode, format string, args ...interface{}) *Error {
+	return NewError(code, fmt.Sprintf(format, args...))
+}
+
+// A rate limited error, asking to try again after the given time.
+func NewRateLimited(text string, retryAfter time.Duration) *Error {
+	return &Error{CodeRateLimited, true, text, retryAfter}
+}
+
+func (e *Error) Error() string {
+	if e.Text == "" {
+		return e.Code.String()
+	}
+
+	return e.Code.String() + ": " + e.Text
+}
+
+// The code of err if it is an *Error, zero otherwise.
+func ErrorCodeOf(err error) ErrorCode {
+	if e, ok := err.(*Error); ok {
+		return e.Code
+	}
+
+	return 0
+}
+
+// Whether err is an *Error with the given code.
+func IsCode(err error, code ErrorCode) bool {
+	return err != nil && ErrorCodeOf(err) == code
+}
+
+// Turns any error into one that can be sent to a peer. Errors that are not
+// already an *Error are internal.
+func toError(err error) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+
+	return NewError(CodeInternal, err.Error())
+}
+
+func (e *Error) message() MessageError {
+	return MessageError{
+		Code:       e.Code,
+		Retryable:  e.Retryable,
+		Text:       e.Text,
+		RetryAfter: int64(e.RetryAfter / time.Millisecond),
+	}
+}
+
+func (me *MessageError) err() *Error {
+	return &Error{
+		Code:       me.Code,
+		Retryable:  me.Retryable,
+		Text:       me.Text,
+		RetryAfter: time.Duration(me.RetryAfter) * time.Millisecond,
+	}
+}
+
+// If the message is an error, returns it as an *Error. Otherwise nil.
+func (m *Message) Err() error {
+	if m.Header == ProtoNo {
+		return m.legacyErr()
+	}
+
+	if m.Header != ProtoError {
+		return nil
+	}
+
+	me := MessageError{}
+	err := m.Read(&me)
+
+	if err != nil {
+		return NewError(CodeInternal, "malformed error: "+err.Error())
+	}
+
+	return me.err()
+}
+
+// Older peers answer with a bare ProtoNo when they refuse something, or one
+// carrying the error text when something went wrong handling the request.
+func (m *Message) legacyErr() *Error {
+	if len(m.Content) == 0 {
+		return NewError(CodeRefused, "")
+	}
+
+	var text string
+
+	if err := m.Read(&text); err != nil {
+		return NewError(CodeInternal, "malformed error: "+err.Error())
+	}
+
+	return NewError(CodeInternal, text)
+}
+
+// Reads a reply to a request, returning it as an error if that is what it is.
+func (c *Client) readReply() (*Message, error) {
+	msg, err := c.ReadMessage()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = msg.Err(); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// A peer sent an entry that does not verify, which is its fault rather than the
+// network's.
+type InvalidEntryError struct {
+	Err error
+}
+
+func (e *InvalidEntryError) Error() string {
+	return "Invalid entry: " + e.Err.Error()
+}
@@ -0,0 +1,76 @@
+package proto
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func reply(t *testing.T, msg *Message) error {
+	client, server := testClients(t)
+
+	go server.WriteMessage(msg)
+
+	_, err := client.readReply()
+
+	return err
+}
+
+func TestErrorRoundTrip(t *testing.T) {
+	sent := []*Error{
+		NewRateLimited("slow down", 1500*time.Millisecond),
+		NewError(CodeNotFound, "no such post"),
+		NewError(CodeInternal, ""),
+		{Code: CodeUnsupported, Retryable: true, Text: "not yet", RetryAfter: time.Minute},
+	}
+
+	for _, i := range sent {
+		client, server := testClients(t)
+
+		go server.WriteErr(i)
+
+		_, err := client.readReply()
+		e, ok := err.(*Error)
+
+		if !ok {
+			t.Fatal("Reply was not an *Error: ", err)
+		}
+
+		if *e != *i {
+			t.Errorf("Sent %+v, received %+v", *i, *e)
+		}
+	}
+}
+
+func TestErrorInternal(t *testing.T) {
+	client, server := testClients(t)
+
+	go server.WriteErr(errors.New("disk full"))
+
+	_, err := client.readReply()
+
+	if !IsCode(err, CodeInternal) || !err.(*Error).Retryable || err.(*Error).Text != "disk full" {
+		t.Fatal("Plain error was sent as ", err)
+	}
+}
+
+// Replies from peers that predate ProtoError are returned as an *Error too.
+func TestErrorLegacy(t *testing.T) {
+	err := reply(t, &Message{Header: ProtoNo})
+
+	if !IsCode(err, CodeRefused) {
+		t.Fatal("Bare ProtoNo was read as ", err)
+	}
+
+	msg := &Message{Header: ProtoNo}
+	msg.Write("disk full")
+	err = reply(t, msg)
+
+	if !IsCode(err, CodeInternal) || err.(*Error).Text != "disk full" {
+		t.Fatal("ProtoNo with text was read as ", err)
+	}
+
+	if err := reply(t, &Message{Header: ProtoOk}); err != nil {
+		t.Fatal("ProtoOk was read as ", err)
+	}
+}
@@ -0,0 +1,97 @@
+// Peer exchange. Right after a handshake, the peer that dialled sends a sample
+// of the fresh entries in its routing table, and the other sends a sample of its
+// own back. New peers fill their routing tables from the first few peers they
+// connect to, rather than waiting on lookups.
+
+package proto
+
+import (
+	"context"
+	"time"
+
+	"github.com/zif/zif/dht"
+)
+
+const (
+	// Advertised by peers that take part in exchanges.
+	CapabilityExchange = "dht.exchange"
+
+	// A sample of entries, answered with ProtoDhtEntries.
+	ProtoDhtExchange = "dht.exchange"
+
+	// The most entries sent in an exchange. Any more that are received are
+	// ignored.
+	ExchangeSize = 16
+
+	// Entries signed longer ago than this are neither sent nor taken.
+	ExchangeMaxAge = time.Hour * 24 * 7
+
+	// How far in the future an entry may have been signed, for clocks that are
+	// a little off.
+	ExchangeMaxSkew = time.Minute * 10
+)
+
+// Sends a sample of entries and reads the sample sent back.
+func (c *Client) Exchange(ctx context.Context, entries dht.Entries) (_ dht.Entries, err error) {
+	defer c.bind(ctx)(&err)
+
+	msg := &Message{Header: ProtoDhtExchange}
+	err = msg.Write(entries)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.WriteMessage(msg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := c.readReply()
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(dht.Entries, 0, ExchangeSize)
+	err = reply.Read(&ret)
+
+	return ret, err
+}
+
+// The entries of an exchange that are worth taking: no more than ExchangeSize,
+// properly signed and fresh. How many were badly signed is returned too, which
+// only a misbehaving peer sends.
+func CheckExchange(entries dht.Entries, now time.Time) (dht.Entries, int) {
+	if len(entries) > ExchangeSize {
+		entries = entries[:ExchangeSize]
+	}
+
+	ret := make(dht.Entries, 0, len(entries))
+	invalid := 0
+
+	for _, i := range entries {
+		if i == nil {
+			continue
+		}
+
+		if i.Verify() != nil {
+			invalid++
+			continue
+		}
+
+		if ExchangeFresh(i, now) {
+			ret = append(ret, i)
+		}
+	}
+
+	return ret, invalid
+}
+
+// Whether an entry was signed recently enough to exchange.
+func ExchangeFresh(entry *dht.Entry, now time.Time) bool {
+	updated := time.Unix(int64(entry.Updated), 0)
+
+	return updated.After(now.Add(-ExchangeMaxAge)) && updated.Before(now.Add(ExchangeMaxSkew))
+}
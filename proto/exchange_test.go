@@ -0,0 +1,71 @@
+package proto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zif/zif/dht"
+)
+
+// An entry of a new peer, signed at the given time.
+func signedAt(t *testing.T, at time.Time) *dht.Entry {
+	tp := newTestPeer(t)
+	tp.entry.Updated = uint64(at.Unix())
+
+	data, err := tp.entry.Bytes()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tp.entry.Signature = tp.Sign(data)
+
+	return &tp.entry
+}
+
+func TestCheckExchange(t *testing.T) {
+	now := time.Now()
+
+	fresh := signedAt(t, now.Add(-time.Hour))
+	stale := signedAt(t, now.Add(-ExchangeMaxAge-time.Hour))
+	future := signedAt(t, now.Add(ExchangeMaxSkew+time.Hour))
+
+	forged := signedAt(t, now)
+	forged.Name = "forged"
+
+	// properly signed, but by someone else than the owner of the address
+	stolen := signedAt(t, now)
+	stolen.Address = fresh.Address
+	stolen.Endpoints = []dht.Endpoint{dht.NewEndpoint("192.0.2.1", 5050)}
+
+	thief := newTestPeer(t)
+	stolen.PublicKey = thief.entry.PublicKey
+
+	data, err := stolen.Bytes()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stolen.Signature = thief.Sign(data)
+
+	checked, invalid := CheckExchange(dht.Entries{fresh, stale, nil, future, forged, stolen}, now)
+
+	if len(checked) != 1 || checked[0] != fresh || invalid != 2 {
+		t.Fatal("Wrong entries taken from an exchange: ", len(checked), invalid)
+	}
+
+	// anything past the limit is ignored, not checked
+	entries := make(dht.Entries, 0, ExchangeSize+1)
+
+	for i := 0; i < ExchangeSize; i++ {
+		entries = append(entries, fresh)
+	}
+
+	entries = append(entries, forged)
+	checked, invalid = CheckExchange(entries, now)
+
+	if len(checked) != ExchangeSize || invalid != 0 {
+		t.Fatal("Took more entries than an exchange may hold: ", len(checked), invalid)
+	}
+}
@@ -1,9 +1,23 @@
+// The handshake proves to each peer who is on the other end of a connection.
+//
+// Both sides send a hello holding their entry, capabilities, the version range
+// they support, the time and a fresh random nonce. Each then signs a hash of the
+// whole transcript: the negotiated version, the channel binding from the key
+// exchange, and both hellos exactly as they were sent. A signature is no good on
+// any other connection, in the other direction, or with anything changed, so it
+// cannot be relayed or replayed. Hellos that are too old, or reuse a nonce we
+// have already seen, are refused outright.
+
 package proto
 
 import (
+	"encoding/binary"
 	"errors"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/sha3"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/zif/zif/common"
@@ -11,223 +25,314 @@ import (
 	"github.com/zif/zif/util"
 )
 
-// Perform a handshake operation given a peer. server.go does the other end of this.
-func handshake(cl Client, lp common.Signer, data common.Encoder) (*dht.Entry, *MessageCapabilities, error) {
-	header, caps, err := handshake_recieve(cl)
+const (
+	// How far the clock of a peer may be from ours. Hellos outside of this are
+	// stale, and nonces only need to be remembered for this long either side.
+	HandshakeMaxSkew = time.Minute * 5
 
-	if err != nil {
-		cl.WriteErr(err)
-		return header, nil, err
-	}
+	HandshakeNonceSize = 32
 
-	if lp == nil {
-		cl.WriteErr(errors.New("Nil localpeer"))
-		return header, nil, errors.New("Handshake passed nil LocalPeer")
-	}
+	// Prefixes for everything hashed or signed in the handshake, so none of it can
+	// be mistaken for anything else that is signed with the same key.
+	handshakeTranscriptDomain = "zif handshake transcript v3"
+	handshakeInitiatorDomain  = "zif handshake initiator"
+	handshakeResponderDomain  = "zif handshake responder"
+)
 
-	cl.WriteMessage(Message{Header: ProtoOk})
-	err = handshake_send(cl, lp, data)
+var (
+	ErrHandshakeStale     = errors.New("Handshake is too old, or from the future")
+	ErrHandshakeReplay    = errors.New("Handshake nonce has been used before")
+	ErrHandshakeVersion   = errors.New("Handshake version does not match the one negotiated")
+	ErrHandshakeSignature = errors.New("Handshake signature not verified")
+	ErrHandshakeBinding   = errors.New("Handshake requires an encrypted connection")
+	ErrHandshakeAddress   = errors.New("Handshake entry address does not match its key")
+)
 
-	if err != nil {
-		return header, nil, err
-	}
+// All the handshake needs from the local peer.
+type handshaker interface {
+	common.Signer
+	GetCapabilities() *MessageCapabilities
+}
 
-	return header, caps, nil
+// Remembers the nonces in recent hellos, so that a recorded handshake cannot be
+// played back.
+type nonceCache struct {
+	lock sync.Mutex
+	seen map[string]time.Time
 }
 
-// Just recieves a handshake from a peer.
-func handshake_recieve(cl Client) (*dht.Entry, *MessageCapabilities, error) {
-	check := func(e error) bool {
-		if e != nil {
-			log.Error(e.Error())
-			cl.Close()
-			return true
+func newNonceCache() *nonceCache {
+	return &nonceCache{seen: make(map[string]time.Time)}
+}
+
+// Records a nonce, returning false if it has been seen already.
+func (nc *nonceCache) add(nonce []byte, now time.Time) bool {
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+
+	// anything older than this would be refused as stale anyway
+	for k, v := range nc.seen {
+		if now.Sub(v) > HandshakeMaxSkew*2 {
+			delete(nc.seen, k)
 		}
+	}
 
+	if _, ok := nc.seen[string(nonce)]; ok {
 		return false
 	}
 
-	log.Debug("Receiving handshake")
+	nc.seen[string(nonce)] = now
 
-	header, err := cl.ReadMessage()
-	log.Debug("Read header")
+	return true
+}
 
-	if check(err) {
-		cl.WriteMessage(Message{Header: ProtoNo})
-		return nil, nil, err
+// Shared by every connection in the process.
+var handshakeNonces = newNonceCache()
+
+// Performs a handshake over cl, which must already be encrypted unless the
+// version is older than ProtoVersionTranscript. The initiator is the side that
+// opened the connection. Returns the entry and capabilities of the remote peer
+// once it has proven that it holds the key for that entry. If check is given, it
+// can refuse the peer once its entry is known.
+func handshake(cl *Client, initiator bool, version int16, lp handshaker, data common.Encoder, check func(*dht.Entry) error) (*dht.Entry, *MessageCapabilities, error) {
+	if version < ProtoVersionTranscript {
+		return cookieHandshake(cl, initiator, lp, data, check)
 	}
 
-	log.Debug("Header recieved")
+	return handshakeWith(cl, initiator, version, lp, data, check, handshakeNonces, time.Now)
+}
+
+func handshakeWith(cl *Client, initiator bool, version int16, lp handshaker, data common.Encoder, check func(*dht.Entry) error, nonces *nonceCache, now func() time.Time) (*dht.Entry, *MessageCapabilities, error) {
+	// without a binding, a signature would be just as good on any connection
+	if len(cl.binding) == 0 {
+		return nil, nil, ErrHandshakeBinding
+	}
 
-	var entry dht.Entry
-	err = header.Read(&entry)
+	local, nonce, err := newHello(lp, data, now())
 
-	if check(err) {
-		cl.WriteMessage(Message{Header: ProtoNo})
+	if err != nil {
 		return nil, nil, err
 	}
 
-	err = entry.Verify()
+	var remote *Message
+
+	if initiator {
+		err = cl.WriteMessage(local)
+
+		if err == nil {
+			remote, err = readHandshake(cl, ProtoHello)
+		}
+	} else {
+		remote, err = readHandshake(cl, ProtoHello)
+	}
 
-	if check(err) {
-		cl.WriteMessage(Message{Header: ProtoNo})
+	if err != nil {
 		return nil, nil, err
 	}
 
-	log.WithFields(log.Fields{"peer": entry.Address.StringOr("")}).Info("Incoming connection")
+	entry, hello, err := checkHello(remote, version, nonce, nonces, now())
 
-	err = cl.WriteMessage(Message{Header: ProtoOk})
+	if err == nil && check != nil {
+		err = check(entry)
+	}
 
-	if check(err) {
+	if err != nil {
+		cl.WriteErr(NewError(CodeRefused, err.Error()))
 		return nil, nil, err
 	}
 
-	// read the caps from the peer
-	peerCapsMsg, err := cl.ReadMessage()
+	log.WithField("peer", entry.Address.StringOr("")).Debug("Hello recieved")
 
-	if check(err) {
-		return nil, nil, err
+	if !initiator {
+		err = cl.WriteMessage(local)
+
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
-	peerCaps := &MessageCapabilities{}
-	peerCapsMsg.Read(peerCaps)
+	var t []byte
+	var ours, theirs string
 
-	// Send the client a cookie for them to sign, this proves they have the
-	// private key, and it is highly unlikely an attacker has a signed cookie
-	// cached.
-	cookie, err := util.CryptoRandBytes(20)
+	if initiator {
+		t = transcript(version, cl.binding, local.Content, remote.Content)
+		ours, theirs = handshakeInitiatorDomain, handshakeResponderDomain
+	} else {
+		t = transcript(version, cl.binding, remote.Content, local.Content)
+		ours, theirs = handshakeResponderDomain, handshakeInitiatorDomain
+	}
 
-	if check(err) {
+	sig := &Message{Header: ProtoSig}
+	err = sig.Write(lp.Sign(append([]byte(ours), t...)))
+
+	if err != nil {
 		return nil, nil, err
 	}
-	msg := Message{Header: ProtoCookie}
-	err = msg.Write(cookie)
+
+	// the initiator proves itself first, the responder only signs once it knows
+	// who it is talking to
+	if initiator {
+		err = cl.WriteMessage(sig)
+
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	msg, err := readHandshake(cl, ProtoSig)
 
 	if err != nil {
 		return nil, nil, err
 	}
 
-	err = cl.WriteMessage(msg)
+	var signature []byte
+	err = msg.Read(&signature)
 
-	if check(err) {
+	if err != nil {
 		return nil, nil, err
 	}
 
-	sig, err := cl.ReadMessage()
+	if !ed25519.Verify(entry.PublicKey, append([]byte(theirs), t...), signature) {
+		log.Error("Failed to verify peer ", entry.Address.StringOr(""))
+		cl.WriteErr(NewError(CodeRefused, ErrHandshakeSignature.Error()))
 
-	if check(err) {
-		return nil, nil, err
+		return nil, nil, ErrHandshakeSignature
 	}
 
-	// need to decompress the signature before verifying
-	var signature [ed25519.SignatureSize]byte
-	sig.Read(&signature)
-	verified := ed25519.Verify(entry.PublicKey, cookie, signature[:])
+	if initiator {
+		err = cl.WriteMessage(Message{Header: ProtoOk})
+	} else {
+		err = cl.WriteMessage(sig)
 
-	if !verified {
-		log.Error("Failed to verify peer ", entry.Address.StringOr(""))
-		cl.WriteMessage(Message{Header: ProtoNo})
-		cl.Close()
-		return nil, nil, errors.New("Signature not verified")
+		if err == nil {
+			_, err = readHandshake(cl, ProtoOk)
+		}
 	}
 
-	cl.WriteMessage(Message{Header: ProtoOk})
+	if err != nil {
+		return nil, nil, err
+	}
 
-	log.WithFields(log.Fields{"peer": entry.Address.StringOr("")}).Info("Verified")
+	log.WithField("peer", entry.Address.StringOr("")).Info("Handshake complete")
 
-	return &entry, peerCaps, nil
+	return entry, &hello.Capabilities, nil
 }
 
-// Sends a handshake to a peer.
-func handshake_send(cl Client, lp common.Signer, data common.Encoder) error {
-	log.Debug("Handshaking with ", cl.conn.RemoteAddr().String())
-
-	/*binary.Write(cl.conn, binary.BigEndian, ProtoZif)
-	binary.Write(cl.conn, binary.BigEndian, ProtoVersion)*/
+// Reads the next handshake message, which must have the given header. A refusal
+// from the peer is returned as an *Error.
+func readHandshake(cl *Client, header string) (*Message, error) {
+	msg, err := cl.ReadMessage()
 
-	header := Message{
-		Header: ProtoHeader,
+	if err != nil {
+		return nil, err
 	}
 
-	err := header.Write(data)
+	if err = msg.Err(); err != nil {
+		return nil, err
+	}
 
-	if err != nil {
-		return err
+	if msg.Header != header {
+		return nil, errors.New("Unexpected handshake message: " + msg.Header)
 	}
 
-	err = cl.WriteMessage(header)
+	return msg, nil
+}
+
+func newHello(lp handshaker, data common.Encoder, now time.Time) (*Message, []byte, error) {
+	entry, err := data.Encode()
 
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	msg, err := cl.ReadMessage()
+	nonce, err := util.CryptoRandBytes(HandshakeNonceSize)
 
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	if !msg.Ok() {
-		return errors.New("Peer refused header")
+	hello := MessageHello{
+		Entry:        entry,
+		Capabilities: *lp.GetCapabilities(),
+		Min:          ProtoVersionMin,
+		Max:          ProtoVersionMax,
+		Time:         now.Unix(),
+		Nonce:        nonce,
 	}
 
-	log.Debug("Header sent, sending cap")
-
-	msgCaps := Message{
-		Header: ProtoCap,
-	}
+	msg := &Message{Header: ProtoHello}
+	err = msg.Write(hello)
 
-	msgCaps.Write(lp.(ProtocolHandler).GetCapabilities())
+	return msg, nonce, err
+}
 
-	err = cl.WriteMessage(msgCaps)
+// Decodes a hello from a peer and makes sure it is fit to be signed: the entry is
+// valid, it is fresh, and it agrees on the version. local is our own nonce, a
+// peer sending that back is reflecting our hello at us.
+func checkHello(msg *Message, version int16, local []byte, nonces *nonceCache, now time.Time) (*dht.Entry, *MessageHello, error) {
+	hello := &MessageHello{}
+	err := msg.Read(hello)
 
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	msg, err = cl.ReadMessage()
-	log.Debug("Cookie")
+	entry, err := dht.DecodeEntry(hello.Entry, false)
 
 	if err != nil {
-		log.Error(err.Error())
-		return err
+		return nil, nil, err
 	}
 
-	log.Info("Cookie recieved, signing")
-
-	// the peer expects us to sign the *decompressed* cookie. So do that.
-	var cookie [20]byte
-	msg.Read(&cookie)
-	sig := lp.Sign(cookie[:])
+	err = entry.Verify()
 
-	msg = &Message{
-		Header: ProtoSig,
+	if err != nil {
+		return nil, nil, err
 	}
 
-	err = msg.Write(sig)
+	// otherwise anyone could present an entry of their own under our address
+	address := dht.NewAddress(entry.PublicKey)
 
-	if err != nil {
-		return err
+	if !address.Equals(&entry.Address) {
+		return nil, nil, ErrHandshakeAddress
 	}
 
-	err = cl.WriteMessage(msg)
+	// the version was agreed before anything was encrypted, so make sure nobody
+	// talked us down to an older one
+	negotiated, err := NegotiateVersion(ProtoVersionMin, ProtoVersionMax, hello.Min, hello.Max)
 
-	if err != nil {
-		return err
+	if err != nil || negotiated != version {
+		return nil, nil, ErrHandshakeVersion
 	}
 
-	msg, err = cl.ReadMessage()
-	log.Debug("Written cookie")
+	sent := time.Unix(hello.Time, 0)
 
-	if err != nil {
-		return err
+	if sent.Before(now.Add(-HandshakeMaxSkew)) || sent.After(now.Add(HandshakeMaxSkew)) {
+		return nil, nil, ErrHandshakeStale
 	}
 
-	if !msg.Ok() {
-		return errors.New("Peer refused signature")
+	if len(hello.Nonce) != HandshakeNonceSize || string(hello.Nonce) == string(local) {
+		return nil, nil, ErrHandshakeReplay
 	}
 
-	log.Info("Handshake sent ok")
+	if !nonces.add(hello.Nonce, now) {
+		return nil, nil, ErrHandshakeReplay
+	}
+
+	return entry, hello, nil
+}
+
+// Hashes everything both peers have said, in the order the initiator then the
+// responder said it. Each part is length prefixed, so no two transcripts hash the
+// same input.
+func transcript(version int16, binding, initiator, responder []byte) []byte {
+	hash := sha3.New256()
+	hash.Write([]byte(handshakeTranscriptDomain))
+	binary.Write(hash, binary.BigEndian, version)
+
+	for _, i := range [][]byte{binding, initiator, responder} {
+		binary.Write(hash, binary.BigEndian, uint32(len(i)))
+		hash.Write(i)
+	}
 
-	return nil
+	return hash.Sum(nil)
 }
@@ -0,0 +1,274 @@
+package proto
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/zif/zif/dht"
+)
+
+type testPeer struct {
+	private ed25519.PrivateKey
+	entry   dht.Entry
+}
+
+func newTestPeer(t *testing.T) *testPeer {
+	pub, priv, err := ed25519.GenerateKey(nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry := dht.Entry{
+		Address:       dht.NewAddress(pub),
+		Name:          "test",
+		PublicAddress: "localhost",
+		PublicKey:     pub,
+		Port:          5050,
+	}
+
+	data, err := entry.Bytes()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry.Signature = ed25519.Sign(priv, data)
+
+	return &testPeer{priv, entry}
+}
+
+func (tp *testPeer) Sign(msg []byte) []byte {
+	return ed25519.Sign(tp.private, msg)
+}
+
+func (tp *testPeer) PublicKey() []byte {
+	return tp.entry.PublicKey
+}
+
+func (tp *testPeer) GetCapabilities() *MessageCapabilities {
+	return &MessageCapabilities{Compression: []string{CompressionNone}}
+}
+
+type handshakeResult struct {
+	entry *dht.Entry
+	err   error
+}
+
+// Runs one side of a handshake over conn, as though it had been encrypted with
+// the given binding.
+func runHandshake(t *testing.T, conn net.Conn, binding []byte, initiator bool, tp *testPeer, nonces *nonceCache, now func() time.Time) chan handshakeResult {
+	ret := make(chan handshakeResult, 1)
+
+	cl, err := NewClient(conn)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cl.binding = binding
+
+	go func() {
+		entry, _, err := handshakeWith(cl, initiator, ProtoVersionMax, tp, tp.entry, nil, nonces, now)
+
+		// make sure the other side is not left waiting
+		if err != nil {
+			conn.Close()
+		}
+
+		ret <- handshakeResult{entry, err}
+	}()
+
+	return ret
+}
+
+// Records everything written to a connection.
+type recordingConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (rc *recordingConn) Write(b []byte) (int, error) {
+	rc.written.Write(b)
+	return rc.Conn.Write(b)
+}
+
+func TestHandshake(t *testing.T) {
+	a, b := newTestPeer(t), newTestPeer(t)
+	connA, connB := net.Pipe()
+	binding := []byte("binding")
+
+	runA := runHandshake(t, connA, binding, true, a, newNonceCache(), time.Now)
+	runB := runHandshake(t, connB, binding, false, b, newNonceCache(), time.Now)
+	resA, resB := <-runA, <-runB
+
+	if resA.err != nil || resB.err != nil {
+		t.Fatal(resA.err, resB.err)
+	}
+
+	if !resA.entry.Address.Equals(&b.entry.Address) || !resB.entry.Address.Equals(&a.entry.Address) {
+		t.Fatal("Handshake returned the wrong entries")
+	}
+}
+
+// Mallory sits between two peers and passes every message along untouched. Each
+// peer has a separate encrypted channel with Mallory, so the bindings differ and
+// neither signature should be accepted.
+func TestHandshakeRelay(t *testing.T) {
+	a, b := newTestPeer(t), newTestPeer(t)
+
+	connA, malloryA := net.Pipe()
+	malloryB, connB := net.Pipe()
+
+	go io.Copy(malloryB, malloryA)
+	go io.Copy(malloryA, malloryB)
+
+	resA := runHandshake(t, connA, []byte("binding a"), true, a, newNonceCache(), time.Now)
+	resB := runHandshake(t, connB, []byte("binding b"), false, b, newNonceCache(), time.Now)
+
+	if err := (<-resB).err; err != ErrHandshakeSignature {
+		t.Fatal("Responder accepted a relayed handshake: ", err)
+	}
+
+	if (<-resA).err == nil {
+		t.Fatal("Initiator accepted a relayed handshake")
+	}
+
+	malloryA.Close()
+	malloryB.Close()
+}
+
+// Plays back a recording of an initiator that has already handshaken, on a
+// connection with the very same binding.
+func TestHandshakeReplay(t *testing.T) {
+	a, b := newTestPeer(t), newTestPeer(t)
+	nonces := newNonceCache()
+	binding := []byte("binding")
+
+	connA, connB := net.Pipe()
+	recorded := &recordingConn{Conn: connA}
+
+	resA := runHandshake(t, recorded, binding, true, a, newNonceCache(), time.Now)
+	resB := runHandshake(t, connB, binding, false, b, nonces, time.Now)
+
+	if (<-resA).err != nil || (<-resB).err != nil {
+		t.Fatal("Handshake failed")
+	}
+
+	mallory, connB := net.Pipe()
+
+	go io.Copy(mallory, &recorded.written)
+	go io.Copy(ioutil.Discard, mallory)
+
+	if err := (<-runHandshake(t, connB, binding, false, b, nonces, time.Now)).err; err != ErrHandshakeReplay {
+		t.Fatal("Replayed handshake was not refused: ", err)
+	}
+
+	mallory.Close()
+}
+
+func TestHandshakeStale(t *testing.T) {
+	a, b := newTestPeer(t), newTestPeer(t)
+	binding := []byte("binding")
+
+	later := func() time.Time {
+		return time.Now().Add(HandshakeMaxSkew * 2)
+	}
+
+	connA, connB := net.Pipe()
+
+	resA := runHandshake(t, connA, binding, true, a, newNonceCache(), time.Now)
+	resB := runHandshake(t, connB, binding, false, b, newNonceCache(), later)
+
+	if err := (<-resB).err; err != ErrHandshakeStale {
+		t.Fatal("Stale handshake was not refused: ", err)
+	}
+
+	if (<-resA).err == nil {
+		t.Fatal("Initiator thinks a refused handshake succeeded")
+	}
+}
+
+func TestHandshakeImpersonation(t *testing.T) {
+	a, b := newTestPeer(t), newTestPeer(t)
+
+	// a presents the entry of b, but can only sign with its own key
+	impostor := &testPeer{a.private, b.entry}
+
+	connA, connB := net.Pipe()
+	binding := []byte("binding")
+
+	resA := runHandshake(t, connA, binding, true, impostor, newNonceCache(), time.Now)
+	resB := runHandshake(t, connB, binding, false, b, newNonceCache(), time.Now)
+
+	if err := (<-resB).err; err != ErrHandshakeSignature {
+		t.Fatal("Impostor was not refused: ", err)
+	}
+
+	<-resA
+}
+
+// Peers that have not upgraded still sign a cookie, with or without a binding
+// depending on whether their version encrypts the connection.
+func TestCookieHandshake(t *testing.T) {
+	for _, version := range []int16{ProtoVersionMin, ProtoVersionSecure} {
+		a, b := newTestPeer(t), newTestPeer(t)
+		impostor := &testPeer{a.private, b.entry}
+
+		var binding []byte
+
+		if version >= ProtoVersionSecure {
+			binding = []byte("binding")
+		}
+
+		for _, initiator := range []*testPeer{a, impostor} {
+			connA, connB := net.Pipe()
+			clA, _ := NewClient(connA)
+			clB, _ := NewClient(connB)
+			clA.binding, clB.binding = binding, binding
+
+			resA := make(chan handshakeResult, 1)
+
+			go func() {
+				entry, _, err := handshake(clA, true, version, initiator, initiator.entry, nil)
+
+				if err != nil {
+					connA.Close()
+				}
+
+				resA <- handshakeResult{entry, err}
+			}()
+
+			entry, _, err := handshake(clB, false, version, b, b.entry, nil)
+
+			if initiator == impostor {
+				if err != ErrHandshakeSignature {
+					t.Fatal("Impostor was not refused at version ", version, ": ", err)
+				}
+
+				connB.Close()
+				<-resA
+
+				continue
+			}
+
+			if err != nil {
+				t.Fatal("Handshake at version ", version, " failed: ", err)
+			}
+
+			if res := <-resA; res.err != nil || !res.entry.Address.Equals(&b.entry.Address) {
+				t.Fatal("Initiator handshake at version ", version, " gave ", res.err)
+			}
+
+			if !entry.Address.Equals(&a.entry.Address) {
+				t.Fatal("Handshake at version ", version, " returned the wrong entry")
+			}
+		}
+	}
+}
@@ -1,27 +1,19 @@
 package proto
 
 import (
+	"context"
 	"net"
 
 	"github.com/hashicorp/yamux"
 	"github.com/zif/zif/common"
 	"github.com/zif/zif/dht"
+	"github.com/zif/zif/util"
 )
 
 type ProtocolHandler interface {
 	common.Signer
 	NetworkPeer
 
-	HandleAnnounce(*Message) error
-	HandleQuery(*Message) error
-	HandleFindClosest(*Message) error
-	HandleSearch(*Message) error
-	HandleRecent(*Message) error
-	HandlePopular(*Message) error
-	HandleHashList(*Message) error
-	HandlePiece(*Message) error
-	HandleAddPeer(*Message) error
-
 	HandleHandshake(ConnHeader) (NetworkPeer, error)
 	HandleCloseConnection(*dht.Address)
 
@@ -36,9 +28,20 @@ type NetworkPeer interface {
 	Session() *yamux.Session
 	AddStream(net.Conn)
 
+	// Limits the bandwidth of a stream accepted from the peer.
+	ShapeStream(net.Conn) net.Conn
+
+	// Limits the requests the peer makes, nil if it is not limited.
+	Limiter() *util.PeerLimiter
+
 	Address() *dht.Address
-	Query(dht.Address) (common.Verifier, error)
-	FindClosest(dht.Address) ([]common.Verifier, error)
+	Query(context.Context, dht.Address) (common.Verifier, error)
+	FindClosest(context.Context, dht.Address) ([]common.Verifier, error)
+	GetCapabilities() *MessageCapabilities
 	SetCapabilities(MessageCapabilities)
 	UpdateSeen()
+
+	// The compression negotiated with this peer.
+	Compression() string
+	CompressionStats() *CompressionStats
 }
@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"errors"
 
-	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/sha3"
 )
 
@@ -24,15 +23,60 @@ type MessageSearchQuery struct {
 	Page  int
 }
 
+// Asks for a page of posts, see posts.go.
+type MessagePostQuery struct {
+	// Only used for searches.
+	Query string
+
+	// From the ProtoDone ending the previous page, nil for the first.
+	Cursor []byte
+
+	// The server may send fewer, see PostPageMax.
+	PageSize int
+}
+
 type MessageRequestPiece struct {
 	Address string
 	Id      int
 	Length  int
+
+	// How the pieces should be sent, see ChoosePieceFormat. Older peers do not
+	// send this, in which case it is empty and text is used.
+	Format string
 }
 
-// Allows us to decode a pieces without also decoding all of the posts within it.
+// Sent ahead of the posts in a piece when the framed format is in use. The posts
+// follow in ProtoPosts messages, Count of them in total, and must hash to Hash.
 type MessagePiece struct {
-	Posts interface{}
+	Id    int
+	Count int
+	Hash  []byte
+}
+
+// Exchanged when a connection is opened. The range of versions the sender
+// supports, and in a reply, the version that has been chosen. If there is no
+// shared version, Reason says why.
+type MessageVersion struct {
+	Min      int16
+	Max      int16
+	Selected int16
+	Reason   string
+}
+
+// Sent by both peers to start a handshake, see handshake.go.
+type MessageHello struct {
+	// The msgpack encoded entry of the sender.
+	Entry        []byte
+	Capabilities MessageCapabilities
+
+	// The range of versions the sender supports, as sent before the connection was
+	// encrypted.
+	Min int16
+	Max int16
+
+	// Unix time the hello was sent.
+	Time  int64
+	Nonce []byte
 }
 
 type MessageCapabilities struct {
@@ -40,19 +84,22 @@ type MessageCapabilities struct {
 	// Index 0 is the preferred method. The method used is the shared method
 	// with the lowest index.
 	Compression []string
-}
 
-func (mp *MessagePiece) Hash() ([]byte, error) {
-	hash := sha3.New256()
+	// The formats pieces can be sent in, chosen the same way as compression.
+	Pieces []string
 
-	//for _, i := range mp.Posts {
-	//h := sha3.Sum256([]byte(i))
-	//hash.Write(h[:])
-	//}
+	// Optional message types this peer can handle, see Server.HandleCapability.
+	Extensions []string
+}
 
-	log.Info("Piece hashed")
+// Sent in place of a reply when a request fails, see errors.go.
+type MessageError struct {
+	Code      ErrorCode
+	Retryable bool
+	Text      string
 
-	return hash.Sum(nil), nil
+	// In milliseconds, zero if not given.
+	RetryAfter int64
 }
 
 func (mhl *MessageCollection) Verify(root []byte) error {
@@ -1,10 +1,43 @@
 // a few network helpers
 package proto
 
-import "github.com/zif/zif/dht"
+import (
+	"context"
+	"net"
+
+	"github.com/zif/zif/dht"
+)
 
 type ConnHeader struct {
 	Client       Client
 	Entry        dht.Entry
 	Capabilities MessageCapabilities
+
+	// The protocol version negotiated for this connection.
+	Version int16
+}
+
+// Applies the deadline of ctx to conn, and closes conn if ctx is cancelled. The
+// returned function stops watching ctx, and must always be called.
+func bindConn(ctx context.Context, conn net.Conn) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// this context can never be cancelled, so there is nothing to watch
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	return func() { close(done) }
 }
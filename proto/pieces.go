@@ -0,0 +1,209 @@
+// The framed piece format. Every piece is a MessagePiece header followed by its
+// posts in batches, each an ordinary message, so nothing in a post can be
+// mistaken for framing and the usual message compression applies.
+
+package proto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/zif/zif/data"
+)
+
+// How many posts are sent in each ProtoPosts message within a piece.
+const PieceBatchSize = 100
+
+// Groups posts into pieces of data.PieceSize and writes them to cl, followed by
+// ProtoDone. start is the id of the first piece. posts is always drained, so
+// whatever is producing it is never left blocked.
+func WritePieces(cl *Client, start int, posts <-chan *data.Post) error {
+	var err error
+
+	defer func() {
+		for range posts {
+		}
+	}()
+
+	id := start
+	piece := data.Piece{}
+	piece.Setup()
+
+	for post := range posts {
+		piece.Add(*post, true)
+
+		if len(piece.Posts) < data.PieceSize {
+			continue
+		}
+
+		err = writePiece(cl, id, &piece)
+
+		if err != nil {
+			return err
+		}
+
+		id++
+		piece = data.Piece{}
+		piece.Setup()
+	}
+
+	if len(piece.Posts) > 0 {
+		err = writePiece(cl, id, &piece)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return cl.WriteMessage(&Message{Header: ProtoDone})
+}
+
+// Each message of a piece is given StreamTimeout to be written.
+func writePiece(cl *Client, id int, piece *data.Piece) error {
+	msg := &Message{Header: ProtoPiece}
+	err := msg.Write(MessagePiece{
+		Id:    id,
+		Count: len(piece.Posts),
+		Hash:  piece.Hash(),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	err = cl.ExtendDeadline()
+
+	if err != nil {
+		return err
+	}
+
+	err = cl.WriteMessage(msg)
+
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(piece.Posts); i += PieceBatchSize {
+		end := i + PieceBatchSize
+
+		if end > len(piece.Posts) {
+			end = len(piece.Posts)
+		}
+
+		msg := &Message{Header: ProtoPosts}
+		err = msg.Write(piece.Posts[i:end])
+
+		if err != nil {
+			return err
+		}
+
+		err = cl.ExtendDeadline()
+
+		if err != nil {
+			return err
+		}
+
+		err = cl.WriteMessage(msg)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reads pieces written by WritePieces until ProtoDone, sending each to ret once
+// its posts have been checked against the piece header. At most length pieces are
+// accepted. Each message is given StreamTimeout to arrive, as with writePiece.
+func readPieces(cl *Client, length int, ret chan<- *data.Piece) error {
+	for n := 0; ; n++ {
+		err := cl.ExtendDeadline()
+
+		if err != nil {
+			return err
+		}
+
+		msg, err := cl.readReply()
+
+		if err != nil {
+			return err
+		}
+
+		if msg.Header == ProtoDone {
+			return nil
+		}
+
+		if msg.Header != ProtoPiece {
+			return fmt.Errorf("Expected piece, got %s", msg.Header)
+		}
+
+		if n >= length {
+			return errors.New("Peer sent more pieces than requested")
+		}
+
+		header := MessagePiece{}
+		err = msg.Read(&header)
+
+		if err != nil {
+			return err
+		}
+
+		piece, err := readPiece(cl, header)
+
+		if err != nil {
+			return err
+		}
+
+		ret <- piece
+	}
+}
+
+func readPiece(cl *Client, header MessagePiece) (*data.Piece, error) {
+	if header.Count < 0 || header.Count > data.PieceSize {
+		return nil, fmt.Errorf("Invalid piece post count: %d", header.Count)
+	}
+
+	piece := &data.Piece{Id: uint(header.Id)}
+	piece.Setup()
+
+	for len(piece.Posts) < header.Count {
+		err := cl.ExtendDeadline()
+
+		if err != nil {
+			return nil, err
+		}
+
+		msg, err := cl.readReply()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if msg.Header != ProtoPosts {
+			return nil, fmt.Errorf("Expected posts, got %s", msg.Header)
+		}
+
+		var posts []data.Post
+		err = msg.Read(&posts)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(piece.Posts)+len(posts) > header.Count {
+			return nil, errors.New("Piece contains more posts than its header says")
+		}
+
+		for _, i := range posts {
+			piece.Add(i, true)
+		}
+	}
+
+	if !bytes.Equal(piece.Hash(), header.Hash) {
+		return nil, errors.New("Piece does not match its header hash")
+	}
+
+	return piece, nil
+}
@@ -0,0 +1,131 @@
+package proto
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/zif/zif/data"
+)
+
+// Posts with text that would have broken the "|" separated text format.
+func awkwardPosts(count int) []data.Post {
+	titles := []string{
+		"a | b | c",
+		"one\ntwo\r\nthree",
+		"日本語のタイトル | ünïcödé ✓",
+		"|||",
+		"\n",
+	}
+
+	ret := make([]data.Post, count)
+
+	for i := range ret {
+		ret[i] = data.Post{
+			Id:         i,
+			InfoHash:   fmt.Sprintf("%040d", i),
+			Title:      fmt.Sprintf("%s %d", titles[i%len(titles)], i),
+			Size:       i * 1024,
+			FileCount:  1,
+			UploadDate: 1500000000 + i,
+			Tags:       "tag|other,\nnext,ταγ",
+			Meta:       `{"a":"|"}`,
+		}
+	}
+
+	return ret
+}
+
+func TestPiecesRoundTrip(t *testing.T) {
+	// spans several pieces, the last one partly full
+	posts := awkwardPosts(data.PieceSize*2 + 10)
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	writer, err := NewClient(local)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewClient(remote)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	written := make(chan error, 1)
+
+	go func() {
+		ch := make(chan *data.Post)
+
+		go func() {
+			defer close(ch)
+
+			for i := range posts {
+				ch <- &posts[i]
+			}
+		}()
+
+		written <- WritePieces(writer, 5, ch)
+	}()
+
+	pieces := make(chan *data.Piece, 10)
+
+	if err := readPieces(reader, 10, pieces); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+
+	close(pieces)
+
+	id := uint(5)
+	n := 0
+
+	for piece := range pieces {
+		if piece.Id != id {
+			t.Fatal("Read piece ", piece.Id, ", expected ", id)
+		}
+
+		for _, i := range piece.Posts {
+			if i != posts[n] {
+				t.Fatalf("Post %d came back as %+v, expected %+v", n, i, posts[n])
+			}
+
+			n++
+		}
+
+		id++
+	}
+
+	if n != len(posts) {
+		t.Fatal("Read ", n, " posts, expected ", len(posts))
+	}
+}
+
+func TestChoosePieceFormat(t *testing.T) {
+	both := []string{PieceFormatFramed, PieceFormatText}
+
+	cases := []struct {
+		client, server []string
+		expected       string
+	}{
+		{both, both, PieceFormatFramed},
+		{nil, both, PieceFormatText},
+		{both, nil, PieceFormatText},
+		{[]string{PieceFormatText}, both, PieceFormatText},
+	}
+
+	for _, i := range cases {
+		chosen := ChoosePieceFormat(MessageCapabilities{Pieces: i.client}, MessageCapabilities{Pieces: i.server})
+
+		if chosen != i.expected {
+			t.Error("Chose ", chosen, " for ", i.client, " and ", i.server, ", expected ", i.expected)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Pages of posts, for search, recent and popular. Rather than a single message
+// holding a fixed page, posts are streamed in batches and followed by ProtoDone,
+// which carries a cursor for the next page. The cursor is opaque to the client,
+// it is only ever passed back to the peer that made it.
+
+package proto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/zif/zif/data"
+)
+
+const (
+	// Advertised by peers that answer the stream headers.
+	CapabilityPostStream = "posts.stream"
+
+	// The page size used if the client does not ask for one.
+	PostPageDefault = 25
+
+	// The most posts a peer will send in one page, whatever is asked for.
+	PostPageMax = 500
+
+	// How many posts are sent in each ProtoPosts message of a page.
+	PostBatchSize = 50
+)
+
+// The page size to use for a request, within the bounds the server allows.
+func PostPageSize(requested int) int {
+	if requested <= 0 {
+		return PostPageDefault
+	}
+
+	if requested > PostPageMax {
+		return PostPageMax
+	}
+
+	return requested
+}
+
+// Whether a peer advertised the given extension.
+func HasExtension(caps *MessageCapabilities, name string) bool {
+	if caps == nil {
+		return false
+	}
+
+	for _, i := range caps.Extensions {
+		if i == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Writes a page of posts in batches, then ProtoDone with the cursor for the next
+// page. A nil cursor tells the client there is nothing more.
+func WritePosts(cl *Client, posts []*data.Post, cursor []byte) error {
+	for i := 0; i < len(posts); i += PostBatchSize {
+		end := i + PostBatchSize
+
+		if end > len(posts) {
+			end = len(posts)
+		}
+
+		msg := &Message{Header: ProtoPosts}
+		err := msg.Write(posts[i:end])
+
+		if err != nil {
+			return err
+		}
+
+		err = cl.WriteMessage(msg)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	done := &Message{Header: ProtoDone}
+	err := done.Write(cursor)
+
+	if err != nil {
+		return err
+	}
+
+	return cl.WriteMessage(done)
+}
+
+// Reads a page written by WritePosts, accepting at most limit posts.
+func readPosts(cl *Client, limit int) ([]*data.Post, []byte, error) {
+	ret := make([]*data.Post, 0, limit)
+
+	for {
+		msg, err := cl.ReadMessage()
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch msg.Header {
+		case ProtoPosts:
+			var posts []*data.Post
+			err = msg.Read(&posts)
+
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if len(ret)+len(posts) > limit {
+				return nil, nil, errors.New("Peer sent more posts than requested")
+			}
+
+			ret = append(ret, posts...)
+
+		case ProtoDone:
+			var cursor []byte
+			err = msg.Read(&cursor)
+
+			return ret, cursor, err
+
+		case ProtoError:
+			return nil, nil, msg.Err()
+
+		default:
+			return nil, nil, fmt.Errorf("Expected posts, got %s", msg.Header)
+		}
+	}
+}
+
+func (c *Client) postPage(ctx context.Context, header string, query MessagePostQuery) (_ []*data.Post, _ []byte, err error) {
+	defer c.bind(ctx)(&err)
+
+	query.PageSize = PostPageSize(query.PageSize)
+
+	msg := &Message{Header: header}
+	err = msg.Write(query)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = c.WriteMessage(msg)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return readPosts(c, query.PageSize)
+}
+
+// Searches the posts of a peer, a page at a time. cursor is nil for the first
+// page, after that it should be whatever the last page returned. The returned
+// cursor is nil once there are no more results.
+func (c *Client) SearchPage(ctx context.Context, search string, cursor []byte, pageSize int) ([]*data.Post, []byte, error) {
+	return c.postPage(ctx, ProtoSearchStream, MessagePostQuery{search, cursor, pageSize})
+}
+
+// Pages through the posts of a peer, newest first. See SearchPage for cursors.
+func (c *Client) RecentPage(ctx context.Context, cursor []byte, pageSize int) ([]*data.Post, []byte, error) {
+	return c.postPage(ctx, ProtoRecentStream, MessagePostQuery{"", cursor, pageSize})
+}
+
+// Pages through the posts of a peer, most popular first. See SearchPage for
+// cursors.
+func (c *Client) PopularPage(ctx context.Context, cursor []byte, pageSize int) ([]*data.Post, []byte, error) {
+	return c.postPage(ctx, ProtoPopularStream, MessagePostQuery{"", cursor, pageSize})
+}
@@ -4,25 +4,54 @@ package proto
 
 var (
 	// Protocol header, so we know this is a zif client.
-	// Version should follow.
-	ProtoZif     int16 = 0x7a66
-	ProtoVersion int16 = 0x0000
+	// The range of versions the peer supports should follow.
+	ProtoZif int16 = 0x7a66
 
+	// The range of protocol versions we are able to speak. Both ends of a
+	// connection advertise their range, and the highest version they share is
+	// used for the rest of the connection.
+	ProtoVersionMin int16 = 0x0001
+	ProtoVersionMax int16 = 0x0003
+
+	// From this version on, connections are encrypted before the handshake.
+	ProtoVersionSecure int16 = 0x0002
+
+	// From this version on, the handshake signs the whole transcript rather than
+	// a cookie, see cookiehandshake.go for the one older peers speak.
+	ProtoVersionTranscript int16 = 0x0003
+
+	ProtoHello = "hello"
+
+	// Sent in the cookie handshake of older versions.
 	ProtoHeader = "header"
 	ProtoCap    = ":ap"
+	ProtoCookie = "cookie"
 
 	// inform a peer on the status of the latest request
 	ProtoOk        = "ok"
 	ProtoNo        = "no"
 	ProtoTerminate = "term"
-	ProtoCookie    = "cookie"
 	ProtoSig       = "sig"
+	ProtoKey       = "key" // An ephemeral key, for encrypting the connection
 	ProtoDone      = "done"
 
+	// Sent instead of "ok" when the version ranges of two peers do not overlap,
+	// the connection is closed straight after.
+	ProtoIncompatible = "incompatible"
+
+	// Sent in place of the usual reply when a request fails, the content is a
+	// MessageError.
+	ProtoError = "error"
+
 	ProtoSearch  = "search"  // Request a search
 	ProtoRecent  = "recent"  // Request recent posts
 	ProtoPopular = "popular" // Request popular posts
 
+	// As above, but the reply is a page of posts in batches, see posts.go.
+	ProtoSearchStream  = "search.stream"
+	ProtoRecentStream  = "recent.stream"
+	ProtoPopularStream = "popular.stream"
+
 	// Request a signed hash list
 	// The content field should contain the bytes for a Zif address.
 	// This is the peer we are requesting a hash list for.
@@ -35,6 +64,7 @@ var (
 	ProtoRequestAddPeer = "req.addpeer"
 
 	ProtoPosts    = "posts" // A list of posts in Content
+	ProtoPiece    = "piece" // A MessagePiece, its posts follow
 	ProtoHashList = "hashlist"
 
 	ProtoDhtEntry       = "dht.entry" // An individual DHT entry in Content
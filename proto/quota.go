@@ -0,0 +1,109 @@
+// Limits how many requests of each kind a peer may make. Requests over quota are
+// answered with a CodeRateLimited error saying when to try again, rather than
+// being served.
+
+package proto
+
+import (
+	"time"
+
+	"github.com/zif/zif/util"
+)
+
+// Kinds of request, each with its own quota.
+const (
+	QuotaSearch      = "search"
+	QuotaQuery       = "query"
+	QuotaFindClosest = "findclosest"
+	QuotaPiece       = "piece"
+	QuotaAnnounce    = "announce"
+	QuotaAddPeer     = "addpeer"
+	QuotaRelay       = "relay"
+	QuotaExchange    = "exchange"
+)
+
+var quotaKinds = map[string]string{
+	ProtoSearch:         QuotaSearch,
+	ProtoSearchStream:   QuotaSearch,
+	ProtoRecent:         QuotaSearch,
+	ProtoRecentStream:   QuotaSearch,
+	ProtoPopular:        QuotaSearch,
+	ProtoPopularStream:  QuotaSearch,
+	ProtoDhtQuery:       QuotaQuery,
+	ProtoDhtFindClosest: QuotaFindClosest,
+	ProtoRequestPiece:   QuotaPiece,
+
+	// fetched once per mirror, alongside the pieces
+	ProtoRequestHashList: QuotaPiece,
+	ProtoDhtAnnounce:     QuotaAnnounce,
+	ProtoRequestAddPeer:  QuotaAddPeer,
+	ProtoRelayConnect:    QuotaRelay,
+	ProtoRelayIncoming:   QuotaRelay,
+	ProtoDhtExchange:     QuotaExchange,
+}
+
+// The kind of request a header is, or nothing if it is not limited.
+func QuotaKind(header string) string {
+	return quotaKinds[header]
+}
+
+func DefaultQuotas() map[string]util.Quota {
+	return map[string]util.Quota{
+		QuotaSearch:      {Rate: time.Second, Burst: 10},
+		QuotaQuery:       {Rate: time.Second / 3, Burst: 10},
+		QuotaFindClosest: {Rate: time.Second / 3, Burst: 10},
+		QuotaPiece:       {Rate: time.Second / 10, Burst: 50},
+
+		// announces may be made again straight away to correct a "mistake" in a
+		// name or description, but otherwise every few minutes is plenty
+		QuotaAnnounce: {Rate: time.Minute * 10, Burst: 3},
+		QuotaAddPeer:  {Rate: time.Minute, Burst: 3},
+
+		// each circuit is a whole connection, so these are rarely needed
+		QuotaRelay: {Rate: time.Second * 10, Burst: 5},
+
+		// peers only exchange when they connect
+		QuotaExchange: {Rate: time.Minute * 5, Burst: 2},
+	}
+}
+
+// Replaces the quota for each kind of request. Kinds that are left out are not
+// limited.
+func (s *Server) SetQuotas(quotas map[string]util.Quota) {
+	copied := make(map[string]util.Quota, len(quotas))
+
+	for k, v := range quotas {
+		copied[k] = v
+	}
+
+	s.handlerLock.Lock()
+	defer s.handlerLock.Unlock()
+
+	s.quotas = copied
+}
+
+func (s *Server) quota(kind string) util.Quota {
+	s.handlerLock.RLock()
+	defer s.handlerLock.RUnlock()
+
+	return s.quotas[kind]
+}
+
+// Charges a message against the quota of the peer that sent it. If it is over,
+// returns the error to send back instead of serving it.
+func (s *Server) chargeQuota(peer NetworkPeer, header string) error {
+	kind := QuotaKind(header)
+	limiter := peer.Limiter()
+
+	if kind == "" || limiter == nil {
+		return nil
+	}
+
+	ok, wait := limiter.Allow(kind, s.quota(kind), time.Now())
+
+	if ok {
+		return nil
+	}
+
+	return NewRateLimited("Too many "+kind+" requests", wait)
+}
@@ -0,0 +1,75 @@
+package proto
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+
+	"github.com/zif/zif/util"
+)
+
+func TestRouteOverQuota(t *testing.T) {
+	s := NewServer(&MessageCapabilities{})
+	s.SetQuotas(map[string]util.Quota{QuotaSearch: {Rate: time.Hour, Burst: 2}})
+
+	s.Handle(ProtoSearch, func(msg *Message) error {
+		return msg.Client.WriteMessage(&Message{Header: ProtoOk})
+	})
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	session, err := yamux.Client(local, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer := &testNetworkPeer{address: *testAddress(t), limiter: &util.PeerLimiter{}, session: session}
+	peer.limiter.Setup()
+
+	for i := 0; i < 2; i++ {
+		if _, err := routeMessage(t, s, peer, &Message{Header: ProtoSearch}); err != nil {
+			t.Fatal("Request within quota failed: ", err)
+		}
+	}
+
+	_, err = routeMessage(t, s, peer, &Message{Header: ProtoSearch})
+
+	if !IsCode(err, CodeRateLimited) {
+		t.Fatal("Request over quota gave ", err)
+	}
+
+	if e := err.(*Error); !e.Retryable || e.RetryAfter <= 0 || e.RetryAfter > time.Hour {
+		t.Fatalf("Rate limited error was %+v", *e)
+	}
+
+	// other kinds of request are not held up
+	s.Handle(ProtoDhtQuery, func(msg *Message) error {
+		return msg.Client.WriteMessage(&Message{Header: ProtoOk})
+	})
+
+	if _, err := routeMessage(t, s, peer, &Message{Header: ProtoDhtQuery}); err != nil {
+		t.Fatal("Request of another kind failed: ", err)
+	}
+
+	if session.IsClosed() {
+		t.Fatal("Session closed before the peer was banned")
+	}
+
+	// keep asking, and eventually the peer is banned and disconnected. One more
+	// than the threshold, as points decay a little in between.
+	for i := 0; i < BanThreshold/PenaltyOverQuota; i++ {
+		routeMessage(t, s, peer, &Message{Header: ProtoSearch})
+	}
+
+	if !s.Reputation().Banned(&peer.address, "") {
+		t.Fatal("Peer was not banned")
+	}
+
+	if !session.IsClosed() {
+		t.Fatal("Banned peer was not disconnected")
+	}
+}
@@ -0,0 +1,117 @@
+// Message handlers are registered against the header they handle, so new types
+// of message can be added without touching the server. A handler can also be
+// gated by a capability, in which case it is only used for peers that advertise
+// that capability too.
+
+package proto
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// Handles a single message. The message contains the client it arrived on, which
+// any reply should be written to.
+type HandlerFunc func(*Message) error
+
+type registeredHandler struct {
+	handle     HandlerFunc
+	capability string
+}
+
+// Registers a handler for messages with the given header, replacing any handler
+// already registered for it.
+func (s *Server) Handle(header string, handler HandlerFunc) {
+	s.HandleCapability(header, "", handler)
+}
+
+// Registers a handler that is only used if the sending peer has the capability.
+// The capability is added to those we advertise, so that other peers know to use
+// it.
+func (s *Server) HandleCapability(header, capability string, handler HandlerFunc) {
+	s.handlerLock.Lock()
+	defer s.handlerLock.Unlock()
+
+	s.handlers[header] = registeredHandler{handler, capability}
+
+	if capability == "" || s.capabilities == nil {
+		return
+	}
+
+	for _, i := range s.capabilities.Extensions {
+		if i == capability {
+			return
+		}
+	}
+
+	// copies of the old slice may still be in use
+	extensions := make([]string, 0, len(s.capabilities.Extensions)+1)
+	extensions = append(extensions, s.capabilities.Extensions...)
+
+	s.capabilities.Extensions = append(extensions, capability)
+}
+
+// A copy of the capabilities we advertise, which change as handlers are
+// registered.
+func (s *Server) Capabilities() MessageCapabilities {
+	s.handlerLock.RLock()
+	defer s.handlerLock.RUnlock()
+
+	if s.capabilities == nil {
+		return MessageCapabilities{}
+	}
+
+	return MessageCapabilities{
+		Compression: append([]string(nil), s.capabilities.Compression...),
+		Pieces:      append([]string(nil), s.capabilities.Pieces...),
+		Extensions:  append([]string(nil), s.capabilities.Extensions...),
+	}
+}
+
+// Stops handling messages with the given header. The capability it was gated by,
+// if any, is still advertised.
+func (s *Server) RemoveHandler(header string) {
+	s.handlerLock.Lock()
+	defer s.handlerLock.Unlock()
+
+	delete(s.handlers, header)
+}
+
+// Finds the handler for a message from a peer with the given capabilities. If
+// there is none, the reason is returned instead.
+func (s *Server) handler(header string, caps *MessageCapabilities) (HandlerFunc, string) {
+	s.handlerLock.RLock()
+	registered, ok := s.handlers[header]
+	s.handlerLock.RUnlock()
+
+	if !ok {
+		return nil, "unknown message type"
+	}
+
+	if registered.capability == "" {
+		return registered.handle, ""
+	}
+
+	if caps != nil {
+		for _, i := range caps.Extensions {
+			if i == registered.capability {
+				return registered.handle, ""
+			}
+		}
+	}
+
+	return nil, "capability not advertised: " + registered.capability
+}
+
+// Tells the peer that a message could not be handled, and why.
+func writeUnsupported(cl *Client, header, reason string) {
+	log.WithFields(log.Fields{
+		"header": header,
+		"reason": reason,
+	}).Info("Unsupported message")
+
+	err := cl.WriteErr(NewErrorf(CodeUnsupported, "%s: %s", header, reason))
+
+	if err != nil {
+		log.Error(err.Error())
+	}
+}
@@ -0,0 +1,146 @@
+package proto
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/hashicorp/yamux"
+
+	"github.com/zif/zif/common"
+	"github.com/zif/zif/dht"
+	"github.com/zif/zif/util"
+)
+
+type testNetworkPeer struct {
+	address dht.Address
+	caps    MessageCapabilities
+	limiter *util.PeerLimiter
+	session *yamux.Session
+}
+
+func (tp *testNetworkPeer) Session() *yamux.Session                  { return tp.session }
+func (tp *testNetworkPeer) AddStream(net.Conn)                       {}
+func (tp *testNetworkPeer) ShapeStream(c net.Conn) net.Conn          { return c }
+func (tp *testNetworkPeer) Limiter() *util.PeerLimiter               { return tp.limiter }
+func (tp *testNetworkPeer) Address() *dht.Address                    { return &tp.address }
+func (tp *testNetworkPeer) GetCapabilities() *MessageCapabilities    { return &tp.caps }
+func (tp *testNetworkPeer) SetCapabilities(caps MessageCapabilities) { tp.caps = caps }
+func (tp *testNetworkPeer) UpdateSeen()                              {}
+func (tp *testNetworkPeer) Compression() string                      { return "" }
+func (tp *testNetworkPeer) CompressionStats() *CompressionStats      { return nil }
+
+func (tp *testNetworkPeer) Query(context.Context, dht.Address) (common.Verifier, error) {
+	return nil, nil
+}
+
+func (tp *testNetworkPeer) FindClosest(context.Context, dht.Address) ([]common.Verifier, error) {
+	return nil, nil
+}
+
+// Routes a message from peer, returning the reply it is sent once routing has
+// finished.
+func routeMessage(t *testing.T, s *Server, peer NetworkPeer, msg *Message) (*Message, error) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	server, err := NewClient(local)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClient(remote)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg.Client = server
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		s.RouteMessage(peer, msg)
+	}()
+
+	reply, err := client.readReply()
+	<-done
+
+	return reply, err
+}
+
+func TestRouteUnsupported(t *testing.T) {
+	s := NewServer(&MessageCapabilities{})
+
+	s.Handle("test.plain", func(msg *Message) error {
+		return msg.Client.WriteMessage(&Message{Header: ProtoOk})
+	})
+
+	s.HandleCapability("test.gated", "test", func(msg *Message) error {
+		return msg.Client.WriteMessage(&Message{Header: ProtoOk})
+	})
+
+	without := &testNetworkPeer{}
+	with := &testNetworkPeer{caps: MessageCapabilities{Extensions: []string{"test"}}}
+
+	cases := []struct {
+		peer      *testNetworkPeer
+		header    string
+		supported bool
+	}{
+		{without, "test.plain", true},
+		{without, "test.unknown", false},
+		{without, "test.gated", false},
+		{with, "test.gated", true},
+	}
+
+	for _, i := range cases {
+		reply, err := routeMessage(t, s, i.peer, &Message{Header: i.header})
+
+		if i.supported {
+			if err != nil || !reply.Ok() {
+				t.Error(i.header, " was not handled: ", err)
+			}
+
+			continue
+		}
+
+		if !IsCode(err, CodeUnsupported) {
+			t.Error(i.header, " was not refused as unsupported: ", err)
+		}
+	}
+}
+
+// Capabilities are read by handshakes while handlers are being registered, run
+// with -race to be of any use.
+func TestCapabilitiesCopied(t *testing.T) {
+	s := NewServer(&MessageCapabilities{Compression: []string{CompressionNone}})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 100; i++ {
+			s.HandleCapability(fmt.Sprintf("test.%d", i), fmt.Sprintf("test%d", i), nil)
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		caps := s.Capabilities()
+
+		// changing a copy must not change what is advertised
+		if len(caps.Extensions) > 0 {
+			caps.Extensions[0] = "changed"
+		}
+	}
+
+	<-done
+
+	caps := s.Capabilities()
+
+	if len(caps.Extensions) != 100 || caps.Extensions[0] != "test0" {
+		t.Fatal("Advertised extensions are ", caps.Extensions)
+	}
+}
@@ -0,0 +1,400 @@
+// Relayed connections, for peers that cannot accept connections themselves.
+//
+// A peer behind a NAT stays connected to a few publicly reachable peers that
+// relay for it, and lists them in its entry. To reach it, a peer connects to one
+// of those relays and asks it for a circuit. The relay opens a stream to the
+// peer behind the NAT, and once both ends have agreed, copies bytes between the
+// two streams. Both ends then negotiate, encrypt and handshake over the circuit
+// exactly as they would over TCP, so the relay only ever sees ciphertext and
+// cannot pretend to be either of them.
+//
+// Requests and replies on a circuit are strictly one after the other, so that
+// nothing meant for the connection inside it is read as part of a message.
+
+package proto
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zif/zif/dht"
+)
+
+const (
+	// Advertised by peers that relay for others.
+	CapabilityRelay = "relay"
+
+	// Asks a relay for a circuit to the address in the content.
+	ProtoRelayConnect = "relay.connect"
+
+	// Sent by a relay to the peer a circuit is for, the content being the
+	// address of the peer that asked for it. It cannot be trusted, who is
+	// really on the other end is only known after the handshake.
+	ProtoRelayIncoming = "relay.incoming"
+)
+
+var (
+	ErrRelayDisabled   = NewError(CodeRefused, "Not relaying for other peers")
+	ErrRelayFull       = NewError(CodeRefused, "Too many relayed connections")
+	ErrRelayPeerFull   = NewError(CodeRefused, "Too many relayed connections for this peer")
+	ErrRelayNotFound   = NewError(CodeNotFound, "Not connected to that peer")
+	errRelayNotAllowed = errors.New("Relay did not respond with ok")
+)
+
+// Limits on relaying, bandwidth is in bytes per second and zero or less is
+// unlimited.
+type RelayConfig struct {
+	Enabled bool
+
+	// Circuits open at once, in total and for any one peer asking.
+	MaxCircuits        int
+	MaxCircuitsPerPeer int
+
+	// Shared by every circuit, and for each one. Relayed bytes count towards the
+	// limits of the peers on both ends too.
+	Bandwidth        int
+	CircuitBandwidth int
+}
+
+func DefaultRelayConfig() RelayConfig {
+	return RelayConfig{
+		Enabled:            false,
+		MaxCircuits:        64,
+		MaxCircuitsPerPeer: 4,
+		Bandwidth:          256 * 1024,
+		CircuitBandwidth:   64 * 1024,
+	}
+}
+
+type RelayStats struct {
+	Circuits int `json:"circuits"`
+
+	Opened  uint64 `json:"opened"`
+	Refused uint64 `json:"refused"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// Keeps track of the circuits a server is relaying.
+type Relay struct {
+	lock    sync.Mutex
+	config  RelayConfig
+	perPeer map[string]int
+	stats   RelayStats
+
+	bandwidth tokenBucket
+
+	// updated outside of the lock, as bytes are copied
+	bytes uint64
+}
+
+func NewRelay(config RelayConfig) *Relay {
+	return &Relay{
+		config:  config,
+		perPeer: make(map[string]int),
+	}
+}
+
+func (r *Relay) Config() RelayConfig {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.config
+}
+
+func (r *Relay) Stats() RelayStats {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	ret := r.stats
+	ret.Bytes = atomic.LoadUint64(&r.bytes)
+
+	return ret
+}
+
+// Opens a circuit for the peer at from, if relaying is enabled and there is
+// room. The circuit must be closed once it is finished with.
+func (r *Relay) Open(from *dht.Address) (*Circuit, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := string(from.Raw)
+
+	if !r.config.Enabled {
+		r.stats.Refused++
+		return nil, ErrRelayDisabled
+	}
+
+	if r.config.MaxCircuits > 0 && r.stats.Circuits >= r.config.MaxCircuits {
+		r.stats.Refused++
+		return nil, ErrRelayFull
+	}
+
+	if r.config.MaxCircuitsPerPeer > 0 && r.perPeer[key] >= r.config.MaxCircuitsPerPeer {
+		r.stats.Refused++
+		return nil, ErrRelayPeerFull
+	}
+
+	r.stats.Circuits++
+	r.stats.Opened++
+	r.perPeer[key]++
+
+	return &Circuit{relay: r, key: key}, nil
+}
+
+func (r *Relay) release(key string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.stats.Circuits--
+	r.perPeer[key]--
+
+	if r.perPeer[key] <= 0 {
+		delete(r.perPeer, key)
+	}
+}
+
+// A single relayed connection.
+type Circuit struct {
+	relay *Relay
+	key   string
+	once  sync.Once
+
+	bandwidth tokenBucket
+}
+
+// Copies between the streams of the two ends of the circuit, until either of
+// them closes. Both are closed before returning.
+func (c *Circuit) Splice(from, to *Client) {
+	a, b := from.conn, to.conn
+
+	defer a.Close()
+	defer b.Close()
+
+	for _, i := range []net.Conn{a, b} {
+		if sc, ok := i.(*shapedConn); ok {
+			sc.setBulk()
+		}
+
+		// circuits last as long as the connection inside them
+		if err := i.SetDeadline(time.Time{}); err != nil {
+			log.Error(err.Error())
+			return
+		}
+	}
+
+	done := make(chan struct{}, 2)
+
+	go func() { c.copy(a, b); done <- struct{}{} }()
+	go func() { c.copy(b, a); done <- struct{}{} }()
+
+	<-done
+
+	// whichever way is still going finds out when its stream is closed
+	a.Close()
+	b.Close()
+	<-done
+}
+
+func (c *Circuit) copy(dst, src net.Conn) {
+	buf := make([]byte, BandwidthChunkSize)
+
+	for {
+		n, err := src.Read(buf)
+
+		if n > 0 {
+			config := c.relay.Config()
+			now := time.Now()
+
+			wait := c.bandwidth.take(n, config.CircuitBandwidth, now)
+
+			if all := c.relay.bandwidth.take(n, config.Bandwidth, now); all > wait {
+				wait = all
+			}
+
+			if wait > 0 {
+				time.Sleep(wait)
+			}
+
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+
+			atomic.AddUint64(&c.relay.bytes, uint64(n))
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *Circuit) Close() {
+	c.once.Do(func() {
+		c.relay.release(c.key)
+	})
+}
+
+// Replaces the limits on relaying, advertising that we relay if it is enabled.
+// Circuits that are already open are left alone.
+func (s *Server) SetRelay(config RelayConfig) {
+	s.relay.lock.Lock()
+	s.relay.config = config
+	s.relay.lock.Unlock()
+
+	if s.capabilities == nil {
+		return
+	}
+
+	s.handlerLock.Lock()
+	defer s.handlerLock.Unlock()
+
+	extensions := make([]string, 0, len(s.capabilities.Extensions)+1)
+
+	for _, i := range s.capabilities.Extensions {
+		if i != CapabilityRelay {
+			extensions = append(extensions, i)
+		}
+	}
+
+	if config.Enabled {
+		extensions = append(extensions, CapabilityRelay)
+	}
+
+	s.capabilities.Extensions = extensions
+}
+
+func (s *Server) Relay() *Relay {
+	return s.relay
+}
+
+// The address of the far end of a circuit. It has no IP, so relayed peers are
+// not banned by the IP of the relay, but they are admitted as though they came
+// from the relay.
+type relayAddr struct {
+	via string
+}
+
+func (ra relayAddr) Network() string { return "relay" }
+func (ra relayAddr) String() string  { return "relay/" + ra.via }
+
+// A connection through a relay, the stream to the relay itself as far as we can
+// tell.
+type relayedConn struct {
+	net.Conn
+	remote relayAddr
+}
+
+func (rc *relayedConn) RemoteAddr() net.Addr {
+	return rc.remote
+}
+
+// The stream under a client, without the bandwidth limits of the peer it is
+// with. The connection inside it has limits of its own.
+func (c *Client) relayed(via *dht.Address) net.Conn {
+	conn := c.conn
+
+	if sc, ok := conn.(*shapedConn); ok {
+		conn = sc.Conn
+	}
+
+	return &relayedConn{conn, relayAddr{via.StringOr("")}}
+}
+
+// Asks the relay on the other end of the client for a circuit to the peer at
+// addr. On success the circuit is returned, ready to be handshaked over, and the
+// client must not be used again.
+func (c *Client) RelayConnect(ctx context.Context, relay, addr dht.Address) (_ net.Conn, err error) {
+	defer c.bind(ctx)(&err)
+
+	log.WithFields(log.Fields{
+		"relay": relay.StringOr(""),
+		"peer":  addr.StringOr(""),
+	}).Info("Requesting relayed connection")
+
+	msg := &Message{
+		Header: ProtoRelayConnect,
+	}
+
+	err = msg.Write(addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.WriteMessage(msg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rep, err := c.readReply()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !rep.Ok() {
+		return nil, errRelayNotAllowed
+	}
+
+	return c.relayed(&relay), nil
+}
+
+// Tells the peer on the other end of the client that from wants a circuit to it.
+// Once this returns, anything written to the client goes to the handshake.
+func (c *Client) RelayIncoming(ctx context.Context, from dht.Address) (err error) {
+	defer c.bind(ctx)(&err)
+
+	msg := &Message{
+		Header: ProtoRelayIncoming,
+	}
+
+	err = msg.Write(from)
+
+	if err != nil {
+		return err
+	}
+
+	err = c.WriteMessage(msg)
+
+	if err != nil {
+		return err
+	}
+
+	rep, err := c.readReply()
+
+	if err != nil {
+		return err
+	}
+
+	if !rep.Ok() {
+		return errRelayNotAllowed
+	}
+
+	return nil
+}
+
+// Accepts a circuit that a relay has offered with ProtoRelayIncoming, returning
+// the connection to be handshaked over. The client must not be used again.
+func AcceptRelay(msg *Message) (net.Conn, error) {
+	err := msg.Client.WriteMessage(Message{Header: ProtoOk})
+
+	if err != nil {
+		return nil, err
+	}
+
+	conn := msg.Client.relayed(msg.From)
+
+	err = conn.SetDeadline(time.Time{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,136 @@
+package proto
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/zif/zif/dht"
+)
+
+func TestRelayLimits(t *testing.T) {
+	a, b := testAddress(t), testAddress(t)
+
+	r := NewRelay(RelayConfig{})
+
+	if _, err := r.Open(a); err != ErrRelayDisabled {
+		t.Fatal("Disabled relay gave ", err)
+	}
+
+	r = NewRelay(RelayConfig{Enabled: true, MaxCircuits: 3, MaxCircuitsPerPeer: 2})
+	circuits := []*Circuit{}
+
+	for _, i := range []*dht.Address{a, a, b} {
+		circuit, err := r.Open(i)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		circuits = append(circuits, circuit)
+	}
+
+	if _, err := r.Open(b); err != ErrRelayFull {
+		t.Fatal("Circuit over the limit gave ", err)
+	}
+
+	// closing twice only gives one place back
+	circuits[2].Close()
+	circuits[2].Close()
+
+	if _, err := r.Open(a); err != ErrRelayPeerFull {
+		t.Fatal("Circuit over the limit for a peer gave ", err)
+	}
+
+	if _, err := r.Open(b); err != nil {
+		t.Fatal("Circuit after a close was refused: ", err)
+	}
+
+	if stats := r.Stats(); stats.Circuits != 3 || stats.Opened != 4 || stats.Refused != 2 {
+		t.Fatalf("Stats were %+v", stats)
+	}
+}
+
+func TestCircuitSplice(t *testing.T) {
+	r := NewRelay(RelayConfig{Enabled: true})
+	circuit, err := r.Open(testAddress(t))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each end of the circuit is a stream from the relay to a peer
+	from, fromPeer := testClients(t)
+	to, toPeer := testClients(t)
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		circuit.Splice(from, to)
+	}()
+
+	sent := bytes.Repeat([]byte("relayed "), 1024)
+	go fromPeer.conn.Write(sent)
+
+	received := make([]byte, len(sent))
+
+	if _, err := io.ReadFull(toPeer.conn, received); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(sent, received) {
+		t.Fatal("Relayed bytes changed")
+	}
+
+	go toPeer.conn.Write([]byte("reply"))
+
+	reply := make([]byte, 5)
+
+	if _, err := io.ReadFull(fromPeer.conn, reply); err != nil || string(reply) != "reply" {
+		t.Fatal("Reply was ", string(reply), ", ", err)
+	}
+
+	// one end going closes the other
+	fromPeer.conn.Close()
+	<-done
+
+	if _, err := toPeer.conn.Read(reply); err == nil {
+		t.Fatal("Far end of the circuit is still open")
+	}
+
+	if stats := r.Stats(); stats.Bytes != uint64(len(sent)+len(reply)) {
+		t.Fatal("Relayed ", stats.Bytes, " bytes, expected ", len(sent)+len(reply))
+	}
+}
+
+// Peers on the far end of a circuit are known by the relay, not by its IP.
+func TestRelayedConnAddress(t *testing.T) {
+	conn, _ := newRemoteConn("203.0.113.1")
+	defer conn.Close()
+
+	bandwidth := &peerBandwidth{shared: NewBandwidth(BandwidthConfig{})}
+
+	client, err := NewClient(newShapedConn(conn, bandwidth))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	via := testAddress(t)
+	relayed := client.relayed(via)
+
+	if _, ok := relayed.(*relayedConn).Conn.(*remoteConn); !ok {
+		t.Fatal("Relayed connection is still shaped")
+	}
+
+	addr := relayed.RemoteAddr()
+
+	if addr.Network() != "relay" || addr.String() != "relay/"+via.StringOr("") {
+		t.Fatal("Relayed connection is from ", addr.Network(), " ", addr.String())
+	}
+
+	if ip := RemoteIP(addr); ip != "" {
+		t.Fatal("Relayed connection has IP ", ip)
+	}
+}
@@ -0,0 +1,366 @@
+// Keeps track of peers that misbehave. Each bad thing a peer does, such as
+// sending an entry or piece that does not verify, failing a handshake or going
+// over its quotas, adds penalty points to its address and to its IP. Points are
+// slowly forgiven, but once there are enough of them the peer is banned: every
+// ban is twice as long as the last, and bans are saved so that they outlast a
+// restart.
+
+package proto
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zif/zif/dht"
+)
+
+const (
+	// Points at which a peer is banned.
+	BanThreshold = 100
+
+	// How many points are forgiven for every hour a peer behaves.
+	BanForgiveRate = 25
+
+	BanMinDuration = time.Minute * 10
+	BanMaxDuration = time.Hour * 24 * 7
+
+	// How often records with nothing left worth keeping are removed.
+	ReputationPruneFrequency = time.Minute
+)
+
+// How many points each kind of misbehaviour costs.
+const (
+	PenaltyBadHandshake = 50
+	PenaltyBadEntry     = 25
+	PenaltyBadPiece     = 50
+	PenaltyOverQuota    = 2
+)
+
+// What a ban applies to.
+const (
+	BanAddress = "address"
+	BanIP      = "ip"
+)
+
+var ErrBanned = errors.New("Peer is banned")
+
+// A ban on an address or IP, as saved and shown by the HTTP API.
+type Ban struct {
+	Kind   string `json:"kind"`
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+
+	// Unix time the ban ends, zero if the peer is not banned right now but has
+	// been before.
+	Until int64 `json:"until"`
+
+	// How many times it has been banned, each ban is longer than the last.
+	Count int `json:"count"`
+}
+
+type reputationRecord struct {
+	points  float64
+	updated time.Time
+
+	bans   int
+	until  time.Time
+	reason string
+}
+
+type Reputation struct {
+	lock    sync.Mutex
+	records map[string]*reputationRecord
+
+	// Where bans are saved, nowhere if empty.
+	path string
+	now  func() time.Time
+
+	pruned time.Time
+}
+
+func NewReputation() *Reputation {
+	return &Reputation{
+		records: make(map[string]*reputationRecord),
+		now:     time.Now,
+	}
+}
+
+// Loads the bans saved in path, which they are then saved back to whenever they
+// change.
+func (r *Reputation) Load(path string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.path = path
+
+	dat, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var bans []Ban
+	err = json.Unmarshal(dat, &bans)
+
+	if err != nil {
+		return err
+	}
+
+	for _, i := range bans {
+		record := &reputationRecord{
+			updated: r.now(),
+			bans:    i.Count,
+			reason:  i.Reason,
+		}
+
+		// when a past ban ended is not saved, so it is kept as though it just had
+		record.until = r.now()
+
+		if i.Until != 0 {
+			record.until = time.Unix(i.Until, 0)
+		}
+
+		r.records[reputationKey(i.Kind, i.Key)] = record
+	}
+
+	return nil
+}
+
+// Adds penalty points to an address and an IP, either may be left empty. Returns
+// true if either is banned as a result.
+func (r *Reputation) Penalise(address *dht.Address, ip string, points int, reason string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	banned := false
+
+	if address != nil && len(address.Raw) != 0 {
+		banned = r.penalise(BanAddress, address.StringOr(""), points, reason) || banned
+	}
+
+	if ip != "" {
+		banned = r.penalise(BanIP, ip, points, reason) || banned
+	}
+
+	return banned
+}
+
+func (r *Reputation) penalise(kind, key string, points int, reason string) bool {
+	now := r.now()
+
+	if now.Sub(r.pruned) >= ReputationPruneFrequency {
+		r.prune(now)
+	}
+
+	record := r.record(kind, key, now)
+
+	if now.Before(record.until) {
+		return true
+	}
+
+	record.points += float64(points)
+
+	log.WithFields(log.Fields{
+		kind:     key,
+		"points": int(record.points),
+	}).Info("Penalised peer: ", reason)
+
+	if record.points < BanThreshold {
+		return false
+	}
+
+	duration := BanMinDuration
+
+	for i := 0; i < record.bans && duration < BanMaxDuration; i++ {
+		duration *= 2
+	}
+
+	if duration > BanMaxDuration {
+		duration = BanMaxDuration
+	}
+
+	record.points = 0
+	record.bans++
+	record.until = now.Add(duration)
+	record.reason = reason
+
+	log.WithFields(log.Fields{
+		kind:       key,
+		"duration": duration,
+	}).Warn("Banned peer: ", reason)
+
+	r.save()
+
+	return true
+}
+
+// Fetches the record for a key, forgiving any points that are due first.
+func (r *Reputation) record(kind, key string, now time.Time) *reputationRecord {
+	record, ok := r.records[reputationKey(kind, key)]
+
+	if !ok {
+		record = &reputationRecord{updated: now}
+		r.records[reputationKey(kind, key)] = record
+	}
+
+	record.points -= now.Sub(record.updated).Hours() * BanForgiveRate
+	record.updated = now
+
+	if record.points < 0 {
+		record.points = 0
+	}
+
+	return record
+}
+
+// Removes the records of peers that have been forgiven every point and have not
+// been banned for at least BanMaxDuration, after which their next ban starts
+// again from BanMinDuration. Otherwise anyone could fill the map by
+// misbehaving from enough addresses. Must be called with the lock held.
+func (r *Reputation) prune(now time.Time) {
+	r.pruned = now
+
+	for k, v := range r.records {
+		points := v.points - now.Sub(v.updated).Hours()*BanForgiveRate
+
+		if points > 0 || now.Sub(v.until) < BanMaxDuration {
+			continue
+		}
+
+		delete(r.records, k)
+	}
+}
+
+// Whether either an address or an IP is banned, either may be left empty.
+func (r *Reputation) Banned(address *dht.Address, ip string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := r.now()
+
+	if address != nil && len(address.Raw) != 0 && r.banned(BanAddress, address.StringOr(""), now) {
+		return true
+	}
+
+	return ip != "" && r.banned(BanIP, ip, now)
+}
+
+func (r *Reputation) banned(kind, key string, now time.Time) bool {
+	record, ok := r.records[reputationKey(kind, key)]
+
+	return ok && now.Before(record.until)
+}
+
+// Every address and IP that is banned, or has been.
+func (r *Reputation) Bans() []Ban {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.bansLocked()
+}
+
+func (r *Reputation) bansLocked() []Ban {
+	ret := make([]Ban, 0)
+	now := r.now()
+
+	for k, v := range r.records {
+		if v.bans == 0 {
+			continue
+		}
+
+		kind, key := splitReputationKey(k)
+		ban := Ban{Kind: kind, Key: key, Reason: v.reason, Count: v.bans}
+
+		if now.Before(v.until) {
+			ban.Until = v.until.Unix()
+		}
+
+		ret = append(ret, ban)
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Key < ret[j].Key })
+
+	return ret
+}
+
+// Lifts the ban on an address or IP, and forgets it was ever banned. Returns
+// false if it was not known.
+func (r *Reputation) Unban(key string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	kind := BanAddress
+
+	if net.ParseIP(key) != nil {
+		kind = BanIP
+	}
+
+	if _, ok := r.records[reputationKey(kind, key)]; !ok {
+		return false
+	}
+
+	delete(r.records, reputationKey(kind, key))
+	r.save()
+
+	log.WithField(kind, key).Info("Unbanned peer")
+
+	return true
+}
+
+// Must be called with the lock held.
+func (r *Reputation) save() {
+	r.prune(r.now())
+
+	if r.path == "" {
+		return
+	}
+
+	dat, err := json.Marshal(r.bansLocked())
+
+	if err != nil {
+		log.Error(err.Error())
+		return
+	}
+
+	err = ioutil.WriteFile(r.path, dat, 0644)
+
+	if err != nil {
+		log.Error(err.Error())
+	}
+}
+
+func reputationKey(kind, key string) string {
+	return kind + " " + key
+}
+
+func splitReputationKey(k string) (string, string) {
+	for i := 0; i < len(k); i++ {
+		if k[i] == ' ' {
+			return k[:i], k[i+1:]
+		}
+	}
+
+	return "", k
+}
+
+// The IP a peer is connected from, see RemoteIP.
+func PeerIP(peer NetworkPeer) string {
+	session := peer.Session()
+
+	if session == nil {
+		return ""
+	}
+
+	return RemoteIP(session.RemoteAddr())
+}
@@ -0,0 +1,238 @@
+package proto
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zif/zif/dht"
+)
+
+// A reputation whose clock only moves when told to.
+func newTestReputation() (*Reputation, *time.Time) {
+	now := time.Unix(1500000000, 0)
+
+	r := NewReputation()
+	r.now = func() time.Time { return now }
+
+	return r, &now
+}
+
+func testAddress(t *testing.T) *dht.Address {
+	addr, err := dht.RandomAddress()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return addr
+}
+
+func TestBanEscalates(t *testing.T) {
+	r, now := newTestReputation()
+	addr := testAddress(t)
+
+	expected := BanMinDuration
+
+	for i := 1; i <= 12; i++ {
+		if !r.Penalise(addr, "", BanThreshold, "test") {
+			t.Fatal("Peer was not banned")
+		}
+
+		bans := r.Bans()
+
+		if len(bans) != 1 || bans[0].Count != i {
+			t.Fatalf("Bans after ban %d are %+v", i, bans)
+		}
+
+		if until := time.Unix(bans[0].Until, 0); until.Sub(*now) != expected {
+			t.Fatal("Ban ", i, " lasts ", until.Sub(*now), ", expected ", expected)
+		}
+
+		*now = now.Add(expected - time.Second)
+
+		if !r.Banned(addr, "") {
+			t.Fatal("Ban ended early")
+		}
+
+		*now = now.Add(time.Second)
+
+		if r.Banned(addr, "") {
+			t.Fatal("Ban did not end")
+		}
+
+		if expected *= 2; expected > BanMaxDuration {
+			expected = BanMaxDuration
+		}
+	}
+}
+
+func TestBanForgives(t *testing.T) {
+	r, now := newTestReputation()
+	addr := testAddress(t)
+
+	r.Penalise(addr, "", BanThreshold-BanForgiveRate, "test")
+	*now = now.Add(time.Hour)
+
+	if r.Penalise(addr, "", BanForgiveRate, "test") {
+		t.Fatal("Peer was banned despite being forgiven")
+	}
+
+	if !r.Penalise(addr, "", BanForgiveRate, "test") {
+		t.Fatal("Peer was not banned")
+	}
+}
+
+func TestBanIP(t *testing.T) {
+	r, _ := newTestReputation()
+	addr, other := testAddress(t), testAddress(t)
+
+	if !r.Penalise(addr, "203.0.113.1", BanThreshold, "test") {
+		t.Fatal("Peer was not banned")
+	}
+
+	if !r.Banned(other, "203.0.113.1") || !r.Banned(nil, "203.0.113.1") {
+		t.Fatal("Another address on a banned IP is not banned")
+	}
+
+	if r.Banned(other, "203.0.113.2") {
+		t.Fatal("Another address on another IP is banned")
+	}
+
+	// penalising an IP alone leaves addresses behind it alone
+	r.Penalise(nil, "203.0.113.3", BanThreshold, "test")
+
+	if r.Banned(other, "") {
+		t.Fatal("Address was banned along with an IP")
+	}
+}
+
+func TestBanSaved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	addr, past := testAddress(t), testAddress(t)
+
+	r := NewReputation()
+
+	if err := r.Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	r.Penalise(addr, "203.0.113.1", BanThreshold, "test")
+
+	// banned before, but not any more
+	r.Penalise(past, "", BanThreshold, "test")
+	r.records[reputationKey(BanAddress, past.StringOr(""))].until = time.Now()
+	r.save()
+
+	loaded := NewReputation()
+
+	if err := loaded.Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if !loaded.Banned(addr, "") || !loaded.Banned(nil, "203.0.113.1") {
+		t.Fatal("Bans were not loaded")
+	}
+
+	if loaded.Banned(past, "") {
+		t.Fatal("Ban that has ended was loaded")
+	}
+
+	if bans := loaded.Bans(); len(bans) != 3 {
+		t.Fatalf("Loaded bans %+v, expected 3", bans)
+	}
+
+	// the next ban of an address that has been banned before is longer
+	loaded.Penalise(past, "", BanThreshold, "test")
+
+	for _, i := range loaded.Bans() {
+		if i.Key == past.StringOr("") && i.Count != 2 {
+			t.Fatal("Loaded ban count is ", i.Count, ", expected 2")
+		}
+	}
+}
+
+func TestUnban(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	addr := testAddress(t)
+
+	r := NewReputation()
+	r.Load(path)
+
+	r.Penalise(addr, "203.0.113.1", BanThreshold, "test")
+
+	if !r.Unban(addr.StringOr("")) || !r.Unban("203.0.113.1") {
+		t.Fatal("Failed to unban")
+	}
+
+	if r.Banned(addr, "203.0.113.1") {
+		t.Fatal("Peer is still banned")
+	}
+
+	if r.Unban(addr.StringOr("")) {
+		t.Fatal("Unbanned a peer that is not banned")
+	}
+
+	loaded := NewReputation()
+	loaded.Load(path)
+
+	if len(loaded.Bans()) != 0 {
+		t.Fatal("Unbanned peers were saved")
+	}
+}
+
+// Peers that are forgiven, and have not been banned in a long while, are
+// forgotten.
+func TestReputationPruned(t *testing.T) {
+	r, now := newTestReputation()
+
+	for i := 0; i < 100; i++ {
+		r.Penalise(testAddress(t), "", 1, "test")
+	}
+
+	banned := testAddress(t)
+	r.Penalise(banned, "", BanThreshold, "test")
+
+	*now = now.Add(time.Hour)
+	r.Penalise(nil, "203.0.113.1", 1, "test")
+
+	if len(r.records) != 2 {
+		t.Fatal("Kept ", len(r.records), " records, expected 2")
+	}
+
+	*now = now.Add(BanMaxDuration)
+	r.Penalise(nil, "203.0.113.2", 1, "test")
+
+	if len(r.records) != 1 {
+		t.Fatal("Kept ", len(r.records), " records, expected 1")
+	}
+}
+
+func TestBannedConnectionRefused(t *testing.T) {
+	s := NewServer(&MessageCapabilities{})
+	s.Reputation().Penalise(nil, "203.0.113.1", BanThreshold, "test")
+
+	conn, remote := newRemoteConn("203.0.113.1")
+	defer remote.Close()
+
+	handled := make(chan struct{})
+
+	go func() {
+		s.HandleConnection(conn, nil, nil)
+		close(handled)
+	}()
+
+	select {
+	case <-handled:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Connection from a banned IP was not refused")
+	}
+
+	if _, err := remote.Write([]byte{0}); err == nil {
+		t.Fatal("Connection from a banned IP was left open")
+	}
+
+	if stats := s.AdmissionStats(); stats.Accepted != 0 {
+		t.Fatal("Connection from a banned IP was admitted")
+	}
+}
@@ -0,0 +1,310 @@
+// Encrypts connections between peers. Once a version has been agreed, both sides
+// send an ephemeral curve25519 key and derive a pair of AES-GCM keys from the
+// shared secret, one for each direction. Everything after that, the handshake
+// included, is encrypted.
+//
+// The key exchange alone is not authenticated, it is tied to the identities of
+// the peers by the handshake. Each side signs the channel binding, a hash of both
+// ephemeral keys, with the key in the entry it presents. Someone in the middle
+// would have a different binding with each peer, so could not pass on either
+// signature.
+
+package proto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/sha3"
+
+	"github.com/zif/zif/util"
+)
+
+// Plaintext is split into records of at most this many bytes.
+const secureRecordSize = 16 * 1024
+
+var (
+	ErrInvalidKey    = errors.New("Invalid key exchange")
+	ErrRecordTooLong = errors.New("Encrypted record too long")
+	ErrDecrypt       = errors.New("Failed to decrypt record")
+)
+
+// A net.Conn that encrypts everything written to it, and decrypts everything
+// read. Records are a big endian uint32 length followed by the sealed data, the
+// nonce is a counter so records cannot be dropped or reordered.
+type secureConn struct {
+	net.Conn
+
+	readLock  sync.Mutex
+	read      cipher.AEAD
+	readNonce uint64
+	readErr   error
+	pending   []byte
+
+	writeLock  sync.Mutex
+	write      cipher.AEAD
+	writeNonce uint64
+}
+
+func nonce(aead cipher.AEAD, counter uint64) []byte {
+	ret := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(ret[len(ret)-8:], counter)
+
+	return ret
+}
+
+func (sc *secureConn) Write(b []byte) (int, error) {
+	sc.writeLock.Lock()
+	defer sc.writeLock.Unlock()
+
+	written := 0
+
+	for len(b) > 0 {
+		n := len(b)
+
+		if n > secureRecordSize {
+			n = secureRecordSize
+		}
+
+		record := make([]byte, 4, 4+n+sc.write.Overhead())
+		record = sc.write.Seal(record, nonce(sc.write, sc.writeNonce), b[:n], nil)
+		sc.writeNonce++
+
+		binary.BigEndian.PutUint32(record[:4], uint32(len(record)-4))
+
+		_, err := sc.Conn.Write(record)
+
+		if err != nil {
+			return written, err
+		}
+
+		written += n
+		b = b[n:]
+	}
+
+	return written, nil
+}
+
+func (sc *secureConn) Read(b []byte) (int, error) {
+	sc.readLock.Lock()
+	defer sc.readLock.Unlock()
+
+	// a record that was only partly read cannot be recovered from
+	if sc.readErr != nil {
+		return 0, sc.readErr
+	}
+
+	if len(sc.pending) == 0 {
+		sc.pending, sc.readErr = sc.readRecord()
+
+		if sc.readErr != nil {
+			return 0, sc.readErr
+		}
+	}
+
+	n := copy(b, sc.pending)
+	sc.pending = sc.pending[n:]
+
+	return n, nil
+}
+
+func (sc *secureConn) readRecord() ([]byte, error) {
+	var header [4]byte
+
+	_, err := io.ReadFull(sc.Conn, header[:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[:])
+
+	if length > uint32(secureRecordSize+sc.read.Overhead()) {
+		return nil, ErrRecordTooLong
+	}
+
+	record := make([]byte, length)
+	_, err = io.ReadFull(sc.Conn, record)
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := sc.read.Open(record[:0], nonce(sc.read, sc.readNonce), record, nil)
+	sc.readNonce++
+
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	return plain, nil
+}
+
+// Swaps ephemeral keys over cl, and returns a client for the encrypted connection
+// that results. The initiator is the side that opened the connection, it sends
+// its key first.
+func secureClient(cl *Client, initiator bool) (*Client, error) {
+	var private, public [32]byte
+
+	random, err := util.CryptoRandBytes(32)
+
+	if err != nil {
+		return nil, err
+	}
+
+	copy(private[:], random)
+	curve25519.ScalarBaseMult(&public, &private)
+
+	send := func() error {
+		msg := &Message{Header: ProtoKey}
+		err := msg.Write(public[:])
+
+		if err != nil {
+			return err
+		}
+
+		return cl.WriteMessage(msg)
+	}
+
+	recieve := func() ([]byte, error) {
+		msg, err := cl.ReadMessage()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if msg.Header != ProtoKey {
+			return nil, ErrInvalidKey
+		}
+
+		var key []byte
+		err = msg.Read(&key)
+
+		return key, err
+	}
+
+	var remote []byte
+
+	if initiator {
+		if err = send(); err == nil {
+			remote, err = recieve()
+		}
+	} else {
+		if remote, err = recieve(); err == nil {
+			err = send()
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(remote) != 32 {
+		return nil, ErrInvalidKey
+	}
+
+	var remoteKey, shared [32]byte
+	copy(remoteKey[:], remote)
+	curve25519.ScalarMult(&shared, &private, &remoteKey)
+
+	// a low order point gives an all zero secret, anyone could work that out
+	if subtle.ConstantTimeCompare(shared[:], make([]byte, 32)) == 1 {
+		return nil, ErrInvalidKey
+	}
+
+	initiatorKey, responderKey := public[:], remote
+
+	if !initiator {
+		initiatorKey, responderKey = remote, public[:]
+	}
+
+	binding := sha3.New256()
+	binding.Write([]byte("zif channel binding"))
+	binding.Write(initiatorKey)
+	binding.Write(responderKey)
+
+	sc, err := newSecureConn(cl.conn, shared[:], binding.Sum(nil), initiator)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret, err := NewClient(sc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret.binding = binding.Sum(nil)
+
+	return ret, nil
+}
+
+func newSecureConn(conn net.Conn, secret, binding []byte, initiator bool) (*secureConn, error) {
+	keys := hkdf(secret, binding, []byte("zif transport keys"), 64)
+
+	toResponder, err := newAEAD(keys[:32])
+
+	if err != nil {
+		return nil, err
+	}
+
+	toInitiator, err := newAEAD(keys[32:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	sc := &secureConn{Conn: conn, read: toInitiator, write: toResponder}
+
+	if !initiator {
+		sc.read, sc.write = toResponder, toInitiator
+	}
+
+	return sc, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// HKDF (RFC 5869) with SHA-256.
+func hkdf(secret, salt, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	ret := make([]byte, 0, length+sha256.Size)
+	var prev []byte
+
+	for i := byte(1); len(ret) < length; i++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(prev)
+		expand.Write(info)
+		expand.Write([]byte{i})
+
+		prev = expand.Sum(nil)
+		ret = append(ret, prev...)
+	}
+
+	return ret[:length]
+}
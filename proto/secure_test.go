@@ -0,0 +1,191 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestHKDF(t *testing.T) {
+	// test cases 1 and 3 of RFC 5869
+	cases := []struct {
+		ikm, salt, info, okm string
+	}{
+		{
+			"0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b",
+			"000102030405060708090a0b0c",
+			"f0f1f2f3f4f5f6f7f8f9",
+			"3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865",
+		},
+		{
+			"0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b",
+			"",
+			"",
+			"8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f3c738d2d9d201395faa4b61a96c8",
+		},
+	}
+
+	decode := func(s string) []byte {
+		ret, err := hex.DecodeString(s)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return ret
+	}
+
+	for n, i := range cases {
+		okm := decode(i.okm)
+
+		if got := hkdf(decode(i.ikm), decode(i.salt), decode(i.info), len(okm)); !bytes.Equal(got, okm) {
+			t.Errorf("Case %d gave %x, expected %x", n, got, okm)
+		}
+	}
+}
+
+// Both ends of a secure connection over a pipe.
+func securePair(t *testing.T) (*secureConn, *secureConn) {
+	a, b := net.Pipe()
+
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+
+	return newTestSecureConn(t, a, true), newTestSecureConn(t, b, false)
+}
+
+func newTestSecureConn(t *testing.T, conn net.Conn, initiator bool) *secureConn {
+	sc, err := newSecureConn(conn, bytes.Repeat([]byte{1}, 32), []byte("binding"), initiator)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sc
+}
+
+func TestSecureRoundTrip(t *testing.T) {
+	initiator, responder := securePair(t)
+
+	// a few whole records and a partial one, each way
+	sent := make([]byte, secureRecordSize*3+123)
+
+	for i := range sent {
+		sent[i] = byte(i * 7)
+	}
+
+	for _, i := range [][2]*secureConn{{initiator, responder}, {responder, initiator}} {
+		written := make(chan error, 1)
+
+		go func(w *secureConn) {
+			_, err := w.Write(sent)
+			written <- err
+		}(i[0])
+
+		received := make([]byte, len(sent))
+
+		if _, err := io.ReadFull(i[1], received); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := <-written; err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(sent, received) {
+			t.Fatal("Received different bytes to those sent")
+		}
+	}
+}
+
+// A connection that writes to and reads from a buffer, so that records can be
+// meddled with in between.
+type bufferConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (bc *bufferConn) Read(b []byte) (int, error)  { return bc.buf.Read(b) }
+func (bc *bufferConn) Write(b []byte) (int, error) { return bc.buf.Write(b) }
+
+// Seals each message as its own record, returning the records.
+func sealRecords(t *testing.T, messages ...string) [][]byte {
+	conn := &bufferConn{}
+	writer := newTestSecureConn(t, conn, true)
+	ret := make([][]byte, 0, len(messages))
+
+	for _, i := range messages {
+		if _, err := writer.Write([]byte(i)); err != nil {
+			t.Fatal(err)
+		}
+
+		ret = append(ret, append([]byte{}, conn.buf.Bytes()...))
+		conn.buf.Reset()
+	}
+
+	return ret
+}
+
+// Reads records, as the responder, returning the error from reading the last.
+func openRecords(t *testing.T, records ...[]byte) error {
+	conn := &bufferConn{}
+	reader := newTestSecureConn(t, conn, false)
+
+	for _, i := range records {
+		conn.buf.Write(i)
+	}
+
+	var err error
+	buf := make([]byte, secureRecordSize)
+
+	for range records {
+		if _, err = reader.Read(buf); err != nil {
+			break
+		}
+	}
+
+	return err
+}
+
+func TestSecureTampered(t *testing.T) {
+	records := sealRecords(t, "first", "second")
+
+	if err := openRecords(t, records...); err != nil {
+		t.Fatal("Untouched records were not read: ", err)
+	}
+
+	tampered := append([]byte{}, records[0]...)
+	tampered[len(tampered)-1] ^= 1
+
+	if err := openRecords(t, tampered); err != ErrDecrypt {
+		t.Fatal("Tampered record was not refused: ", err)
+	}
+}
+
+// Records are sealed with a counter, so one that is played again, or out of
+// order, does not decrypt.
+func TestSecureReplay(t *testing.T) {
+	records := sealRecords(t, "first", "second")
+
+	if err := openRecords(t, records[0], records[0]); err != ErrDecrypt {
+		t.Fatal("Replayed record was not refused: ", err)
+	}
+
+	if err := openRecords(t, records[1]); err != ErrDecrypt {
+		t.Fatal("Record out of order was not refused: ", err)
+	}
+}
+
+func TestSecureRecordTooLong(t *testing.T) {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, secureRecordSize*2)
+
+	if err := openRecords(t, header); err != ErrRecordTooLong {
+		t.Fatal("Long record was not refused: ", err)
+	}
+}
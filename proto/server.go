@@ -3,73 +3,162 @@ package proto
 // tcp server
 
 import (
-	"encoding/binary"
 	"io"
 	"net"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/zif/zif/common"
+	"github.com/zif/zif/dht"
 	"github.com/zif/zif/util"
 )
 
+// How long a stream has to send its request and be answered. Bulk replies push
+// it back as they go, see Client.ExtendDeadline.
+const StreamTimeout = time.Second * 10
+
 type Server struct {
-	listener     net.Listener
+	listenerLock sync.Mutex
+	listeners    []net.Listener
+	closed       bool
 	capabilities *MessageCapabilities
+
+	handlerLock sync.RWMutex
+	handlers    map[string]registeredHandler
+	quotas      map[string]util.Quota
+
+	admission  *admission
+	reputation *Reputation
+	relay      *Relay
 }
 
 func NewServer(cap *MessageCapabilities) *Server {
 	ret := &Server{}
 
 	ret.capabilities = cap
+	ret.handlers = make(map[string]registeredHandler)
+	ret.quotas = DefaultQuotas()
+	ret.admission = newAdmission(DefaultAdmissionConfig())
+	ret.reputation = NewReputation()
+	ret.relay = NewRelay(DefaultRelayConfig())
 
 	return ret
 }
 
-func (s *Server) Listen(addr string, handler ProtocolHandler, data common.Encoder) {
-	var err error
-
-	s.listener, err = net.Listen("tcp", addr)
+// Listens on addr with the transport, then serves the listener in the
+// background.
+func (s *Server) Listen(t Transport, addr string, handler ProtocolHandler, data common.Encoder) (net.Listener, error) {
+	listener, err := t.Listen(addr)
 
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	log.WithField("address", addr).Info("Listening")
+	log.WithFields(log.Fields{
+		"transport": t.String(),
+		"address":   listener.Addr().String(),
+	}).Info("Listening")
+
+	go s.Serve(listener, handler, data)
+
+	return listener, nil
+}
+
+// Accepts connections from listener until it is closed, by Close or otherwise.
+// A server can serve any number of listeners at once.
+func (s *Server) Serve(listener net.Listener, handler ProtocolHandler, data common.Encoder) {
+	s.listenerLock.Lock()
+	s.listeners = append(s.listeners, listener)
+
+	// closed before we even got started
+	if s.closed {
+		listener.Close()
+	}
+	s.listenerLock.Unlock()
 
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := listener.Accept()
 
-		if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Temporary() {
 			log.Error(err.Error())
 			continue
 		}
 
-		log.Info("New TCP connection")
+		if err != nil {
+			log.Info("Stopped listening: ", err.Error())
+			return
+		}
 
-		var zif int16
-		binary.Read(conn, binary.LittleEndian, &zif)
+		log.WithField("network", listener.Addr().Network()).Info("New connection")
 
-		if zif != ProtoZif {
-			log.Error("This is not a Zif connection: ", zif)
-			continue
-		}
+		go s.HandleConnection(conn, handler, data)
+	}
+}
 
-		log.Debug("Zif connection")
+// Replaces the limits on incoming connections. Connections that are already open
+// are left alone, even if they are now over a limit.
+func (s *Server) SetAdmission(config AdmissionConfig) {
+	s.admission.setConfig(config)
+}
 
-		var version int16
-		binary.Read(conn, binary.LittleEndian, &version)
+func (s *Server) AdmissionStats() AdmissionStats {
+	return s.admission.getStats()
+}
 
-		if version != ProtoVersion {
-			log.Error("Incorrect protocol version: ", version)
-			continue
+// The penalties and bans of every peer.
+func (s *Server) Reputation() *Reputation {
+	return s.reputation
+}
+
+// Negotiates a protocol version with a newly accepted connection, then performs
+// the handshake. Peers that we cannot talk to are told why, and disconnected.
+// Connections from banned IPs, or that would take us over the admission limits,
+// are dropped before anything is read from them.
+func (s *Server) HandleConnection(conn net.Conn, handler ProtocolHandler, data common.Encoder) {
+	remote := conn.RemoteAddr().String()
+	ip := RemoteIP(conn.RemoteAddr())
+
+	if s.reputation.Banned(nil, ip) {
+		log.WithField("remote", remote).Info("Refused connection: ", ErrBanned.Error())
+		conn.Close()
+		return
+	}
+
+	admitted, err := s.admission.admit(conn)
+
+	if err != nil {
+		log.WithField("remote", remote).Info("Refused connection: ", err.Error())
+		conn.Close()
+		return
+	}
+
+	header, err := s.Handshake(admitted, handler, data)
+	s.admission.handshakeDone(err)
+
+	if err != nil {
+		log.WithField("remote", remote).Error(err.Error())
+		admitted.Close()
+
+		// whoever sent these knew exactly what they were doing
+		if err == ErrHandshakeSignature || err == ErrHandshakeAddress || err == ErrHandshakeReplay {
+			s.reputation.Penalise(nil, ip, PenaltyBadHandshake, err.Error())
 		}
 
-		log.Debug("Correct version")
+		return
+	}
+
+	peer, err := handler.HandleHandshake(*header)
 
-		log.Debug("Handshaking new connection")
-		go s.Handshake(conn, handler, data)
+	if err != nil {
+		log.WithField("remote", remote).Error(err.Error())
+		admitted.Close()
+		return
 	}
+
+	handler.SetNetworkPeer(peer)
+
+	s.ListenStream(peer, handler)
 }
 
 func (s *Server) ListenStream(peer NetworkPeer, handler ProtocolHandler) {
@@ -95,7 +184,10 @@ func (s *Server) ListenStream(peer NetworkPeer, handler ProtocolHandler) {
 			return
 		}
 
-		err = stream.SetDeadline(time.Now().Add(time.Second * 10))
+		// set on the shaped stream, so that waiting for bandwidth stops at it
+		// rather than running into it on the next write
+		shaped := peer.ShapeStream(stream)
+		err = shaped.SetDeadline(time.Now().Add(StreamTimeout))
 
 		if err != nil {
 			log.Error(err.Error())
@@ -107,7 +199,7 @@ func (s *Server) ListenStream(peer NetworkPeer, handler ProtocolHandler) {
 		peer.AddStream(stream)
 		peer.UpdateSeen()
 
-		go s.HandleStream(peer, handler, stream)
+		go s.HandleStream(peer, handler, shaped)
 	}
 }
 
@@ -121,6 +213,8 @@ func (s *Server) HandleStream(peer NetworkPeer, handler ProtocolHandler, stream
 		return
 	}
 
+	cl.SetCompression(peer.Compression(), peer.CompressionStats())
+
 	for {
 		msg, err := cl.ReadMessage()
 
@@ -133,77 +227,114 @@ func (s *Server) HandleStream(peer NetworkPeer, handler ProtocolHandler, stream
 		msg.Client = cl
 		msg.From = peer.Address()
 
-		s.RouteMessage(msg, handler)
+		s.RouteMessage(peer, msg)
 	}
 }
 
-func (s *Server) RouteMessage(msg *Message, handler ProtocolHandler) {
-	var err error
-
+// Passes a message to whichever handler is registered for its header. If there
+// is not one, or the peer has not advertised the capability it needs, the peer is
+// told that the message is unsupported. Peers that are over their quota for the
+// message are told when to try again, and penalised for it.
+func (s *Server) RouteMessage(peer NetworkPeer, msg *Message) {
 	defer msg.Client.Close()
 
-	switch msg.Header {
+	handle, reason := s.handler(msg.Header, peer.GetCapabilities())
+
+	if handle == nil {
+		writeUnsupported(msg.Client, msg.Header, reason)
+		return
+	}
 
-	case ProtoDhtAnnounce:
-		err = handler.HandleAnnounce(msg)
-	case ProtoDhtQuery:
-		err = handler.HandleQuery(msg)
-	case ProtoDhtFindClosest:
-		err = handler.HandleFindClosest(msg)
-	case ProtoSearch:
-		err = handler.HandleSearch(msg)
-	case ProtoRecent:
-		err = handler.HandleRecent(msg)
-	case ProtoPopular:
-		err = handler.HandlePopular(msg)
-	case ProtoRequestHashList:
-		err = handler.HandleHashList(msg)
-	case ProtoRequestPiece:
-		err = handler.HandlePiece(msg)
-	case ProtoRequestAddPeer:
-		err = handler.HandleAddPeer(msg)
+	if err := s.chargeQuota(peer, msg.Header); err != nil {
+		log.WithFields(log.Fields{
+			"peer":   peer.Address().StringOr(""),
+			"header": msg.Header,
+		}).Info("Request over quota")
 
-	default:
-		log.Error("Unknown message type")
+		msg.Client.WriteErr(err)
 
+		if s.reputation.Penalise(peer.Address(), PeerIP(peer), PenaltyOverQuota, "Request over quota") {
+			peer.Session().Close()
+		}
+
+		return
 	}
 
+	err := handle(msg)
+
+	// handlers leave telling the peer what went wrong to us
 	if err != nil {
-		log.Error(err.Error())
+		log.WithField("header", msg.Header).Error(err.Error())
+		msg.Client.WriteErr(err)
 	}
-
 }
 
-func (s *Server) Handshake(conn net.Conn, lp ProtocolHandler, data common.Encoder) {
+// Negotiates a version, encrypts the connection and handshakes, all within the
+// handshake timeout.
+func (s *Server) Handshake(conn net.Conn, lp ProtocolHandler, data common.Encoder) (*ConnHeader, error) {
+	timeout := s.admission.getConfig().HandshakeTimeout
+
+	if timeout > 0 {
+		err := conn.SetDeadline(time.Now().Add(timeout))
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	cl, err := NewClient(conn)
 
 	if err != nil {
-		log.Error(err.Error())
-		return
+		return nil, err
 	}
 
-	header, caps, err := handshake(*cl, lp, data)
+	version, err := acceptVersion(cl)
 
 	if err != nil {
-		log.Error(err.Error())
-		return
+		return nil, err
+	}
+
+	if version >= ProtoVersionSecure {
+		cl, err = secureClient(cl, false)
+
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	peer, err := lp.HandleHandshake(ConnHeader{*cl, *header, *caps})
+	log.WithField("version", version).Debug("Handshaking new connection")
+
+	ip := RemoteIP(conn.RemoteAddr())
+
+	header, caps, err := handshake(cl, false, version, lp, data, func(entry *dht.Entry) error {
+		if s.reputation.Banned(&entry.Address, ip) {
+			return ErrBanned
+		}
+
+		return nil
+	})
 
 	if err != nil {
-		log.Error(err.Error())
-		return
+		return nil, err
 	}
 
-	lp.SetCapabilities(*caps)
-	lp.SetNetworkPeer(peer)
+	// the session that follows has deadlines of its own
+	err = conn.SetDeadline(time.Time{})
 
-	go s.ListenStream(peer, lp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ConnHeader{*cl, *header, *caps, version}, nil
 }
 
 func (s *Server) Close() {
-	if s.listener != nil {
-		s.listener.Close()
+	s.listenerLock.Lock()
+	defer s.listenerLock.Unlock()
+
+	s.closed = true
+
+	for _, i := range s.listeners {
+		i.Close()
 	}
 }
@@ -1,20 +1,16 @@
-// Keeps track of open TCP connections, as well as yamux sessions
+// Keeps track of open connections, as well as yamux sessions
 
 package proto
 
 import (
-	"encoding/binary"
+	"context"
 	"errors"
-	"fmt"
 	"net"
 	"time"
 
-	"golang.org/x/net/proxy"
-
 	"github.com/hashicorp/yamux"
 	log "github.com/sirupsen/logrus"
 	"github.com/zif/zif/common"
-	"github.com/zif/zif/dht"
 )
 
 type StreamManager struct {
@@ -29,9 +25,28 @@ type StreamManager struct {
 	// Open yamux streams
 	clients []Client
 
-	Socks     bool
-	SocksPort int
-	torDialer proxy.Dialer
+	// Shared with every other peer, nil if the bandwidth of this one is not
+	// limited.
+	bandwidth *peerBandwidth
+}
+
+// Limits the bandwidth of every stream opened from now on, see bandwidth.go.
+func (sm *StreamManager) SetBandwidth(b *Bandwidth) {
+	if b == nil {
+		sm.bandwidth = nil
+		return
+	}
+
+	sm.bandwidth = &peerBandwidth{shared: b}
+}
+
+// Wraps a stream so that it uses the bandwidth of this peer, if it is limited.
+func (sm *StreamManager) Shape(stream net.Conn) net.Conn {
+	if sm.bandwidth == nil {
+		return stream
+	}
+
+	return newShapedConn(stream, sm.bandwidth)
 }
 
 func (sm *StreamManager) SetConnection(conn ConnHeader) {
@@ -44,116 +59,73 @@ func (sm *StreamManager) Setup() {
 	sm.clients = make([]Client, 0, 10)
 }
 
-func (sm *StreamManager) OpenSocks(addr string, lp ProtocolHandler, data common.Encoder) (*ConnHeader, error) {
-	if sm.torDialer == nil {
-		dialer, err := proxy.SOCKS5("tcp", fmt.Sprintf("127.0.0.1:%d", sm.SocksPort), nil, proxy.Direct)
-
-		if err != nil {
-			return nil, err
-		}
-
-		sm.torDialer = dialer
-	}
-
-	conn, err := sm.torDialer.Dial("tcp", addr)
-
-	if err != nil {
-		return nil, err
-	}
-
-	return sm.handleConnection(conn, lp, data)
+// Handshakes over a connection that a transport, or a relay, has opened.
+func (sm *StreamManager) OpenConn(ctx context.Context, conn net.Conn, lp ProtocolHandler, data common.Encoder) (*ConnHeader, error) {
+	return sm.handleConnection(ctx, conn, lp, data)
 }
 
-func (sm *StreamManager) OpenTCP(addr string, lp ProtocolHandler, data common.Encoder) (*ConnHeader, error) {
-	if sm.Socks {
-		return sm.OpenSocks(addr, lp, data)
-	}
+// Negotiates a version and handshakes over a newly dialed connection. Both are
+// bound to ctx, once they are done the connection outlives it.
+func (sm *StreamManager) handleConnection(ctx context.Context, conn net.Conn, lp ProtocolHandler, data common.Encoder) (_ *ConnHeader, err error) {
+	stop := bindConn(ctx, conn)
 
-	if sm.connection.Client.conn != nil {
-		return &sm.connection, nil
-	}
+	defer func() {
+		stop()
 
-	conn, err := net.Dial("tcp", addr)
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}()
+
+	c, err := NewClient(conn)
 
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	return sm.handleConnection(conn, lp, data)
-}
+	log.WithFields(log.Fields{
+		"min": ProtoVersionMin,
+		"max": ProtoVersionMax,
+	}).Info("Sending version")
 
-func (sm *StreamManager) handleConnection(conn net.Conn, lp ProtocolHandler, data common.Encoder) (*ConnHeader, error) {
-	log.WithField("zif", ProtoZif).Info("Sending")
-	err := binary.Write(conn, binary.LittleEndian, ProtoZif)
+	version, err := requestVersion(c)
 
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	log.WithField("version", ProtoVersion).Info("Sending")
-	err = binary.Write(conn, binary.LittleEndian, ProtoVersion)
+	if version >= ProtoVersionSecure {
+		c, err = secureClient(c, true)
 
-	if err != nil {
-		return nil, err
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
 	}
 
-	header, caps, err := sm.Handshake(conn, lp, data)
+	header, caps, err := handshake(c, true, version, lp, data, nil)
 
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	if header == nil {
-		return nil, errors.New("Failed to handshake, nil entry")
-	}
-
-	c, err := NewClient(conn)
+	// the handshake deadline must not apply to the session
+	err = conn.SetDeadline(time.Time{})
 
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	pair := ConnHeader{*c, *header, *caps}
+	pair := ConnHeader{*c, *header, *caps, version}
 	sm.connection = pair
 
 	return &pair, nil
 }
 
-func (sm *StreamManager) Handshake(conn net.Conn, lp ProtocolHandler, data common.Encoder) (*dht.Entry, *MessageCapabilities, error) {
-	cl, err := NewClient(conn)
-
-	if err != nil {
-		return nil, nil, err
-	}
-
-	log.Debug("Sending handshake")
-	err = handshake_send(*cl, lp, data)
-
-	msg, err := cl.ReadMessage()
-
-	if err != nil {
-		return nil, nil, nil
-	}
-
-	if !msg.Ok() {
-		return nil, nil, errors.New(string(msg.Content))
-	}
-
-	// server now knows that we are definitely who we say we are.
-	// but...
-	// is the server who we think it is?
-	// better check!
-	server_header, caps, err := handshake_recieve(*cl)
-
-	if err != nil {
-		return nil, nil, err
-	}
-
-	log.Info("Handshake complete")
-
-	return server_header, caps, nil
-}
-
 func (sm *StreamManager) ConnectClient() (*yamux.Session, error) {
 	// If there is already a client connected, return that.
 	if sm.client != nil {
@@ -220,7 +192,9 @@ func (sm *StreamManager) GetSession() *yamux.Session {
 	return nil
 }
 
-func (sm *StreamManager) OpenStream() (*Client, error) {
+// Opens a new stream over the session, with the deadline of ctx if it has one
+// and StreamTimeout from now if not, so that nothing waits on a peer forever.
+func (sm *StreamManager) OpenStream(ctx context.Context) (*Client, error) {
 	var ret Client
 	var err error
 	session := sm.GetSession()
@@ -229,15 +203,24 @@ func (sm *StreamManager) OpenStream() (*Client, error) {
 		return nil, errors.New("Cannot open stream, no session")
 	}
 
-	ret.conn, err = session.Open()
+	stream, err := session.Open()
 
 	if err != nil {
 		return nil, err
 	}
 
-	err = ret.conn.SetDeadline(time.Now().Add(time.Second * 10))
+	ret.conn = sm.Shape(stream)
+
+	deadline, ok := ctx.Deadline()
+
+	if !ok {
+		deadline = time.Now().Add(StreamTimeout)
+	}
+
+	err = ret.conn.SetDeadline(deadline)
 
 	if err != nil {
+		ret.conn.Close()
 		return nil, err
 	}
 
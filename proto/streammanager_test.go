@@ -0,0 +1,95 @@
+package proto
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// A stream manager with a session to a peer that accepts streams but never
+// answers on them.
+func silentPeer(t *testing.T) *StreamManager {
+	local, remote := net.Pipe()
+
+	client, err := yamux.Client(local, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := yamux.Server(remote, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	go func() {
+		for {
+			if _, err := server.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	sm := &StreamManager{}
+	sm.Setup()
+	sm.client = client
+
+	return sm
+}
+
+// How long a read from a stream opened with ctx waits on a silent peer, giving
+// up after twice StreamTimeout.
+func readTimeout(t *testing.T, ctx context.Context) time.Duration {
+	stream, err := silentPeer(t).OpenStream(ctx)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer stream.Close()
+
+	start := time.Now()
+	read := make(chan error, 1)
+
+	go func() {
+		_, err := stream.conn.Read(make([]byte, 1))
+		read <- err
+	}()
+
+	select {
+	case err := <-read:
+		if err == nil {
+			t.Fatal("Read from a silent peer succeeded")
+		}
+	case <-time.After(StreamTimeout * 2):
+		t.Fatal("Read from a silent peer never timed out")
+	}
+
+	return time.Since(start)
+}
+
+func TestOpenStreamDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	if waited := readTimeout(t, ctx); waited > StreamTimeout/2 {
+		t.Fatal("Stream ignored the deadline of its context, waited ", waited)
+	}
+}
+
+// Requests made for HTTP commands have contexts without deadlines, which must
+// not leave them waiting forever.
+func TestOpenStreamDefaultDeadline(t *testing.T) {
+	t.Parallel()
+
+	readTimeout(t, context.Background())
+}
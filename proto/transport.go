@@ -0,0 +1,344 @@
+// Transports carry the connections that Zif handshakes over. Each dials some
+// types of endpoint, and may listen, so that new ways of reaching peers can be
+// added without the handshake knowing anything about them.
+
+package proto
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+
+	"golang.org/x/net/proxy"
+
+	"github.com/zif/zif/dht"
+)
+
+var (
+	ErrNoTransport   = errors.New("No transport for endpoint")
+	ErrCannotListen  = errors.New("Transport cannot listen")
+	ErrPipeNotFound  = errors.New("Nothing listening on pipe")
+	ErrPipeListening = errors.New("Pipe is already listening")
+)
+
+type Transport interface {
+	// The endpoint types this can dial.
+	Types() []string
+
+	Dial(ctx context.Context, endpoint dht.Endpoint) (net.Conn, error)
+
+	// Listens on addr, in whatever form this transport takes. Transports that
+	// can only dial return ErrCannotListen.
+	Listen(addr string) (net.Listener, error)
+
+	// The endpoints peers can reach a listener from this transport at, as far
+	// as can be told locally.
+	Endpoints(listener net.Listener) []dht.Endpoint
+
+	String() string
+}
+
+// The transports a peer dials with, chosen by the type of the endpoint.
+type Transports struct {
+	lock   sync.RWMutex
+	byType map[string]Transport
+}
+
+// Later transports take over the types of earlier ones.
+func NewTransports(transports ...Transport) *Transports {
+	ret := &Transports{byType: make(map[string]Transport)}
+
+	for _, i := range transports {
+		ret.Add(i)
+	}
+
+	return ret
+}
+
+// Dials the types of t with it from now on.
+func (ts *Transports) Add(t Transport) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	for _, i := range t.Types() {
+		ts.byType[i] = t
+	}
+}
+
+// The transport that dials kind, or nil if there is none.
+func (ts *Transports) For(kind string) Transport {
+	ts.lock.RLock()
+	defer ts.lock.RUnlock()
+
+	return ts.byType[kind]
+}
+
+func (ts *Transports) Dial(ctx context.Context, endpoint dht.Endpoint) (net.Conn, error) {
+	t := ts.For(endpoint.Type)
+
+	if t == nil {
+		return nil, ErrNoTransport
+	}
+
+	return t.Dial(ctx, endpoint)
+}
+
+// Dials IP and DNS endpoints directly.
+type TCPTransport struct{}
+
+func (TCPTransport) Types() []string {
+	return []string{dht.EndpointIPv4, dht.EndpointIPv6, dht.EndpointDNS}
+}
+
+func (TCPTransport) Dial(ctx context.Context, endpoint dht.Endpoint) (net.Conn, error) {
+	dialer := net.Dialer{}
+
+	return dialer.DialContext(ctx, "tcp", endpoint.HostPort())
+}
+
+func (TCPTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+// The address of the listener if it is a public one. If it is listening on
+// every address, the public addresses of every interface.
+func (TCPTransport) Endpoints(listener net.Listener) []dht.Endpoint {
+	return publicEndpoints(listener.Addr())
+}
+
+func publicEndpoints(a net.Addr) []dht.Endpoint {
+	addr, ok := a.(*net.TCPAddr)
+
+	if !ok {
+		return nil
+	}
+
+	ips := []net.IP{addr.IP}
+
+	if addr.IP.IsUnspecified() {
+		ips = nil
+		addrs, _ := net.InterfaceAddrs()
+
+		for _, i := range addrs {
+			if ipnet, ok := i.(*net.IPNet); ok {
+				// listening on 0.0.0.0 may not cover IPv6
+				if addr.IP.To4() == nil || ipnet.IP.To4() != nil {
+					ips = append(ips, ipnet.IP)
+				}
+			}
+		}
+	}
+
+	ret := make([]dht.Endpoint, 0, len(ips))
+
+	for _, i := range ips {
+		if i.IsGlobalUnicast() && !i.IsPrivate() {
+			ret = append(ret, dht.NewEndpoint(i.String(), addr.Port))
+		}
+	}
+
+	return ret
+}
+
+func (TCPTransport) String() string { return "tcp" }
+
+// Dials through a SOCKS5 proxy, such as Tor, which resolves names itself.
+type SocksTransport struct {
+	// The address of the proxy.
+	Proxy string
+}
+
+func (SocksTransport) Types() []string {
+	return []string{dht.EndpointIPv4, dht.EndpointIPv6, dht.EndpointDNS, dht.EndpointOnion}
+}
+
+func (st SocksTransport) Dial(ctx context.Context, endpoint dht.Endpoint) (net.Conn, error) {
+	dialer, err := proxy.SOCKS5("tcp", st.Proxy, nil, proxy.Direct)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the proxy dialer knows nothing of contexts, so dial in the background and
+	// give up waiting if ctx finishes first.
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+
+	result := make(chan dialResult, 1)
+
+	go func() {
+		conn, err := dialer.Dial("tcp", endpoint.HostPort())
+		result <- dialResult{conn, err}
+	}()
+
+	select {
+	case res := <-result:
+		return res.conn, res.err
+
+	case <-ctx.Done():
+		// make sure the connection is not leaked if it turns up late
+		go func() {
+			if res := <-result; res.conn != nil {
+				res.conn.Close()
+			}
+		}()
+
+		return nil, ctx.Err()
+	}
+}
+
+func (SocksTransport) Listen(addr string) (net.Listener, error) {
+	return nil, ErrCannotListen
+}
+
+func (SocksTransport) Endpoints(listener net.Listener) []dht.Endpoint {
+	return nil
+}
+
+func (st SocksTransport) String() string { return "socks " + st.Proxy }
+
+// Dials and listens on unix sockets, for peers on the same machine.
+type UnixTransport struct{}
+
+func (UnixTransport) Types() []string {
+	return []string{dht.EndpointUnix}
+}
+
+func (UnixTransport) Dial(ctx context.Context, endpoint dht.Endpoint) (net.Conn, error) {
+	dialer := net.Dialer{}
+
+	return dialer.DialContext(ctx, "unix", endpoint.Address)
+}
+
+// Listens on the socket at the path addr, replacing one left by an earlier run.
+func (UnixTransport) Listen(addr string) (net.Listener, error) {
+	if info, err := os.Lstat(addr); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(addr)
+	}
+
+	return net.Listen("unix", addr)
+}
+
+func (UnixTransport) Endpoints(listener net.Listener) []dht.Endpoint {
+	return []dht.Endpoint{{Type: dht.EndpointUnix, Address: listener.Addr().String()}}
+}
+
+func (UnixTransport) String() string { return "unix" }
+
+// Connects peers in the same process with in-memory pipes, by the name they
+// listen on. Peers must share the transport to reach each other.
+type PipeTransport struct {
+	lock      sync.Mutex
+	listeners map[string]*pipeListener
+	dialled   int
+}
+
+func NewPipeTransport() *PipeTransport {
+	return &PipeTransport{listeners: make(map[string]*pipeListener)}
+}
+
+func (pt *PipeTransport) Types() []string {
+	return []string{dht.EndpointPipe}
+}
+
+func (pt *PipeTransport) Dial(ctx context.Context, endpoint dht.Endpoint) (net.Conn, error) {
+	pt.lock.Lock()
+	listener, ok := pt.listeners[endpoint.Address]
+	pt.dialled++
+	remote := pipeAddr("dial/" + strconv.Itoa(pt.dialled))
+	pt.lock.Unlock()
+
+	if !ok {
+		return nil, ErrPipeNotFound
+	}
+
+	client, server := net.Pipe()
+
+	select {
+	case listener.conns <- &pipeConn{server, listener.addr, remote}:
+		return &pipeConn{client, remote, listener.addr}, nil
+
+	case <-listener.closed:
+		return nil, ErrPipeNotFound
+
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (pt *PipeTransport) Listen(addr string) (net.Listener, error) {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+
+	if _, ok := pt.listeners[addr]; ok {
+		return nil, ErrPipeListening
+	}
+
+	ret := &pipeListener{
+		transport: pt,
+		addr:      pipeAddr(addr),
+		conns:     make(chan net.Conn),
+		closed:    make(chan struct{}),
+	}
+
+	pt.listeners[addr] = ret
+
+	return ret, nil
+}
+
+func (pt *PipeTransport) Endpoints(listener net.Listener) []dht.Endpoint {
+	return []dht.Endpoint{{Type: dht.EndpointPipe, Address: listener.Addr().String()}}
+}
+
+func (pt *PipeTransport) String() string { return "pipe" }
+
+type pipeAddr string
+
+func (pa pipeAddr) Network() string { return "pipe" }
+func (pa pipeAddr) String() string  { return string(pa) }
+
+type pipeConn struct {
+	net.Conn
+	local, remote pipeAddr
+}
+
+func (pc *pipeConn) LocalAddr() net.Addr  { return pc.local }
+func (pc *pipeConn) RemoteAddr() net.Addr { return pc.remote }
+
+type pipeListener struct {
+	transport *PipeTransport
+	addr      pipeAddr
+	conns     chan net.Conn
+	closed    chan struct{}
+	once      sync.Once
+}
+
+func (pl *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-pl.conns:
+		return conn, nil
+	case <-pl.closed:
+		return nil, errors.New("Pipe listener closed")
+	}
+}
+
+func (pl *pipeListener) Close() error {
+	pl.once.Do(func() {
+		pl.transport.lock.Lock()
+		delete(pl.transport.listeners, string(pl.addr))
+		pl.transport.lock.Unlock()
+
+		close(pl.closed)
+	})
+
+	return nil
+}
+
+func (pl *pipeListener) Addr() net.Addr {
+	return pl.addr
+}
@@ -0,0 +1,62 @@
+package proto
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zif/zif/dht"
+)
+
+func TestUnixTransport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zif.sock")
+	transports := NewTransports(TCPTransport{}, UnixTransport{})
+
+	listener, err := UnixTransport{}.Listen(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+
+	endpoints := UnixTransport{}.Endpoints(listener)
+
+	if len(endpoints) != 1 || endpoints[0].Valid() != nil {
+		t.Fatal("Unix listener has the wrong endpoints: ", endpoints)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	go func() {
+		conn, err := listener.Accept()
+
+		if err == nil {
+			io.WriteString(conn, "zif")
+			conn.Close()
+		}
+	}()
+
+	conn, err := transports.Dial(ctx, endpoints[0])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	buf := make([]byte, 3)
+
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "zif" {
+		t.Fatal("Unix socket did not carry the bytes written to it: ", err)
+	}
+
+	_, err = transports.Dial(ctx, dht.Endpoint{Type: dht.EndpointOnion, Address: "example.onion", Port: 5050})
+
+	if err != ErrNoTransport {
+		t.Fatal("Dialled an onion without a transport for it: ", err)
+	}
+}
@@ -0,0 +1,152 @@
+// Protocol version negotiation. This happens before anything else on a new
+// connection, so that the wire format can change without splitting the network.
+
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Returned when two peers do not share a protocol version.
+type VersionError struct {
+	// The range the remote peer advertised.
+	Min int16
+	Max int16
+
+	Reason string
+}
+
+func (ve *VersionError) Error() string {
+	return fmt.Sprintf("Incompatible protocol version, peer supports %d-%d, we support %d-%d: %s",
+		ve.Min, ve.Max, ProtoVersionMin, ProtoVersionMax, ve.Reason)
+}
+
+// Picks the highest version supported by both ranges.
+func NegotiateVersion(localMin, localMax, remoteMin, remoteMax int16) (int16, error) {
+	if remoteMin > remoteMax {
+		return 0, &VersionError{remoteMin, remoteMax, "invalid version range"}
+	}
+
+	version := localMax
+	if remoteMax < version {
+		version = remoteMax
+	}
+
+	if version < localMin || version < remoteMin {
+		return 0, &VersionError{remoteMin, remoteMax, "no shared version"}
+	}
+
+	return version, nil
+}
+
+// Sends the Zif magic number followed by the range of versions we support, then
+// waits for the remote peer to pick one. This is the first thing sent over a new
+// outgoing connection.
+func requestVersion(cl *Client) (int16, error) {
+	for _, i := range []int16{ProtoZif, ProtoVersionMin, ProtoVersionMax} {
+		err := binary.Write(cl.conn, binary.LittleEndian, i)
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	msg, err := cl.ReadMessage()
+
+	if err != nil {
+		return 0, err
+	}
+
+	if msg.Header == ProtoIncompatible {
+		rejected := MessageVersion{}
+		err = msg.Read(&rejected)
+
+		if err != nil {
+			return 0, err
+		}
+
+		return 0, &VersionError{rejected.Min, rejected.Max, rejected.Reason}
+	}
+
+	if !msg.Ok() {
+		return 0, errors.New("Peer refused version")
+	}
+
+	selected := MessageVersion{}
+	err = msg.Read(&selected)
+
+	if err != nil {
+		return 0, err
+	}
+
+	// make sure the peer has not picked something we cannot speak
+	if selected.Selected < ProtoVersionMin || selected.Selected > ProtoVersionMax {
+		return 0, &VersionError{selected.Min, selected.Max, "peer selected an unsupported version"}
+	}
+
+	log.WithField("version", selected.Selected).Debug("Version negotiated")
+
+	return selected.Selected, nil
+}
+
+// Reads the magic number and version range from a new incoming connection, and
+// replies with the version that will be used. If there is no shared version, the
+// peer is told why before an error is returned. Closing the connection is left
+// to the caller.
+func acceptVersion(cl *Client) (int16, error) {
+	var zif, min, max int16
+
+	err := binary.Read(cl.conn, binary.LittleEndian, &zif)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if zif != ProtoZif {
+		return 0, fmt.Errorf("This is not a Zif connection: %d", zif)
+	}
+
+	err = binary.Read(cl.conn, binary.LittleEndian, &min)
+
+	if err != nil {
+		return 0, err
+	}
+
+	err = binary.Read(cl.conn, binary.LittleEndian, &max)
+
+	if err != nil {
+		return 0, err
+	}
+
+	version, err := NegotiateVersion(ProtoVersionMin, ProtoVersionMax, min, max)
+
+	if err != nil {
+		msg := &Message{Header: ProtoIncompatible}
+		msg.Write(MessageVersion{
+			Min:    ProtoVersionMin,
+			Max:    ProtoVersionMax,
+			Reason: err.(*VersionError).Reason,
+		})
+
+		cl.WriteMessage(msg)
+
+		return 0, err
+	}
+
+	msg := &Message{Header: ProtoOk}
+	err = msg.Write(MessageVersion{
+		Min:      ProtoVersionMin,
+		Max:      ProtoVersionMax,
+		Selected: version,
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return version, cl.WriteMessage(msg)
+}
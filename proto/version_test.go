@@ -0,0 +1,150 @@
+package proto
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	cases := []struct {
+		localMin, localMax, remoteMin, remoteMax int16
+		expected                                 int16
+	}{
+		{3, 3, 3, 3, 3},
+		{1, 3, 2, 5, 3},
+		{2, 6, 1, 4, 4},
+		{1, 1, 1, 9, 1},
+	}
+
+	for _, i := range cases {
+		version, err := NegotiateVersion(i.localMin, i.localMax, i.remoteMin, i.remoteMax)
+
+		if err != nil || version != i.expected {
+			t.Errorf("Negotiated %d (%v) between %d-%d and %d-%d, expected %d",
+				version, err, i.localMin, i.localMax, i.remoteMin, i.remoteMax, i.expected)
+		}
+	}
+
+	for _, i := range [][4]int16{{1, 2, 3, 4}, {3, 4, 1, 2}, {1, 5, 4, 2}} {
+		_, err := NegotiateVersion(i[0], i[1], i[2], i[3])
+
+		if ve, ok := err.(*VersionError); !ok || ve.Min != i[2] || ve.Max != i[3] {
+			t.Errorf("Negotiating between %d-%d and %d-%d gave %v", i[0], i[1], i[2], i[3], err)
+		}
+	}
+}
+
+func testClients(t *testing.T) (*Client, *Client) {
+	a, b := net.Pipe()
+
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+
+	ca, err := NewClient(a)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cb, err := NewClient(b)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ca, cb
+}
+
+func TestVersionAccepted(t *testing.T) {
+	client, server := testClients(t)
+	accepted := make(chan error, 1)
+
+	go func() {
+		_, err := acceptVersion(server)
+		accepted <- err
+	}()
+
+	version, err := requestVersion(client)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-accepted; err != nil {
+		t.Fatal(err)
+	}
+
+	if version != ProtoVersionMax {
+		t.Fatal("Negotiated version ", version, ", expected ", ProtoVersionMax)
+	}
+}
+
+// A peer that only speaks newer versions is told which we speak, and why it was
+// refused.
+func TestVersionIncompatible(t *testing.T) {
+	client, server := testClients(t)
+	accepted := make(chan error, 1)
+
+	go func() {
+		_, err := acceptVersion(server)
+		accepted <- err
+	}()
+
+	for _, i := range []int16{ProtoZif, ProtoVersionMax + 1, ProtoVersionMax + 2} {
+		if err := binary.Write(client.conn, binary.LittleEndian, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msg, err := client.ReadMessage()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.Header != ProtoIncompatible {
+		t.Fatal("Reply was ", msg.Header, ", expected ", ProtoIncompatible)
+	}
+
+	rejected := MessageVersion{}
+
+	if err := msg.Read(&rejected); err != nil {
+		t.Fatal(err)
+	}
+
+	if rejected.Min != ProtoVersionMin || rejected.Max != ProtoVersionMax || rejected.Reason == "" {
+		t.Fatalf("Refusal was %+v", rejected)
+	}
+
+	if _, ok := (<-accepted).(*VersionError); !ok {
+		t.Fatal("Accepting side did not return a version error")
+	}
+}
+
+// The other way round, an older peer refuses our range.
+func TestVersionRefused(t *testing.T) {
+	client, server := testClients(t)
+
+	go func() {
+		var header [3]int16
+		binary.Read(server.conn, binary.LittleEndian, &header)
+
+		msg := &Message{Header: ProtoIncompatible}
+		msg.Write(MessageVersion{Min: 1, Max: 1, Reason: "too new"})
+		server.WriteMessage(msg)
+	}()
+
+	_, err := requestVersion(client)
+	ve, ok := err.(*VersionError)
+
+	if !ok {
+		t.Fatal("Refusal was not a version error: ", err)
+	}
+
+	if ve.Min != 1 || ve.Max != 1 || ve.Reason != "too new" {
+		t.Fatalf("Refusal was %+v", ve)
+	}
+}
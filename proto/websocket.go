@@ -0,0 +1,95 @@
+package proto
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/zif/zif/dht"
+	"github.com/zif/zif/websocket"
+)
+
+// Where Zif connections are upgraded to WebSockets, on any HTTP server.
+const WebSocketPath = "/zif/"
+
+// Carries Zif connections in WebSockets, which browsers can open and HTTP
+// proxies let through. The handshake and session inside are the same as over
+// TCP.
+type WebSocketTransport struct {
+	// Used to dial wss endpoints, may be nil.
+	TLS *tls.Config
+
+	// A SOCKS5 proxy to dial through, as SocksTransport does. Empty dials
+	// directly.
+	Proxy string
+}
+
+func (WebSocketTransport) Types() []string {
+	return []string{dht.EndpointWS, dht.EndpointWSS}
+}
+
+func (wt WebSocketTransport) Dial(ctx context.Context, endpoint dht.Endpoint) (net.Conn, error) {
+	u := url.URL{Scheme: endpoint.Type, Host: endpoint.HostPort(), Path: WebSocketPath}
+
+	if wt.Proxy == "" {
+		return websocket.Dial(ctx, u.String(), wt.TLS)
+	}
+
+	conn, err := SocksTransport{Proxy: wt.Proxy}.Dial(ctx, endpoint)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return websocket.Client(ctx, conn, u.String(), wt.TLS)
+}
+
+// Listens on a TCP address with an HTTP server of its own, which only serves
+// WebSockets. To serve them alongside other things, mount a websocket.Listener
+// on a router instead.
+func (WebSocketTransport) Listen(addr string) (net.Listener, error) {
+	tcp, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &webSocketListener{websocket.NewListener(tcp.Addr()), tcp}
+
+	mux := http.NewServeMux()
+	mux.Handle(WebSocketPath, ret.Listener)
+
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: time.Second * 10}
+	go server.Serve(tcp)
+
+	return ret, nil
+}
+
+// Where a listener on a public address can be reached, as with TCP. Behind a
+// proxy that terminates TLS, the endpoint to advertise has to be set by hand.
+func (WebSocketTransport) Endpoints(listener net.Listener) []dht.Endpoint {
+	ret := publicEndpoints(listener.Addr())
+
+	for i := range ret {
+		ret[i].Type = dht.EndpointWS
+	}
+
+	return ret
+}
+
+func (WebSocketTransport) String() string { return "websocket" }
+
+// A WebSocket listener that owns its HTTP server.
+type webSocketListener struct {
+	*websocket.Listener
+	tcp net.Listener
+}
+
+func (wl *webSocketListener) Close() error {
+	wl.Listener.Close()
+
+	return wl.tcp.Close()
+}
@@ -0,0 +1,169 @@
+package proto
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zif/zif/dht"
+)
+
+// Just enough of a SOCKS5 proxy to connect to an address without a password,
+// counting the connections made through it.
+func fakeSocks(t *testing.T) (string, *int32) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { listener.Close() })
+
+	count := new(int32)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				target, err := socksRequest(conn)
+
+				if err != nil {
+					return
+				}
+
+				remote, err := net.Dial("tcp", target)
+
+				if err != nil {
+					return
+				}
+
+				defer remote.Close()
+
+				atomic.AddInt32(count, 1)
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+				go io.Copy(remote, conn)
+				io.Copy(conn, remote)
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), count
+}
+
+// Reads the greeting and connect request, returning the address asked for.
+func socksRequest(conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+
+	if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+		return "", err
+	}
+
+	conn.Write([]byte{5, 0})
+
+	request := make([]byte, 4)
+
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", err
+	}
+
+	var host string
+
+	switch request[3] {
+	case 1, 4:
+		ip := make(net.IP, 4)
+
+		if request[3] == 4 {
+			ip = make(net.IP, 16)
+		}
+
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+
+		host = ip.String()
+	default:
+		length := make([]byte, 1)
+
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", err
+		}
+
+		name := make([]byte, length[0])
+
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+
+		host = string(name)
+	}
+
+	port := make([]byte, 2)
+
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func TestWebSocketProxy(t *testing.T) {
+	proxy, proxied := fakeSocks(t)
+
+	listener, err := WebSocketTransport{}.Listen("127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+
+		if err == nil {
+			io.WriteString(conn, "zif")
+			conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	endpoint := dht.Endpoint{Type: dht.EndpointWS, Address: "127.0.0.1", Port: port}
+
+	conn, err := WebSocketTransport{Proxy: proxy}.Dial(ctx, endpoint)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	buf := make([]byte, 3)
+
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "zif" {
+		t.Fatal("WebSocket did not carry the bytes written to it: ", err)
+	}
+
+	if atomic.LoadInt32(proxied) != 1 {
+		t.Fatal("WebSocket was not dialled through the proxy")
+	}
+}
@@ -0,0 +1,403 @@
+// Keeps the peers that matter to us connected. Most peers are connected to when
+// they are needed and forgotten when they go away, but the peers we seed for, the
+// peers we have mirrored and the nodes we bootstrapped from are "sticky": if the
+// connection to one is lost it is redialled, backing off exponentially (with a
+// bit of jitter, so that a whole network does not redial in lockstep) for as long
+// as it cannot be reached.
+
+package zif
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/zif/zif/dht"
+	"github.com/zif/zif/util"
+)
+
+const (
+	ReconnectMinBackoff = time.Second * 5
+	ReconnectMaxBackoff = time.Minute * 10
+)
+
+// Why a peer is sticky.
+const (
+	StickySeed      = "seed"
+	StickyMirror    = "mirror"
+	StickyBootstrap = "bootstrap"
+	StickyRelay     = "relay"
+)
+
+// What a sticky peer is up to.
+const (
+	StickyConnected  = "connected"
+	StickyConnecting = "connecting"
+	StickyWaiting    = "waiting"
+)
+
+// The state of a sticky peer, as shown by the HTTP API.
+type StickyPeer struct {
+	Address string   `json:"address"`
+	Reasons []string `json:"reasons"`
+	State   string   `json:"state"`
+
+	// Failed attempts since the peer was last connected, and why the last one
+	// failed.
+	Failures  int    `json:"failures"`
+	LastError string `json:"lastError,omitempty"`
+
+	// Unix times, zero if they have not happened.
+	Connected   int64 `json:"connected"`
+	NextAttempt int64 `json:"nextAttempt"`
+}
+
+type stickyPeer struct {
+	address dht.Address
+	reasons map[string]bool
+	info    StickyPeer
+
+	wake   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type Reconnector struct {
+	lp *LocalPeer
+
+	lock    sync.Mutex
+	peers   map[string]*stickyPeer
+	started bool
+}
+
+func NewReconnector(lp *LocalPeer) *Reconnector {
+	return &Reconnector{
+		lp:    lp,
+		peers: make(map[string]*stickyPeer),
+	}
+}
+
+// Loads the sticky peers saved last time, and starts keeping them all connected.
+func (r *Reconnector) Start() {
+	r.load()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.started = true
+
+	for _, sp := range r.peers {
+		go r.supervise(sp)
+	}
+}
+
+// Stops reconnecting to anything.
+func (r *Reconnector) Close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.started = false
+
+	for _, sp := range r.peers {
+		sp.cancel()
+	}
+}
+
+// Makes a peer sticky for the given reason. A peer stays sticky until every
+// reason it was added for has been removed.
+func (r *Reconnector) Add(addr dht.Address, reason string) {
+	if addr.Equals(r.lp.Address()) {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := string(addr.Raw)
+	sp, ok := r.peers[key]
+
+	if ok && sp.reasons[reason] {
+		return
+	}
+
+	if !ok {
+		sp = r.newSticky(addr)
+		r.peers[key] = sp
+
+		log.WithFields(log.Fields{
+			"peer":   addr.StringOr(""),
+			"reason": reason,
+		}).Info("Keeping peer connected")
+
+		if r.started {
+			go r.supervise(sp)
+		}
+	}
+
+	sp.reasons[reason] = true
+	r.save()
+}
+
+// Removes a reason for a peer to be sticky, if there are none left it is no
+// longer reconnected to.
+func (r *Reconnector) Remove(addr dht.Address, reason string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	sp, ok := r.peers[string(addr.Raw)]
+
+	if !ok {
+		return
+	}
+
+	delete(sp.reasons, reason)
+
+	if len(sp.reasons) == 0 {
+		sp.cancel()
+		delete(r.peers, string(addr.Raw))
+	}
+
+	r.save()
+}
+
+// Stops reconnecting to a peer, whatever it was sticky for.
+func (r *Reconnector) Forget(addr dht.Address) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	sp, ok := r.peers[string(addr.Raw)]
+
+	if !ok {
+		return false
+	}
+
+	sp.cancel()
+	delete(r.peers, string(addr.Raw))
+	r.save()
+
+	return true
+}
+
+// Lets the reconnector know that a peer has gone away, so that a sticky one is
+// redialled straight away rather than at the next check.
+func (r *Reconnector) Disconnected(addr dht.Address) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	sp, ok := r.peers[string(addr.Raw)]
+
+	if !ok {
+		return
+	}
+
+	select {
+	case sp.wake <- struct{}{}:
+	default:
+	}
+}
+
+// The state of every sticky peer, ordered by address.
+func (r *Reconnector) Peers() []StickyPeer {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	ret := make([]StickyPeer, 0, len(r.peers))
+
+	for _, sp := range r.peers {
+		info := sp.info
+		info.Reasons = make([]string, 0, len(sp.reasons))
+
+		for reason := range sp.reasons {
+			info.Reasons = append(info.Reasons, reason)
+		}
+
+		sort.Strings(info.Reasons)
+		ret = append(ret, info)
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Address < ret[j].Address })
+
+	return ret
+}
+
+func (r *Reconnector) newSticky(addr dht.Address) *stickyPeer {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &stickyPeer{
+		address: addr,
+		reasons: make(map[string]bool),
+		info:    StickyPeer{Address: addr.StringOr(""), State: StickyWaiting},
+		wake:    make(chan struct{}, 1),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// Keeps a single peer connected until it is no longer sticky.
+func (r *Reconnector) supervise(sp *stickyPeer) {
+	failures := 0
+
+	for {
+		if r.lp.GetPeer(sp.address) != nil {
+			r.reseed(sp)
+
+			r.update(sp, func(info *StickyPeer) {
+				if info.State != StickyConnected {
+					info.Connected = time.Now().Unix()
+				}
+
+				info.State = StickyConnected
+				info.Failures = 0
+				info.NextAttempt = 0
+			})
+
+			failures = 0
+
+			// in case we are never told about the disconnect, check every so often
+			select {
+			case <-sp.wake:
+			case <-time.After(HeartbeatFrequency):
+			case <-sp.ctx.Done():
+				return
+			}
+
+			continue
+		}
+
+		r.update(sp, func(info *StickyPeer) { info.State = StickyConnecting })
+
+		ctx, cancel := context.WithTimeout(sp.ctx, PeerTimeout)
+		_, _, err := r.lp.ConnectPeer(ctx, sp.address)
+		cancel()
+
+		if sp.ctx.Err() != nil {
+			return
+		}
+
+		if err == nil {
+			log.WithField("peer", sp.address.StringOr("")).Info("Reconnected to peer")
+			continue
+		}
+
+		failures++
+		wait := reconnectBackoff(failures)
+
+		log.WithFields(log.Fields{
+			"peer":  sp.address.StringOr(""),
+			"retry": wait,
+		}).Info("Failed to reconnect: ", err.Error())
+
+		r.update(sp, func(info *StickyPeer) {
+			info.State = StickyWaiting
+			info.Failures = failures
+			info.LastError = err.Error()
+			info.NextAttempt = time.Now().Add(wait).Unix()
+		})
+
+		select {
+		case <-time.After(wait):
+		case <-sp.ctx.Done():
+			return
+		}
+	}
+}
+
+// The seed manager of a peer we seed for is stopped when it disconnects, so it
+// has to be started again once the peer is back.
+func (r *Reconnector) reseed(sp *stickyPeer) {
+	r.lock.Lock()
+	seed := sp.reasons[StickySeed]
+	r.lock.Unlock()
+
+	if !seed {
+		return
+	}
+
+	if err := r.lp.peerManager.AddSeedManager(sp.address); err != nil {
+		log.WithField("peer", sp.address.StringOr("")).Error("Failed to restart seed manager: ", err.Error())
+	}
+}
+
+func (r *Reconnector) update(sp *stickyPeer, fn func(*StickyPeer)) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	fn(&sp.info)
+}
+
+// How long to wait after the given number of failures in a row. Doubles each
+// time up to ReconnectMaxBackoff, then somewhere between half of that and all of
+// it is chosen at random.
+func reconnectBackoff(failures int) time.Duration {
+	backoff := ReconnectMinBackoff
+
+	for i := 1; i < failures && backoff < ReconnectMaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > ReconnectMaxBackoff {
+		backoff = ReconnectMaxBackoff
+	}
+
+	half := int64(backoff / 2)
+
+	return time.Duration(half + util.CryptoRandInt(0, half+1))
+}
+
+// Sticky peers are saved as a map of encoded address to reasons. Must be called
+// with the lock held.
+func (r *Reconnector) save() {
+	saved := make(map[string][]string)
+
+	for _, sp := range r.peers {
+		for reason := range sp.reasons {
+			saved[sp.info.Address] = append(saved[sp.info.Address], reason)
+		}
+	}
+
+	dat, err := json.Marshal(saved)
+
+	if err != nil {
+		log.Error(err.Error())
+		return
+	}
+
+	err = ioutil.WriteFile(r.lp.DataPath("sticky.json"), dat, 0644)
+
+	if err != nil {
+		log.Error(err.Error())
+	}
+}
+
+func (r *Reconnector) load() {
+	dat, err := ioutil.ReadFile(r.lp.DataPath("sticky.json"))
+
+	if err != nil {
+		return
+	}
+
+	saved := make(map[string][]string)
+	err = json.Unmarshal(dat, &saved)
+
+	if err != nil {
+		log.Error(err.Error())
+		return
+	}
+
+	for address, reasons := range saved {
+		addr, err := dht.DecodeAddress(address)
+
+		if err != nil {
+			continue
+		}
+
+		for _, reason := range reasons {
+			r.Add(addr, reason)
+		}
+	}
+}
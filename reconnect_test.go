@@ -0,0 +1,140 @@
+package zif
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zif/zif/dht"
+)
+
+func newTestLocalPeer(t *testing.T) *LocalPeer {
+	lp := &LocalPeer{Directory: t.TempDir()}
+	lp.GenerateKey()
+	lp.Setup()
+
+	t.Cleanup(func() { lp.DHT.Close() })
+
+	return lp
+}
+
+func randomAddress(t *testing.T) dht.Address {
+	addr, err := dht.RandomAddress()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return *addr
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	expected := ReconnectMinBackoff
+
+	for failures := 1; failures < 20; failures++ {
+		for i := 0; i < 50; i++ {
+			wait := reconnectBackoff(failures)
+
+			if wait < expected/2 || wait > expected {
+				t.Fatal("Backoff after ", failures, " failures was ", wait, ", expected between ", expected/2, " and ", expected)
+			}
+		}
+
+		if expected *= 2; expected > ReconnectMaxBackoff {
+			expected = ReconnectMaxBackoff
+		}
+	}
+}
+
+// However many failures there have been, the wait should not always be the same.
+func TestReconnectJitter(t *testing.T) {
+	seen := make(map[time.Duration]bool)
+
+	for i := 0; i < 50; i++ {
+		seen[reconnectBackoff(30)] = true
+	}
+
+	if len(seen) < 2 {
+		t.Fatal("Backoff has no jitter")
+	}
+}
+
+func TestStickySaved(t *testing.T) {
+	lp := newTestLocalPeer(t)
+	a, b := randomAddress(t), randomAddress(t)
+
+	lp.AddSticky(a, StickySeed)
+	lp.AddSticky(a, StickyMirror)
+	lp.AddSticky(b, StickyBootstrap)
+
+	// nothing is kept for the local peer itself
+	lp.AddSticky(*lp.Address(), StickySeed)
+
+	r := NewReconnector(lp)
+	r.load()
+
+	peers := r.Peers()
+
+	if len(peers) != 2 {
+		t.Fatal("Loaded ", len(peers), " sticky peers, expected 2")
+	}
+
+	for _, i := range peers {
+		var expected string
+
+		switch i.Address {
+		case a.StringOr(""):
+			expected = StickyMirror + "," + StickySeed
+		case b.StringOr(""):
+			expected = StickyBootstrap
+		default:
+			t.Fatal("Loaded an unknown sticky peer: ", i.Address)
+		}
+
+		if reasons := strings.Join(i.Reasons, ","); reasons != expected {
+			t.Fatal("Loaded reasons ", reasons, ", expected ", expected)
+		}
+	}
+
+	lp.RemoveSticky(a, StickySeed)
+	lp.RemoveSticky(a, StickyMirror)
+
+	r = NewReconnector(lp)
+	r.load()
+
+	if peers := r.Peers(); len(peers) != 1 || peers[0].Address != b.StringOr("") {
+		t.Fatal("Peer with no reasons left was still saved")
+	}
+}
+
+func TestForgetSticky(t *testing.T) {
+	lp := newTestLocalPeer(t)
+	cs := NewCommandServer(lp)
+	addr := randomAddress(t)
+
+	lp.AddSticky(addr, StickySeed)
+	lp.AddSticky(addr, StickyMirror)
+
+	if res := cs.ForgetSticky(CommandForgetSticky{Address: addr.StringOr("")}); !res.IsOK {
+		t.Fatal(res.Error)
+	}
+
+	if len(lp.StickyPeers()) != 0 {
+		t.Fatal("Forgotten peer is still sticky")
+	}
+
+	dat, err := ioutil.ReadFile(lp.DataPath("sticky.json"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(dat), addr.StringOr("")) {
+		t.Fatal("Forgotten peer is still saved")
+	}
+
+	if res := cs.ForgetSticky(CommandForgetSticky{Address: addr.StringOr("")}); res.IsOK {
+		t.Fatal("Forgot a peer that was not sticky")
+	}
+}
@@ -2,6 +2,8 @@ package zif
 
 import (
 	"bytes"
+	"context"
+	"sync"
 	"time"
 
 	"github.com/zif/zif/dht"
@@ -24,15 +26,17 @@ type SeedManager struct {
 	// the address we are tracking seeds for
 	track dht.Address
 	entry *dht.Entry
-	Close chan bool
+
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
 // Creates a new seed manager, given an address to track seeds for and the
 // localpeer.
 func NewSeedManager(track dht.Address, lp *LocalPeer) (*SeedManager, error) {
 	ret := SeedManager{
-		lp:    lp,
-		Close: make(chan bool),
+		lp:   lp,
+		stop: make(chan struct{}),
 	}
 
 	entry, err := lp.QueryEntry(track)
@@ -53,9 +57,15 @@ func (sm *SeedManager) Start() {
 	go sm.findSeeds()
 }
 
+// Stop looking for seeds. Safe to call more than once.
+func (sm *SeedManager) Stop() {
+	sm.stopOnce.Do(func() { close(sm.stop) })
+}
+
 // queries all seeds to see if we can find new seeds
 func (sm *SeedManager) findSeeds() {
 	ticker := time.NewTicker(SeedSearchFrequency)
+	defer ticker.Stop()
 
 	find := func() {
 		entry, err := sm.lp.QueryEntry(sm.track)
@@ -67,6 +77,10 @@ func (sm *SeedManager) findSeeds() {
 
 		sm.entry = entry
 
+		// a search should never run into the next one
+		ctx, cancel := context.WithTimeout(context.Background(), SeedSearchFrequency)
+		defer cancel()
+
 		log.Info("Searching for new seeds")
 		for _, i := range sm.entry.Seeds {
 			addr := dht.Address{Raw: i}
@@ -80,7 +94,7 @@ func (sm *SeedManager) findSeeds() {
 				continue
 			}
 
-			peer, entry, err := sm.lp.ConnectPeer(addr)
+			peer, entry, err := sm.lp.ConnectPeer(ctx, addr)
 
 			if err != nil {
 				log.Error(err.Error())
@@ -96,7 +110,7 @@ func (sm *SeedManager) findSeeds() {
 
 			log.WithField("peer", es).Info("Querying for seeds")
 
-			qResultVerifiable, err := peer.Query(sm.entry.Address)
+			qResultVerifiable, err := peer.Query(ctx, sm.entry.Address)
 			if err != nil {
 				continue
 			}
@@ -110,7 +124,7 @@ func (sm *SeedManager) findSeeds() {
 			for n, i := range result {
 				seedAddress := dht.Address{Raw: i}
 
-				entry, err := sm.lp.Resolve(seedAddress)
+				entry, err := sm.lp.Resolve(ctx, seedAddress)
 
 				// nope, we won't be adding this one
 				if err != nil {
@@ -159,7 +173,7 @@ func (sm *SeedManager) findSeeds() {
 		select {
 		case _ = <-ticker.C:
 			find()
-		case _ = <-sm.Close:
+		case <-sm.stop:
 			return
 		}
 	}
@@ -0,0 +1,379 @@
+// Downloads a collection from several peers at once. Every piece can be checked
+// against the signed hash list on its own, so it does not matter who it comes
+// from, only that it matches.
+
+package zif
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/zif/zif/data"
+	"github.com/zif/zif/dht"
+	"github.com/zif/zif/proto"
+)
+
+const (
+	// The most peers a single mirror downloads from.
+	SwarmMaxSources = 8
+
+	// How many pieces a source is asked for at once. This starts small, grows
+	// for sources that keep up and shrinks for those that do not.
+	SwarmRangeMin   = 1
+	SwarmRangeStart = 4
+	SwarmRangeMax   = 64
+
+	// Each piece in a range adds this much to the time the source is given, if it
+	// takes longer the rest of the range is handed to someone else.
+	SwarmPieceTimeout = time.Second * 30
+
+	// A source that fails this many ranges in a row is dropped.
+	SwarmMaxFailures = 3
+)
+
+var PieceMismatch = errors.New("Piece hash mismatch")
+
+type swarmSource struct {
+	peer      *Peer
+	rangeSize int
+	failures  int
+}
+
+type Swarm struct {
+	address    dht.Address
+	hashList   []byte
+	db         *data.Database
+	checkpoint *data.Checkpoint
+
+	sources []*swarmSource
+
+	// guards the queue, and everything the workers share
+	lock     sync.Mutex
+	wake     *sync.Cond
+	queue    []int
+	inFlight int
+	banned   []dht.Address
+
+	// inserts are done one at a time, sqlite does not like concurrent writers
+	commitLock sync.Mutex
+	progress   int
+}
+
+// Creates a swarm that will download every piece in hashList missing from the
+// checkpoint, for the collection belonging to address.
+func NewSwarm(address dht.Address, hashList []byte, db *data.Database, checkpoint *data.Checkpoint) *Swarm {
+	ret := &Swarm{
+		address:    address,
+		hashList:   hashList,
+		db:         db,
+		checkpoint: checkpoint,
+	}
+
+	ret.wake = sync.NewCond(&ret.lock)
+
+	return ret
+}
+
+// Adds a peer to download pieces from. This must be done before Run.
+func (s *Swarm) AddSource(p *Peer) {
+	for _, i := range s.sources {
+		if i.peer.Address().Equals(p.Address()) {
+			return
+		}
+	}
+
+	s.sources = append(s.sources, &swarmSource{peer: p, rangeSize: SwarmRangeStart})
+}
+
+// Sources that were caught sending pieces that do not match the hash list.
+func (s *Swarm) Banned() []dht.Address {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]dht.Address{}, s.banned...)
+}
+
+// Downloads all of the missing pieces, sending the number of pieces held so far
+// to onPiece after each is committed. Returns once every piece has been
+// committed, or there are no sources left to try.
+func (s *Swarm) Run(ctx context.Context, onPiece chan int) error {
+	s.queue = s.checkpoint.Missing(s.hashList)
+	s.progress = len(s.hashList)/32 - len(s.queue)
+
+	if len(s.queue) == 0 {
+		return nil
+	}
+
+	if len(s.sources) == 0 {
+		return errors.New("No sources to mirror from")
+	}
+
+	// waiting workers need to notice cancellation too
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.lock.Lock()
+			s.wake.Broadcast()
+			s.lock.Unlock()
+		case <-stop:
+		}
+	}()
+
+	var wg sync.WaitGroup
+
+	for _, i := range s.sources {
+		wg.Add(1)
+
+		go func(src *swarmSource) {
+			defer wg.Done()
+			s.work(ctx, src, onPiece)
+		}(i)
+	}
+
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if len(s.queue) > 0 {
+		return fmt.Errorf("Mirror failed, no sources left for %d pieces", len(s.queue))
+	}
+
+	// from the start, as pieces committed by earlier runs that failed have not
+	// been indexed yet. Posts that have been are ignored.
+	return s.db.GenerateFts(0)
+}
+
+// Keeps handing ranges to a source until there is nothing left, or it has been
+// dropped.
+func (s *Swarm) work(ctx context.Context, src *swarmSource, onPiece chan int) {
+	defer func() {
+		// others may be waiting on pieces this source would have fetched
+		s.lock.Lock()
+		s.wake.Broadcast()
+		s.lock.Unlock()
+	}()
+
+	for {
+		start, length, ok := s.take(ctx, src.rangeSize)
+
+		if !ok {
+			return
+		}
+
+		began := time.Now()
+
+		rctx, cancel := context.WithTimeout(ctx, SwarmPieceTimeout*time.Duration(length))
+		err := s.fetch(rctx, src.peer, start, length, onPiece)
+		cancel()
+
+		s.release(start, length)
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		srcLog := log.WithField("peer", src.peer.Address().StringOr(""))
+
+		if err == PieceMismatch {
+			srcLog.Error("Peer sent a bad piece, banning it from this mirror")
+			src.peer.Penalise(proto.PenaltyBadPiece, err.Error())
+
+			s.lock.Lock()
+			s.banned = append(s.banned, *src.peer.Address())
+			s.lock.Unlock()
+
+			return
+		}
+
+		if err != nil {
+			src.failures++
+			src.rangeSize /= 2
+
+			if src.rangeSize < SwarmRangeMin {
+				src.rangeSize = SwarmRangeMin
+			}
+
+			srcLog.WithField("failures", src.failures).Info("Mirror source failed: ", err.Error())
+
+			if src.failures >= SwarmMaxFailures {
+				srcLog.Info("Dropping mirror source")
+				return
+			}
+
+			continue
+		}
+
+		src.failures = 0
+
+		// finishing in less than half the time allowed means it can take more
+		if time.Since(began) < SwarmPieceTimeout*time.Duration(length)/2 {
+			src.rangeSize *= 2
+
+			if src.rangeSize > SwarmRangeMax {
+				src.rangeSize = SwarmRangeMax
+			}
+		}
+	}
+}
+
+// Takes a run of up to size consecutive pieces from the front of the queue,
+// waiting if the queue is empty but other sources may yet give pieces back.
+func (s *Swarm) take(ctx context.Context, size int) (int, int, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for len(s.queue) == 0 && s.inFlight > 0 && ctx.Err() == nil {
+		s.wake.Wait()
+	}
+
+	if len(s.queue) == 0 || ctx.Err() != nil {
+		return 0, 0, false
+	}
+
+	length := 1
+	for length < size && length < len(s.queue) && s.queue[length] == s.queue[0]+length {
+		length++
+	}
+
+	start := s.queue[0]
+	s.queue = s.queue[length:]
+	s.inFlight += length
+
+	return start, length, true
+}
+
+// Puts any pieces in a range that were not committed back on the queue.
+func (s *Swarm) release(start, length int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	requeue := make([]int, 0)
+
+	for id := start; id < start+length; id++ {
+		if !s.checkpoint.Has(id, s.hashList[32*id:32*id+32]) {
+			requeue = append(requeue, id)
+		}
+	}
+
+	s.inFlight -= length
+
+	if len(requeue) > 0 {
+		// keep the queue sorted, so ranges stay consecutive
+		merged := make([]int, 0, len(s.queue)+len(requeue))
+		i, j := 0, 0
+
+		for i < len(s.queue) || j < len(requeue) {
+			if j >= len(requeue) || (i < len(s.queue) && s.queue[i] < requeue[j]) {
+				merged = append(merged, s.queue[i])
+				i++
+			} else {
+				merged = append(merged, requeue[j])
+				j++
+			}
+		}
+
+		s.queue = merged
+	}
+
+	s.wake.Broadcast()
+}
+
+// Requests a range of pieces from a peer and commits each one that matches the
+// hash list. Stops at the first piece that does not.
+func (s *Swarm) fetch(ctx context.Context, p *Peer, start, length int, onPiece chan int) error {
+	stream, err := p.OpenStream(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer stream.Close()
+
+	pieces := stream.Pieces(ctx, s.address, start, length, p.pieceFormat)
+
+	if pieces == nil {
+		return errors.New("Failed to request pieces")
+	}
+
+	// if we give up early, make sure the reader is not left blocked
+	defer func() {
+		stream.Close()
+
+		for range pieces {
+		}
+	}()
+
+	received := 0
+
+	for piece := range pieces {
+		id := int(piece.Id)
+		hash := piece.Hash()
+
+		// the peer may simply not have it, seeds can be behind
+		if len(piece.Posts) == 0 {
+			return fmt.Errorf("Peer does not have piece %d", id)
+		}
+
+		if id < start || id >= start+length || !bytes.Equal(s.hashList[32*id:32*id+32], hash) {
+			return PieceMismatch
+		}
+
+		err = s.commit(ctx, id, hash, piece, onPiece)
+
+		if err != nil {
+			return err
+		}
+
+		received++
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if received < length {
+		return fmt.Errorf("Recieved %d of %d pieces", received, length)
+	}
+
+	return nil
+}
+
+// Progress is sent once the lock is released, so that a slow reader only holds
+// up the source whose piece it is.
+func (s *Swarm) commit(ctx context.Context, id int, hash []byte, piece *data.Piece, onPiece chan int) error {
+	s.commitLock.Lock()
+
+	err := s.db.InsertPiece(piece)
+
+	if err == nil {
+		err = s.checkpoint.Commit(id, hash)
+	}
+
+	if err != nil {
+		s.commitLock.Unlock()
+		return err
+	}
+
+	s.progress++
+	progress := s.progress
+
+	s.commitLock.Unlock()
+
+	select {
+	case onPiece <- progress:
+	case <-ctx.Done():
+	}
+
+	return nil
+}
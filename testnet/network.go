@@ -0,0 +1,253 @@
+// Runs whole networks of peers within a single process, so that tests can see
+// how they behave together. Every node listens on its own loopback port and
+// keeps everything it stores in its own temporary directory, all of which is
+// removed once the network is closed.
+
+package testnet
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/zif/zif"
+	"github.com/zif/zif/data"
+	"github.com/zif/zif/dht"
+)
+
+// How often WaitFor checks its condition.
+const PollFrequency = time.Millisecond * 50
+
+type Node struct {
+	*zif.LocalPeer
+
+	// Runs commands as though they came from the HTTP API.
+	Commands *zif.CommandServer
+
+	listener net.Listener
+}
+
+type Network struct {
+	Nodes []*Node
+
+	lock sync.Mutex
+	dir  string
+}
+
+// Starts a network of count nodes, none of which know about each other yet.
+func New(count int) (*Network, error) {
+	dir, err := ioutil.TempDir("", "zif-testnet")
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &Network{dir: dir}
+
+	for i := 0; i < count; i++ {
+		_, err := ret.AddNode()
+
+		if err != nil {
+			ret.Close()
+			return nil, err
+		}
+	}
+
+	return ret, nil
+}
+
+// Starts another node in the network.
+func (n *Network) AddNode() (*Node, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	name := fmt.Sprintf("node%d", len(n.Nodes))
+	dir := filepath.Join(n.dir, name)
+
+	err := os.Mkdir(dir, 0777)
+
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		return nil, err
+	}
+
+	lp := &zif.LocalPeer{Directory: dir}
+	lp.GenerateKey()
+
+	err = lp.WriteKey()
+
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	lp.Setup()
+
+	lp.Entry.Name = name
+	lp.Entry.Desc = "A node in a test network"
+	lp.Entry.SetLocalPeer(lp)
+
+	err = lp.SetPublicAddress("127.0.0.1", listener.Addr().(*net.TCPAddr).Port)
+
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	lp.Database = data.NewDatabase(lp.DataPath("posts.db"))
+
+	err = lp.Database.Connect()
+
+	if err == nil {
+		err = lp.SaveEntry()
+	}
+
+	if err != nil {
+		listener.Close()
+		lp.Close()
+		return nil, err
+	}
+
+	lp.Serve(listener)
+
+	ret := &Node{
+		LocalPeer: lp,
+		Commands:  zif.NewCommandServer(lp),
+		listener:  listener,
+	}
+
+	n.Nodes = append(n.Nodes, ret)
+
+	return ret, nil
+}
+
+// Closes every node, then removes everything they stored.
+func (n *Network) Close() error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	for _, i := range n.Nodes {
+		i.Close()
+	}
+
+	n.Nodes = nil
+
+	return os.RemoveAll(n.dir)
+}
+
+// Bootstraps every node but the first off of the first, one after another.
+func (n *Network) Bootstrap(ctx context.Context) error {
+	for _, i := range n.Nodes[1:] {
+		err := i.Bootstrap(ctx, n.Nodes[0])
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Where the node can be connected to.
+func (n *Node) Addr() string {
+	return n.listener.Addr().String()
+}
+
+// The encoded Zif address of the node.
+func (n *Node) AddressString() string {
+	return n.Address().StringOr("")
+}
+
+func (n *Node) Bootstrap(ctx context.Context, to *Node) error {
+	return result(n.Commands.Bootstrap(ctx, zif.CommandBootstrap{Address: to.Addr()}))
+}
+
+// Adds a post to the node, and indexes it so that it can be searched for.
+func (n *Node) AddPost(post data.Post) (int64, error) {
+	res := n.Commands.AddPost(zif.CommandAddPost{Post: post, Index: true})
+
+	if err := result(res); err != nil {
+		return 0, err
+	}
+
+	return res.Result.(int64), nil
+}
+
+// Mirrors the posts of another node, resolving it first if need be.
+func (n *Node) Mirror(ctx context.Context, from *Node) error {
+	return result(n.Commands.Mirror(ctx, zif.CommandMirror{Address: from.AddressString()}))
+}
+
+// Searches the posts of another node. If they have been mirrored the mirror is
+// searched, otherwise the node is asked.
+func (n *Node) Search(ctx context.Context, on *Node, query string) ([]*data.Post, error) {
+	res := n.Commands.PeerSearch(ctx, zif.CommandPeerSearch{
+		CommandPeer: zif.CommandPeer{Address: on.AddressString()},
+		Query:       query,
+	})
+
+	if err := result(res); err != nil {
+		return nil, err
+	}
+
+	// mirrors give back a value, peers a pointer
+	switch posts := res.Result.(type) {
+	case data.SearchResult:
+		return posts.Posts, nil
+	case *data.SearchResult:
+		return posts.Posts, nil
+	}
+
+	return nil, fmt.Errorf("Unexpected search result: %T", res.Result)
+}
+
+// Whether the node has an entry for another in its DHT.
+func (n *Node) Knows(other *Node) bool {
+	entry, err := n.DHT.Query(*other.Address())
+
+	return err == nil && entry != nil
+}
+
+// Resolves the address of another node through the network.
+func (n *Node) Resolve(ctx context.Context, other *Node) (*dht.Entry, error) {
+	return n.LocalPeer.Resolve(ctx, *other.Address())
+}
+
+// Checks cond until it holds, or gives up after timeout. Returns whether it held.
+func WaitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		if cond() {
+			return true
+		}
+
+		if time.Now().After(deadline) {
+			return false
+		}
+
+		time.Sleep(PollFrequency)
+	}
+}
+
+func result(cr zif.CommandResult) error {
+	if cr.Error != nil {
+		return cr.Error
+	}
+
+	if !cr.IsOK {
+		return fmt.Errorf("Command failed: %v", cr.Result)
+	}
+
+	return nil
+}
@@ -0,0 +1,550 @@
+package testnet
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/zif/zif/data"
+	"github.com/zif/zif/dht"
+	"github.com/zif/zif/proto"
+)
+
+const testTimeout = time.Second * 30
+
+func newNetwork(t *testing.T, count int) (*Network, context.Context) {
+	n, err := New(count)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+
+	t.Cleanup(func() {
+		cancel()
+
+		if err := n.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	return n, ctx
+}
+
+// Stops the nodes taking part in peer exchange, for tests of how they find each
+// other without it.
+func withoutExchange(n *Network) {
+	for _, i := range n.Nodes {
+		i.Server.RemoveHandler(proto.ProtoDhtExchange)
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	n, ctx := newNetwork(t, 3)
+
+	if err := n.Bootstrap(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, i := range n.Nodes[1:] {
+		if !i.Knows(n.Nodes[0]) {
+			t.Fatal(i.Entry.Name, " does not know the node it bootstrapped off")
+		}
+	}
+
+	// the first node learns of the others as they connect to it
+	if !WaitFor(testTimeout, func() bool {
+		return n.Nodes[0].Knows(n.Nodes[1]) && n.Nodes[0].Knows(n.Nodes[2])
+	}) {
+		t.Fatal("Bootstrap node does not know the nodes that bootstrapped off it")
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	n, ctx := newNetwork(t, 2)
+	a, b := n.Nodes[0], n.Nodes[1]
+
+	if err := b.Bootstrap(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+
+	peer := b.GetPeer(*a.Address())
+
+	if peer == nil {
+		t.Fatal("Not connected to the bootstrap node")
+	}
+
+	if err := peer.Announce(ctx, b.LocalPeer); err != nil {
+		t.Fatal("Announce was refused: ", err)
+	}
+}
+
+// Neither of the last two nodes has heard of the other, so resolving has to go
+// through the first.
+func TestResolve(t *testing.T) {
+	n, ctx := newNetwork(t, 3)
+	a, b, c := n.Nodes[0], n.Nodes[1], n.Nodes[2]
+	withoutExchange(n)
+
+	if err := b.Bootstrap(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Bootstrap(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+
+	if !WaitFor(testTimeout, func() bool { return a.Knows(c) }) {
+		t.Fatal("Bootstrap node never heard of the last node")
+	}
+
+	if b.Knows(c) {
+		t.Skip("Node already knows who it is meant to resolve")
+	}
+
+	entry, err := b.Resolve(ctx, c)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !entry.Address.Equals(c.Address()) || entry.Port != c.Entry.Port {
+		t.Fatal("Resolved the wrong entry")
+	}
+}
+
+func TestExplore(t *testing.T) {
+	n, ctx := newNetwork(t, 4)
+	withoutExchange(n)
+
+	if err := n.Bootstrap(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := result(n.Nodes[1].Commands.Explore()); err != nil {
+		t.Fatal(err)
+	}
+
+	if !WaitFor(testTimeout, func() bool {
+		return n.Nodes[1].Knows(n.Nodes[2]) && n.Nodes[1].Knows(n.Nodes[3])
+	}) {
+		t.Fatal("Exploring did not find every node")
+	}
+}
+
+func TestMirrorAndSearch(t *testing.T) {
+	n, ctx := newNetwork(t, 2)
+	a, b := n.Nodes[0], n.Nodes[1]
+
+	for i := 0; i < 10; i++ {
+		_, err := a.AddPost(data.Post{
+			InfoHash:   fmt.Sprintf("%040d", i),
+			Title:      fmt.Sprintf("test post %d", i),
+			Size:       1024,
+			FileCount:  1,
+			UploadDate: int(time.Now().Unix()),
+			Tags:       "test",
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := b.Bootstrap(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+
+	// before mirroring, searches go to the node itself
+	posts, err := b.Search(ctx, a, "post")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(posts) != 10 {
+		t.Fatal("Remote search found ", len(posts), " posts, expected 10")
+	}
+
+	if err := b.Mirror(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+
+	if !b.Databases.Has(a.AddressString()) {
+		t.Fatal("Mirror was not stored")
+	}
+
+	posts, err = b.Search(ctx, a, "post")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(posts) != 10 {
+		t.Fatal("Mirror search found ", len(posts), " posts, expected 10")
+	}
+}
+
+// Once a node has mirrored another it keeps looking for its seeds, which must not
+// stop either of them from closing, however many times the connection between
+// them is reported closed.
+func TestCloseWithSeeds(t *testing.T) {
+	n, ctx := newNetwork(t, 2)
+	a, b := n.Nodes[0], n.Nodes[1]
+
+	if _, err := a.AddPost(data.Post{
+		InfoHash:   fmt.Sprintf("%040d", 0),
+		Title:      "test post",
+		Size:       1024,
+		FileCount:  1,
+		UploadDate: int(time.Now().Unix()),
+		Tags:       "test",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Bootstrap(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Mirror(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+
+	// as the heartbeat and the stream listener both would
+	b.HandleCloseConnection(a.Address())
+	b.HandleCloseConnection(a.Address())
+
+	closed := make(chan error, 1)
+	go func() { closed <- n.Close() }()
+
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Network did not close")
+	}
+}
+
+// The first endpoint the node lists cannot be reached, so the one after it has
+// to be dialled alongside.
+func TestDialEndpoints(t *testing.T) {
+	n, ctx := newNetwork(t, 3)
+	a, b, c := n.Nodes[0], n.Nodes[1], n.Nodes[2]
+	port := c.Entry.Port
+
+	if err := c.SetPublicAddress("127.0.0.1", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.AddEndpoint(dht.NewEndpoint("localhost", port)); err != nil {
+		t.Fatal(err)
+	}
+
+	c.SignEntry()
+
+	if err := c.SaveEntry(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Bootstrap(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Bootstrap(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+
+	if !WaitFor(testTimeout, func() bool { return a.Knows(c) }) {
+		t.Fatal("Bootstrap node never heard of the last node")
+	}
+
+	peer, _, err := b.ConnectPeer(ctx, *c.Address())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !peer.Address().Equals(c.Address()) {
+		t.Fatal("Connected to the wrong peer")
+	}
+}
+
+// A node that cannot be dialled is reached through the relay it lists, which
+// copies the connection between the two without being part of it.
+func TestRelay(t *testing.T) {
+	n, ctx := newNetwork(t, 3)
+	r, a, b := n.Nodes[0], n.Nodes[1], n.Nodes[2]
+
+	r.Server.SetRelay(proto.RelayConfig{Enabled: true, MaxCircuits: 1})
+
+	// nothing listens on port 1
+	if err := b.SetPublicAddress("127.0.0.1", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.UseRelays([]dht.Address{*r.Address()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := b.AddPost(data.Post{
+		InfoHash:   fmt.Sprintf("%040d", 0),
+		Title:      "relayed post",
+		Size:       1024,
+		FileCount:  1,
+		UploadDate: int(time.Now().Unix()),
+		Tags:       "test",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Bootstrap(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Bootstrap(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+
+	posts, err := a.Search(ctx, b, "relayed")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(posts) != 1 {
+		t.Fatal("Relayed search found ", len(posts), " posts, expected 1")
+	}
+
+	if stats := r.Server.Relay().Stats(); stats.Circuits != 1 || stats.Bytes == 0 {
+		t.Fatalf("Relay stats were %+v", stats)
+	}
+
+	// b only knows a by the relay it came through
+	peer := b.GetPeer(*a.Address())
+
+	if peer == nil {
+		t.Fatal("Relayed peer was not added")
+	}
+
+	if addr := peer.Session().RemoteAddr(); addr.Network() != "relay" {
+		t.Fatal("Relayed peer is at ", addr.String())
+	}
+
+	// the relay is full, so another node cannot get through
+	c, err := n.AddNode()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Bootstrap(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := c.ConnectPeer(ctx, *b.Address()); err == nil {
+		t.Fatal("Connected through a full relay")
+	}
+
+	a.GetPeer(*b.Address()).Terminate()
+
+	if !WaitFor(testTimeout, func() bool { return r.Server.Relay().Stats().Circuits == 0 }) {
+		t.Fatal("Circuit was not closed along with the connection inside it")
+	}
+
+	if _, _, err := c.ConnectPeer(ctx, *b.Address()); err != nil {
+		t.Fatal("Could not connect once the relay had room: ", err)
+	}
+}
+
+// Nodes with no endpoints but in-memory pipes can still reach each other, as
+// the handshake knows nothing of how the connection was made.
+func TestPipeTransport(t *testing.T) {
+	n, ctx := newNetwork(t, 2)
+	a, b := n.Nodes[0], n.Nodes[1]
+	pipes := proto.NewPipeTransport()
+
+	for _, i := range n.Nodes {
+		i.Transports.Add(pipes)
+
+		if err := i.SetPublicAddress("", 0); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := i.ListenOn(pipes, i.Entry.Name, true); err != nil {
+			t.Fatal(err)
+		}
+
+		i.SignEntry()
+	}
+
+	if _, err := b.DHT.Insert(*a.Entry); err != nil {
+		t.Fatal(err)
+	}
+
+	peer, _, err := b.ConnectPeer(ctx, *a.Address())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if network := peer.Session().RemoteAddr().Network(); network != "pipe" {
+		t.Fatal("Connected over ", network, " rather than a pipe")
+	}
+}
+
+func TestWebSocketTransport(t *testing.T) {
+	n, ctx := newNetwork(t, 2)
+	a, b := n.Nodes[0], n.Nodes[1]
+
+	for _, i := range n.Nodes {
+		i.Transports.Add(proto.WebSocketTransport{})
+	}
+
+	// so that only the WebSocket can be dialled
+	if err := a.SetPublicAddress("", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// served from an HTTP server with other things on it, as with the API
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler, err := a.ServeWebSocket(listener.Addr(), false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(proto.WebSocketPath, handler)
+
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	defer server.Close()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	if err := a.AddEndpoint(dht.Endpoint{Type: dht.EndpointWS, Address: "127.0.0.1", Port: port}); err != nil {
+		t.Fatal(err)
+	}
+
+	a.SignEntry()
+
+	if _, err := b.DHT.Insert(*a.Entry); err != nil {
+		t.Fatal(err)
+	}
+
+	peer, _, err := b.ConnectPeer(ctx, *a.Address())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := peer.Ping(ctx); err != nil {
+		t.Fatal("Session over a WebSocket does not work: ", err)
+	}
+}
+
+func TestPeerExchange(t *testing.T) {
+	n, ctx := newNetwork(t, 4)
+	a, b, c, d := n.Nodes[0], n.Nodes[1], n.Nodes[2], n.Nodes[3]
+
+	// a has heard of b and d, and b of c
+	for _, i := range []struct{ to, of *Node }{{a, b}, {a, d}, {b, c}} {
+		if _, err := i.to.DHT.Insert(*i.of.Entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// connecting asks for nothing but b's own entry, so the rest can only come
+	// from the exchange
+	if _, _, err := a.ConnectPeer(ctx, *b.Address()); err != nil {
+		t.Fatal(err)
+	}
+
+	if !WaitFor(time.Second*5, func() bool { return a.Knows(c) && b.Knows(d) }) {
+		t.Fatal("Entries were not exchanged on connecting")
+	}
+
+	// both were sent as they were signed, so they are still the same entries
+	entry, err := a.DHT.Query(*c.Address())
+
+	if err != nil || entry.Verify() != nil || entry.Updated != c.Entry.Updated {
+		t.Fatal("Exchanged entry was not stored properly: ", err)
+	}
+}
+
+// The entry of a node changes when its port mapping is renewed, which can happen
+// while peers are querying it. They are never sent one that is half changed.
+func TestEntryChange(t *testing.T) {
+	n, ctx := newNetwork(t, 2)
+	a, b := n.Nodes[0], n.Nodes[1]
+
+	// more queries than would usually be allowed
+	a.Server.SetQuotas(nil)
+
+	if err := b.Bootstrap(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+
+	peer, _, err := b.ConnectPeer(ctx, *a.Address())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done, stopped := make(chan struct{}), make(chan struct{})
+
+	// stopped before the network is closed, or saving would fail
+	defer func() {
+		close(done)
+		<-stopped
+	}()
+
+	go func() {
+		defer close(stopped)
+
+		for port := 1024; ; port++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			if err := a.SetPublicAddress("192.0.2.1", port); err != nil {
+				t.Error(err)
+				return
+			}
+
+			if err := a.SaveEntry(); err != nil {
+				t.Error(err)
+				return
+			}
+
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	// each is a stream of its own, of which only a few are allowed a second
+	for i := 0; i < 8; i++ {
+		entry, err := peer.Query(ctx, *a.Address())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := entry.Verify(); err != nil {
+			t.Fatal("Queried entry was changed while it was sent: ", err)
+		}
+	}
+}
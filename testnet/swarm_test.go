@@ -0,0 +1,150 @@
+package testnet
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/zif/zif"
+	"github.com/zif/zif/data"
+	"github.com/zif/zif/dht"
+	"github.com/zif/zif/proto"
+)
+
+// How many pieces the swarm tests download, enough that every source is given
+// some.
+const swarmPieces = 8
+
+// Stores a collection of posts in the node as though it had mirrored them from
+// address, titled so that different titles give different hashes.
+func storeMirror(t *testing.T, n *Node, address dht.Address, title string) *data.Database {
+	db := data.NewDatabase(n.DataPath(address.StringOr("") + "-" + title + ".db"))
+
+	if err := db.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(db.Close)
+
+	for i := 0; i < swarmPieces; i++ {
+		piece := &data.Piece{}
+		piece.Setup()
+
+		for j := 0; j < data.PieceSize; j++ {
+			id := i*data.PieceSize + j + 1
+
+			piece.Add(data.Post{
+				Id:         id,
+				InfoHash:   fmt.Sprintf("%040d", id),
+				Title:      fmt.Sprintf("%s %d", title, id),
+				Size:       1024,
+				FileCount:  1,
+				UploadDate: 1500000000,
+			}, true)
+		}
+
+		if err := db.InsertPiece(piece); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n.Databases.Set(address.StringOr(""), db)
+
+	return db
+}
+
+func hashList(t *testing.T, db *data.Database) []byte {
+	col, err := data.CreateCollection(db, 0, data.PieceSize)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return col.HashList
+}
+
+// One of the sources sends pieces that do not match the hash list, so it should
+// be banned from the mirror and penalised, and its pieces fetched from the other.
+func TestSwarmBadSource(t *testing.T) {
+	n, ctx := newNetwork(t, 3)
+	good, bad, c := n.Nodes[0], n.Nodes[1], n.Nodes[2]
+
+	address, err := dht.RandomAddress()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list := hashList(t, storeMirror(t, good, *address, "good"))
+	storeMirror(t, bad, *address, "bad")
+
+	goodPeer, err := c.ConnectPeerDirect(ctx, good.Addr())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	badPeer, err := c.ConnectPeerDirect(ctx, bad.Addr())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := data.NewDatabase(c.DataPath("swarm.db"))
+
+	if err := db.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	checkpoint, err := data.OpenCheckpoint(c.DataPath("checkpoint.dat"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer checkpoint.Close()
+
+	swarm := zif.NewSwarm(*address, list, db, checkpoint)
+	swarm.AddSource(badPeer)
+	swarm.AddSource(goodPeer)
+
+	progress := make(chan int)
+
+	go func() {
+		for range progress {
+		}
+	}()
+
+	err = swarm.Run(ctx, progress)
+	close(progress)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	banned := swarm.Banned()
+
+	if len(banned) == 0 {
+		t.Skip("Bad source was never given a piece")
+	}
+
+	if len(banned) != 1 || !banned[0].Equals(bad.Address()) {
+		t.Fatal("Banned the wrong sources: ", banned)
+	}
+
+	// a little over a bad piece's worth of points short of a ban, as some of them
+	// will have been forgiven already
+	if !c.Server.Reputation().Penalise(bad.Address(), "", proto.BanThreshold-proto.PenaltyBadPiece+1, "test") {
+		t.Fatal("Bad source was not penalised")
+	}
+
+	if missing := checkpoint.Missing(list); len(missing) != 0 {
+		t.Fatal("Pieces were not refetched: ", missing)
+	}
+
+	if !bytes.Equal(hashList(t, db), list) {
+		t.Fatal("Mirrored pieces do not match the hash list")
+	}
+}
@@ -1,53 +1,30 @@
 package zif
 
 import (
-	"fmt"
-	"os"
-	"path/filepath"
-	"strings"
+	"context"
+	"net"
+	"strconv"
 
-	torc "github.com/postfix/goControlTor"
 	log "github.com/sirupsen/logrus"
-)
-
-func SetupZifTorService(port, tor int, cookie string) (*torc.TorControl, string, error) {
-	control := &torc.TorControl{}
-
-	serviceDir, _ := filepath.Abs(filepath.Dir(os.Args[0]))
-	log.Info(serviceDir)
-	servicePort := map[int]string{port: fmt.Sprintf("127.0.0.1:%d", port)}
-
-	err := control.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", tor))
-
-	if err != nil {
-		log.Error(err.Error())
-		return nil, "", err
-	}
 
-	log.Info("Dialed Tor control port")
-
-	err = control.CookieAuthenticate(cookie)
-
-	if err != nil {
-		log.Error(err.Error())
-		return nil, "", err
-	}
-
-	log.Info("Authenticated with Tor, creating service")
+	"github.com/zif/zif/torcontrol"
+)
 
-	err = control.CreateHiddenService(serviceDir, servicePort)
+// Puts the local peer up as an onion service, which forwards port to the same
+// port on localhost. The key is kept in the data directory, so the onion address
+// stays the same. The service is put back up if Tor restarts, and taken down
+// along with the local peer.
+func (lp *LocalPeer) ListenTor(ctx context.Context, config torcontrol.Config, port int) (string, error) {
+	target := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	service, err := torcontrol.NewService(ctx, config, lp.DataPath("onion.dat"), port, target)
 
 	if err != nil {
-		log.Error(err.Error())
-		return nil, "", err
+		return "", err
 	}
 
-	log.Info("Service created")
-
-	onion, err := torc.ReadOnion(serviceDir)
-	onion = strings.TrimSpace(onion)
+	log.WithField("onion", service.Onion()).Info("Created onion service")
 
-	log.WithField("onion", onion).Info("Connecting to Tor")
+	lp.torService = service
 
-	return control, onion, nil
+	return service.Onion(), nil
 }
@@ -0,0 +1,424 @@
+// Talks to Tor through its control port, to put Zif up as an onion service. Only
+// as much of the control protocol as that needs is here: authenticating, and
+// adding and removing onion services.
+
+package torcontrol
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	safeCookieServerKey = "Tor safe cookie authentication server-to-controller hash"
+	safeCookieClientKey = "Tor safe cookie authentication controller-to-server hash"
+
+	cookieLength = 32
+	nonceLength  = 32
+)
+
+var (
+	ErrClosed         = errors.New("Tor control connection closed")
+	ErrNoAuthMethod   = errors.New("Tor does not allow any authentication method we have")
+	errBadServerHash  = errors.New("Tor did not know the auth cookie")
+	errMalformedReply = errors.New("Malformed reply from Tor")
+)
+
+type Config struct {
+	// The address of the control port, such as "127.0.0.1:9051".
+	Control string
+
+	// Used if set, otherwise the auth cookie is.
+	Password string
+
+	// The path of the auth cookie. If empty, the path Tor gives is used.
+	Cookie string
+}
+
+// An error status Tor replied with, such as 515 for a bad password.
+type Error struct {
+	Code int
+	Text string
+}
+
+func (e *Error) Error() string {
+	return "Tor replied " + strconv.Itoa(e.Code) + ": " + e.Text
+}
+
+type reply struct {
+	code  int
+	lines []string
+}
+
+// The KEY=VALUE pairs in the lines of a reply, values may be quoted.
+func (r *reply) values() map[string]string {
+	ret := make(map[string]string)
+
+	for _, line := range r.lines {
+		for _, i := range splitLine(line) {
+			if n := strings.IndexByte(i, '='); n > 0 {
+				ret[i[:n]] = i[n+1:]
+			}
+		}
+	}
+
+	return ret
+}
+
+// Splits a line on spaces, outside of quoted strings, which are unquoted.
+func splitLine(line string) []string {
+	ret := make([]string, 0, 4)
+	var token strings.Builder
+	quoted, escaped, started := false, false, false
+
+	for _, r := range line {
+		switch {
+		case escaped:
+			token.WriteRune(r)
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+			started = true
+		case r == ' ' && !quoted:
+			if started {
+				ret = append(ret, token.String())
+				token.Reset()
+				started = false
+			}
+		default:
+			token.WriteRune(r)
+			started = true
+		}
+	}
+
+	if started {
+		ret = append(ret, token.String())
+	}
+
+	return ret
+}
+
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// Reads a reply, which is every line up to one with a space after its code.
+// Data lines, after a "+", run until a line with only a full stop.
+func readReply(r *bufio.Reader) (*reply, error) {
+	ret := &reply{}
+
+	for {
+		line, err := r.ReadString('\n')
+
+		if err != nil {
+			return nil, err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+
+		if len(line) < 4 {
+			return nil, errMalformedReply
+		}
+
+		ret.code, err = strconv.Atoi(line[:3])
+
+		if err != nil {
+			return nil, errMalformedReply
+		}
+
+		ret.lines = append(ret.lines, line[4:])
+
+		switch line[3] {
+		case ' ':
+			return ret, nil
+
+		case '+':
+			for {
+				data, err := r.ReadString('\n')
+
+				if err != nil {
+					return nil, err
+				}
+
+				if data = strings.TrimRight(data, "\r\n"); data == "." {
+					break
+				}
+
+				ret.lines = append(ret.lines, data)
+			}
+
+		case '-':
+		default:
+			return nil, errMalformedReply
+		}
+	}
+}
+
+// An authenticated control connection.
+type Conn struct {
+	conn net.Conn
+
+	// one command at a time, each waits for its reply
+	lock    sync.Mutex
+	replies chan *reply
+
+	done chan struct{}
+}
+
+// Connects to the control port and authenticates, with the password if there is
+// one and with the auth cookie otherwise.
+func Dial(ctx context.Context, config Config) (*Conn, error) {
+	dialer := net.Dialer{}
+	nc, err := dialer.DialContext(ctx, "tcp", config.Control)
+
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Conn{
+		conn: nc,
+		done: make(chan struct{}),
+
+		// room for a reply that comes after its command gave up on it
+		replies: make(chan *reply, 1),
+	}
+
+	go c.read()
+
+	err = c.authenticate(ctx, config)
+
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *Conn) read() {
+	defer close(c.done)
+
+	r := bufio.NewReader(c.conn)
+
+	for {
+		rep, err := readReply(r)
+
+		if err != nil {
+			c.conn.Close()
+			return
+		}
+
+		// asynchronous events, which we never ask for
+		if rep.code/100 == 6 {
+			continue
+		}
+
+		c.replies <- rep
+	}
+}
+
+// Sends a command and waits for its reply, which is an error unless it is 250.
+// If ctx finishes first, the connection is closed, as the reply would otherwise
+// be taken for the reply to the next command.
+func (c *Conn) command(ctx context.Context, cmd string) (*reply, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	deadline, _ := ctx.Deadline()
+	c.conn.SetWriteDeadline(deadline)
+
+	_, err := c.conn.Write([]byte(cmd + "\r\n"))
+
+	if err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+
+	select {
+	case rep := <-c.replies:
+		if rep.code != 250 {
+			return nil, &Error{rep.code, strings.Join(rep.lines, " ")}
+		}
+
+		return rep, nil
+
+	case <-c.done:
+		return nil, ErrClosed
+
+	case <-ctx.Done():
+		c.conn.Close()
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Conn) authenticate(ctx context.Context, config Config) error {
+	rep, err := c.command(ctx, "PROTOCOLINFO 1")
+
+	if err != nil {
+		return err
+	}
+
+	values := rep.values()
+	methods := make(map[string]bool)
+
+	for _, i := range strings.Split(values["METHODS"], ",") {
+		methods[i] = true
+	}
+
+	cookie := config.Cookie
+
+	if cookie == "" {
+		cookie = values["COOKIEFILE"]
+	}
+
+	switch {
+	case config.Password != "" && methods["HASHEDPASSWORD"]:
+		_, err = c.command(ctx, "AUTHENTICATE "+quote(config.Password))
+
+	case methods["SAFECOOKIE"] && cookie != "":
+		err = c.safeCookie(ctx, cookie)
+
+	case methods["COOKIE"] && cookie != "":
+		var secret []byte
+		secret, err = readCookie(cookie)
+
+		if err == nil {
+			_, err = c.command(ctx, "AUTHENTICATE "+hex.EncodeToString(secret))
+		}
+
+	case methods["NULL"]:
+		_, err = c.command(ctx, "AUTHENTICATE")
+
+	default:
+		err = ErrNoAuthMethod
+	}
+
+	return err
+}
+
+func readCookie(path string) ([]byte, error) {
+	secret, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(secret) != cookieLength {
+		return nil, errors.New("Tor auth cookie is the wrong length")
+	}
+
+	return secret, nil
+}
+
+// Proves that we can read the cookie without sending it, and checks that Tor can
+// too, so that whatever is on the control port cannot steal it.
+func (c *Conn) safeCookie(ctx context.Context, path string) error {
+	secret, err := readCookie(path)
+
+	if err != nil {
+		return err
+	}
+
+	clientNonce := make([]byte, nonceLength)
+
+	if _, err := rand.Read(clientNonce); err != nil {
+		return err
+	}
+
+	rep, err := c.command(ctx, "AUTHCHALLENGE SAFECOOKIE "+hex.EncodeToString(clientNonce))
+
+	if err != nil {
+		return err
+	}
+
+	values := rep.values()
+	serverHash, err := hex.DecodeString(values["SERVERHASH"])
+
+	if err != nil {
+		return errMalformedReply
+	}
+
+	serverNonce, err := hex.DecodeString(values["SERVERNONCE"])
+
+	if err != nil {
+		return errMalformedReply
+	}
+
+	msg := append(append(append([]byte{}, secret...), clientNonce...), serverNonce...)
+
+	if !hmac.Equal(serverHash, safeCookieHash(safeCookieServerKey, msg)) {
+		return errBadServerHash
+	}
+
+	_, err = c.command(ctx, "AUTHENTICATE "+hex.EncodeToString(safeCookieHash(safeCookieClientKey, msg)))
+
+	return err
+}
+
+func safeCookieHash(key string, msg []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(msg)
+
+	return mac.Sum(nil)
+}
+
+// Adds an onion service, which forwards port to target until it is deleted or
+// the connection closes. The key is "ED25519-V3:" followed by the key in base64,
+// or empty for a new one. The service ID, which is the onion address without
+// ".onion", is returned along with the key.
+func (c *Conn) AddOnion(ctx context.Context, key string, port int, target string) (string, string, error) {
+	request := key
+
+	if request == "" {
+		request = "NEW:ED25519-V3"
+	}
+
+	rep, err := c.command(ctx, "ADD_ONION "+request+" Port="+strconv.Itoa(port)+","+target)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	values := rep.values()
+
+	if values["ServiceID"] == "" {
+		return "", "", errMalformedReply
+	}
+
+	if key == "" {
+		key = values["PrivateKey"]
+
+		if key == "" {
+			return "", "", errMalformedReply
+		}
+	}
+
+	return values["ServiceID"], key, nil
+}
+
+func (c *Conn) DelOnion(ctx context.Context, id string) error {
+	_, err := c.command(ctx, "DEL_ONION "+id)
+
+	return err
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// Closed once the connection is, and any onion services on it are gone.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
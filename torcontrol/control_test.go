@@ -0,0 +1,321 @@
+package torcontrol
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testTimeout = time.Second * 10
+
+// Just enough of a Tor control port to authenticate and add onion services.
+type fakeTor struct {
+	listener   net.Listener
+	methods    string
+	password   string
+	cookiePath string
+	cookie     []byte
+
+	lock     sync.Mutex
+	services map[string]net.Conn
+	conns    []net.Conn
+	deleted  []string
+}
+
+func newFakeTor(t *testing.T, methods, password string) *fakeTor {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ft := &fakeTor{
+		listener:   listener,
+		methods:    methods,
+		password:   password,
+		cookiePath: filepath.Join(t.TempDir(), "control_auth_cookie"),
+		cookie:     make([]byte, cookieLength),
+		services:   make(map[string]net.Conn),
+	}
+
+	rand.Read(ft.cookie)
+
+	if err := ioutil.WriteFile(ft.cookiePath, ft.cookie, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			ft.lock.Lock()
+			ft.conns = append(ft.conns, conn)
+			ft.lock.Unlock()
+
+			go ft.handle(conn)
+		}
+	}()
+
+	return ft
+}
+
+func (ft *fakeTor) config() Config {
+	return Config{Control: ft.listener.Addr().String()}
+}
+
+// Closes every control connection, as Tor restarting would.
+func (ft *fakeTor) drop() {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+
+	for _, i := range ft.conns {
+		i.Close()
+	}
+
+	ft.conns = nil
+}
+
+func (ft *fakeTor) service(id string) bool {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+
+	_, ok := ft.services[id]
+
+	return ok
+}
+
+func (ft *fakeTor) handle(conn net.Conn) {
+	defer func() {
+		conn.Close()
+
+		ft.lock.Lock()
+		defer ft.lock.Unlock()
+
+		for id, owner := range ft.services {
+			if owner == conn {
+				delete(ft.services, id)
+			}
+		}
+	}()
+
+	r := bufio.NewReader(conn)
+	authenticated := false
+	var clientHash []byte
+
+	for {
+		line, err := r.ReadString('\n')
+
+		if err != nil {
+			return
+		}
+
+		words := strings.SplitN(strings.TrimRight(line, "\r\n"), " ", 2)
+		arg := ""
+
+		if len(words) == 2 {
+			arg = words[1]
+		}
+
+		switch {
+		case words[0] == "PROTOCOLINFO":
+			io.WriteString(conn, "250-PROTOCOLINFO 1\r\n250-AUTH METHODS="+ft.methods+
+				` COOKIEFILE="`+ft.cookiePath+"\"\r\n250-VERSION Tor=\"0.4.8.9\"\r\n250 OK\r\n")
+
+		case words[0] == "AUTHCHALLENGE":
+			clientNonce, _ := hex.DecodeString(strings.TrimPrefix(arg, "SAFECOOKIE "))
+			serverNonce := make([]byte, nonceLength)
+			rand.Read(serverNonce)
+
+			msg := append(append(append([]byte{}, ft.cookie...), clientNonce...), serverNonce...)
+			clientHash = safeCookieHash(safeCookieClientKey, msg)
+
+			io.WriteString(conn, "250 AUTHCHALLENGE SERVERHASH="+
+				hex.EncodeToString(safeCookieHash(safeCookieServerKey, msg))+
+				" SERVERNONCE="+hex.EncodeToString(serverNonce)+"\r\n")
+
+		case words[0] == "AUTHENTICATE":
+			authenticated = (ft.password != "" && arg == quote(ft.password)) ||
+				(clientHash != nil && arg == hex.EncodeToString(clientHash))
+
+			if !authenticated {
+				io.WriteString(conn, "515 Authentication failed\r\n")
+				return
+			}
+
+			io.WriteString(conn, "250 OK\r\n")
+
+		case !authenticated:
+			io.WriteString(conn, "514 Authentication required.\r\n")
+			return
+
+		case words[0] == "ADD_ONION":
+			key := strings.Fields(arg)[0]
+			reply := ""
+
+			if key == "NEW:ED25519-V3" {
+				secret := make([]byte, 64)
+				rand.Read(secret)
+
+				key = "ED25519-V3:" + base64.StdEncoding.EncodeToString(secret)
+				reply = "250-PrivateKey=" + key + "\r\n"
+			}
+
+			id := fakeServiceID(key)
+
+			ft.lock.Lock()
+			ft.services[id] = conn
+			ft.lock.Unlock()
+
+			io.WriteString(conn, "250-ServiceID="+id+"\r\n"+reply+"250 OK\r\n")
+
+		case words[0] == "DEL_ONION":
+			ft.lock.Lock()
+			delete(ft.services, arg)
+			ft.deleted = append(ft.deleted, arg)
+			ft.lock.Unlock()
+
+			io.WriteString(conn, "250 OK\r\n")
+
+		default:
+			io.WriteString(conn, "510 Unrecognized command\r\n")
+		}
+	}
+}
+
+func fakeServiceID(key string) string {
+	hash := sha256.Sum256([]byte(key))
+
+	return strings.ToLower(base32.StdEncoding.EncodeToString(hash[:]))[:56]
+}
+
+func TestSafeCookie(t *testing.T) {
+	ft := newFakeTor(t, "COOKIE,SAFECOOKIE", "")
+	keyPath := filepath.Join(t.TempDir(), "onion.dat")
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	s, err := NewService(ctx, ft.config(), keyPath, 5050, "127.0.0.1:5050")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	onion := s.Onion()
+	id := strings.TrimSuffix(onion, ".onion")
+
+	if !ft.service(id) {
+		t.Fatal("Onion service was not added")
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ft.lock.Lock()
+	deleted := ft.deleted
+	ft.lock.Unlock()
+
+	if ft.service(id) || len(deleted) != 1 || deleted[0] != id {
+		t.Fatal("Onion service was not deleted on close")
+	}
+
+	// the key is kept, so the address stays the same
+	s, err = NewService(ctx, ft.config(), keyPath, 5050, "127.0.0.1:5050")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.Close()
+
+	if s.Onion() != onion {
+		t.Fatal("Onion address changed: ", onion, s.Onion())
+	}
+}
+
+func TestPassword(t *testing.T) {
+	ft := newFakeTor(t, "HASHEDPASSWORD", `pass "word"`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	config := ft.config()
+	config.Password = "wrong"
+
+	_, err := Dial(ctx, config)
+
+	if e, ok := err.(*Error); !ok || e.Code != 515 {
+		t.Fatal("Authenticated with the wrong password: ", err)
+	}
+
+	config.Password = `pass "word"`
+
+	conn, err := Dial(ctx, config)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	id, key, err := conn.AddOnion(ctx, "", 5050, "127.0.0.1:5050")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !ft.service(id) || !strings.HasPrefix(key, "ED25519-V3:") {
+		t.Fatal("New onion service was not added properly: ", id, key)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	ft := newFakeTor(t, "SAFECOOKIE", "")
+	keyPath := filepath.Join(t.TempDir(), "onion.dat")
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	s, err := NewService(ctx, ft.config(), keyPath, 5050, "127.0.0.1:5050")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.Close()
+
+	id := strings.TrimSuffix(s.Onion(), ".onion")
+	old := s.Conn()
+	ft.drop()
+
+	for !ft.service(id) || s.Conn() == old {
+		select {
+		case <-time.After(time.Millisecond * 50):
+		case <-ctx.Done():
+			t.Fatal("Onion service was not put back up")
+		}
+	}
+
+	if s.Onion() != id+".onion" {
+		t.Fatal("Onion address changed after reconnecting")
+	}
+}
@@ -0,0 +1,184 @@
+package torcontrol
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// How long to wait between attempts to put the service back up, doubling
+	// each time up to the maximum.
+	RetryMin = time.Second
+	RetryMax = time.Minute
+
+	commandTimeout = time.Second * 30
+)
+
+// An onion service that is kept up. Services added with ADD_ONION go when the
+// control connection does, so whenever it drops it is made again, with the same
+// key and so at the same address.
+type Service struct {
+	config Config
+	port   int
+	target string
+	key    string
+	id     string
+
+	lock sync.Mutex
+	conn *Conn
+
+	closed chan struct{}
+	done   chan struct{}
+	once   sync.Once
+}
+
+// Puts up an onion service that forwards port to target. Its key is read from
+// keyPath, or made by Tor and written there if there is none yet.
+func NewService(ctx context.Context, config Config, keyPath string, port int, target string) (*Service, error) {
+	key := ""
+	dat, err := ioutil.ReadFile(keyPath)
+
+	if err == nil {
+		key = strings.TrimSpace(string(dat))
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	s := &Service{
+		config: config,
+		port:   port,
+		target: target,
+		key:    key,
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	err = s.add(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if key == "" {
+		err = ioutil.WriteFile(keyPath, []byte(s.key), 0400)
+
+		if err != nil {
+			s.conn.Close()
+			return nil, err
+		}
+	}
+
+	go s.keepUp()
+
+	return s, nil
+}
+
+// Connects to Tor and adds the service.
+func (s *Service) add(ctx context.Context) error {
+	conn, err := Dial(ctx, s.config)
+
+	if err != nil {
+		return err
+	}
+
+	id, key, err := conn.AddOnion(ctx, s.key, s.port, s.target)
+
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	s.lock.Lock()
+	s.conn = conn
+	s.id = id
+	s.key = key
+	s.lock.Unlock()
+
+	return nil
+}
+
+func (s *Service) keepUp() {
+	defer close(s.done)
+
+	for {
+		select {
+		case <-s.Conn().Done():
+		case <-s.closed:
+			return
+		}
+
+		log.Error("Lost connection to Tor, onion service is down")
+
+		wait := RetryMin
+
+		for {
+			select {
+			case <-time.After(wait):
+			case <-s.closed:
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+			err := s.add(ctx)
+			cancel()
+
+			if err == nil {
+				break
+			}
+
+			log.Info("Failed to put onion service back up: ", err.Error())
+
+			if wait *= 2; wait > RetryMax {
+				wait = RetryMax
+			}
+		}
+
+		log.WithField("onion", s.Onion()).Info("Onion service is back up")
+	}
+}
+
+// The onion address of the service, such as "xyz.onion".
+func (s *Service) Onion() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.id + ".onion"
+}
+
+// The control connection the service is on now.
+func (s *Service) Conn() *Conn {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.conn
+}
+
+// Takes the service down with DEL_ONION, and stops putting it back up.
+func (s *Service) Close() error {
+	var err error
+
+	s.once.Do(func() {
+		close(s.closed)
+		<-s.done
+
+		conn := s.Conn()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+
+		s.lock.Lock()
+		id := s.id
+		s.lock.Unlock()
+
+		err = conn.DelOnion(ctx, id)
+		conn.Close()
+	})
+
+	return err
+}
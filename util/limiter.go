@@ -1,6 +1,9 @@
 package util
 
-import "time"
+import (
+	"sync"
+	"time"
+)
 
 type Limiter struct {
 	Throttle chan time.Time
@@ -51,16 +54,64 @@ func (l *Limiter) Stop() {
 	close(l.Throttle)
 }
 
-// Limits requests from peers
+// How often something may be done: once every Rate, saving up to Burst.
+type Quota struct {
+	Rate  time.Duration
+	Burst int
+}
+
+// Limits requests from peers, each kind of request separately. The quota for a
+// kind is given each time, so it can be changed while peers are connected.
 type PeerLimiter struct {
-	queryLimiter    *Limiter
-	announceLimiter *Limiter
+	lock    sync.Mutex
+	buckets map[string]*quotaBucket
+}
+
+type quotaBucket struct {
+	tokens float64
+	last   time.Time
 }
 
 func (pl *PeerLimiter) Setup() {
-	// Allow an announce every 10 minutes, bursting to allow three.
-	// The burst is there as people may make "mistakes" with titles or descriptions
-	pl.announceLimiter = NewLimiter(time.Minute*10, 3, true)
+	pl.buckets = make(map[string]*quotaBucket)
+}
+
+// Uses up one request of the given kind. If there are none left, returns false
+// and how long it will be until there is one. A quota with a rate of zero or less
+// is unlimited.
+func (pl *PeerLimiter) Allow(kind string, quota Quota, now time.Time) (bool, time.Duration) {
+	if quota.Rate <= 0 {
+		return true, 0
+	}
+
+	burst := float64(quota.Burst)
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+
+	bucket, ok := pl.buckets[kind]
+
+	if !ok {
+		bucket = &quotaBucket{tokens: burst, last: now}
+		pl.buckets[kind] = bucket
+	}
+
+	bucket.tokens += float64(now.Sub(bucket.last)) / float64(quota.Rate)
+	bucket.last = now
+
+	if bucket.tokens > burst {
+		bucket.tokens = burst
+	}
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) * float64(quota.Rate))
+	}
+
+	bucket.tokens--
 
-	pl.queryLimiter = NewLimiter(time.Second/3, 3, true)
+	return true, 0
 }
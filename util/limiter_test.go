@@ -0,0 +1,64 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeerLimiterAllow(t *testing.T) {
+	pl := PeerLimiter{}
+	pl.Setup()
+
+	quota := Quota{Rate: time.Second, Burst: 3}
+	now := time.Unix(1500000000, 0)
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := pl.Allow("test", quota, now); !ok {
+			t.Fatal("Request ", i, " of the burst was refused")
+		}
+	}
+
+	ok, wait := pl.Allow("test", quota, now)
+
+	if ok || wait != time.Second {
+		t.Fatal("Request over the burst gave ", ok, ", wait ", wait)
+	}
+
+	// other kinds have their own bucket
+	if ok, _ := pl.Allow("other", quota, now); !ok {
+		t.Fatal("Another kind of request was refused")
+	}
+
+	ok, wait = pl.Allow("test", quota, now.Add(time.Second/4))
+
+	if ok || wait != time.Second*3/4 {
+		t.Fatal("Request before a refill gave ", ok, ", wait ", wait)
+	}
+
+	now = now.Add(time.Second)
+
+	if ok, _ := pl.Allow("test", quota, now); !ok {
+		t.Fatal("Request after a refill was refused")
+	}
+
+	if ok, _ := pl.Allow("test", quota, now); ok {
+		t.Fatal("Only one request should have refilled")
+	}
+
+	// a long wait only saves up a burst
+	now = now.Add(time.Hour)
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := pl.Allow("test", quota, now); !ok {
+			t.Fatal("Request ", i, " after a long wait was refused")
+		}
+	}
+
+	if ok, _ := pl.Allow("test", quota, now); ok {
+		t.Fatal("More than a burst was saved up")
+	}
+
+	if ok, _ := pl.Allow("test", Quota{}, now); !ok {
+		t.Fatal("Unlimited quota refused a request")
+	}
+}
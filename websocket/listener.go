@@ -0,0 +1,70 @@
+package websocket
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+)
+
+var ErrListenerClosed = errors.New("WebSocket listener closed")
+
+// Accepts the connections that its ServeHTTP upgrades, so that WebSockets can be
+// served from any router, alongside whatever else it serves.
+type Listener struct {
+	addr   net.Addr
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+// The address is what Addr gives, normally that of the HTTP server.
+func NewListener(addr net.Addr) *Listener {
+	return &Listener{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *Listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-l.closed:
+		http.Error(w, "Not accepting WebSocket connections", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+
+	conn, err := Upgrade(w, r)
+
+	if err != nil {
+		return
+	}
+
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Stops accepting connections. Requests still come to ServeHTTP, but are turned
+// away.
+func (l *Listener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,531 @@
+// WebSockets, as in RFC 6455, so that Zif connections can be carried to and from
+// browsers and through proxies that only allow HTTP. Only what a byte stream
+// needs is here: binary messages are read and written as one stream, text
+// messages are refused, and pings are answered.
+
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+
+	finBit  = 0x80
+	maskBit = 0x80
+
+	closeNormal      = 1000
+	closeProtocol    = 1002
+	closeUnsupported = 1003
+
+	// Longer writes are split into several frames.
+	maxFrameLength = 1 << 16
+
+	maxControlLength = 125
+
+	// Appended to the key of the client to make the accept key.
+	acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	closeTimeout = time.Second
+)
+
+var (
+	ErrBadHandshake = errors.New("Bad WebSocket handshake")
+	ErrProtocol     = errors.New("WebSocket protocol error")
+	ErrText         = errors.New("WebSocket text messages are not supported")
+)
+
+// A WebSocket connection as a stream of bytes.
+type Conn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	client bool
+
+	readLock sync.Mutex
+	// what is left of the frame being read
+	remaining int64
+	mask      [4]byte
+	masked    bool
+	maskPos   int
+	readErr   error
+
+	writeLock sync.Mutex
+	closeSent bool
+}
+
+func newConn(conn net.Conn, r *bufio.Reader, client bool) *Conn {
+	return &Conn{conn: conn, r: r, client: client}
+}
+
+func acceptKey(key string) string {
+	hash := sha1.Sum([]byte(key + acceptGUID))
+
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// Whether a comma separated header has the token in it, ignoring case.
+func headerHas(h http.Header, name, token string) bool {
+	for _, value := range h[http.CanonicalHeaderKey(name)] {
+		for _, i := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(i), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Dials a ws:// or wss:// URL and does the opening handshake. The TLS config is
+// only used for wss://, and may be nil.
+func Dial(ctx context.Context, rawurl string, config *tls.Config) (*Conn, error) {
+	u, err := url.Parse(rawurl)
+
+	if err != nil {
+		return nil, err
+	}
+
+	port := ""
+
+	switch u.Scheme {
+	case "ws":
+		port = "80"
+	case "wss":
+		port = "443"
+	default:
+		return nil, errors.New("Not a WebSocket URL: " + rawurl)
+	}
+
+	addr := u.Host
+
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return Client(ctx, conn, rawurl, config)
+}
+
+// Does the opening handshake for a ws:// or wss:// URL over a connection to its
+// host that is already open, such as one through a proxy. conn is closed if the
+// handshake fails.
+func Client(ctx context.Context, conn net.Conn, rawurl string, config *tls.Config) (*Conn, error) {
+	u, err := url.Parse(rawurl)
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		conn.Close()
+		return nil, errors.New("Not a WebSocket URL: " + rawurl)
+	}
+
+	// the handshake knows nothing of contexts
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if u.Scheme == "wss" {
+		if config == nil {
+			config = &tls.Config{}
+		}
+
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName = u.Hostname()
+		}
+
+		tc := tls.Client(conn, config)
+
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		conn = tc
+	}
+
+	ret, err := handshake(conn, u)
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return ret, nil
+}
+
+func handshake(conn net.Conn, u *url.URL) (*Conn, error) {
+	nonce := make([]byte, 16)
+
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Host:       u.Host,
+		Header: http.Header{
+			"Upgrade":               {"websocket"},
+			"Connection":            {"Upgrade"},
+			"Sec-Websocket-Key":     {key},
+			"Sec-Websocket-Version": {"13"},
+		},
+	}
+
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusSwitchingProtocols ||
+		!headerHas(res.Header, "Upgrade", "websocket") ||
+		!headerHas(res.Header, "Connection", "upgrade") ||
+		res.Header.Get("Sec-Websocket-Accept") != acceptKey(key) {
+		return nil, ErrBadHandshake
+	}
+
+	return newConn(conn, r, true), nil
+}
+
+// Does the opening handshake for a request, and takes over its connection. If
+// the request is not a WebSocket one, an error is written back and returned.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	key := r.Header.Get("Sec-Websocket-Key")
+	nonce, err := base64.StdEncoding.DecodeString(key)
+
+	if r.Method != http.MethodGet || !headerHas(r.Header, "Upgrade", "websocket") ||
+		!headerHas(r.Header, "Connection", "upgrade") || err != nil || len(nonce) != 16 {
+		http.Error(w, "Not a WebSocket handshake", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+
+	if r.Header.Get("Sec-Websocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, ErrBadHandshake
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+
+	if !ok {
+		http.Error(w, "Cannot take over the connection", http.StatusInternalServerError)
+		return nil, errors.New("Response cannot be hijacked")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the server may have set deadlines for the request
+	conn.SetDeadline(time.Time{})
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n" +
+		"Connection: Upgrade\r\nSec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n")
+
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return newConn(conn, rw.Reader, false), nil
+}
+
+// Reads the payloads of binary messages. Control frames in between them are
+// dealt with as they come.
+func (c *Conn) Read(p []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	for c.remaining == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+
+		if err := c.nextFrame(); err != nil {
+			c.readErr = err
+			return 0, err
+		}
+	}
+
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+
+	if c.masked {
+		c.maskPos = maskBytes(c.mask, c.maskPos, p[:n])
+	}
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
+
+// Reads frame headers up to the next one with data in it.
+func (c *Conn) nextFrame() error {
+	var header [2]byte
+
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return err
+	}
+
+	fin := header[0]&finBit != 0
+	op := header[0] & 0xf
+	masked := header[1]&maskBit != 0
+	length := int64(header[1] & 0x7f)
+
+	// no extensions are agreed, so the reserved bits must be clear, and only
+	// clients mask
+	if header[0]&0x70 != 0 || masked == c.client {
+		return c.fail(closeProtocol)
+	}
+
+	switch length {
+	case 126:
+		var ext [2]byte
+
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return err
+		}
+
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+
+	case 127:
+		var ext [8]byte
+
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return err
+		}
+
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+
+		if length < 0 {
+			return c.fail(closeProtocol)
+		}
+	}
+
+	c.masked = masked
+	c.maskPos = 0
+
+	if masked {
+		if _, err := io.ReadFull(c.r, c.mask[:]); err != nil {
+			return err
+		}
+	}
+
+	switch op {
+	case opBinary, opContinuation:
+		c.remaining = length
+		return nil
+
+	case opText:
+		c.fail(closeUnsupported)
+		return ErrText
+
+	case opClose, opPing, opPong:
+		if !fin || length > maxControlLength {
+			return c.fail(closeProtocol)
+		}
+
+		payload := make([]byte, length)
+
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return err
+		}
+
+		if masked {
+			maskBytes(c.mask, 0, payload)
+		}
+
+		switch op {
+		case opPing:
+			return c.writeFrame(opPong, payload)
+
+		case opClose:
+			// echo the status back, as the closing handshake asks
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+
+			c.writeClose(payload)
+
+			return io.EOF
+		}
+
+		return nil
+	}
+
+	return c.fail(closeProtocol)
+}
+
+// Closes the connection with a status, after a protocol error.
+func (c *Conn) fail(code uint16) error {
+	c.writeClose(closePayload(code))
+	c.conn.Close()
+
+	return ErrProtocol
+}
+
+func closePayload(code uint16) []byte {
+	ret := make([]byte, 2)
+	binary.BigEndian.PutUint16(ret, code)
+
+	return ret
+}
+
+// XORs b with the mask, starting pos bytes into it, and returns where the next
+// byte would start.
+func maskBytes(mask [4]byte, pos int, b []byte) int {
+	for i := range b {
+		b[i] ^= mask[pos&3]
+		pos++
+	}
+
+	return pos & 3
+}
+
+// Writes p as binary frames.
+func (c *Conn) Write(p []byte) (int, error) {
+	written := 0
+
+	for written < len(p) {
+		n := len(p) - written
+
+		if n > maxFrameLength {
+			n = maxFrameLength
+		}
+
+		if err := c.writeFrame(opBinary, p[written:written+n]); err != nil {
+			return written, err
+		}
+
+		written += n
+	}
+
+	return written, nil
+}
+
+// Writes a whole message in one frame. Clients mask what they send, with a new
+// key every frame.
+func (c *Conn) writeFrame(op byte, payload []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.closeSent {
+		return net.ErrClosed
+	}
+
+	if op == opClose {
+		c.closeSent = true
+	}
+
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, finBit|op)
+
+	var maskFlag byte
+
+	if c.client {
+		maskFlag = maskBit
+	}
+
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskFlag|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskFlag|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, maskFlag|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+
+	start := len(frame)
+
+	if c.client {
+		var mask [4]byte
+
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+
+		frame = append(frame, mask[:]...)
+		start += 4
+		frame = append(frame, payload...)
+		maskBytes(mask, 0, frame[start:])
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	_, err := c.conn.Write(frame)
+
+	return err
+}
+
+func (c *Conn) writeClose(payload []byte) {
+	c.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	c.writeFrame(opClose, payload)
+	c.conn.SetWriteDeadline(time.Time{})
+}
+
+// Sends a close frame, if one has not been yet, and closes the connection
+// without waiting for the other side to send one back.
+func (c *Conn) Close() error {
+	c.writeClose(closePayload(closeNormal))
+
+	return c.conn.Close()
+}
+
+func (c *Conn) LocalAddr() net.Addr                { return c.conn.LocalAddr() }
+func (c *Conn) RemoteAddr() net.Addr               { return c.conn.RemoteAddr() }
+func (c *Conn) SetDeadline(t time.Time) error      { return c.conn.SetDeadline(t) }
+func (c *Conn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *Conn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
@@ -0,0 +1,160 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testTimeout = time.Second * 10
+
+func newServer(t *testing.T) (*Listener, string) {
+	listener := NewListener(nil)
+	server := httptest.NewServer(listener)
+
+	t.Cleanup(func() {
+		listener.Close()
+		server.Close()
+	})
+
+	return listener, "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func accept(t *testing.T, listener *Listener) <-chan net.Conn {
+	ret := make(chan net.Conn, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		ret <- conn
+	}()
+
+	return ret
+}
+
+func TestConn(t *testing.T) {
+	listener, url := newServer(t)
+	accepted := accept(t, listener)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client, err := Dial(ctx, url, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	server := <-accepted
+
+	if server == nil {
+		t.FailNow()
+	}
+
+	// echo everything back, so that both directions are read
+	echoed := make(chan error, 1)
+
+	go func() {
+		_, err := io.Copy(server, server)
+		echoed <- err
+	}()
+
+	// a ping in between messages is answered, and not read as data
+	if err := client.writeFrame(opPing, []byte("zif")); err != nil {
+		t.Fatal(err)
+	}
+
+	// each of the three ways a length can be written, and more than one frame
+	for _, size := range []int{10, 200, 70000, maxFrameLength*2 + 1} {
+		sent := make([]byte, size)
+		rand.Read(sent)
+
+		go client.Write(sent)
+
+		received := make([]byte, size)
+
+		if _, err := io.ReadFull(client, received); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(sent, received) {
+			t.Fatal("Connection did not carry ", size, " bytes properly")
+		}
+	}
+
+	client.Close()
+
+	// io.Copy stops without an error at the end of the stream
+	if err := <-echoed; err != nil {
+		t.Fatal("Close frame was not read as the end of the stream: ", err)
+	}
+}
+
+func TestText(t *testing.T) {
+	listener, url := newServer(t)
+	accepted := accept(t, listener)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client, err := Dial(ctx, url, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	server := <-accepted
+
+	if server == nil {
+		t.FailNow()
+	}
+
+	client.writeFrame(opText, []byte("zif"))
+
+	if _, err := server.Read(make([]byte, 3)); err != ErrText {
+		t.Fatal("Read a text message: ", err)
+	}
+}
+
+func TestBadHandshake(t *testing.T) {
+	_, url := newServer(t)
+
+	res, err := http.Get("http" + strings.TrimPrefix(url, "ws"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatal("Plain request was not turned away: ", res.Status)
+	}
+
+	plain := httptest.NewServer(http.NotFoundHandler())
+	defer plain.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	_, err = Dial(ctx, "ws"+strings.TrimPrefix(plain.URL, "http"), nil)
+
+	if err != ErrBadHandshake {
+		t.Fatal("Dialled a server that does not serve WebSockets: ", err)
+	}
+}